@@ -22,6 +22,10 @@ func AdminAPI(router H.Router, authmw H.Middleware) {
 	router.PUT("/user/:username", authmw(H.HandlerFunc(EditUserHandler)))
 	router.DELETE("/user/:username", authmw(H.HandlerFunc(DeleteUserHandler)))
 	router.GET("/users", authmw(H.HandlerFunc(ListUsersHandler)))
+	router.POST("/scan", authmw(H.HandlerFunc(ScanLibraryHandler)))
+	router.GET("/reorganize", authmw(H.HandlerFunc(PlanReorganizeHandler)))
+	router.POST("/reorganize", authmw(H.HandlerFunc(ReorganizeHandler)))
+	router.POST("/reorganize/rollback", authmw(H.HandlerFunc(RollbackReorganizeHandler)))
 }
 
 func readAdmin(req *http.Request) *musicdb.User {
@@ -161,6 +165,7 @@ func EditUserHandler(w http.ResponseWriter, req *http.Request) (interface{}, err
 	user.LinkedInID = tmpuser.LinkedInID
 	user.SlackID = tmpuser.SlackID
 	user.BitBucketID = tmpuser.BitBucketID
+	user.WriteTags = tmpuser.WriteTags
 	user.DateModified = &now
 	if admin.IsAdmin {
 		user.HomeDirectory = tmpuser.HomeDirectory
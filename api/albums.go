@@ -0,0 +1,141 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func AlbumAPI(router H.Router, authmw H.Middleware) {
+	router.GET("/album/:id", authmw(H.HandlerFunc(GetAlbumByID)))
+	router.PUT("/album/:id", authmw(H.HandlerFunc(UpdateAlbum)))
+	router.GET("/album/:id/tracks", authmw(H.HandlerFunc(GetAlbumTracks)))
+}
+
+// getAlbumById loads the album in the url, if it belongs to the user
+func getAlbumById(req *http.Request) (*musicdb.Album, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Unauthorized
+	}
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	album, err := db.GetAlbum(id)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if album == nil || album.OwnerID != user.PersistentID {
+		return nil, H.NotFound.Wrapf(nil, "Album %s does not exist", id)
+	}
+	return album, nil
+}
+
+func GetAlbumByID(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	album, err := getAlbumById(req)
+	if err != nil {
+		return nil, err
+	}
+	cacheFor(w, time.Minute * 15)
+	return album, nil
+}
+
+func GetAlbumTracks(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	album, err := getAlbumById(req)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := db.AlbumTracks(album, &album.OwnerID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	cacheFor(w, time.Minute * 15)
+	return tracks, nil
+}
+
+type AlbumUpdate struct {
+	Name           *string              `json:"name"`
+	ArtistName     *string              `json:"artist_name"`
+	Year           *int                 `json:"year"`
+	ReleaseType    *musicdb.ReleaseType `json:"release_type"`
+	DiscCount      *uint8               `json:"disc_count"`
+	ArtworkTrackID *pid.PersistentID    `json:"artwork_track_id"`
+	Rating         *uint8               `json:"rating"`
+}
+
+// UpdateAlbum changes the fields of an album that are in the request.
+// the name, artist and rating are passed on to its tracks.
+func UpdateAlbum(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	album, err := getAlbumById(req)
+	if err != nil {
+		return nil, err
+	}
+	update := &AlbumUpdate{}
+	err = H.ReadJSON(req, update)
+	if err != nil {
+		return nil, err
+	}
+	if update.Name != nil {
+		album.Name = *update.Name
+	}
+	if update.ArtistName != nil {
+		album.ArtistName = update.ArtistName
+	}
+	if update.Year != nil {
+		album.Year = update.Year
+	}
+	if update.ReleaseType != nil {
+		if !update.ReleaseType.Valid() {
+			return nil, H.BadRequest.Wrapf(nil, "unknown release type %s", *update.ReleaseType)
+		}
+		album.ReleaseType = update.ReleaseType
+	}
+	if update.DiscCount != nil {
+		album.DiscCount = update.DiscCount
+	}
+	if update.ArtworkTrackID != nil {
+		tr, err := db.GetTrack(*update.ArtworkTrackID)
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
+		if tr == nil || tr.AlbumID == nil || *tr.AlbumID != album.PersistentID {
+			return nil, H.BadRequest.Wrap(nil, "artwork track not on album")
+		}
+		album.ArtworkTrackID = update.ArtworkTrackID
+	}
+	if update.Rating != nil {
+		if *update.Rating > 100 {
+			return nil, H.BadRequest.Wrap(nil, "rating out of range")
+		}
+		album.Rating = update.Rating
+	}
+	if strings.TrimSpace(album.Name) == "" {
+		return nil, H.BadRequest.Wrap(nil, "album name can't be empty")
+	}
+	err = db.SaveAlbum(album)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	tracks, err := db.AlbumTracks(album, &album.OwnerID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	hub, err := getWebsocketHub()
+	if err == nil {
+		evt := &LibraryEvent{
+			Type: "library",
+			Tracks: tracks,
+		}
+		hub.BroadcastEvent(evt)
+	}
+	album, err = db.GetAlbum(album.PersistentID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return album, nil
+}
@@ -67,6 +67,9 @@ func UpdateArtwork(w http.ResponseWriter, req *http.Request) (interface{}, error
 		return nil, err
 	}
 	fn, err := db.SaveTrackArtwork(tr, ext, img)
+	if err == nil {
+		autoWriteTags(req, []*musicdb.Track{tr}, true)
+	}
 	return fn, err
 }
 
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func ArtistAPI(router H.Router, authmw H.Middleware) {
+	router.GET("/artist/:id", authmw(H.HandlerFunc(GetArtistByID)))
+	router.PUT("/artist/:id", authmw(H.HandlerFunc(UpdateArtist)))
+	router.GET("/artist/:id/tracks", authmw(H.HandlerFunc(GetArtistTracks)))
+	router.GET("/artist/:id/albums", authmw(H.HandlerFunc(GetArtistAlbums)))
+	router.POST("/artist/:id/merge", authmw(H.HandlerFunc(MergeArtists)))
+}
+
+// getArtistById loads the artist in the url, if it belongs to the user
+func getArtistById(req *http.Request) (*musicdb.Artist, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Unauthorized
+	}
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	artist, err := db.GetArtist(id)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if artist == nil || artist.OwnerID != user.PersistentID {
+		return nil, H.NotFound.Wrapf(nil, "Artist %s does not exist", id)
+	}
+	return artist, nil
+}
+
+func GetArtistByID(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	artist, err := getArtistById(req)
+	if err != nil {
+		return nil, err
+	}
+	cacheFor(w, time.Minute * 15)
+	return artist, nil
+}
+
+func GetArtistTracks(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	artist, err := getArtistById(req)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := db.ArtistTracks(artist, &artist.OwnerID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	cacheFor(w, time.Minute * 15)
+	return tracks, nil
+}
+
+func GetArtistAlbums(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	artist, err := getArtistById(req)
+	if err != nil {
+		return nil, err
+	}
+	albums, err := db.ArtistAlbums(artist, &artist.OwnerID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	cacheFor(w, time.Minute * 15)
+	return albums, nil
+}
+
+type ArtistUpdate struct {
+	Name          *string   `json:"name"`
+	SortAs        *string   `json:"sort_as"`
+	Aliases       *[]string `json:"aliases"`
+	MusicBrainzID *string   `json:"musicbrainz_id"`
+	SpotifyID     *string   `json:"spotify_id"`
+	Biography     *string   `json:"biography"`
+	ImageURL      *string   `json:"image_url"`
+}
+
+// emptyNil is nil for a string that's only whitespace, so it can clear
+// a field
+func emptyNil(s *string) *string {
+	if s == nil || strings.TrimSpace(*s) == "" {
+		return nil
+	}
+	v := strings.TrimSpace(*s)
+	return &v
+}
+
+// UpdateArtist changes the fields of an artist that are in the
+// request.  an empty string clears an optional field, and the aliases,
+// if given, replace the artist's aliases.
+func UpdateArtist(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	artist, err := getArtistById(req)
+	if err != nil {
+		return nil, err
+	}
+	update := &ArtistUpdate{}
+	err = H.ReadJSON(req, update)
+	if err != nil {
+		return nil, err
+	}
+	if update.Name != nil {
+		if strings.TrimSpace(*update.Name) == "" {
+			return nil, H.BadRequest.Wrap(nil, "artist name can't be empty")
+		}
+		artist.Name = *update.Name
+	}
+	if update.SortAs != nil {
+		artist.SortAs = emptyNil(update.SortAs)
+	}
+	if update.Aliases != nil {
+		artist.Aliases = *update.Aliases
+	} else {
+		artist.Aliases = nil
+	}
+	if update.MusicBrainzID != nil {
+		artist.MusicBrainzID = emptyNil(update.MusicBrainzID)
+	}
+	if update.SpotifyID != nil {
+		artist.SpotifyID = emptyNil(update.SpotifyID)
+	}
+	if update.Biography != nil {
+		artist.Biography = emptyNil(update.Biography)
+	}
+	if update.ImageURL != nil {
+		artist.ImageURL = emptyNil(update.ImageURL)
+	}
+	err = db.SaveArtist(artist)
+	if err != nil {
+		if errors.Cause(err) == musicdb.ErrArtistAliasTaken {
+			return nil, H.BadRequest.Wrap(err, "")
+		}
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	artist, err = db.GetArtist(artist.PersistentID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return artist, nil
+}
+
+type ArtistMerge struct {
+	IDs []pid.PersistentID `json:"ids"`
+}
+
+// MergeArtists folds the artists in the request into the one in the url
+func MergeArtists(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	artist, err := getArtistById(req)
+	if err != nil {
+		return nil, err
+	}
+	merge := &ArtistMerge{}
+	err = H.ReadJSON(req, merge)
+	if err != nil {
+		return nil, err
+	}
+	if len(merge.IDs) == 0 {
+		return nil, H.BadRequest.Wrap(nil, "no artists to merge")
+	}
+	others := make([]*musicdb.Artist, len(merge.IDs))
+	for i, id := range merge.IDs {
+		other, err := db.GetArtist(id)
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
+		if other == nil || other.OwnerID != artist.OwnerID {
+			return nil, H.NotFound.Wrapf(nil, "Artist %s does not exist", id)
+		}
+		others[i] = other
+	}
+	err = db.MergeArtists(artist, others)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	artist, err = db.GetArtist(artist.PersistentID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return artist, nil
+}
@@ -21,9 +21,15 @@ import (
 	"github.com/rclancey/sendmail"
 	"github.com/rclancey/spotify"
 	"github.com/rclancey/synos/musicdb"
+	"github.com/rclancey/synos/scrobble"
+	"github.com/rclancey/synos/transcode"
 )
 
 type DatabaseConfig struct {
+	// postgres or sqlite
+	Type     string `json:"type"`//     arg:"--db-type"`
+	// the database file, for sqlite
+	Path     string `json:"path"`//     arg:"--db-path"`
 	Name     string `json:"name"`//     arg:"--db-name"`
 	Host     string `json:"host"`//     arg:"--db-host"`
 	Port     int    `json:"port"`//     arg:"--db-port"`
@@ -41,7 +47,39 @@ func (cfg *DatabaseConfig) Clone() *DatabaseConfig {
 	return &clone
 }
 
+func (cfg *DatabaseConfig) Init(top *SynosConfig) error {
+	if cfg.Type != "sqlite" {
+		return nil
+	}
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join("var", "synos.db")
+	}
+	fn, err := top.Abs(cfg.Path)
+	if err != nil {
+		return err
+	}
+	err = top.WritableDir(filepath.Dir(fn))
+	if err != nil {
+		return err
+	}
+	cfg.Path = fn
+	return nil
+}
+
+func (cfg *DatabaseConfig) Dialect() (musicdb.Dialect, error) {
+	return musicdb.GetDialect(cfg.Type)
+}
+
 func (cfg *DatabaseConfig) DSN() string {
+	if cfg.Type == "sqlite" {
+		// wait for other connections to finish writing instead of
+		// failing, and let reads go on while they do
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = 5
+		}
+		return fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL&_txlock=immediate", cfg.Path, timeout * 1000)
+	}
 	safe := func(k string, v interface{}) string {
 		switch xv := v.(type) {
 		case string:
@@ -81,7 +119,7 @@ func (cfg *DatabaseConfig) DSN() string {
 
 func (cfg *DatabaseConfig) DB() (*musicdb.DB, error) {
 	if cfg.db == nil {
-		db, err := musicdb.Open(cfg.DSN())
+		db, err := musicdb.Open(cfg.Type, cfg.DSN())
 		if err != nil {
 			return nil, err
 		}
@@ -113,6 +151,10 @@ type FinderConfig struct {
 	MediaPath   []string `json:"media_path"`//   arg:"--media-path"`
 	MediaFolder []string `json:"media_folder"`// arg:"--media-folder"`
 	CoverArt    []string `json:"cover_art"`//    arg:"--cover-art"`
+	Scan        bool     `json:"scan"`//         arg:"--scan"`
+	Watch       bool     `json:"watch"`//        arg:"--watch"`
+	Fingerprint bool     `json:"fingerprint"`//  arg:"--fingerprint"`
+	TrashDays   int      `json:"trash_days"`//   arg:"--trash-days"`
 	finder *musicdb.FileFinder
 }
 
@@ -159,6 +201,60 @@ type SonosConfig struct {
 	*httpserver.NetworkConfig
 }
 
+type DLNAConfig struct {
+	*httpserver.NetworkConfig
+	Enabled bool   `json:"enabled"`
+	Name    string `json:"name"`
+	// whose playlists and private tracks to serve
+	Username string `json:"user"`
+}
+
+func (cfg *DLNAConfig) Init() error {
+	if cfg.NetworkConfig == nil {
+		return nil
+	}
+	return cfg.NetworkConfig.Init()
+}
+
+type TranscodeConfig struct {
+	CacheDirectory string `json:"cache"`
+	// megabytes
+	CacheSize      int64  `json:"cache_size"`
+	Workers        int    `json:"workers"`
+	cache *transcode.Cache
+}
+
+func (cfg *TranscodeConfig) Init(top *SynosConfig) error {
+	dn, err := top.Abs(cfg.CacheDirectory)
+	if err != nil {
+		return err
+	}
+	err = top.WritableDir(dn)
+	if err != nil {
+		return err
+	}
+	cfg.CacheDirectory = dn
+	return nil
+}
+
+func (cfg *TranscodeConfig) Cache() (*transcode.Cache, error) {
+	if cfg.cache == nil {
+		cache, err := transcode.NewCache(cfg.CacheDirectory, cfg.CacheSize * 1024 * 1024, cfg.Workers)
+		if err != nil {
+			return nil, err
+		}
+		cfg.cache = cache
+	}
+	return cfg.cache, nil
+}
+
+type LoudnessConfig struct {
+	Analyze bool             `json:"analyze"`
+	Preamp  float64          `json:"preamp"`
+	Radio   musicdb.GainMode `json:"radio"`
+	Sonos   musicdb.GainMode `json:"sonos"`
+}
+
 type SleepTime struct {
 	Time     int    `json:"time"`
 	Override *int64 `json:"override"`
@@ -235,6 +331,8 @@ func (cfg *ITunesConfig) Init(top *SynosConfig) error {
 
 type LastFMConfig struct {
 	APIKey         string `json:"api_key"`//    arg:"--lastfm-api-key"`
+	// needed for scrobbling
+	Secret         string `json:"secret"`
 	CacheDirectory string `json:"cache"`//      arg:"--lastfm-cache"`
 	CacheTime      int    `json:"cache_time"`// arg:"--lastfm-cache-time"`
 	client *lastfm.LastFM
@@ -263,6 +361,11 @@ func (cfg *LastFMConfig) Client() *lastfm.LastFM {
 	return cfg.client
 }
 
+type ListenBrainzConfig struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`
+}
+
 type SpotifyConfig struct {
 	ClientID       string `json:"client_id"`//     arg:"--spotify-client-id"`
 	ClientSecret   string `json:"client_secret"`// arg:"--spotify-client-secret"`
@@ -336,11 +439,15 @@ type SynosConfig struct {
 	Finder   FinderConfig    `json:"finder"   arg:"finder"`
 	Airplay  AirplayConfig   `json:"airplay"  arg:"airplay"`
 	Sonos    SonosConfig `    json:"sonos"    arg:"sonos"`
+	DLNA     DLNAConfig      `json:"dlna"     arg:"dlna"`
 	Jooki    JookiConfig     `json:"jooki"    arg:"jooki"`
 	ITunes   ITunesConfig    `json:"itunes"   arg:"itunes"`
 	LastFM   LastFMConfig    `json:"lastfm"   arg:"lastfm"`
+	ListenBrainz ListenBrainzConfig `json:"listenbrainz" arg:"listenbrainz"`
 	Spotify  SpotifyConfig   `json:"spotify"  arg:"spotify"`
 	Lyrics   LyricsConfig    `json:"lyrics"   arg:"lyrics"`
+	Loudness LoudnessConfig  `json:"loudness" arg:"loudness"`
+	Transcode TranscodeConfig `json:"transcode" arg:"transcode"`
 }
 
 func (cfg *SynosConfig) Init() error {
@@ -352,6 +459,10 @@ func (cfg *SynosConfig) Init() error {
 	if err != nil {
 		return err
 	}
+	err = cfg.Database.Init(cfg)
+	if err != nil {
+		return err
+	}
 	err = cfg.Finder.Init(cfg)
 	if err != nil {
 		return err
@@ -364,6 +475,10 @@ func (cfg *SynosConfig) Init() error {
 	if err != nil {
 		return err
 	}
+	err = cfg.DLNA.Init()
+	if err != nil {
+		return err
+	}
 	err = cfg.Jooki.Init(cfg)
 	if err != nil {
 		return err
@@ -380,6 +495,10 @@ func (cfg *SynosConfig) Init() error {
 	if err != nil {
 		return err
 	}
+	err = cfg.Transcode.Init(cfg)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -429,9 +548,13 @@ func DefaultSynosConfig() *SynosConfig {
 				"cover.png",
 				"cover.gif",
 			},
+			TrashDays: 30,
 		},
 		Airplay: AirplayConfig{},
 		Sonos: SonosConfig{},
+		DLNA: DLNAConfig{
+			Name: "Synos",
+		},
 		Jooki: JookiConfig{},
 		ITunes: ITunesConfig{
 			Library: []string{
@@ -447,6 +570,9 @@ func DefaultSynosConfig() *SynosConfig {
 			CacheDirectory: "var/cache/lastfm",
 			CacheTime: 30 * 24 * 60 * 60,
 		},
+		ListenBrainz: ListenBrainzConfig{
+			URL: scrobble.ListenBrainzRoot,
+		},
 		Spotify: SpotifyConfig{
 			CacheDirectory: "var/cache/spotify",
 			CacheTime: 30 * 24 * 60 * 60,
@@ -455,6 +581,11 @@ func DefaultSynosConfig() *SynosConfig {
 			CacheDirectory: "var/cache/lyrics",
 			CacheTime: 30 * 24 * 60 * 60,
 		},
+		Transcode: TranscodeConfig{
+			CacheDirectory: "var/cache/transcode",
+			CacheSize: 2048,
+			Workers: 2,
+		},
 	}
 }
 
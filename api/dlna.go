@@ -0,0 +1,39 @@
+package api
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/dlna"
+	"github.com/rclancey/synos/musicdb"
+)
+
+// DLNAServer advertises the library to DLNA renderers on the local
+// network.  the description and control urls live under /dlna on the
+// main server, and renderers stream from the usual track urls.
+func DLNAServer(srv *httpserver.Server) error {
+	var owner *musicdb.User
+	if cfg.DLNA.Username != "" {
+		owner = &musicdb.User{Username: cfg.DLNA.Username}
+		err := owner.Reload(db)
+		if err != nil {
+			return errors.Wrapf(err, "no such dlna user %s", cfg.DLNA.Username)
+		}
+	}
+	s := dlna.NewServer(cfg.DLNA.Name, SynosVersion, cfg.Bind.RootURL(cfg.DLNA, false), db, owner)
+	s.Register(srv.Prefix("/dlna"))
+	if cfg.DLNA.NetworkConfig == nil {
+		return errors.New("dlna network not configured")
+	}
+	iface := cfg.DLNA.GetInterface()
+	if iface == nil {
+		return errors.New("dlna network not configured")
+	}
+	err := s.Start(iface)
+	if err != nil {
+		return err
+	}
+	srv.RegisterOnShutdown(func() {
+		s.Close()
+	})
+	return nil
+}
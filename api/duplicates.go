@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+type DuplicateMerge struct {
+	SurvivorID *pid.PersistentID  `json:"survivor_id,omitempty"`
+	TrackIDs   []pid.PersistentID `json:"track_ids"`
+}
+
+func ListDuplicates(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Unauthorized
+	}
+	groups, err := db.FindDuplicates(user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return groups, nil
+}
+
+func MergeDuplicates(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Unauthorized
+	}
+	var dm DuplicateMerge
+	err := H.ReadJSON(req, &dm)
+	if err != nil {
+		return nil, err
+	}
+	if len(dm.TrackIDs) < 2 {
+		return nil, H.BadRequest.Wrap(nil, "need at least two tracks to merge")
+	}
+	tracks := make([]*musicdb.Track, len(dm.TrackIDs))
+	for i, id := range dm.TrackIDs {
+		tracks[i], err = db.GetTrack(id)
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
+		if tracks[i] == nil {
+			return nil, H.NotFound.Wrapf(nil, "Track %s does not exist", id)
+		}
+		if !canWriteTrack(user, tracks[i]) {
+			return nil, H.Forbidden
+		}
+	}
+	var survivorId pid.PersistentID
+	if dm.SurvivorID != nil {
+		survivorId = *dm.SurvivorID
+	} else {
+		// with no survivor chosen, keep the one FindDuplicates ranks first
+		best := tracks[0]
+		for _, tr := range tracks[1:] {
+			if musicdb.BetterDuplicate(tr, best) {
+				best = tr
+			}
+		}
+		survivorId = best.PersistentID
+	}
+	// the duplicates' files move to the trash, which the media folder
+	// watcher shouldn't see before the database does
+	scanLock.Lock()
+	survivor, err := db.MergeDuplicates(survivorId, dm.TrackIDs, user)
+	scanLock.Unlock()
+	if err != nil {
+		if errors.Is(err, musicdb.ErrNotDuplicates) {
+			return nil, H.BadRequest.Wrap(err, "")
+		}
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	err = db.UpdateSmartTracks()
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	hub, err := getWebsocketHub()
+	if err == nil {
+		evt := &LibraryEvent{
+			Type: "library",
+			Tracks: []*musicdb.Track{survivor},
+		}
+		hub.BroadcastEvent(evt)
+	}
+	return survivor, nil
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/logging"
+	"github.com/rclancey/synos/musicdb"
+)
+
+type TrackFingerprint struct {
+	TrackID     pid.PersistentID            `json:"track_id"`
+	Fingerprint string                      `json:"fingerprint"`
+	Matches     []*musicdb.FingerprintMatch `json:"matches"`
+}
+
+var fingerprintLock sync.Mutex
+
+// FingerprintLibraries fingerprints every track that doesn't have one
+// yet.  it decodes every file, so it's slow the first time through.
+func FingerprintLibraries() error {
+	errlog, err := cfg.Logging.ErrorLogger()
+	if err != nil {
+		return err
+	}
+	users, err := db.ListUsers()
+	if err != nil {
+		errlog.Errorln("error loading users:", err)
+		return err
+	}
+	for _, user := range users {
+		err := fingerprintLibrary(user, errlog)
+		if err != nil {
+			errlog.Errorln("error fingerprinting library for", user.Username, err)
+		}
+	}
+	return nil
+}
+
+func fingerprintLibrary(user *musicdb.User, errlog *logging.Logger) error {
+	fingerprintLock.Lock()
+	defer fingerprintLock.Unlock()
+	n := 0
+	for {
+		tracks, err := db.TracksWithoutFingerprint(user, 100)
+		if err != nil {
+			return err
+		}
+		if len(tracks) == 0 {
+			break
+		}
+		for _, tr := range tracks {
+			_, err := db.FingerprintTrack(tr)
+			if err != nil {
+				errlog.Debugln("can't fingerprint", tr.PersistentID, tr.Path(), err)
+			} else {
+				n++
+			}
+		}
+	}
+	if n > 0 {
+		errlog.Infof("fingerprinted %d tracks for %s", n, user.Username)
+	}
+	return nil
+}
+
+func GetTrackFingerprint(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	tr, err := getTrackById(req)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := db.GetFingerprint(tr.PersistentID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if fp == nil {
+		fp, err = db.FingerprintTrack(tr)
+		if err != nil {
+			return nil, H.NotFound.Wrap(err, "can't fingerprint track")
+		}
+	}
+	matches, err := db.FindTracksByFingerprint(fp, getUser(req))
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	others := []*musicdb.FingerprintMatch{}
+	for _, m := range matches {
+		if m.Track.PersistentID != tr.PersistentID {
+			others = append(others, m)
+		}
+	}
+	return &TrackFingerprint{
+		TrackID: tr.PersistentID,
+		Fingerprint: fp.Encode(),
+		Matches: others,
+	}, nil
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func HistoryAPI(router H.Router, authmw H.Middleware) {
+	router.GET("/history", authmw(H.HandlerFunc(PlayHistory)))
+	router.GET("/track/:id/history", authmw(H.HandlerFunc(TrackPlayHistory)))
+}
+
+// playSource reads the source parameter that players add to track urls
+func playSource(req *http.Request) musicdb.PlaySource {
+	return musicdb.ParsePlaySource(req.URL.Query().Get("source"))
+}
+
+func PlayHistory(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	return playHistory(req, nil)
+}
+
+func TrackPlayHistory(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	return playHistory(req, &id)
+}
+
+// playHistory lists the requesting user's plays, or another user's if
+// an admin asks for them, most recent first
+func playHistory(req *http.Request, trackId *pid.PersistentID) (interface{}, error) {
+	admin := readAdmin(req)
+	if admin == nil {
+		return nil, H.Forbidden
+	}
+	user, err := queryUser(req, admin)
+	if err != nil {
+		return nil, err
+	}
+	var params struct {
+		Count int
+		Page int
+		Source *string
+		Skipped *bool
+		Since *musicdb.Time
+		Until *musicdb.Time
+	}
+	params.Count = 100
+	params.Page = 1
+	err = H.QueryScan(req, &params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Page < 1 {
+		params.Page = 1
+	}
+	q := musicdb.PlayHistoryQuery{
+		UserID: &user.PersistentID,
+		TrackID: trackId,
+		Skipped: params.Skipped,
+		Since: params.Since,
+		Until: params.Until,
+		Limit: params.Count,
+		Offset: (params.Page - 1) * params.Count,
+	}
+	if params.Source != nil {
+		src := musicdb.ParsePlaySource(*params.Source)
+		q.Source = &src
+	}
+	events, err := db.PlayHistory(q)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return events, nil
+}
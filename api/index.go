@@ -7,6 +7,7 @@ import (
 	"time"
 
 	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
 	"github.com/rclancey/synos/musicdb"
 )
 
@@ -104,6 +105,13 @@ func ListAlbums(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	}
 	genre  := musicdb.NewGenre(req.URL.Query().Get("genre"))
 	artist := musicdb.NewArtist(req.URL.Query().Get("artist"))
+	if req.URL.Query().Get("artist_id") != "" {
+		var err error
+		artist, err = getArtistParam(req, user)
+		if err != nil {
+			return nil, err
+		}
+	}
 	albums, err := db.GetAlbums(artist, genre, &user.PersistentID)
 	if err != nil {
 		return nil, DatabaseError.Wrap(err, "")
@@ -157,15 +165,36 @@ func ListSongs(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	album  := musicdb.NewAlbum(q.Get("album"), artist)
 	var tracks []*musicdb.Track
 	var err error
+	if q.Get("artist_id") != "" {
+		artist, err = getArtistParam(req, user)
+		if err != nil {
+			return nil, err
+		}
+		album = musicdb.NewAlbum(q.Get("album"), artist)
+	}
+	if q.Get("album_id") != "" {
+		id := new(pid.PersistentID)
+		err = id.Decode(q.Get("album_id"))
+		if err != nil {
+			return nil, H.BadRequest.Wrap(nil, "not a valid album id")
+		}
+		album, err = db.GetAlbum(*id)
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
+		if album == nil || album.OwnerID != user.PersistentID {
+			return nil, H.NotFound
+		}
+	}
 	if album != nil {
-		log.Printf("artist = %s, album = %s", album.Artist.SortName, album.SortName)
+		log.Printf("album = %s", album.SortName)
 		tracks, err = db.AlbumTracks(album, &user.PersistentID)
 	} else if artist != nil {
 		tracks, err = db.ArtistTracks(artist, &user.PersistentID)
 	} else if genre != nil {
 		tracks, err = db.GenreTracks(genre, &user.PersistentID)
 	} else {
-		return nil, H.BadRequest.Wrap(nil, "must include album, artist or genre")
+		return nil, H.BadRequest.Wrap(nil, "must include album, album_id, artist, artist_id or genre")
 	}
 	if err != nil {
 		return nil, DatabaseError.Wrap(err, "")
@@ -173,3 +202,21 @@ func ListSongs(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	cacheFor(w, time.Minute * 15)
 	return tracks, nil
 }
+
+// getArtistParam loads the artist in the artist_id query param, if it
+// belongs to the user
+func getArtistParam(req *http.Request, user *musicdb.User) (*musicdb.Artist, error) {
+	id := new(pid.PersistentID)
+	err := id.Decode(req.URL.Query().Get("artist_id"))
+	if err != nil {
+		return nil, H.BadRequest.Wrap(nil, "not a valid artist id")
+	}
+	artist, err := db.GetArtist(*id)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if artist == nil || artist.OwnerID != user.PersistentID {
+		return nil, H.NotFound
+	}
+	return artist, nil
+}
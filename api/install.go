@@ -13,6 +13,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/rclancey/authenticator"
+	"github.com/rclancey/synos/musicdb"
 )
 
 type SynosInstaller struct {
@@ -30,8 +31,9 @@ type Migration interface {
 type SimpleMigration []string
 
 func (mig SimpleMigration) Migrate(tx *sqlx.Tx) error {
+	d := musicdb.DriverDialect(tx.DriverName())
 	for _, query := range mig {
-		_, err := tx.Exec(query)
+		_, err := tx.Exec(d.Rewrite(query))
 		if err != nil {
 			return err
 		}
@@ -45,6 +47,19 @@ func (mig ComplexMigration) Migrate(tx *sqlx.Tx) error {
 	return mig(tx)
 }
 
+// DialectMigration is a migration that's done differently in each kind
+// of database, by the name of its dialect
+type DialectMigration map[string]Migration
+
+func (mig DialectMigration) Migrate(tx *sqlx.Tx) error {
+	d := musicdb.DriverDialect(tx.DriverName())
+	m, ok := mig[d.Name()]
+	if !ok {
+		return errors.Errorf("migration not supported by %s", d.Name())
+	}
+	return m.Migrate(tx)
+}
+
 func NewSynosInstaller(config *SynosConfig) (*SynosInstaller, error) {
 	u, err := user.Current()
 	if err != nil {
@@ -68,6 +83,13 @@ func (si *SynosInstaller) GetLastMigrationID() int {
 }
 
 func (si *SynosInstaller) createDB() error {
+	d, err := si.config.Database.Dialect()
+	if err != nil {
+		return err
+	}
+	if d.Name() == "sqlite" {
+		return si.createSQLiteDB(d)
+	}
 	tmpcfg := si.config.Database.Clone()
 	name := tmpcfg.Name
 	if name == "" {
@@ -77,7 +99,7 @@ func (si *SynosInstaller) createDB() error {
 	if !re.MatchString(name) {
 		return errors.New("invalid database name")
 	}
-	conn, err := sqlx.Connect("postgres", tmpcfg.DSN())
+	conn, err := sqlx.Connect(d.DriverName(), tmpcfg.DSN())
 	if err == nil {
 		log.Println("database exists")
 		conn.Close()
@@ -85,7 +107,7 @@ func (si *SynosInstaller) createDB() error {
 	}
 	log.Println("creating database")
 	tmpcfg.Name = "template1"
-	conn, err = sqlx.Connect("postgres", tmpcfg.DSN())
+	conn, err = sqlx.Connect(d.DriverName(), tmpcfg.DSN())
 	if err != nil {
 		return err
 	}
@@ -96,12 +118,38 @@ func (si *SynosInstaller) createDB() error {
 		return err
 	}
 	tmpcfg.Name = name
-	conn, err = sqlx.Connect("postgres", tmpcfg.DSN())
+	conn, err = sqlx.Connect(d.DriverName(), tmpcfg.DSN())
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	query = `CREATE TABLE version (
+	return si.createVersionTable(conn, d)
+}
+
+// createSQLiteDB makes the database file, which sqlite does when it's
+// opened, and the version table in it if it's not there yet
+func (si *SynosInstaller) createSQLiteDB(d musicdb.Dialect) error {
+	conn, err := sqlx.Connect(d.DriverName(), si.config.Database.DSN())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var n int
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'version'`
+	err = conn.QueryRowx(query).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Println("database exists")
+		return nil
+	}
+	log.Println("creating database")
+	return si.createVersionTable(conn, d)
+}
+
+func (si *SynosInstaller) createVersionTable(conn *sqlx.DB, d musicdb.Dialect) error {
+	query := `CREATE TABLE version (
 		version_id integer NOT NULL PRIMARY KEY,
 		install_date timestamp with time zone NOT NULL,
 		update_date timestamp with time zone NOT NULL,
@@ -109,7 +157,7 @@ func (si *SynosInstaller) createDB() error {
 		version character varying(255) NOT NULL,
 		migration_id integer NOT NULL
 	)`
-	_, err = conn.Exec(query)
+	_, err := conn.Exec(d.Rewrite(query))
 	if err != nil {
 		return err
 	}
@@ -140,8 +188,11 @@ func (si *SynosInstaller) Connect() error {
 	if err != nil {
 		return err
 	}
-	dsn := si.config.Database.DSN()
-	db, err := sqlx.Connect("postgres", dsn)
+	d, err := si.config.Database.Dialect()
+	if err != nil {
+		return err
+	}
+	db, err := musicdb.Connect(d, si.config.Database.DSN())
 	if err != nil {
 		return err
 	}
@@ -282,20 +333,21 @@ func (si *SynosInstaller) getMigrations() []Migration {
 
 		// 5: new auth config
 		ComplexMigration(func(tx *sqlx.Tx) error {
+			d := musicdb.DriverDialect(tx.DriverName())
 			query := `ALTER TABLE xuser ADD COLUMN password_auth TEXT`
-			_, err := tx.Exec(query)
+			_, err := tx.Exec(d.Rewrite(query))
 			if err != nil {
 				log.Println("mig5.1", err)
 				return err
 			}
 			query = `ALTER TABLE xuser ADD COLUMN twofactor_auth TEXT`
-			_, err = tx.Exec(query)
+			_, err = tx.Exec(d.Rewrite(query))
 			if err != nil {
 				log.Println("mig5.2", err)
 				return err
 			}
 			query = `ALTER TABLE xuser ADD COLUMN tmp_twofactor_auth TEXT`
-			_, err = tx.Exec(query)
+			_, err = tx.Exec(d.Rewrite(query))
 			if err != nil {
 				log.Println("mig5.3", err)
 				return err
@@ -310,7 +362,7 @@ func (si *SynosInstaller) getMigrations() []Migration {
 			}
 			auths := map[int64]*OldAuth{}
 			query = `SELECT id, auth FROM xuser WHERE auth IS NOT NULL AND auth != ''`
-			rows, err := tx.Queryx(query)
+			rows, err := tx.Queryx(d.Rewrite(query))
 			if err != nil {
 				log.Println("mig5.4", err)
 				return err
@@ -342,7 +394,7 @@ func (si *SynosInstaller) getMigrations() []Migration {
 					}
 				}
 				query := `UPDATE xuser SET password_auth = ?, twofactor_auth = ?, tmp_twofactor_auth = ? WHERE id = ?`
-				_, err = tx.Exec(tx.Rebind(query), pw, cfg.TwoFactor, cfg.TmpTwoFactor, id)
+				_, err = tx.Exec(tx.Rebind(d.Rewrite(query)), pw, cfg.TwoFactor, cfg.TmpTwoFactor, id)
 				if err != nil {
 					log.Println("mig5.5", id, err)
 					pwval, _ := pw.Value()
@@ -352,15 +404,317 @@ func (si *SynosInstaller) getMigrations() []Migration {
 					return err
 				}
 			}
+			if d.Name() == "sqlite" {
+				// sqlite only has DROP COLUMN from 3.35
+				ok, err := sqliteVersionAtLeast(tx, 3, 35)
+				if err != nil {
+					log.Println("mig5.6", err)
+					return err
+				}
+				if !ok {
+					return sqliteDropUserAuth(tx, d)
+				}
+			}
 			query = `ALTER TABLE xuser DROP COLUMN auth`
-			_, err = tx.Exec(query)
+			_, err = tx.Exec(d.Rewrite(query))
 			if err != nil {
 				log.Println("mig5.6", err)
 				return err
 			}
 			return nil
 		}),
+
+		// 6: media folder scanner
+		SimpleMigration{
+			`CREATE TABLE scan_file (
+				track_id bigint NOT NULL PRIMARY KEY,
+				owner_id bigint NOT NULL,
+				path character varying(4095) NOT NULL,
+				size bigint,
+				mod_date timestamp with time zone,
+				data bytea
+			)`,
+			`CREATE UNIQUE INDEX scan_file_path_idx ON scan_file (owner_id, path)`,
+		},
+
+		// 7: tag write-back setting
+		SimpleMigration{
+			`ALTER TABLE xuser ADD COLUMN write_tags boolean DEFAULT false NOT NULL`,
+		},
+
+		// 8: acoustic fingerprints
+		SimpleMigration{
+			`CREATE TABLE track_fingerprint (
+				track_id bigint NOT NULL PRIMARY KEY,
+				fingerprint text NOT NULL,
+				date_added timestamp with time zone DEFAULT now() NOT NULL
+			)`,
+			`CREATE TABLE fingerprint_hash (
+				hash integer NOT NULL,
+				track_id bigint NOT NULL
+			)`,
+			`CREATE INDEX fingerprint_hash_idx ON fingerprint_hash (hash)`,
+			`CREATE INDEX fingerprint_hash_track_idx ON fingerprint_hash (track_id)`,
+		},
+
+		// 9: loudness analysis
+		SimpleMigration{
+			`ALTER TABLE track ADD COLUMN track_gain double precision`,
+			`ALTER TABLE track ADD COLUMN track_peak double precision`,
+			`ALTER TABLE track ADD COLUMN album_gain double precision`,
+			`ALTER TABLE track ADD COLUMN album_peak double precision`,
+		},
+
+		// 10: per-user play history
+		SimpleMigration{
+			`CREATE TABLE play_event (
+				id bigint NOT NULL PRIMARY KEY,
+				user_id bigint,
+				track_id bigint NOT NULL,
+				play_date timestamp with time zone NOT NULL,
+				duration integer,
+				source character varying(32) NOT NULL,
+				skipped boolean DEFAULT false NOT NULL
+			)`,
+			`CREATE INDEX play_event_track_idx ON play_event (track_id, play_date)`,
+			`CREATE INDEX play_event_user_idx ON play_event (user_id, play_date)`,
+		},
+
+		// 11: scrobbling
+		SimpleMigration{
+			`ALTER TABLE xuser ADD COLUMN lastfm_user character varying(255)`,
+			`ALTER TABLE xuser ADD COLUMN lastfm_session character varying(255)`,
+			`ALTER TABLE xuser ADD COLUMN listenbrainz_user character varying(255)`,
+			`ALTER TABLE xuser ADD COLUMN listenbrainz_token character varying(255)`,
+			`CREATE TABLE scrobble_queue (
+				id bigint NOT NULL PRIMARY KEY,
+				user_id bigint NOT NULL,
+				service character varying(32) NOT NULL,
+				play_event_id bigint,
+				play_date timestamp with time zone NOT NULL,
+				data text NOT NULL,
+				attempts integer DEFAULT 0 NOT NULL,
+				next_attempt timestamp with time zone NOT NULL,
+				last_error text
+			)`,
+			`CREATE INDEX scrobble_queue_next_idx ON scrobble_queue (next_attempt)`,
+			`CREATE INDEX scrobble_queue_event_idx ON scrobble_queue (play_event_id)`,
+		},
+
+		// 12: full text search index
+		DialectMigration{
+			"postgres": SimpleMigration{
+				`CREATE TABLE IF NOT EXISTS lyrics (
+					id bigint NOT NULL PRIMARY KEY,
+					search character varying(511),
+					lyrics text
+				)`,
+				`CREATE INDEX IF NOT EXISTS lyrics_search_idx ON lyrics (search)`,
+				`ALTER TABLE track ADD COLUMN IF NOT EXISTS lyrics_id bigint`,
+				`UPDATE track SET lyrics_id = lyrics.id FROM lyrics WHERE track.lyrics_id IS NULL AND lyrics.search = lower(coalesce(track.artist, '') || ' ' || coalesce(track.name, ''))`,
+				`ALTER TABLE track ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+					setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+					setweight(to_tsvector('english', coalesce(artist, '') || ' ' || coalesce(album_artist, '')), 'A') ||
+					setweight(to_tsvector('english', coalesce(album, '') || ' ' || coalesce(composer, '')), 'B') ||
+					setweight(to_tsvector('english', coalesce(work, '') || ' ' || coalesce(movement_name, '')), 'B') ||
+					setweight(to_tsvector('english', coalesce(grouping, '') || ' ' || coalesce(comments, '')), 'C')
+				) STORED`,
+				`CREATE INDEX track_search_idx ON track USING GIN (search_vector)`,
+				`ALTER TABLE lyrics ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+					setweight(to_tsvector('english', coalesce(lyrics, '')), 'D')
+				) STORED`,
+				`CREATE INDEX lyrics_search_vector_idx ON lyrics USING GIN (search_vector)`,
+			},
+			// sqlite can't store generated columns that are added later, and
+			// has no tsvector, so the index is the weighted text that
+			// ts_match and ts_rank search through, a line for each weight
+			"sqlite": SimpleMigration{
+				`CREATE TABLE IF NOT EXISTS lyrics (
+					id bigint NOT NULL PRIMARY KEY,
+					search character varying(511),
+					lyrics text
+				)`,
+				`CREATE INDEX IF NOT EXISTS lyrics_search_idx ON lyrics (search)`,
+				`ALTER TABLE track ADD COLUMN lyrics_id bigint`,
+				`UPDATE track SET lyrics_id = lyrics.id FROM lyrics WHERE track.lyrics_id IS NULL AND lyrics.search = lower(coalesce(track.artist, '') || ' ' || coalesce(track.name, ''))`,
+				`ALTER TABLE track ADD COLUMN search_vector text GENERATED ALWAYS AS (
+					'A' || char(9) || coalesce(name, '') || ' ' || coalesce(artist, '') || ' ' || coalesce(album_artist, '') || char(10) ||
+					'B' || char(9) || coalesce(album, '') || ' ' || coalesce(composer, '') || ' ' || coalesce(work, '') || ' ' || coalesce(movement_name, '') || char(10) ||
+					'C' || char(9) || coalesce(grouping, '') || ' ' || coalesce(comments, '')
+				) VIRTUAL`,
+				`ALTER TABLE lyrics ADD COLUMN search_vector text GENERATED ALWAYS AS (
+					'D' || char(9) || coalesce(lyrics, '')
+				) VIRTUAL`,
+			},
+		},
+
+		// 13: albums
+		SimpleMigration{
+			`CREATE TABLE album (
+				id bigint NOT NULL PRIMARY KEY,
+				owner_id bigint NOT NULL,
+				name character varying(255) NOT NULL,
+				sort_name character varying(255) NOT NULL,
+				artist character varying(255),
+				sort_artist character varying(255) DEFAULT '' NOT NULL,
+				year integer,
+				release_type character varying(32),
+				disc_count smallint,
+				artwork_track_id bigint,
+				rating smallint,
+				date_added timestamp with time zone,
+				date_modified timestamp with time zone
+			)`,
+			`CREATE UNIQUE INDEX album_key_idx ON album (owner_id, sort_artist, sort_name)`,
+			`ALTER TABLE track ADD COLUMN album_id bigint`,
+			`CREATE INDEX track_album_id_idx ON track (album_id)`,
+		},
+
+		// 14: put existing tracks on albums
+		ComplexMigration(musicdb.BackfillAlbums),
+
+		// 15: artists
+		SimpleMigration{
+			`CREATE TABLE artist (
+				id bigint NOT NULL PRIMARY KEY,
+				owner_id bigint NOT NULL,
+				name character varying(255) NOT NULL,
+				sort_name character varying(255) NOT NULL,
+				sort_as character varying(255),
+				musicbrainz_id character varying(36),
+				spotify_id character varying(64),
+				biography text,
+				image_url text,
+				date_added timestamp with time zone,
+				date_modified timestamp with time zone
+			)`,
+			`CREATE INDEX artist_owner_idx ON artist (owner_id, sort_name)`,
+			`CREATE TABLE artist_alias (
+				artist_id bigint NOT NULL,
+				owner_id bigint NOT NULL,
+				name character varying(255) NOT NULL,
+				sort_name character varying(255) NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX artist_alias_key_idx ON artist_alias (owner_id, sort_name)`,
+			`CREATE INDEX artist_alias_artist_idx ON artist_alias (artist_id)`,
+			`CREATE TABLE track_artist (
+				track_id bigint NOT NULL,
+				artist_id bigint NOT NULL,
+				role character varying(32) NOT NULL,
+				position integer DEFAULT 0 NOT NULL,
+				PRIMARY KEY (track_id, artist_id, role)
+			)`,
+			`CREATE INDEX track_artist_artist_idx ON track_artist (artist_id, role)`,
+		},
+
+		// 16: link existing tracks to artists
+		ComplexMigration(musicdb.BackfillArtists),
+
+		// 17: playlist revisions
+		SimpleMigration{
+			`ALTER TABLE playlist ADD COLUMN revision integer DEFAULT 0 NOT NULL`,
+			`CREATE TABLE playlist_revision (
+				playlist_id bigint NOT NULL,
+				revision integer NOT NULL,
+				user_id bigint,
+				name character varying(255),
+				parent_id bigint,
+				sort_field character varying(126),
+				smart bytea,
+				track_ids text,
+				date_added timestamp with time zone NOT NULL,
+				PRIMARY KEY (playlist_id, revision)
+			)`,
+		},
+
+		// 18: keep existing playlists as their first revisions
+		ComplexMigration(musicdb.BackfillPlaylistRevisions),
+
+		// 19: trash for deleted tracks and playlists
+		SimpleMigration{
+			`CREATE TABLE trash (
+				id bigint NOT NULL,
+				kind character varying(16) NOT NULL,
+				owner_id bigint NOT NULL,
+				name text,
+				deleted_at timestamp with time zone NOT NULL,
+				deleted_by bigint,
+				actor character varying(16) NOT NULL,
+				file text,
+				data bytea NOT NULL,
+				PRIMARY KEY (kind, id)
+			)`,
+			`CREATE INDEX trash_owner_idx ON trash (owner_id, deleted_at)`,
+			`CREATE INDEX trash_deleted_idx ON trash (deleted_at)`,
+		},
+	}
+}
+
+// sqliteVersionAtLeast says whether the sqlite library is at least a
+// version
+func sqliteVersionAtLeast(tx *sqlx.Tx, major, minor int) (bool, error) {
+	var version string
+	err := tx.QueryRow(`SELECT sqlite_version()`).Scan(&version)
+	if err != nil {
+		return false, err
 	}
+	var maj, min int
+	_, err = fmt.Sscanf(version, "%d.%d", &maj, &min)
+	if err != nil {
+		return false, errors.Wrapf(err, "can't parse sqlite version %s", version)
+	}
+	return maj > major || (maj == major && min >= minor), nil
+}
+
+// sqliteDropUserAuth drops the old auth column from xuser the way sqlite
+// did before it had DROP COLUMN, by copying everything else into a new
+// table in its place
+func sqliteDropUserAuth(tx *sqlx.Tx, d musicdb.Dialect) error {
+	cols := `id, username, first_name, last_name, email, phone, avatar,
+		apple_id, github_id, google_id, amazon_id, facebook_id, twitter_id,
+		linkedin_id, slack_id, bitbucket_id, date_added, date_modified,
+		active, homedir, admin, library_id, last_library_update,
+		password_auth, twofactor_auth, tmp_twofactor_auth`
+	queries := []string{
+		`CREATE TABLE xuser_new (
+			id bigint NOT NULL PRIMARY KEY,
+			username character varying(255) NOT NULL UNIQUE,
+			first_name character varying(255),
+			last_name character varying(255),
+			email character varying(255) UNIQUE,
+			phone character varying(255) UNIQUE,
+			avatar character varying(255),
+			apple_id character varying(255) UNIQUE,
+			github_id character varying(255) UNIQUE,
+			google_id character varying(255) UNIQUE,
+			amazon_id character varying(255) UNIQUE,
+			facebook_id character varying(255) UNIQUE,
+			twitter_id character varying(255) UNIQUE,
+			linkedin_id character varying(255) UNIQUE,
+			slack_id character varying(255) UNIQUE,
+			bitbucket_id character varying(255) UNIQUE,
+			date_added timestamp with time zone DEFAULT now() NOT NULL,
+			date_modified timestamp with time zone DEFAULT now() NOT NULL,
+			active boolean DEFAULT true NOT NULL,
+			homedir character varying(255),
+			admin boolean DEFAULT false NOT NULL,
+			library_id bigint,
+			last_library_update timestamp with time zone,
+			password_auth TEXT,
+			twofactor_auth TEXT,
+			tmp_twofactor_auth TEXT
+		)`,
+		`INSERT INTO xuser_new (` + cols + `) SELECT ` + cols + ` FROM xuser`,
+		`DROP TABLE xuser`,
+		`ALTER TABLE xuser_new RENAME TO xuser`,
+	}
+	for _, query := range queries {
+		_, err := tx.Exec(d.Rewrite(query))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 var installMigration = SimpleMigration{
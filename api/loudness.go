@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/logging"
+	"github.com/rclancey/synos/musicdb"
+)
+
+var loudnessLock sync.Mutex
+
+// tracks that couldn't be measured, so they aren't tried again until
+// the server restarts
+var loudnessFailed = map[pid.PersistentID]bool{}
+
+// AnalyzeLibraries measures the loudness of every track that hasn't
+// been measured yet
+func AnalyzeLibraries() error {
+	errlog, err := cfg.Logging.ErrorLogger()
+	if err != nil {
+		return err
+	}
+	users, err := db.ListUsers()
+	if err != nil {
+		errlog.Errorln("error loading users:", err)
+		return err
+	}
+	for _, user := range users {
+		err := analyzeLibrary(user, errlog)
+		if err != nil {
+			errlog.Errorln("error analyzing loudness for", user.Username, err)
+		}
+	}
+	return nil
+}
+
+func analyzeLibrary(user *musicdb.User, errlog *logging.Logger) error {
+	loudnessLock.Lock()
+	defer loudnessLock.Unlock()
+	groups, err := db.LoudnessGroups(user)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, tracks := range groups {
+		retry := false
+		for _, tr := range tracks {
+			if (tr.TrackGain == nil || tr.AlbumGain == nil) && !loudnessFailed[tr.PersistentID] {
+				retry = true
+				break
+			}
+		}
+		if !retry {
+			continue
+		}
+		failed, err := db.AnalyzeLoudness(tracks)
+		for _, id := range failed {
+			loudnessFailed[id] = true
+		}
+		if err != nil {
+			return err
+		}
+		n += len(tracks) - len(failed)
+	}
+	if n > 0 {
+		errlog.Infof("analyzed loudness of %d tracks for %s", n, user.Username)
+	}
+	return nil
+}
+
+func AnalyzeTrackLoudness(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	tr, err := getTrackById(req)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := db.LoudnessAlbum(tr)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	loudnessLock.Lock()
+	defer loudnessLock.Unlock()
+	failed, err := db.AnalyzeLoudness(tracks)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	for _, id := range failed {
+		if id == tr.PersistentID {
+			return nil, H.BadRequest.Wrap(nil, "can't measure track loudness")
+		}
+	}
+	return tracks, nil
+}
@@ -104,6 +104,9 @@ configure itunes
 monitor itunes
 
 track api
+history api
+stats api
+scrobble api
 playlist api
 genius api
 recents api
@@ -112,6 +115,8 @@ art api
 cron api
 radio api
 websocket api
+subsonic api
+dlna server
 if sonos {
 	sonos api
 }
@@ -232,10 +237,42 @@ func startup() (*logging.Logger, *httpserver.Server, error) {
 	lastFm = cfg.LastFM.Client()
 	spot = cfg.Spotify.Client()
 	azClient = cfg.Lyrics.Client()
+	scrobbler = startScrobbler()
 	watch, err := WatchITunes()
 	if err != nil {
 		errlog.Errorln("error watching itunes libraries:", err)
 	}
+	go func() {
+		// fingerprinting and loudness analysis pick up anything the
+		// scan adds, so they go after it
+		if cfg.Finder.Scan {
+			err := ScanLibraries()
+			if err != nil {
+				errlog.Errorln("error scanning media folders:", err)
+			}
+		}
+		if cfg.Finder.Fingerprint {
+			err := FingerprintLibraries()
+			if err != nil {
+				errlog.Errorln("error fingerprinting media folders:", err)
+			}
+		}
+		if cfg.Loudness.Analyze {
+			err := AnalyzeLibraries()
+			if err != nil {
+				errlog.Errorln("error analyzing loudness:", err)
+			}
+		}
+	}()
+	var mediaWatch chan bool
+	if cfg.Finder.Watch {
+		mediaWatch, err = WatchMediaFolders()
+		if err != nil {
+			errlog.Errorln("error watching media folders:", err)
+		}
+	}
+
+	trashPurge := PurgeTrash()
 
 	srv, err := httpserver.NewServer(cfg.ServerConfig)
 	if err != nil {
@@ -248,8 +285,16 @@ func startup() (*logging.Logger, *httpserver.Server, error) {
 		lastFm = nil
 		spot = nil
 		watch <- true
+		if mediaWatch != nil {
+			close(mediaWatch)
+		}
+		trashPurge <- true
 		sonosDevice = nil
 		jookiDevice = nil
+		if scrobbler != nil {
+			scrobbler.Close()
+			scrobbler = nil
+		}
 	})
 
 	errlog.Infoln("Synos server starting...")
@@ -289,16 +334,29 @@ func startup() (*logging.Logger, *httpserver.Server, error) {
 	SetupAPI(srv, nil)
 	VersionAPI(api, authmw)
 	TrackAPI(api, authmw)
+	HistoryAPI(api, authmw)
+	StatsAPI(api.Prefix("/stats"), authmw)
+	ScrobbleAPI(api.Prefix("/scrobble"), authmw)
 	PlaylistAPI(api, authmw)
+	TrashAPI(api, authmw)
 	GeniusAPI(api.Prefix("/genius"), authmw)
 	RecentsAPI(api, authmw)
 	IndexAPI(api, authmw)
+	AlbumAPI(api, authmw)
+	ArtistAPI(api, authmw)
 	ArtAPI(api, authmw)
 	CronAPI(api, authmw)
 	RadioAPI(api, authmw)
 	AdminAPI(api.Prefix("/admin"), authmw)
 	WebSocketAPI(api, authmw)
 	srv.RegisterWebSocketHub(websocketHub)
+	SubsonicAPI(srv.Prefix("/rest"))
+	if cfg.DLNA.Enabled {
+		err := DLNAServer(srv)
+		if err != nil {
+			errlog.Errorln("error starting dlna server:", err)
+		}
+	}
 	/*
 	if cfg.Sonos != SonosConfig{} {
 		SonosAPI(api.Prefix("/sonos"), authmw)
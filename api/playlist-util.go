@@ -39,7 +39,14 @@ func M3U(tracks []*musicdb.Track) ([]string, error) {
 			song = *track.Name
 		}
 		u := cfg.Bind.RootURL(cfg.Sonos, false)
-		u.Path = fmt.Sprintf("/api/track/%s%s", track.PersistentID.String(), track.GetExt())
+		if cfg.Loudness.Sonos != musicdb.GainNone {
+			// normalized tracks are transcoded to mp3
+			u.Path = fmt.Sprintf("/api/track/%s.mp3", track.PersistentID.String())
+			u.RawQuery = "gain=" + string(cfg.Loudness.Sonos) + "&source=" + string(musicdb.SourceSonos)
+		} else {
+			u.Path = fmt.Sprintf("/api/track/%s%s", track.PersistentID.String(), track.GetExt())
+			u.RawQuery = "source=" + string(musicdb.SourceSonos)
+		}
 		lines[i * 2 + 1] = fmt.Sprintf("#EXTINF:%d,<%s><%s><%s>", t, m3uEscape(artist), m3uEscape(album), m3uEscape(song))
 		lines[i * 2 + 2] = u.String()
 	}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func getParentPlaylistID(s string) (*pid.PersistentID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var id pid.PersistentID
+	err := (&id).Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// ImportPlaylist makes a playlist from an m3u, pls or xspf file posted
+// as the request body.  the format comes from the format or filename
+// query parameters, or the content type, or failing those, the file
+// itself.
+func ImportPlaylist(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	q := req.URL.Query()
+	format := musicdb.PlaylistFormat(q.Get("format"))
+	if format == "" {
+		format = musicdb.PlaylistFormatFor(q.Get("filename"), req.Header.Get("Content-Type"))
+	}
+	parent, err := getParentPlaylistID(q.Get("parent"))
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "bad parent playlist id")
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "can't read playlist file")
+	}
+	pf, err := musicdb.ParsePlaylistFile(data, format)
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "can't parse playlist file")
+	}
+	res, err := db.ImportPlaylist(user, pf, "", q.Get("name"), parent)
+	if err != nil {
+		return nil, playlistSaveError(err)
+	}
+	return res, nil
+}
+
+var playlistExportTypes = map[musicdb.PlaylistFormat][2]string{
+	musicdb.PlaylistM3U: {"audio/x-mpegurl", ".m3u8"},
+	musicdb.PlaylistPLS: {"audio/x-scpls", ".pls"},
+	musicdb.PlaylistXSPF: {"application/xspf+xml", ".xspf"},
+}
+
+func attachmentName(name, ext string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`"/\:*?<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "playlist"
+	}
+	return fmt.Sprintf("attachment; filename=\"%s%s\"", name, ext)
+}
+
+// ExportPlaylist sends a playlist as an m3u8, pls, xspf or json file.
+// the paths=absolute query parameter gives full paths to the files;
+// otherwise they're relative to the media folder.
+func ExportPlaylist(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := db.GetPlaylist(id, user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if pl == nil {
+		return nil, H.NotFound.Wrapf(nil, "playlist %s does not exist", id)
+	}
+	if pl.Folder {
+		return nil, H.BadRequest.Wrapf(nil, "can't export playlist folders")
+	}
+	q := req.URL.Query()
+	format := strings.ToLower(q.Get("format"))
+	if format == "" || format == "m3u8" {
+		format = string(musicdb.PlaylistM3U)
+	}
+	types, ok := playlistExportTypes[musicdb.PlaylistFormat(format)]
+	if !ok && format != "json" {
+		return nil, H.BadRequest.Wrapf(nil, "unknown playlist format %s", format)
+	}
+	var tracks []*musicdb.Track
+	if pl.Smart != nil {
+		tracks, err = db.SmartTracks(pl.Smart)
+	} else {
+		tracks, err = db.PlaylistTracks(pl)
+	}
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if format == "json" {
+		pl.PlaylistItems = tracks
+		pl.TrackIDs = make([]pid.PersistentID, len(tracks))
+		for i, tr := range tracks {
+			pl.TrackIDs[i] = tr.PersistentID
+		}
+		return pl, nil
+	}
+	var buf bytes.Buffer
+	err = musicdb.WritePlaylistFile(&buf, musicdb.PlaylistFormat(format), pl.Name, tracks, q.Get("paths") == "absolute")
+	if err != nil {
+		return nil, H.InternalServerError.Wrap(err, "")
+	}
+	w.Header().Set("Content-Type", types[0])
+	w.Header().Set("Content-Disposition", attachmentName(pl.Name, types[1]))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+	return nil, nil
+}
+
+// ExportLibrary sends the user's whole library as an itunes library xml
+// file
+func ExportLibrary(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	var buf bytes.Buffer
+	err := db.WriteITunesLibrary(&buf, user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", attachmentName("iTunes Music Library", ".xml"))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+	return nil, nil
+}
+
+// ImportPlaylistMain is the entry point for the import-playlist
+// command, which makes a playlist for each file named on the command
+// line
+func ImportPlaylistMain() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := flags.String("config", "synos.json", "synos configuration file")
+	username := flags.String("user", "", "user to own the playlists")
+	name := flags.String("name", "", "name of the playlist (defaults to the one in the file)")
+	parentId := flags.String("parent", "", "id of the folder to put the playlists in")
+	flags.Parse(os.Args[1:])
+	if *username == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	parent, err := getParentPlaylistID(*parentId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg = DefaultSynosConfig()
+	err = cfg.LoadFromFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.ServerRoot, err = filepath.Abs(filepath.Clean(H.EnvEval(cfg.ServerRoot)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cfg.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err = cfg.Database.DB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Finder.FileFinder()
+	user := &musicdb.User{Username: *username}
+	err = user.Reload(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reports := []*musicdb.PlaylistImport{}
+	for _, fn := range flags.Args() {
+		fn, err = filepath.Abs(fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pf, err := musicdb.ParsePlaylistFile(data, musicdb.PlaylistFormatFor(fn, ""))
+		if err != nil {
+			log.Fatalf("%s: %s", fn, err)
+		}
+		res, err := db.ImportPlaylist(user, pf, filepath.Dir(fn), *name, parent)
+		if err != nil {
+			log.Fatalf("%s: %s", fn, err)
+		}
+		reports = append(reports, res)
+	}
+	data, _ := json.MarshalIndent(reports, "", "  ")
+	fmt.Println(string(data))
+}
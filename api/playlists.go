@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"log"
 	"net/http"
 	"path"
@@ -23,14 +24,20 @@ func PlaylistAPI(router H.Router, authmw H.Middleware) {
 	router.GET("/playlist/:id/tracks.m3u", authmw(H.HandlerFunc(PlaylistTracks)))
 	router.GET("/playlist/:id/track_ids", authmw(H.HandlerFunc(PlaylistTrackIDs)))
 	router.GET("/playlist/:id/track-ids", authmw(H.HandlerFunc(PlaylistTrackIDs)))
+	router.GET("/playlist/:id/export", authmw(H.HandlerFunc(ExportPlaylist)))
 	router.POST("/playlist", authmw(H.HandlerFunc(CreatePlaylist)))
+	router.POST("/playlists/import", authmw(H.HandlerFunc(ImportPlaylist)))
 	router.PUT("/playlist/:id/tracks", authmw(H.HandlerFunc(EditPlaylistTracks)))
 	router.PUT("/playlist/:id", authmw(H.HandlerFunc(EditPlaylist)))
 	router.PATCH("/playlist/:id", authmw(H.HandlerFunc(AppendPlaylistTracks)))
 	router.DELETE("/playlist/:id", authmw(H.HandlerFunc(DeletePlaylist)))
+	router.GET("/playlist/:id/revisions", authmw(H.HandlerFunc(ListPlaylistRevisions)))
+	router.GET("/playlist/:id/revisions/:revision", authmw(H.HandlerFunc(GetPlaylistRevision)))
+	router.POST("/playlist/:id/revisions/:revision/restore", authmw(H.HandlerFunc(RestorePlaylistRevision)))
 	router.PUT("/shared/:id", authmw(H.HandlerFunc(SharePlaylist)))
 	router.DELETE("/shared/:id", authmw(H.HandlerFunc(UnsharePlaylist)))
 	router.GET("/itunes-playlist/:id", authmw(H.HandlerFunc(GetItunesPlaylist)))
+	router.POST("/smart-query", authmw(H.HandlerFunc(SmartQuery)))
 }
 
 /*
@@ -302,17 +309,22 @@ func EditPlaylist(w http.ResponseWriter, req *http.Request) (interface{}, error)
 	}
 	pl.SortField = xpl.SortField
 	pl.Name = xpl.Name
-	err = db.SavePlaylist(pl)
+	base, err := getBaseRevision(req)
 	if err != nil {
-		switch err {
-		case musicdb.CircularPlaylistFolder:
-			return nil, H.BadRequest.Wrap(err, "")
-		case musicdb.NoSuchPlaylistFolder:
-			return nil, H.BadRequest.Wrap(err, "")
-		case musicdb.ParentNotAFolder:
-			return nil, H.BadRequest.Wrap(err, "")
-		default:
-			return nil, DatabaseError.Wrap(err, "")
+		return nil, err
+	}
+	if base != nil {
+		conflict, err := db.SavePlaylistEdit(pl, *base, user)
+		if err != nil {
+			return nil, playlistSaveError(err)
+		}
+		if conflict != nil {
+			return writeConflict(w, conflict)
+		}
+	} else {
+		err = db.SavePlaylist(pl)
+		if err != nil {
+			return nil, playlistSaveError(err)
 		}
 	}
 	if !pl.Folder {
@@ -365,6 +377,20 @@ func EditPlaylistTracks(w http.ResponseWriter, req *http.Request) (interface{},
 	for i, tr := range tracks {
 		pl.TrackIDs[i] = tr.PersistentID
 	}
+	base, err := getBaseRevision(req)
+	if err != nil {
+		return nil, err
+	}
+	if base != nil {
+		conflict, err := db.SavePlaylistEdit(pl, *base, user)
+		if err != nil {
+			return nil, playlistSaveError(err)
+		}
+		if conflict != nil {
+			return writeConflict(w, conflict)
+		}
+		return pl, nil
+	}
 	err = db.SavePlaylistTracks(pl)
 	if err != nil {
 		return nil, DatabaseError.Wrap(err, "")
@@ -443,7 +469,7 @@ func DeletePlaylist(w http.ResponseWriter, req *http.Request) (interface{}, erro
 	if !pl.Folder && pl.Smart == nil {
 		pl.TrackIDs, _ = db.PlaylistTrackIDs(pl)
 	}
-	err = db.DeletePlaylist(pl)
+	err = db.DeletePlaylist(pl, user)
 	if err != nil {
 		switch err {
 		case musicdb.PlaylistFolderNotEmpty:
@@ -547,3 +573,213 @@ func UnsharePlaylist(w http.ResponseWriter, req *http.Request) (interface{}, err
 	}
 	return pl, nil
 }
+
+// getBaseRevision reads the revision of a playlist an edit was made to,
+// if the client gave one.  without it, the edit just replaces what's
+// there.
+func getBaseRevision(req *http.Request) (*int, error) {
+	s := req.URL.Query().Get("revision")
+	if s == "" {
+		return nil, nil
+	}
+	rev, err := strconv.Atoi(s)
+	if err != nil || rev < 0 {
+		return nil, H.BadRequest.Wrapf(err, "bad revision %s", s)
+	}
+	return &rev, nil
+}
+
+func playlistSaveError(err error) error {
+	switch err {
+	case musicdb.CircularPlaylistFolder, musicdb.NoSuchPlaylistFolder, musicdb.ParentNotAFolder, musicdb.ErrNoSuchRevision:
+		return H.BadRequest.Wrap(err, "")
+	case musicdb.ErrPlaylistChanged:
+		return H.Conflict.Wrap(err, "")
+	}
+	return DatabaseError.Wrap(err, "")
+}
+
+// writeConflict sends a 409 with the edit that couldn't be merged and
+// what changed since, so the client can sort it out and try again
+func writeConflict(w http.ResponseWriter, conflict *musicdb.PlaylistConflict) (interface{}, error) {
+	data, err := json.Marshal(conflict)
+	if err != nil {
+		return nil, H.InternalServerError.Wrap(err, "")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusConflict)
+	w.Write(data)
+	return nil, nil
+}
+
+func getPlaylistRevisionNumber(req *http.Request) (int, error) {
+	s := pathVar(req, "revision")
+	rev, err := strconv.Atoi(s)
+	if err != nil || rev < 0 {
+		return 0, H.BadRequest.Wrapf(err, "bad revision %s", s)
+	}
+	return rev, nil
+}
+
+func ListPlaylistRevisions(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := db.GetPlaylist(id, user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if pl == nil {
+		return nil, H.NotFound.Wrapf(nil, "playlist %s does not exist", id)
+	}
+	revs, err := db.PlaylistRevisions(pl)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return revs, nil
+}
+
+func GetPlaylistRevision(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	revision, err := getPlaylistRevisionNumber(req)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := db.GetPlaylist(id, user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if pl == nil {
+		return nil, H.NotFound.Wrapf(nil, "playlist %s does not exist", id)
+	}
+	rev, err := db.GetPlaylistRevision(pl, revision)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if rev == nil {
+		return nil, H.NotFound.Wrapf(nil, "playlist %s has no revision %d", id, revision)
+	}
+	return rev, nil
+}
+
+// RestorePlaylistRevision puts a playlist back the way it was at an
+// earlier revision, which undoes the edits made since
+func RestorePlaylistRevision(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	revision, err := getPlaylistRevisionNumber(req)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := db.GetPlaylist(id, user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	if pl == nil {
+		return nil, H.NotFound.Wrapf(nil, "playlist %s does not exist", id)
+	}
+	if pl.OwnerID != user.PersistentID {
+		return nil, H.Forbidden
+	}
+	if pl.GeniusTrackID != nil {
+		return nil, H.BadRequest.Wrap(nil, "can't modify genius playlist tracks")
+	}
+	err = db.RestorePlaylistRevision(pl, revision, user)
+	if err != nil {
+		if err == musicdb.ErrNoSuchRevision {
+			return nil, H.NotFound.Wrapf(nil, "playlist %s has no revision %d", id, revision)
+		}
+		return nil, playlistSaveError(err)
+	}
+	if !pl.Folder {
+		if pl.Smart != nil {
+			pl.PlaylistItems, err = db.SmartTracks(pl.Smart)
+		} else {
+			pl.PlaylistItems, err = db.PlaylistTracks(pl)
+		}
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
+	}
+	return pl, nil
+}
+
+type SmartQueryRequest struct {
+	Query *string        `json:"query,omitempty"`
+	Smart *musicdb.Smart `json:"smart,omitempty"`
+}
+
+type SmartQueryResponse struct {
+	Query  string                   `json:"query"`
+	Smart  *musicdb.Smart           `json:"smart,omitempty"`
+	Error  *musicdb.SmartQueryError `json:"error,omitempty"`
+	Count  int                      `json:"count"`
+	Tracks []*musicdb.Track         `json:"tracks"`
+}
+
+// SmartQuery checks a smart playlist query and previews the tracks it
+// picks.  given a smart playlist instead, it gives the query for it.
+// a query that doesn't parse isn't a failed request: the error says
+// where in the query the problem is.
+func SmartQuery(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	params := &SmartQueryRequest{}
+	err := H.ReadJSON(req, params)
+	if err != nil {
+		return nil, err
+	}
+	res := &SmartQueryResponse{Tracks: []*musicdb.Track{}}
+	if params.Smart != nil {
+		if params.Smart.RuleSet == nil {
+			return nil, H.BadRequest.Wrap(nil, "smart playlist has no rules")
+		}
+		res.Smart = params.Smart
+		res.Query = params.Smart.String()
+	} else if params.Query != nil {
+		res.Query = *params.Query
+		res.Smart, err = musicdb.ParseSmart(res.Query)
+		if err != nil {
+			qerr, ok := err.(*musicdb.SmartQueryError)
+			if !ok {
+				return nil, H.BadRequest.Wrap(err, "")
+			}
+			res.Error = qerr
+			return res, nil
+		}
+	} else {
+		return nil, H.BadRequest.Wrap(nil, "no query or smart playlist")
+	}
+	tracks, err := db.SmartTracks(res.Smart)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	res.Count = len(tracks)
+	n := 100
+	if s := req.URL.Query().Get("count"); s != "" {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, H.BadRequest.Wrap(err, "bad count")
+		}
+	}
+	if len(tracks) > n {
+		tracks = tracks[:n]
+	}
+	res.Tracks = tracks
+	return res, nil
+}
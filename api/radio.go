@@ -6,14 +6,70 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"sync"
 
 	H "github.com/rclancey/httpserver/v2"
 	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
 	"github.com/rclancey/synos/radio"
 )
 
 var streams = map[string]*radio.Stream{}
 
+// who's tuned in to each station, so the station's plays can be credited
+// to them
+var listeners = map[string][]*musicdb.User{}
+var listenersLock sync.Mutex
+
+func addListener(key string, user *musicdb.User) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	listeners[key] = append(listeners[key], user)
+}
+
+func removeListener(key string, user *musicdb.User) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	users := listeners[key]
+	for i, u := range users {
+		if u == user {
+			listeners[key] = append(users[:i], users[i+1:]...)
+			break
+		}
+	}
+	if len(listeners[key]) == 0 {
+		delete(listeners, key)
+	}
+}
+
+// stationPlayed records a play of a station's track for each of its
+// listeners
+func stationPlayed(key string, tr *musicdb.Track) {
+	users := map[pid.PersistentID]*musicdb.User{}
+	anon := false
+	listenersLock.Lock()
+	for _, u := range listeners[key] {
+		if u == nil {
+			anon = true
+		} else {
+			users[u.PersistentID] = u
+		}
+	}
+	listenersLock.Unlock()
+	for _, u := range users {
+		_, err := recordPlay(u, tr, musicdb.SourceRadio)
+		if err != nil {
+			log.Println("error recording radio play:", err)
+		}
+	}
+	if anon || len(users) == 0 {
+		_, err := recordPlay(nil, tr, musicdb.SourceRadio)
+		if err != nil {
+			log.Println("error recording radio play:", err)
+		}
+	}
+}
+
 func RadioAPI(router H.Router, authmw H.Middleware) {
 	streams = map[string]*radio.Stream{}
 	router.GET("/radio", authmw(H.HandlerFunc(ListStations)))
@@ -34,6 +90,7 @@ type CreateStationMessage struct {
 	StationType string `json:"type"`
 	PlaylistID *pid.PersistentID `json:"playlist_id"`
 	Shuffle bool `json:"shuffle"`
+	Gain *musicdb.GainMode `json:"gain"`
 }
 
 func CreateStation(w http.ResponseWriter, req *http.Request) (interface{}, error) {
@@ -52,10 +109,18 @@ func CreateStation(w http.ResponseWriter, req *http.Request) (interface{}, error
 	if err != nil {
 		return nil, err
 	}
+	if msg.Gain != nil {
+		station.SetGain(*msg.Gain, cfg.Loudness.Preamp)
+	} else {
+		station.SetGain(cfg.Loudness.Radio, cfg.Loudness.Preamp)
+	}
 	stream, err = radio.NewStream(name, station)
 	if err != nil {
 		return nil, err
 	}
+	stream.OnTrack = func(tr *musicdb.Track) {
+		stationPlayed(key, tr)
+	}
 	streams[key] = stream
 	return stream, nil
 }
@@ -73,6 +138,9 @@ func PlayStation(w http.ResponseWriter, req *http.Request) (interface{}, error)
 	}
 	c, r := stream.Connect()
 	defer r.Close()
+	user := getUser(req)
+	addListener(key, user)
+	defer removeListener(key, user)
 	w.Header().Set("Connection", "Keep-Alive")
 	w.Header().Set("Content-Type", "audio/mpeg")
 	w.Header().Set("Bitrate", "128")
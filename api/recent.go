@@ -7,6 +7,7 @@ import (
 	"time"
 
 	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
 	"github.com/rclancey/synos/musicdb"
 )
 
@@ -15,12 +16,14 @@ func RecentsAPI(router H.Router, authmw H.Middleware) {
 }
 
 type Album struct {
+	PersistentID *pid.PersistentID `json:"persistent_id,omitempty"`
 	Artist string `json:"artist"`
 	Album string `json:"album"`
 	Tracks []*musicdb.Track `json:"tracks"`
 }
 
 type albumKey struct {
+	ID pid.PersistentID
 	Artist string
 	Album string
 }
@@ -62,7 +65,9 @@ func ListRecents(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 		})
 		*/
 		key := albumKey{}
-		if t.AlbumArtist != nil && *t.AlbumArtist != "" {
+		if t.AlbumID != nil {
+			key.ID = *t.AlbumID
+		} else if t.AlbumArtist != nil && *t.AlbumArtist != "" {
 			/*
 			if t.SortAlbumArtist != nil && *t.SortAlbumArtist != "" {
 				key.Artist = *t.SortAlbumArtist
@@ -94,6 +99,7 @@ func ListRecents(w http.ResponseWriter, r *http.Request) (interface{}, error) {
 		album, ok := albums[key]
 		if !ok {
 			album = &Album{
+				PersistentID: t.AlbumID,
 				Tracks: []*musicdb.Track{},
 			}
 			if t.AlbumArtist != nil && *t.AlbumArtist != "" {
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func reorganizeJournal(user *musicdb.User) (string, error) {
+	dn, err := cfg.Abs("var/reorganize")
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dn, 0775)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dn, user.Username + ".journal"), nil
+}
+
+func reorganizeAdmin(req *http.Request) (*musicdb.User, error) {
+	admin := readAdmin(req)
+	if admin == nil || !admin.IsAdmin {
+		return nil, H.Forbidden
+	}
+	return queryUser(req, admin)
+}
+
+func reorganizeLibrary(user *musicdb.User) (*musicdb.ReorganizeResult, error) {
+	journal, err := reorganizeJournal(user)
+	if err != nil {
+		return nil, FilesystemError.Wrap(err, "can't create reorganize journal")
+	}
+	// hold the scan lock so the media folder watcher sees the moves
+	// only after the database knows about them
+	scanLock.Lock()
+	defer scanLock.Unlock()
+	plan, err := db.PlanReorganize(user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	res, err := db.Reorganize(plan, journal)
+	if err != nil {
+		if errors.Is(err, musicdb.ErrReorganizeInProgress) {
+			return nil, H.Conflict.Wrap(err, "")
+		}
+		return res, FilesystemError.Wrap(err, "")
+	}
+	broadcastMoves(user, res)
+	return res, nil
+}
+
+func rollbackReorganize(user *musicdb.User) (*musicdb.ReorganizeResult, error) {
+	journal, err := reorganizeJournal(user)
+	if err != nil {
+		return nil, FilesystemError.Wrap(err, "can't find reorganize journal")
+	}
+	scanLock.Lock()
+	defer scanLock.Unlock()
+	res, err := db.RollbackReorganize(journal)
+	if err != nil {
+		return res, FilesystemError.Wrap(err, "")
+	}
+	broadcastMoves(user, res)
+	return res, nil
+}
+
+func broadcastMoves(user *musicdb.User, res *musicdb.ReorganizeResult) {
+	if res == nil || len(res.Moved) == 0 {
+		return
+	}
+	hub, err := getWebsocketHub()
+	if err != nil {
+		return
+	}
+	ids := []pid.PersistentID{}
+	for _, mv := range res.Moved {
+		if mv.TrackID != 0 {
+			ids = append(ids, mv.TrackID)
+		}
+	}
+	tracks := []*musicdb.Track{}
+	for _, id := range ids {
+		tr, err := db.GetTrack(id)
+		if err == nil && tr != nil {
+			tracks = append(tracks, tr)
+		}
+	}
+	evt := &LibraryEvent{
+		Type: "library",
+		User: user.Clean(),
+		Tracks: tracks,
+	}
+	hub.BroadcastEvent(evt)
+}
+
+func PlanReorganizeHandler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user, err := reorganizeAdmin(req)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := db.PlanReorganize(user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return plan, nil
+}
+
+func ReorganizeHandler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user, err := reorganizeAdmin(req)
+	if err != nil {
+		return nil, err
+	}
+	return reorganizeLibrary(user)
+}
+
+func RollbackReorganizeHandler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user, err := reorganizeAdmin(req)
+	if err != nil {
+		return nil, err
+	}
+	return rollbackReorganize(user)
+}
+
+// ReorganizeMain is the entry point for the reorganize command, which
+// does the same as the admin endpoints without a running server
+func ReorganizeMain() {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := flags.String("config", "synos.json", "synos configuration file")
+	username := flags.String("user", "", "user whose library to reorganize")
+	execute := flags.Bool("execute", false, "move files instead of just printing the plan")
+	rollback := flags.Bool("rollback", false, "undo the last reorganization")
+	flags.Parse(os.Args[1:])
+	if *username == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	cfg = DefaultSynosConfig()
+	err := cfg.LoadFromFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.ServerRoot, err = filepath.Abs(filepath.Clean(H.EnvEval(cfg.ServerRoot)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cfg.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err = cfg.Database.DB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Finder.FileFinder()
+	user := &musicdb.User{Username: *username}
+	err = user.Reload(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var out interface{}
+	if *rollback {
+		out, err = rollbackReorganize(user)
+	} else if *execute {
+		out, err = reorganizeLibrary(user)
+	} else {
+		out, err = db.PlanReorganize(user)
+	}
+	if out != nil {
+		data, _ := json.MarshalIndent(out, "", "  ")
+		fmt.Println(string(data))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/logging"
+	"github.com/rclancey/synos/musicdb"
+	"github.com/rclancey/synos/watcher"
+)
+
+var scanLock sync.Mutex
+
+func ScanLibraries() error {
+	errlog, err := cfg.Logging.ErrorLogger()
+	if err != nil {
+		return err
+	}
+	users, err := db.ListUsers()
+	if err != nil {
+		errlog.Errorln("error loading users:", err)
+		return err
+	}
+	finder := musicdb.GetGlobalFinder()
+	for _, user := range users {
+		if finder.UserMediaFolder(user.HomeDirectory) == "" {
+			errlog.Debugln("no media folder found for", user.Username)
+			continue
+		}
+		_, err := scanLibrary(user, errlog, false)
+		if err != nil {
+			errlog.Errorln("error scanning library for", user.Username, err)
+		}
+	}
+	return nil
+}
+
+func scanLibrary(user *musicdb.User, errlog *logging.Logger, force bool) (*musicdb.ScanResult, error) {
+	scanLock.Lock()
+	defer scanLock.Unlock()
+	errlog.Infoln("media folder scan", user.Username)
+	H.Measure("library_scan", map[string]string{"user": user.Username}, 1)
+	defer H.Measure("library_scan", map[string]string{"user": user.Username}, 0)
+	// a scan that finds too much missing still applies everything
+	// else, so res comes back with the error
+	res, scanErr := db.ScanLibrary(user, force)
+	if res == nil {
+		return nil, scanErr
+	}
+	errlog.Infof("media folder scan complete for %s: %d added, %d updated, %d moved, %d deleted", user.Username, len(res.Added), len(res.Updated), len(res.Moved), len(res.Deleted))
+	if !res.Changed() {
+		return res, scanErr
+	}
+	user.UpdateLibrary(db)
+	err := db.UpdateFolderTracks()
+	if err != nil {
+		errlog.Error(err)
+	}
+	err = db.UpdateSmartTracks()
+	if err != nil {
+		errlog.Error(err)
+	}
+	hub, err := getWebsocketHub()
+	if err == nil {
+		evt := &LibraryEvent{
+			Type: "library",
+			User: user.Clean(),
+			Tracks: res.Tracks(),
+		}
+		hub.BroadcastEvent(evt)
+	}
+	return res, scanErr
+}
+
+func applyMediaChanges(user *musicdb.User, fns []string, errlog *logging.Logger) {
+	scanLock.Lock()
+	defer scanLock.Unlock()
+	errlog.Debugln("media folder changes", user.Username, fns)
+	res, err := db.ScanPaths(user, fns)
+	if err != nil {
+		errlog.Errorln("error applying media folder changes for", user.Username, err)
+		if res == nil {
+			return
+		}
+	}
+	if !res.Changed() {
+		return
+	}
+	errlog.Infof("media folder changes for %s: %d added, %d updated, %d moved, %d deleted", user.Username, len(res.Added), len(res.Updated), len(res.Moved), len(res.Deleted))
+	if cfg.Finder.Fingerprint && (len(res.Added) > 0 || len(res.Updated) > 0) {
+		go fingerprintLibrary(user, errlog)
+	}
+	if cfg.Loudness.Analyze && (len(res.Added) > 0 || len(res.Updated) > 0) {
+		go analyzeLibrary(user, errlog)
+	}
+	user.UpdateLibrary(db)
+	pls, err := db.UpdateSmartTracksFor(res.TrackIDs(), len(res.Deleted) > 0)
+	if err != nil {
+		errlog.Error(err)
+	}
+	err = db.UpdateParentFolderTracks(pls)
+	if err != nil {
+		errlog.Error(err)
+	}
+	hub, err := getWebsocketHub()
+	if err == nil {
+		evt := &LibraryEvent{
+			Type: "library",
+			User: user.Clean(),
+			Playlists: pls,
+			Tracks: res.Tracks(),
+		}
+		hub.BroadcastEvent(evt)
+	}
+}
+
+func WatchMediaFolders() (chan bool, error) {
+	errlog, err := cfg.Logging.ErrorLogger()
+	if err != nil {
+		return nil, err
+	}
+	users, err := db.ListUsers()
+	if err != nil {
+		errlog.Errorln("error loading users:", err)
+		return nil, err
+	}
+	finder := musicdb.GetGlobalFinder()
+	watchers := []*watcher.Watcher{}
+	userByWatcher := map[*watcher.Watcher]*musicdb.User{}
+	for _, user := range users {
+		root := finder.UserMediaFolder(user.HomeDirectory)
+		if root == "" {
+			errlog.Debugln("no media folder found for", user.Username)
+			continue
+		}
+		w, err := watcher.NewWatcher(2 * time.Second, root)
+		if err != nil {
+			errlog.Errorln("error watching media folder", root, err)
+			continue
+		}
+		errlog.Debugln("watching media folder", root, "for", user.Username)
+		watchers = append(watchers, w)
+		userByWatcher[w] = user
+	}
+	if len(watchers) == 0 {
+		return nil, errors.New("no media folders to watch")
+	}
+	quit := make(chan bool)
+	for _, w := range watchers {
+		go func(w *watcher.Watcher, user *musicdb.User) {
+			for {
+				select {
+				case <-quit:
+					w.Close()
+					return
+				case fns := <-w.C:
+					applyMediaChanges(user, fns, errlog)
+				case err := <-w.Errors:
+					errlog.Errorln("media folder watcher error for", user.Username, err)
+				}
+			}
+		}(w, userByWatcher[w])
+	}
+	return quit, nil
+}
+
+func ScanLibraryHandler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	admin := readAdmin(req)
+	if admin == nil {
+		return nil, H.Forbidden
+	}
+	errlog, err := cfg.Logging.ErrorLogger()
+	if err != nil {
+		return nil, err
+	}
+	user, err := queryUser(req, admin)
+	if err != nil {
+		return nil, err
+	}
+	force, _ := strconv.ParseBool(req.URL.Query().Get("force"))
+	res, err := scanLibrary(user, errlog, force)
+	if err != nil {
+		if errors.Is(err, musicdb.ErrTooManyMissing) {
+			return nil, H.Conflict.Wrap(err, "tracks for missing files were kept; scan again with force=true to delete them")
+		}
+		return nil, H.InternalServerError.Wrap(err, "can't scan media folder")
+	}
+	return res, nil
+}
+
+// queryUser finds the user named in the request's user parameter,
+// defaulting to the requesting user.  only admins may name someone else.
+func queryUser(req *http.Request, admin *musicdb.User) (*musicdb.User, error) {
+	username := req.URL.Query().Get("user")
+	if username == "" || username == admin.Username {
+		return admin, nil
+	}
+	if !admin.IsAdmin {
+		return nil, H.Forbidden
+	}
+	user := &musicdb.User{Username: username}
+	err := user.Reload(db)
+	if err != nil {
+		return nil, H.NotFound.Wrapf(err, "no such user %s", username)
+	}
+	return user, nil
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/musicdb"
+	"github.com/rclancey/synos/scrobble"
+)
+
+var scrobbler *scrobble.Scrobbler
+
+func ScrobbleAPI(router H.Router, authmw H.Middleware) {
+	router.GET("/", authmw(H.HandlerFunc(ScrobbleStatus)))
+	router.GET("/lastfm/connect", authmw(H.HandlerFunc(ConnectLastFM)))
+	router.GET("/lastfm/callback", authmw(H.HandlerFunc(LastFMCallback)))
+	router.PUT("/listenbrainz", authmw(H.HandlerFunc(ConnectListenBrainz)))
+	router.DELETE("/:service", authmw(H.HandlerFunc(DisconnectScrobbler)))
+}
+
+// startScrobbler sets up the services the config has credentials for,
+// and starts working through the queue.  there's no scrobbler if there
+// aren't any.
+func startScrobbler() *scrobble.Scrobbler {
+	services := []scrobble.Service{}
+	if cfg.LastFM.APIKey != "" && cfg.LastFM.Secret != "" {
+		services = append(services, scrobble.NewLastFM(cfg.LastFM.APIKey, cfg.LastFM.Secret))
+	}
+	if cfg.ListenBrainz.Enabled {
+		services = append(services, scrobble.NewListenBrainz(cfg.ListenBrainz.URL))
+	}
+	if len(services) == 0 {
+		return nil
+	}
+	s := scrobble.NewScrobbler(db, services...)
+	s.Start()
+	return s
+}
+
+func getScrobbler() *scrobble.Scrobbler {
+	return scrobbler
+}
+
+func lastFMService() *scrobble.LastFM {
+	s := getScrobbler()
+	if s == nil {
+		return nil
+	}
+	lf, _ := s.Service("lastfm").(*scrobble.LastFM)
+	return lf
+}
+
+func listenBrainzService() *scrobble.ListenBrainz {
+	s := getScrobbler()
+	if s == nil {
+		return nil
+	}
+	lb, _ := s.Service("listenbrainz").(*scrobble.ListenBrainz)
+	return lb
+}
+
+// recordPlay adds a play to the history, and passes it on to the user's
+// scrobbling services
+func recordPlay(user *musicdb.User, tr *musicdb.Track, src musicdb.PlaySource) (*musicdb.PlayEvent, error) {
+	ev := musicdb.NewPlayEvent(user, tr, src)
+	err := db.RecordPlay(tr, ev)
+	if err != nil {
+		return nil, err
+	}
+	scrobblePlay(user, tr, ev)
+	return ev, nil
+}
+
+// recordStreamedPlay is recordPlay for a track being fetched by a
+// player, which only counts if it isn't part of a play that's already
+// been recorded
+func recordStreamedPlay(user *musicdb.User, tr *musicdb.Track, src musicdb.PlaySource) (*musicdb.PlayEvent, error) {
+	ev := musicdb.NewPlayEvent(user, tr, src)
+	ok, err := db.RecordStreamedPlay(tr, ev)
+	if err != nil || !ok {
+		return nil, err
+	}
+	scrobblePlay(user, tr, ev)
+	return ev, nil
+}
+
+func scrobblePlay(user *musicdb.User, tr *musicdb.Track, ev *musicdb.PlayEvent) {
+	s := getScrobbler()
+	if s == nil || user == nil {
+		return
+	}
+	// the user from the request doesn't carry their credentials
+	full := &musicdb.User{PersistentID: user.PersistentID}
+	err := full.Reload(db)
+	if err != nil {
+		log.Println("can't load user for scrobbling:", err)
+		return
+	}
+	s.NowPlaying(full, tr)
+	err = s.Scrobble(full, tr, ev)
+	if err != nil {
+		log.Println("error queueing scrobble:", err)
+	}
+}
+
+type ScrobbleStatusResponse struct {
+	LastFM           bool    `json:"lastfm"`
+	LastFMUser       *string `json:"lastfm_user,omitempty"`
+	ListenBrainz     bool    `json:"listenbrainz"`
+	ListenBrainzUser *string `json:"listenbrainz_user,omitempty"`
+	Queued           int     `json:"queued"`
+}
+
+// ScrobbleStatus says which services are available and which the user
+// has connected to
+func ScrobbleStatus(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	status := &ScrobbleStatusResponse{
+		LastFM: lastFMService() != nil,
+		ListenBrainz: listenBrainzService() != nil,
+	}
+	if user.LastFMSession != nil {
+		status.LastFMUser = user.LastFMUser
+	}
+	if user.ListenBrainzToken != nil {
+		status.ListenBrainzUser = user.ListenBrainzUser
+	}
+	n, err := db.QueuedScrobbleCount(user.PersistentID)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	status.Queued = n
+	return status, nil
+}
+
+// requestURL rebuilds the url a request was made to, for handing
+// callbacks to outside services
+func requestURL(req *http.Request, path string, query url.Values) string {
+	u := &url.URL{
+		Scheme: "http",
+		Host: req.Host,
+		Path: path,
+	}
+	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		u.Scheme = "https"
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// ConnectLastFM gives the url to send the user to so they can let us
+// scrobble to their last.fm account.  last.fm sends them back to
+// LastFMCallback, which sends them on to the redirect parameter.
+func ConnectLastFM(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	lf := lastFMService()
+	if lf == nil {
+		return nil, H.NotFound.Wrap(nil, "last.fm scrobbling not configured")
+	}
+	q := url.Values{}
+	redirect := req.URL.Query().Get("redirect")
+	if redirect != "" {
+		q.Set("redirect", redirect)
+	}
+	cb := requestURL(req, "/api/scrobble/lastfm/callback", q)
+	return map[string]string{"url": lf.AuthorizeURL(cb)}, nil
+}
+
+func LastFMCallback(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	lf := lastFMService()
+	if lf == nil {
+		return nil, H.NotFound.Wrap(nil, "last.fm scrobbling not configured")
+	}
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return nil, H.BadRequest.Wrap(nil, "no last.fm token")
+	}
+	name, key, err := lf.GetSession(token)
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "can't get last.fm session")
+	}
+	user.LastFMUser = &name
+	user.LastFMSession = &key
+	err = user.Update()
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	redirect := req.URL.Query().Get("redirect")
+	if redirect == "" || !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	return H.Redirect(redirect), nil
+}
+
+// ConnectListenBrainz saves the user token from the user's ListenBrainz
+// profile, once ListenBrainz has vouched for it
+func ConnectListenBrainz(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	lb := listenBrainzService()
+	if lb == nil {
+		return nil, H.NotFound.Wrap(nil, "listenbrainz scrobbling not configured")
+	}
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	var params struct {
+		Token string `json:"token"`
+	}
+	err := H.ReadJSON(req, &params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Token == "" {
+		return nil, H.BadRequest.Wrap(nil, "no listenbrainz token")
+	}
+	name, err := lb.ValidateToken(params.Token)
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "invalid listenbrainz token")
+	}
+	user.ListenBrainzUser = &name
+	user.ListenBrainzToken = &params.Token
+	err = user.Update()
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return user.Clean(), nil
+}
+
+func DisconnectScrobbler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	service := pathVar(req, "service")
+	switch service {
+	case "lastfm":
+		user.LastFMUser = nil
+		user.LastFMSession = nil
+	case "listenbrainz":
+		user.ListenBrainzUser = nil
+		user.ListenBrainzToken = nil
+	default:
+		return nil, H.NotFound
+	}
+	err := user.Update()
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	err = db.ClearScrobbles(user.PersistentID, service)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return user.Clean(), nil
+}
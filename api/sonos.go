@@ -16,6 +16,10 @@ import (
 
 var sonosDevice *sonos.Sonos
 
+// sonosUser is whoever last queued up music on the sonos; plays there
+// are credited to them
+var sonosUser *musicdb.User
+
 func SonosAPI(router H.Router, authmw H.Middleware) {
 	router.GET("/available", authmw(H.HandlerFunc(HasSonos)))
 	router.GET("/queue", authmw(H.HandlerFunc(SonosGetQueue)))
@@ -67,6 +71,7 @@ func getSonos(quick bool) (*sonos.Sonos, error) {
 		log.Println("error getting sonos:", err)
 		return nil, err
 	}
+	sonosDevice.GainMode = cfg.Loudness.Sonos
 	hub, err := getWebsocketHub()
 	if err != nil {
 		sonosDevice = nil
@@ -74,6 +79,8 @@ func getSonos(quick bool) (*sonos.Sonos, error) {
 	}
 	go func() {
 		timer := time.NewTimer(time.Minute * 5)
+		playing := false
+		var current pid.PersistentID
 		for {
 			select {
 			case msg, ok := <-sonosDevice.Events:
@@ -82,6 +89,9 @@ func getSonos(quick bool) (*sonos.Sonos, error) {
 					sonosDevice = nil
 					break
 				}
+				if evt, isAV := msg.(*sonos.AVTransportEvent); isAV {
+					playing, current = sonosPlayed(evt, playing, current)
+				}
 				hub.BroadcastEvent(&SonosEvent{Type: "sonos", Event: msg})
 				if !timer.Stop() {
 					<-timer.C
@@ -98,6 +108,43 @@ func getSonos(quick bool) (*sonos.Sonos, error) {
 	return sonosDevice, nil
 }
 
+// sonosPlayed records a play when the sonos starts playing a track
+// from the library that it wasn't already playing.  transport events
+// only carry what's changed, so the play state and current track are
+// carried over from one event to the next.
+func sonosPlayed(evt *sonos.AVTransportEvent, playing bool, current pid.PersistentID) (bool, pid.PersistentID) {
+	switch evt.TransportState {
+	case "PLAYING":
+		playing = true
+	case "":
+	case "TRANSITIONING":
+		return playing, current
+	default:
+		// stopped or paused; starting up again counts as a new play
+		return false, 0
+	}
+	if !playing || evt.CurrentTrack == nil || evt.CurrentTrack.PersistentID == 0 {
+		return playing, current
+	}
+	if evt.CurrentTrack.PersistentID == current {
+		return playing, current
+	}
+	current = evt.CurrentTrack.PersistentID
+	tr, err := db.GetTrack(current)
+	if err != nil {
+		log.Println("error getting sonos track:", err)
+		return playing, current
+	}
+	if tr == nil {
+		return playing, current
+	}
+	_, err = recordPlay(sonosUser, tr, musicdb.SourceSonos)
+	if err != nil {
+		log.Println("error recording sonos play:", err)
+	}
+	return playing, current
+}
+
 func HasSonos(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	return sonosDevice != nil, nil
 }
@@ -221,6 +268,7 @@ func SonosReplaceQueue(w http.ResponseWriter, req *http.Request) (interface{}, e
 	if err != nil {
 		return nil, SonosError.Wrap(err, "")
 	}
+	sonosUser = user
 	err = dev.Play()
 	if err != nil {
 		return nil, SonosError.Wrap(err, "")
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func StatsAPI(router H.Router, authmw H.Middleware) {
+	router.GET("/top/:kind", authmw(H.HandlerFunc(TopStats)))
+	router.GET("/listening/:interval", authmw(H.HandlerFunc(ListeningStats)))
+	router.GET("/discovery", authmw(H.HandlerFunc(DiscoveryStats)))
+	router.GET("/year/:year", authmw(H.HandlerFunc(YearInReview)))
+}
+
+type statsParams struct {
+	Count int
+	Since *musicdb.Time
+	Until *musicdb.Time
+	TZ string `url:"tz"`
+	All bool
+}
+
+// statsWindow reads the user and time window the stats are for.  stats
+// default to the requesting user's plays; admins can ask for another
+// user's, or with all=true for everyone's.
+func statsWindow(req *http.Request) (musicdb.StatsWindow, *statsParams, *time.Location, error) {
+	var w musicdb.StatsWindow
+	admin := readAdmin(req)
+	if admin == nil {
+		return w, nil, nil, H.Forbidden
+	}
+	params := &statsParams{Count: 25}
+	err := H.QueryScan(req, params)
+	if err != nil {
+		return w, nil, nil, err
+	}
+	if params.All {
+		if !admin.IsAdmin {
+			return w, nil, nil, H.Forbidden
+		}
+	} else {
+		user, err := queryUser(req, admin)
+		if err != nil {
+			return w, nil, nil, err
+		}
+		w.UserID = &user.PersistentID
+	}
+	w.Since = params.Since
+	w.Until = params.Until
+	loc := time.UTC
+	if params.TZ != "" {
+		loc, err = time.LoadLocation(params.TZ)
+		if err != nil {
+			return w, nil, nil, H.BadRequest.Wrapf(err, "unknown time zone %s", params.TZ)
+		}
+	}
+	return w, params, loc, nil
+}
+
+func TopStats(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	win, params, _, err := statsWindow(req)
+	if err != nil {
+		return nil, err
+	}
+	var stats interface{}
+	switch pathVar(req, "kind") {
+	case "artists":
+		stats, err = db.TopArtists(win, params.Count)
+	case "albums":
+		stats, err = db.TopAlbums(win, params.Count)
+	case "genres":
+		stats, err = db.TopGenres(win, params.Count)
+	case "tracks":
+		stats, err = db.TopTracks(win, params.Count)
+	default:
+		return nil, H.NotFound
+	}
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return stats, nil
+}
+
+func ListeningStats(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	win, _, loc, err := statsWindow(req)
+	if err != nil {
+		return nil, err
+	}
+	interval := pathVar(req, "interval")
+	if !musicdb.ListeningIntervals[interval] {
+		return nil, H.NotFound
+	}
+	buckets, err := db.ListeningTime(win, interval, loc)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return buckets, nil
+}
+
+func DiscoveryStats(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	win, _, _, err := statsWindow(req)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := db.Discovery(win)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return stats, nil
+}
+
+func YearInReview(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	win, params, loc, err := statsWindow(req)
+	if err != nil {
+		return nil, err
+	}
+	if win.UserID == nil {
+		return nil, H.BadRequest.Wrap(nil, "year in review is per user")
+	}
+	year, err := strconv.Atoi(pathVar(req, "year"))
+	if err != nil {
+		return nil, H.BadRequest.Wrapf(err, "bad year %s", pathVar(req, "year"))
+	}
+	count := params.Count
+	if req.URL.Query().Get("count") == "" {
+		count = 10
+	}
+	summary, err := db.YearInReview(*win.UserID, year, loc, count)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return summary, nil
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/api/subsonic"
+	"github.com/rclancey/synos/musicdb"
+	"github.com/rclancey/synos/transcode"
+)
+
+// SubsonicAPI serves the subsonic protocol for third party clients.
+// it does its own authentication, since clients send credentials with
+// every request rather than logging in.
+func SubsonicAPI(router H.Router) {
+	s := &subsonic.Server{
+		DB: db,
+		Version: SynosVersion,
+		Media: subsonicMedia,
+		CoverArt: GetAlbumArtFilename,
+	}
+	subsonic.API(router, s)
+}
+
+// subsonicMedia picks the file to stream for a subsonic client.  clients
+// that only give a bitrate cap get mp3 when the original exceeds it, and
+// formats we can't produce fall back to the original file.
+func subsonicMedia(tr *musicdb.Track, format string, bitrate int) (string, string, error) {
+	fn := tr.Path()
+	if format == "" && bitrate > 0 && tr.BitRate != nil && int(*tr.BitRate) > bitrate {
+		format = "mp3"
+	}
+	if format == "" {
+		return fn, tr.ContentType(), nil
+	}
+	out, ct, err := transcodeFile(fn, format, bitrate * 1000, nil)
+	if err != nil {
+		if errors.Is(err, transcode.ErrUnknownFormat) {
+			return fn, tr.ContentType(), nil
+		}
+		return "", "", err
+	}
+	if ct == "" {
+		ct = tr.ContentType()
+	}
+	return out, ct, nil
+}
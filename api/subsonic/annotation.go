@@ -0,0 +1,87 @@
+package subsonic
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+func canWriteTrack(user *musicdb.User, tr *musicdb.Track) bool {
+	return user.IsAdmin || tr.OwnerID == user.PersistentID
+}
+
+// scrobble records plays.  submission=false is a now playing notice,
+// which we have nowhere to put.
+func (s *Server) scrobble(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	ids := req.Form["id"]
+	if len(ids) == 0 {
+		return nil, missingParameter("id")
+	}
+	if req.Form.Get("submission") == "false" {
+		return &Response{}, nil
+	}
+	times := req.Form["time"]
+	for i, id := range ids {
+		tr, err := s.getTrack(id)
+		if err != nil {
+			return nil, err
+		}
+		when := time.Now()
+		if i < len(times) {
+			ms, err := strconv.ParseInt(times[i], 10, 64)
+			if err == nil {
+				when = time.Unix(ms / 1000, (ms % 1000) * int64(time.Millisecond))
+			}
+		}
+		ev := musicdb.NewPlayEvent(user, tr, musicdb.SourceSubsonic)
+		ev.PlayDate = musicdb.FromTime(when)
+		err = s.DB.RecordPlay(tr, ev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Response{}, nil
+}
+
+// setStarred maps subsonic stars onto the loved flag.  albums and
+// artists can't be loved in synos, so starring them is refused rather
+// than silently dropped.
+func (s *Server) setStarred(req *http.Request, user *musicdb.User, starred bool) (*Response, error) {
+	if len(req.Form["albumId"]) > 0 || len(req.Form["artistId"]) > 0 {
+		return nil, NewError(ErrGeneric, "Only songs can be starred")
+	}
+	ids := req.Form["id"]
+	if len(ids) == 0 {
+		return nil, missingParameter("id")
+	}
+	tracks := make([]*musicdb.Track, len(ids))
+	for i, id := range ids {
+		tr, err := s.getTrack(id)
+		if err != nil {
+			return nil, err
+		}
+		if !canWriteTrack(user, tr) {
+			return nil, NewError(ErrNotAuthorized, "User is not authorized to modify song %s", id)
+		}
+		tracks[i] = tr
+	}
+	for _, tr := range tracks {
+		loved := starred
+		tr.Loved = &loved
+	}
+	err := s.DB.SaveTracks(tracks)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{}, nil
+}
+
+func (s *Server) star(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	return s.setStarred(req, user, true)
+}
+
+func (s *Server) unstar(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	return s.setStarred(req, user, false)
+}
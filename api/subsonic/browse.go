@@ -0,0 +1,239 @@
+package subsonic
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+// sort names already have these stripped
+const ignoredArticles = "The El La Los Las Le Les"
+
+// synos keeps each user's library separate, so there's only ever the
+// one folder
+const musicFolderID = 1
+
+func (s *Server) getMusicFolders(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	folders := &MusicFolders{
+		MusicFolder: []*MusicFolder{
+			&MusicFolder{ID: musicFolderID, Name: "Music"},
+		},
+	}
+	return &Response{MusicFolders: folders}, nil
+}
+
+func indexName(sortName string) string {
+	for _, r := range sortName {
+		if unicode.IsLetter(r) {
+			return strings.ToUpper(string(r))
+		}
+		break
+	}
+	return "#"
+}
+
+// indexArtists groups artists by the first letter of their sort names.
+// the artist queries return them in sort order, so each letter's group
+// is contiguous.
+func indexArtists(artists []*musicdb.Artist, albumCounts map[string]int) []*Index {
+	indexes := []*Index{}
+	imap := map[string]*Index{}
+	for _, artist := range artists {
+		name := indexName(artist.SortName)
+		idx, ok := imap[name]
+		if !ok {
+			idx = &Index{Name: name, Artist: []*Artist{}}
+			imap[name] = idx
+			indexes = append(indexes, idx)
+		}
+		a := makeArtist(artist)
+		if albumCounts != nil {
+			a.AlbumCount = albumCounts[artist.SortName]
+		}
+		idx.Artist = append(idx.Artist, a)
+	}
+	return indexes
+}
+
+func (s *Server) getIndexes(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	artists, err := s.DB.Artists(&user.PersistentID)
+	if err != nil {
+		return nil, err
+	}
+	indexes := &Indexes{
+		LastModified: time.Now().UnixNano() / int64(time.Millisecond),
+		IgnoredArticles: ignoredArticles,
+		Index: indexArtists(artists, nil),
+	}
+	return &Response{Indexes: indexes}, nil
+}
+
+func (s *Server) getArtists(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	artists, err := s.DB.Artists(&user.PersistentID)
+	if err != nil {
+		return nil, err
+	}
+	albums, err := s.DB.Albums(&user.PersistentID)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, album := range albums {
+		if album.Artist != nil {
+			counts[album.Artist.SortName] += 1
+		}
+	}
+	res := &Artists{
+		IgnoredArticles: ignoredArticles,
+		Index: indexArtists(artists, counts),
+	}
+	return &Response{Artists: res}, nil
+}
+
+// artistAlbums looks up an artist from its id along with its albums,
+// from which it also picks up the artist's display name
+func (s *Server) artistAlbums(id string, user *musicdb.User) (*Artist, []*musicdb.Album, error) {
+	artist := parseArtistID(id)
+	if artist == nil {
+		return nil, nil, notFound("Artist", id)
+	}
+	albums, err := s.DB.ArtistAlbums(artist, &user.PersistentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(albums) == 0 {
+		return nil, nil, notFound("Artist", id)
+	}
+	res := &Artist{
+		ID: id,
+		Name: artist.SortName,
+		CoverArt: id,
+		AlbumCount: len(albums),
+	}
+	for _, album := range albums {
+		if album.Artist != nil && album.Artist.SortName == artist.SortName {
+			res.Name = firstName(album.Artist.Sorted(), res.Name)
+			break
+		}
+	}
+	return res, albums, nil
+}
+
+func (s *Server) getArtist(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	artist, albums, err := s.artistAlbums(id, user)
+	if err != nil {
+		return nil, err
+	}
+	artist.Album = make([]*Album, len(albums))
+	for i, album := range albums {
+		artist.Album[i] = makeAlbum(album)
+	}
+	return &Response{Artist: artist}, nil
+}
+
+func (s *Server) albumTracks(id string, user *musicdb.User) (*musicdb.Album, []*musicdb.Track, error) {
+	album := parseAlbumID(id)
+	if album == nil {
+		return nil, nil, notFound("Album", id)
+	}
+	tracks, err := s.DB.AlbumTracks(album, &user.PersistentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, nil, notFound("Album", id)
+	}
+	return album, tracks, nil
+}
+
+func (s *Server) getAlbum(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	album, tracks, err := s.albumTracks(id, user)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Album: makeAlbumTracks(album, tracks)}, nil
+}
+
+// getMusicDirectory serves the folder based browsing older clients use,
+// with artists containing albums containing songs
+func (s *Server) getMusicDirectory(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	if strings.HasPrefix(id, albumPrefix) {
+		album, tracks, err := s.albumTracks(id, user)
+		if err != nil {
+			return nil, err
+		}
+		info := makeAlbumTracks(album, tracks)
+		dir := &Directory{
+			ID: id,
+			Parent: info.ArtistID,
+			Name: info.Name,
+			Child: info.Song,
+		}
+		return &Response{Directory: dir}, nil
+	}
+	artist, albums, err := s.artistAlbums(id, user)
+	if err != nil {
+		return nil, err
+	}
+	dir := &Directory{
+		ID: id,
+		Name: artist.Name,
+		Child: make([]*Child, len(albums)),
+	}
+	for i, album := range albums {
+		info := makeAlbum(album)
+		dir.Child[i] = &Child{
+			ID: info.ID,
+			Parent: id,
+			IsDir: true,
+			Title: info.Name,
+			Album: info.Name,
+			Artist: info.Artist,
+			CoverArt: info.CoverArt,
+		}
+	}
+	return &Response{Directory: dir}, nil
+}
+
+// getTrack looks up a track by its subsonic id
+func (s *Server) getTrack(id string) (*musicdb.Track, error) {
+	p, ok := parsePersistentID(id)
+	if !ok {
+		return nil, notFound("Song", id)
+	}
+	tr, err := s.DB.GetTrack(p)
+	if err != nil {
+		return nil, err
+	}
+	if tr == nil {
+		return nil, notFound("Song", id)
+	}
+	return tr, nil
+}
+
+func (s *Server) getSong(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	tr, err := s.getTrack(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Song: makeChild(tr)}, nil
+}
@@ -0,0 +1,274 @@
+package subsonic
+
+import (
+	"encoding/base64"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+// synos has no ids for artists and albums, which are just groupings of
+// tracks by sort name, so their subsonic ids encode the sort names.
+// tracks and playlists use their persistent ids.
+
+const (
+	artistPrefix = "ar-"
+	albumPrefix = "al-"
+)
+
+func artistID(artist *musicdb.Artist) string {
+	if artist == nil {
+		return ""
+	}
+	return artistPrefix + base64.RawURLEncoding.EncodeToString([]byte(artist.SortName))
+}
+
+func albumID(album *musicdb.Album) string {
+	key := ""
+	if album.Artist != nil {
+		key = album.Artist.SortName
+	}
+	key += "\x00" + album.SortName
+	return albumPrefix + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func parseArtistID(id string) *musicdb.Artist {
+	if !strings.HasPrefix(id, artistPrefix) {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(id, artistPrefix))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return &musicdb.Artist{SortName: string(data), Names: map[string]int{}}
+}
+
+func parseAlbumID(id string) *musicdb.Album {
+	if !strings.HasPrefix(id, albumPrefix) {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(id, albumPrefix))
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(string(data), "\x00", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil
+	}
+	album := &musicdb.Album{SortName: parts[1], Names: map[string]int{}}
+	if parts[0] != "" {
+		album.Artist = &musicdb.Artist{SortName: parts[0], Names: map[string]int{}}
+	}
+	return album
+}
+
+func parsePersistentID(id string) (pid.PersistentID, bool) {
+	p := new(pid.PersistentID)
+	err := p.Decode(id)
+	if err != nil {
+		return pid.PersistentID(0), false
+	}
+	return *p, true
+}
+
+// trackArtist is the artist a track's album is filed under, matching
+// the grouping the album queries use
+func trackArtist(tr *musicdb.Track) *musicdb.Artist {
+	if tr.AlbumArtist != nil && *tr.AlbumArtist != "" {
+		sort := musicdb.MakeSortArtist(*tr.AlbumArtist)
+		if tr.SortAlbumArtist != nil && *tr.SortAlbumArtist != "" {
+			sort = *tr.SortAlbumArtist
+		}
+		return &musicdb.Artist{SortName: sort, Names: map[string]int{*tr.AlbumArtist: 1}}
+	}
+	if tr.Artist != nil && *tr.Artist != "" {
+		sort := musicdb.MakeSortArtist(*tr.Artist)
+		if tr.SortArtist != nil && *tr.SortArtist != "" {
+			sort = *tr.SortArtist
+		}
+		return &musicdb.Artist{SortName: sort, Names: map[string]int{*tr.Artist: 1}}
+	}
+	return nil
+}
+
+func trackAlbum(tr *musicdb.Track) *musicdb.Album {
+	if tr.Album == nil || *tr.Album == "" {
+		return nil
+	}
+	sort := musicdb.MakeSort(*tr.Album)
+	if tr.SortAlbum != nil && *tr.SortAlbum != "" {
+		sort = *tr.SortAlbum
+	}
+	return &musicdb.Album{
+		Artist: trackArtist(tr),
+		SortName: sort,
+		Names: map[string]int{*tr.Album: 1},
+	}
+}
+
+func firstName(names []string, def string) string {
+	if len(names) == 0 {
+		return def
+	}
+	return names[0]
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func isoTime(t *musicdb.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Time().In(time.UTC).Format("2006-01-02T15:04:05.000Z")
+}
+
+func trackYear(tr *musicdb.Track) int {
+	if tr.ReleaseDate == nil {
+		return 0
+	}
+	return tr.ReleaseDate.Time().In(time.UTC).Year()
+}
+
+func trackDuration(tr *musicdb.Track) int {
+	if tr.TotalTime == nil {
+		return 0
+	}
+	return int(*tr.TotalTime / 1000)
+}
+
+func songID(tr *musicdb.Track) string {
+	return tr.PersistentID.String()
+}
+
+func makeChild(tr *musicdb.Track) *Child {
+	c := &Child{
+		ID: songID(tr),
+		Title: str(tr.Name),
+		Album: str(tr.Album),
+		Artist: str(tr.Artist),
+		Year: trackYear(tr),
+		Genre: str(tr.Genre),
+		CoverArt: songID(tr),
+		ContentType: tr.ContentType(),
+		Suffix: strings.TrimPrefix(strings.ToLower(tr.GetExt()), "."),
+		Duration: trackDuration(tr),
+		PlayCount: tr.PlayCount,
+		Created: isoTime(tr.DateAdded),
+		Played: isoTime(tr.PlayDate),
+		ArtistID: artistID(trackArtist(tr)),
+		Type: "music",
+	}
+	if c.Title == "" && tr.Location != nil {
+		c.Title = strings.TrimSuffix(path.Base(*tr.Location), path.Ext(*tr.Location))
+	}
+	album := trackAlbum(tr)
+	if album != nil {
+		c.AlbumID = albumID(album)
+		c.Parent = c.AlbumID
+	}
+	if tr.TrackNumber != nil {
+		c.Track = int(*tr.TrackNumber)
+	}
+	if tr.DiscNumber != nil {
+		c.DiscNumber = int(*tr.DiscNumber)
+	}
+	if tr.Size != nil {
+		c.Size = *tr.Size
+	}
+	if tr.BitRate != nil {
+		c.BitRate = int(*tr.BitRate)
+	}
+	if tr.Rating != nil {
+		// itunes ratings run 0-100
+		c.UserRating = int(*tr.Rating) / 20
+	}
+	if tr.Loved != nil && *tr.Loved {
+		// we don't record when a track was loved
+		c.Starred = isoTime(tr.DateModified)
+		if c.Starred == "" {
+			c.Starred = isoTime(tr.DateAdded)
+		}
+		if c.Starred == "" {
+			c.Starred = time.Unix(0, 0).In(time.UTC).Format("2006-01-02T15:04:05.000Z")
+		}
+	}
+	if tr.TrackGain != nil || tr.AlbumGain != nil {
+		c.ReplayGain = &ReplayGain{
+			TrackGain: tr.TrackGain,
+			AlbumGain: tr.AlbumGain,
+			TrackPeak: tr.TrackPeak,
+			AlbumPeak: tr.AlbumPeak,
+		}
+	}
+	return c
+}
+
+func makeArtist(artist *musicdb.Artist) *Artist {
+	return &Artist{
+		ID: artistID(artist),
+		Name: firstName(artist.Sorted(), artist.SortName),
+	}
+}
+
+// makeAlbum describes an album from the index queries, which only know
+// its names and track count
+func makeAlbum(album *musicdb.Album) *Album {
+	a := &Album{
+		ID: albumID(album),
+		Name: firstName(album.Sorted(), album.SortName),
+		CoverArt: albumID(album),
+		SongCount: album.Count(),
+	}
+	if album.Artist != nil {
+		a.Artist = firstName(album.Artist.Sorted(), album.Artist.SortName)
+		a.ArtistID = artistID(album.Artist)
+	}
+	return a
+}
+
+// makeAlbumTracks describes an album from its tracks
+func makeAlbumTracks(album *musicdb.Album, tracks []*musicdb.Track) *Album {
+	a := &Album{
+		ID: albumID(album),
+		CoverArt: albumID(album),
+		SongCount: len(tracks),
+		ArtistID: artistID(album.Artist),
+		Song: make([]*Child, len(tracks)),
+	}
+	for i, tr := range tracks {
+		a.Song[i] = makeChild(tr)
+		a.Duration += trackDuration(tr)
+		a.PlayCount += tr.PlayCount
+		if a.Name == "" {
+			a.Name = str(tr.Album)
+		}
+		if a.Artist == "" {
+			art := trackArtist(tr)
+			if art != nil {
+				a.Artist = firstName(art.Sorted(), "")
+			}
+		}
+		if a.Year == 0 {
+			a.Year = trackYear(tr)
+		}
+		if a.Genre == "" {
+			a.Genre = str(tr.Genre)
+		}
+		created := isoTime(tr.DateAdded)
+		if created != "" && (a.Created == "" || created < a.Created) {
+			a.Created = created
+		}
+	}
+	if a.Name == "" {
+		a.Name = album.SortName
+	}
+	return a
+}
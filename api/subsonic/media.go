@@ -0,0 +1,112 @@
+package subsonic
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+// serveFile sends a file with range support, which clients rely on
+// for seeking
+func serveFile(w http.ResponseWriter, req *http.Request, fn string, contentType string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, req, filepath.Base(fn), st.ModTime(), f)
+	return nil
+}
+
+func (s *Server) stream(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	tr, err := s.getTrack(id)
+	if err != nil {
+		return nil, err
+	}
+	format := strings.ToLower(req.Form.Get("format"))
+	if format == "raw" {
+		format = ""
+	}
+	bitrate := 0
+	if format != "" || req.Form.Get("maxBitRate") != "" {
+		bitrate, _ = strconv.Atoi(req.Form.Get("maxBitRate"))
+	}
+	fn, ct, err := s.Media(tr, format, bitrate)
+	if err != nil {
+		return nil, err
+	}
+	// play counts are left to the scrobble endpoint, which clients call
+	// once a song has actually been listened to
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	return nil, serveFile(w, req, fn, ct)
+}
+
+func (s *Server) download(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	tr, err := s.getTrack(id)
+	if err != nil {
+		return nil, err
+	}
+	fn := tr.Path()
+	w.Header().Set("Content-Disposition", "attachment; filename=" + strconv.Quote(filepath.Base(fn)))
+	return nil, serveFile(w, req, fn, tr.ContentType())
+}
+
+// coverTracks finds the tracks whose artwork can stand in for a cover
+// art id, which may name a song, an album or an artist
+func (s *Server) coverTracks(id string, user *musicdb.User) ([]*musicdb.Track, error) {
+	if strings.HasPrefix(id, albumPrefix) {
+		_, tracks, err := s.albumTracks(id, user)
+		return tracks, err
+	}
+	if strings.HasPrefix(id, artistPrefix) {
+		_, albums, err := s.artistAlbums(id, user)
+		if err != nil {
+			return nil, err
+		}
+		return s.DB.AlbumTracks(albums[0], &user.PersistentID)
+	}
+	tr, err := s.getTrack(id)
+	if err != nil {
+		return nil, err
+	}
+	return []*musicdb.Track{tr}, nil
+}
+
+func (s *Server) getCoverArt(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	tracks, err := s.coverTracks(id, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, tr := range tracks {
+		fn, err := s.CoverArt(tr)
+		if err == nil {
+			w.Header().Set("Cache-Control", "max-age=" + strconv.Itoa(int(time.Hour.Seconds())))
+			return nil, serveFile(w, req, fn, "")
+		}
+	}
+	return nil, notFound("Cover art", id)
+}
@@ -0,0 +1,101 @@
+package subsonic
+
+import (
+	"net/http"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+func (s *Server) playlistTracks(pl *musicdb.Playlist) ([]*musicdb.Track, error) {
+	if pl.Smart != nil {
+		return s.DB.SmartTracks(pl.Smart)
+	}
+	return s.DB.PlaylistTracks(pl)
+}
+
+func (s *Server) makePlaylist(pl *musicdb.Playlist, user *musicdb.User, entries bool) (*Playlist, error) {
+	tracks, err := s.playlistTracks(pl)
+	if err != nil {
+		return nil, err
+	}
+	res := &Playlist{
+		ID: pl.PersistentID.String(),
+		Name: pl.Name,
+		Public: pl.Shared,
+		SongCount: len(tracks),
+		Created: isoTime(pl.DateAdded),
+		Changed: isoTime(pl.DateModified),
+	}
+	if pl.OwnerID == user.PersistentID {
+		res.Owner = user.Username
+	}
+	if res.Changed == "" {
+		res.Changed = res.Created
+	}
+	if len(tracks) > 0 {
+		res.CoverArt = songID(tracks[0])
+	}
+	if entries {
+		res.Entry = make([]*Child, len(tracks))
+	}
+	for i, tr := range tracks {
+		res.Duration += trackDuration(tr)
+		if entries {
+			res.Entry[i] = makeChild(tr)
+		}
+	}
+	return res, nil
+}
+
+// flattenPlaylists lists the playlists in a tree, leaving out the
+// folders, which subsonic has no notion of
+func flattenPlaylists(tree []*musicdb.Playlist) []*musicdb.Playlist {
+	pls := []*musicdb.Playlist{}
+	for _, pl := range tree {
+		if pl.Folder {
+			pls = append(pls, flattenPlaylists(pl.Children)...)
+		} else {
+			pls = append(pls, pl)
+		}
+	}
+	return pls
+}
+
+func (s *Server) getPlaylists(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	tree, err := s.DB.GetPlaylistTree(nil, user)
+	if err != nil {
+		return nil, err
+	}
+	pls := flattenPlaylists(tree)
+	res := &Playlists{Playlist: make([]*Playlist, len(pls))}
+	for i, pl := range pls {
+		res.Playlist[i], err = s.makePlaylist(pl, user, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Response{Playlists: res}, nil
+}
+
+func (s *Server) getPlaylist(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	id := req.Form.Get("id")
+	if id == "" {
+		return nil, missingParameter("id")
+	}
+	p, ok := parsePersistentID(id)
+	if !ok {
+		return nil, notFound("Playlist", id)
+	}
+	pl, err := s.DB.GetPlaylist(p, user)
+	if err != nil {
+		return nil, err
+	}
+	if pl == nil || pl.Folder {
+		return nil, notFound("Playlist", id)
+	}
+	res, err := s.makePlaylist(pl, user, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Playlist: res}, nil
+}
@@ -0,0 +1,96 @@
+package subsonic
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+func intParam(req *http.Request, name string, def int) int {
+	v, err := strconv.Atoi(req.Form.Get(name))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+func page(n, count, offset int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + count
+	if end > n {
+		end = n
+	}
+	return offset, end
+}
+
+// searchWords strips the query down to plain words, since the track
+// search hands them to the full text query parser.  clients that sync
+// the whole library search for "" or "*".
+func searchWords(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+func (s *Server) search3(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	query := searchWords(req.Form.Get("query"))
+	artistCount := intParam(req, "artistCount", 20)
+	albumCount := intParam(req, "albumCount", 20)
+	songCount := intParam(req, "songCount", 20)
+	res := &SearchResult3{
+		Artist: []*Artist{},
+		Album: []*Album{},
+		Song: []*Child{},
+	}
+	var artists []*musicdb.Artist
+	var albums []*musicdb.Album
+	var err error
+	if artistCount > 0 {
+		if query == "" {
+			artists, err = s.DB.Artists(&user.PersistentID)
+		} else {
+			artists, err = s.DB.SearchArtists(musicdb.Search{LooseArtist: &query, OwnerID: &user.PersistentID})
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, end := page(len(artists), artistCount, intParam(req, "artistOffset", 0))
+		for _, artist := range artists[start:end] {
+			res.Artist = append(res.Artist, makeArtist(artist))
+		}
+	}
+	if albumCount > 0 {
+		if query == "" {
+			albums, err = s.DB.Albums(&user.PersistentID)
+		} else {
+			albums, err = s.DB.SearchAlbums(musicdb.Search{LooseAlbum: &query, OwnerID: &user.PersistentID})
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, end := page(len(albums), albumCount, intParam(req, "albumOffset", 0))
+		for _, album := range albums[start:end] {
+			res.Album = append(res.Album, makeAlbum(album))
+		}
+	}
+	if songCount > 0 {
+		search := musicdb.Search{OwnerID: &user.PersistentID}
+		if query != "" {
+			search.Any = &query
+		}
+		tracks, err := s.DB.SearchTracks(search, songCount, intParam(req, "songOffset", 0))
+		if err != nil {
+			return nil, err
+		}
+		for _, tr := range tracks {
+			res.Song = append(res.Song, makeChild(tr))
+		}
+	}
+	return &Response{SearchResult3: res}, nil
+}
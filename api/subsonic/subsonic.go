@@ -0,0 +1,232 @@
+package subsonic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/musicdb"
+)
+
+const APIVersion = "1.16.1"
+
+// MediaFunc returns the file to send for a track, transcoded to format
+// and limited to bitrate (in kbps) when those are given, along with its
+// content type
+type MediaFunc func(tr *musicdb.Track, format string, bitrate int) (string, string, error)
+
+// CoverArtFunc returns the filename of a track's artwork
+type CoverArtFunc func(tr *musicdb.Track) (string, error)
+
+type Server struct {
+	DB *musicdb.DB
+	Version string
+	Media MediaFunc
+	CoverArt CoverArtFunc
+	authCache map[string]time.Time
+	authLock sync.Mutex
+}
+
+type handler func(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error)
+
+// API registers the subsonic endpoints.  clients call them both with
+// and without the .view suffix, and with GET or a form POST.
+func API(router H.Router, s *Server) {
+	endpoints := map[string]handler{
+		"ping": s.ping,
+		"getLicense": s.getLicense,
+		"getOpenSubsonicExtensions": s.getOpenSubsonicExtensions,
+		"getMusicFolders": s.getMusicFolders,
+		"getIndexes": s.getIndexes,
+		"getMusicDirectory": s.getMusicDirectory,
+		"getArtists": s.getArtists,
+		"getArtist": s.getArtist,
+		"getAlbum": s.getAlbum,
+		"getSong": s.getSong,
+		"getPlaylists": s.getPlaylists,
+		"getPlaylist": s.getPlaylist,
+		"stream": s.stream,
+		"download": s.download,
+		"getCoverArt": s.getCoverArt,
+		"scrobble": s.scrobble,
+		"star": s.star,
+		"unstar": s.unstar,
+		"search3": s.search3,
+	}
+	for name, f := range endpoints {
+		h := s.handle(f)
+		router.GET("/" + name, h)
+		router.GET("/" + name + ".view", h)
+		router.POST("/" + name, h)
+		router.POST("/" + name + ".view", h)
+	}
+}
+
+func (s *Server) handle(f handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := req.ParseForm()
+		if err != nil {
+			s.write(w, req, errorResponse(NewError(ErrGeneric, err.Error())))
+			return
+		}
+		user, err := s.authenticate(req)
+		if err != nil {
+			s.write(w, req, errorResponse(err))
+			return
+		}
+		res, err := f(w, req, user)
+		if err != nil {
+			s.write(w, req, errorResponse(err))
+			return
+		}
+		if res != nil {
+			s.write(w, req, res)
+		}
+	})
+}
+
+// write sends a response in the format the client asked for.  errors
+// are reported in the body with a 200 status, as the spec requires.
+func (s *Server) write(w http.ResponseWriter, req *http.Request, res *Response) {
+	res.Xmlns = "http://subsonic.org/restapi"
+	res.Version = APIVersion
+	res.Type = "synos"
+	res.ServerVersion = s.Version
+	res.OpenSubsonic = true
+	if res.Status == "" {
+		res.Status = "ok"
+	}
+	var data []byte
+	var err error
+	h := w.Header()
+	switch req.Form.Get("f") {
+	case "json":
+		data, err = json.Marshal(map[string]*Response{"subsonic-response": res})
+		h.Set("Content-Type", "application/json; charset=utf-8")
+	case "jsonp":
+		data, err = json.Marshal(map[string]*Response{"subsonic-response": res})
+		data = []byte(req.Form.Get("callback") + "(" + string(data) + ");")
+		h.Set("Content-Type", "application/javascript; charset=utf-8")
+	default:
+		data, err = xml.Marshal(res)
+		data = append([]byte(xml.Header), data...)
+		h.Set("Content-Type", "text/xml; charset=utf-8")
+	}
+	if err != nil {
+		log.Println("error encoding subsonic response:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// authenticate checks the u and p parameters against the user's synos
+// password.  token authentication needs the plain text password, which
+// we don't keep, so it's refused, as are users with two factor auth
+// turned on, since subsonic clients have no way of supplying a code.
+func (s *Server) authenticate(req *http.Request) (*musicdb.User, error) {
+	q := req.Form
+	if q.Get("apiKey") != "" {
+		return nil, NewError(ErrAuthNotSupported, "API key authentication is not supported")
+	}
+	username := q.Get("u")
+	if username == "" {
+		return nil, missingParameter("u")
+	}
+	if q.Get("t") != "" || q.Get("s") != "" {
+		return nil, NewError(ErrTokenAuthNotSupported, "Token authentication is not supported; use a password")
+	}
+	password := q.Get("p")
+	if password == "" {
+		return nil, missingParameter("p")
+	}
+	if strings.HasPrefix(password, "enc:") {
+		data, err := hex.DecodeString(strings.TrimPrefix(password, "enc:"))
+		if err != nil {
+			return nil, NewError(ErrBadCredentials, "Wrong username or password")
+		}
+		password = string(data)
+	}
+	au, err := s.DB.GetUser(username)
+	if err != nil {
+		return nil, NewError(ErrBadCredentials, "Wrong username or password")
+	}
+	user, ok := au.(*musicdb.User)
+	if !ok || user.Password == nil {
+		return nil, NewError(ErrBadCredentials, "Wrong username or password")
+	}
+	if user.TwoFactor != nil {
+		return nil, NewError(ErrNotAuthorized, "Two factor authentication is enabled for this user")
+	}
+	if s.checkAuthCache(username, password) {
+		return user, nil
+	}
+	err = user.Password.Authenticate(password)
+	if err != nil {
+		return nil, NewError(ErrBadCredentials, "Wrong username or password")
+	}
+	s.setAuthCache(username, password)
+	return user, nil
+}
+
+// clients send credentials with every request, including each stream
+// and cover art fetch, so successful logins are remembered for a while
+// rather than hashing the password every time
+func authCacheKey(username, password string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) checkAuthCache(username, password string) bool {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.authCache == nil {
+		return false
+	}
+	key := authCacheKey(username, password)
+	exp, ok := s.authCache[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(exp) {
+		delete(s.authCache, key)
+		return false
+	}
+	return true
+}
+
+func (s *Server) setAuthCache(username, password string) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.authCache == nil {
+		s.authCache = map[string]time.Time{}
+	}
+	now := time.Now()
+	for key, exp := range s.authCache {
+		if now.After(exp) {
+			delete(s.authCache, key)
+		}
+	}
+	s.authCache[authCacheKey(username, password)] = now.Add(10 * time.Minute)
+}
+
+func (s *Server) ping(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	return &Response{}, nil
+}
+
+func (s *Server) getLicense(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	return &Response{License: &License{Valid: true}}, nil
+}
+
+func (s *Server) getOpenSubsonicExtensions(w http.ResponseWriter, req *http.Request, user *musicdb.User) (*Response, error) {
+	exts := []*OpenSubsonicExtension{}
+	return &Response{OpenSubsonicExtensions: &exts}, nil
+}
@@ -0,0 +1,201 @@
+package subsonic
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+)
+
+const (
+	ErrGeneric = 0
+	ErrMissingParameter = 10
+	ErrClientVersion = 20
+	ErrServerVersion = 30
+	ErrBadCredentials = 40
+	ErrTokenAuthNotSupported = 41
+	ErrAuthNotSupported = 42
+	ErrNotAuthorized = 50
+	ErrNotFound = 70
+)
+
+type Error struct {
+	Code int `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+func NewError(code int, msg string, args ...interface{}) *Error {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	return &Error{Code: code, Message: msg}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("subsonic error %d: %s", e.Code, e.Message)
+}
+
+func errorResponse(err error) *Response {
+	serr, ok := err.(*Error)
+	if !ok {
+		log.Println("subsonic error:", err)
+		serr = NewError(ErrGeneric, err.Error())
+	}
+	return &Response{Status: "failed", Error: serr}
+}
+
+func missingParameter(name string) *Error {
+	return NewError(ErrMissingParameter, "Required parameter is missing: %s", name)
+}
+
+func notFound(kind, id string) *Error {
+	return NewError(ErrNotFound, "%s not found: %s", kind, id)
+}
+
+// Response is the subsonic-response envelope.  the same structs encode
+// to both the xml and json flavors of the protocol, so attributes and
+// repeated elements carry matching names in both tags.
+type Response struct {
+	XMLName xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns string `xml:"xmlns,attr" json:"-"`
+	Status string `xml:"status,attr" json:"status"`
+	Version string `xml:"version,attr" json:"version"`
+	Type string `xml:"type,attr" json:"type"`
+	ServerVersion string `xml:"serverVersion,attr,omitempty" json:"serverVersion,omitempty"`
+	OpenSubsonic bool `xml:"openSubsonic,attr" json:"openSubsonic"`
+	Error *Error `xml:"error,omitempty" json:"error,omitempty"`
+	License *License `xml:"license,omitempty" json:"license,omitempty"`
+	OpenSubsonicExtensions *[]*OpenSubsonicExtension `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders *MusicFolders `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes *Indexes `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Directory *Directory `xml:"directory,omitempty" json:"directory,omitempty"`
+	Artists *Artists `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist *Artist `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album *Album `xml:"album,omitempty" json:"album,omitempty"`
+	Song *Child `xml:"song,omitempty" json:"song,omitempty"`
+	Playlists *Playlists `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist *Playlist `xml:"playlist,omitempty" json:"playlist,omitempty"`
+	SearchResult3 *SearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type License struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type OpenSubsonicExtension struct {
+	Name string `xml:"name,attr" json:"name"`
+	Versions []int `xml:"versions" json:"versions"`
+}
+
+type MusicFolder struct {
+	ID int `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type MusicFolders struct {
+	MusicFolder []*MusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type Index struct {
+	Name string `xml:"name,attr" json:"name"`
+	Artist []*Artist `xml:"artist" json:"artist"`
+}
+
+type Indexes struct {
+	LastModified int64 `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index []*Index `xml:"index" json:"index"`
+}
+
+type Artists struct {
+	IgnoredArticles string `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index []*Index `xml:"index" json:"index"`
+}
+
+type Artist struct {
+	ID string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int `xml:"albumCount,attr,omitempty" json:"albumCount,omitempty"`
+	Album []*Album `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type Album struct {
+	ID string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	ArtistID string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int `xml:"songCount,attr" json:"songCount"`
+	Duration int `xml:"duration,attr" json:"duration"`
+	PlayCount uint `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	Created string `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Year int `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Song []*Child `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+type ReplayGain struct {
+	TrackGain *float64 `xml:"trackGain,attr,omitempty" json:"trackGain,omitempty"`
+	AlbumGain *float64 `xml:"albumGain,attr,omitempty" json:"albumGain,omitempty"`
+	TrackPeak *float64 `xml:"trackPeak,attr,omitempty" json:"trackPeak,omitempty"`
+	AlbumPeak *float64 `xml:"albumPeak,attr,omitempty" json:"albumPeak,omitempty"`
+}
+
+// Child is a song or, in the folder based browsing endpoints, an album
+type Child struct {
+	ID string `xml:"id,attr" json:"id"`
+	Parent string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir bool `xml:"isDir,attr" json:"isDir"`
+	Title string `xml:"title,attr" json:"title"`
+	Album string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track int `xml:"track,attr,omitempty" json:"track,omitempty"`
+	Year int `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size uint64 `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration int `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+	BitRate int `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	UserRating int `xml:"userRating,attr,omitempty" json:"userRating,omitempty"`
+	PlayCount uint `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	DiscNumber int `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Created string `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Starred string `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+	Played string `xml:"played,attr,omitempty" json:"played,omitempty"`
+	AlbumID string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	ReplayGain *ReplayGain `xml:"replayGain,omitempty" json:"replayGain,omitempty"`
+}
+
+type Directory struct {
+	ID string `xml:"id,attr" json:"id"`
+	Parent string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name string `xml:"name,attr" json:"name"`
+	Child []*Child `xml:"child" json:"child"`
+}
+
+type Playlist struct {
+	ID string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+	Owner string `xml:"owner,attr,omitempty" json:"owner,omitempty"`
+	Public bool `xml:"public,attr" json:"public"`
+	SongCount int `xml:"songCount,attr" json:"songCount"`
+	Duration int `xml:"duration,attr" json:"duration"`
+	Created string `xml:"created,attr" json:"created"`
+	Changed string `xml:"changed,attr" json:"changed"`
+	CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Entry []*Child `xml:"entry,omitempty" json:"entry,omitempty"`
+}
+
+type Playlists struct {
+	Playlist []*Playlist `xml:"playlist" json:"playlist"`
+}
+
+type SearchResult3 struct {
+	Artist []*Artist `xml:"artist" json:"artist"`
+	Album []*Album `xml:"album" json:"album"`
+	Song []*Child `xml:"song" json:"song"`
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+	"github.com/rclancey/synos/tagwriter"
+)
+
+type TagWriteResult struct {
+	TrackID pid.PersistentID    `json:"track_id"`
+	Changes []*tagwriter.Change `json:"changes"`
+	Written bool                `json:"written"`
+	Error   *string             `json:"error,omitempty"`
+}
+
+type MultiTrackTagWrite struct {
+	TrackIDs []pid.PersistentID `json:"track_ids"`
+	DryRun   bool               `json:"dry_run"`
+}
+
+func intFromUint8(v *uint8) *int {
+	n := 0
+	if v != nil {
+		n = int(*v)
+	}
+	return &n
+}
+
+func stringOrEmpty(s *string) *string {
+	if s == nil {
+		return stringp("")
+	}
+	return s
+}
+
+// trackTags builds the tags for a track's file from the database, which
+// is treated as authoritative: fields missing from the track are removed
+// from the file.  lyrics and artwork are left alone when we don't have
+// any, since the file may be the only place they exist.
+func trackTags(tr *musicdb.Track, art bool) *tagwriter.Tags {
+	tags := &tagwriter.Tags{
+		Name: stringOrEmpty(tr.Name),
+		Artist: stringOrEmpty(tr.Artist),
+		Album: stringOrEmpty(tr.Album),
+		AlbumArtist: stringOrEmpty(tr.AlbumArtist),
+		Genre: stringOrEmpty(tr.Genre),
+		TrackNumber: intFromUint8(tr.TrackNumber),
+		TrackCount: intFromUint8(tr.TrackCount),
+		DiscNumber: intFromUint8(tr.DiscNumber),
+		DiscCount: intFromUint8(tr.DiscCount),
+		Compilation: &tr.Compilation,
+	}
+	year := 0
+	if tr.ReleaseDate != nil {
+		year = tr.ReleaseDate.Time().In(time.UTC).Year()
+	}
+	tags.Year = &year
+	lyrics, err := tr.GetLyrics()
+	if err == nil && lyrics != nil && *lyrics != "" {
+		tags.Lyrics = lyrics
+	}
+	if art {
+		fn, err := GetAlbumArtFilename(tr)
+		if err == nil {
+			data, err := ioutil.ReadFile(fn)
+			if err == nil {
+				tags.Artwork = &tagwriter.Artwork{
+					MIMEType: mime.TypeByExtension(filepath.Ext(fn)),
+					Data: data,
+				}
+			}
+		}
+	}
+	return tags
+}
+
+func canWriteTrack(user *musicdb.User, tr *musicdb.Track) bool {
+	return user.IsAdmin || tr.OwnerID == user.PersistentID
+}
+
+func writeTrackTags(tr *musicdb.Track, art bool, dryRun bool) (*TagWriteResult, error) {
+	fn := tr.Path()
+	if !tagwriter.CanWrite(fn) {
+		return nil, errors.Wrap(tagwriter.ErrUnsupportedFormat, fn)
+	}
+	tags := trackTags(tr, art)
+	changes, err := tagwriter.Preview(fn, tags)
+	if err != nil {
+		return nil, err
+	}
+	res := &TagWriteResult{
+		TrackID: tr.PersistentID,
+		Changes: changes,
+	}
+	if dryRun || len(changes) == 0 {
+		return res, nil
+	}
+	// hold the scan lock so the media folder watcher doesn't pick up
+	// the rewritten file as an outside change
+	scanLock.Lock()
+	defer scanLock.Unlock()
+	err = tagwriter.Write(fn, tags)
+	if err != nil {
+		return nil, err
+	}
+	res.Written = true
+	err = db.RefreshScanFile(tr)
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// autoWriteTags writes edits back to the files of users who have asked
+// for it.  failures are only logged, since the database update they
+// follow has already succeeded.
+func autoWriteTags(req *http.Request, tracks []*musicdb.Track, art bool) {
+	user := readAdmin(req)
+	if user == nil || !user.WriteTags {
+		return
+	}
+	errlog, err := cfg.Logging.ErrorLogger()
+	if err != nil {
+		return
+	}
+	for _, tr := range tracks {
+		if !canWriteTrack(user, tr) || !tagwriter.CanWrite(tr.Path()) {
+			continue
+		}
+		_, err := writeTrackTags(tr, art, false)
+		if err != nil {
+			errlog.Errorln("error writing tags for", tr.PersistentID, err)
+		}
+	}
+}
+
+func PreviewTrackTags(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	tr, err := getTrackById(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := writeTrackTags(tr, true, true)
+	if err != nil {
+		return nil, H.BadRequest.Wrap(err, "can't read tags")
+	}
+	return res, nil
+}
+
+func WriteTrackTags(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	tr, err := getTrackById(req)
+	if err != nil {
+		return nil, err
+	}
+	if !canWriteTrack(user, tr) {
+		return nil, H.Forbidden
+	}
+	dryRun := req.URL.Query().Get("dry_run") == "true"
+	res, err := writeTrackTags(tr, true, dryRun)
+	if err != nil {
+		return nil, FilesystemError.Wrap(err, "can't write tags")
+	}
+	return res, nil
+}
+
+func WriteTracksTags(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := readAdmin(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	var mtw MultiTrackTagWrite
+	err := H.ReadJSON(req, &mtw)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*TagWriteResult, len(mtw.TrackIDs))
+	for i, tid := range mtw.TrackIDs {
+		tr, err := db.GetTrack(tid)
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
+		if tr == nil {
+			return nil, H.NotFound.Wrapf(nil, "Track %s does not exist", tid)
+		}
+		if !canWriteTrack(user, tr) {
+			return nil, H.Forbidden
+		}
+		res, err := writeTrackTags(tr, true, mtw.DryRun)
+		if err != nil {
+			msg := err.Error()
+			if res == nil {
+				res = &TagWriteResult{TrackID: tid}
+			}
+			res.Error = &msg
+		}
+		results[i] = res
+	}
+	return results, nil
+}
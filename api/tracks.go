@@ -9,7 +9,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -40,15 +39,25 @@ func TrackAPI(router H.Router, authmw H.Middleware) {
 	router.PUT("/track/:id/lyrics", H.HandlerFunc(SetTrackLyrics))
 	router.GET("/track/:id", H.HandlerFunc(GetTrack))
 	router.PUT("/track/:id", authmw(H.HandlerFunc(UpdateTrack)))
+	router.DELETE("/track/:id", authmw(H.HandlerFunc(DeleteTrack)))
 	router.POST("/track", authmw(H.HandlerFunc(AddTrack)))
 	router.PUT("/track/:id/skip", authmw(H.HandlerFunc(SkipTrack)))
 	router.PUT("/track/:id/rate", authmw(H.HandlerFunc(RateTrack)))
+	router.GET("/track/:id/tags", authmw(H.HandlerFunc(PreviewTrackTags)))
+	router.POST("/track/:id/tags", authmw(H.HandlerFunc(WriteTrackTags)))
+	router.GET("/track/:id/fingerprint", authmw(H.HandlerFunc(GetTrackFingerprint)))
+	router.POST("/track/:id/loudness", authmw(H.HandlerFunc(AnalyzeTrackLoudness)))
 	router.GET("/tracks/count", authmw(H.HandlerFunc(TrackCount)))
 	router.GET("/tracks/plays", authmw(H.HandlerFunc(PlayCounts)))
 	router.GET("/tracks/skips", authmw(H.HandlerFunc(SkipCounts)))
 	router.GET("/tracks/search", authmw(H.HandlerFunc(SearchTracks)))
+	router.GET("/tracks/search/lyrics", authmw(H.HandlerFunc(SearchLyrics)))
+	router.GET("/tracks/duplicates", authmw(H.HandlerFunc(ListDuplicates)))
 	router.GET("/tracks", authmw(H.HandlerFunc(ListTracks)))
+	router.GET("/tracks/export.xml", authmw(H.HandlerFunc(ExportLibrary)))
 	router.PUT("/tracks", authmw(H.HandlerFunc(UpdateTracks)))
+	router.POST("/tracks/tags", authmw(H.HandlerFunc(WriteTracksTags)))
+	router.POST("/tracks/duplicates/merge", authmw(H.HandlerFunc(MergeDuplicates)))
 	router.GET("/itunes-track/:id", H.HandlerFunc(GetItunesTrack))
 }
 
@@ -186,8 +195,11 @@ func GetTrack(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	}
 	fn := tr.Path()
 	log.Printf("get track %s: %s\n", tr.PersistentID, fn)
+	// a player's first fetch of a track either has no range or asks
+	// for all of it.  probes for the first few bytes and fetches for
+	// the rest of the track aren't plays.
 	rng := req.Header.Get("Range")
-	if rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+	if rng == "" || rng == "bytes=0-" {
 		user := getUsername(req)
 		H.Count("tracks_played", map[string]string{"user": user})
 		if tr.Size != nil {
@@ -196,17 +208,36 @@ func GetTrack(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 		if tr.TotalTime != nil {
 			H.Increment("tracks_played_time", map[string]string{"user": user}, float64(*tr.TotalTime))
 		}
-		tr.PlayCount += 1
-		if tr.PlayDate == nil {
-			tr.PlayDate = new(musicdb.Time)
+		src := playSource(req)
+		if src == musicdb.SourceUnknown {
+			src = musicdb.SourceWeb
+		}
+		// sonos fetches tracks ahead of playing them, so its plays are
+		// recorded from its transport events instead
+		if src != musicdb.SourceSonos {
+			_, err = recordStreamedPlay(getUser(req), tr, src)
+			if err != nil {
+				log.Println("error recording play:", err)
+			}
 		}
-		tr.PlayDate.Set(time.Now().In(time.UTC))
-		db.SaveTrack(tr)
 	}
 	h := w.Header()
 	h.Set("transferMode.dlna.org", "Streaming")
 	h.Set("X-XSS-Protection", "1; mode=block")
 	h.Set("X-Content-Type-Options", "nosniff")
+	q := req.URL.Query()
+	format := q.Get("format")
+	var gain *float64
+	mode := musicdb.GainMode(q.Get("gain"))
+	if mode != musicdb.GainNone {
+		gain = tr.PlaybackGain(mode, cfg.Loudness.Preamp)
+		if gain != nil && format == "" {
+			format = "mp3"
+		}
+	}
+	if format != "" {
+		return transcodeTrack(w, fn, format, q.Get("bitrate"), gain)
+	}
 	return H.StaticFile(fn), nil
 }
 
@@ -306,6 +337,7 @@ func UpdateTrack(w http.ResponseWriter, req *http.Request) (interface{}, error)
 	if err != nil {
 		return nil, DatabaseError.Wrap(err, "")
 	}
+	autoWriteTags(req, tracks, false)
 	hub, err := getWebsocketHub()
 	if err == nil {
 		evt := &LibraryEvent{
@@ -322,15 +354,27 @@ func SkipTrack(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	tr.SkipCount += 1
-	if tr.SkipDate == nil {
-		tr.SkipDate = new(musicdb.Time)
+	ev := musicdb.NewPlayEvent(getUser(req), tr, playSource(req))
+	// how far into the track the listener got, in milliseconds
+	pos := req.URL.Query().Get("position")
+	if pos != "" {
+		ms, err := strconv.ParseUint(pos, 10, 32)
+		if err != nil {
+			return nil, H.BadRequest.Wrapf(err, "position param %s not an int", pos)
+		}
+		dur := uint(ms)
+		ev.Duration = &dur
 	}
-	tr.SkipDate.Set(time.Now().In(time.UTC))
-	err = db.SaveTrack(tr)
+	err = db.RecordSkip(tr, ev)
 	if err != nil {
 		return nil, DatabaseError.Wrap(err, "")
 	}
+	if s := getScrobbler(); s != nil {
+		err = s.Skipped(tr, ev)
+		if err != nil {
+			log.Println("error cancelling scrobble:", err)
+		}
+	}
 	return tr, nil
 }
 
@@ -352,15 +396,29 @@ func RateTrack(w http.ResponseWriter, req *http.Request) (interface{}, error) {
 	return tr, nil
 }
 
+// DeleteTrack moves a track to the trash.  its file goes to the trash
+// folder of the media folder it was in.
 func DeleteTrack(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
 	tr, err := getTrackById(req)
 	if err != nil {
 		return nil, err
 	}
-	err = db.DeleteTrack(tr)
+	if tr.OwnerID != user.PersistentID {
+		return nil, H.Forbidden
+	}
+	// the media folder watcher would otherwise see the file go before
+	// the track does
+	scanLock.Lock()
+	err = db.DeleteTrack(tr, user)
+	scanLock.Unlock()
 	if err != nil {
-		return nil, err
+		return nil, DatabaseError.Wrap(err, "")
 	}
+	trashChanged(user, []pid.PersistentID{tr.PersistentID}, true)
 	return true, nil
 }
 
@@ -467,6 +525,7 @@ func UpdateTracks(w http.ResponseWriter, req *http.Request) (interface{}, error)
 	if err != nil {
 		return nil, DatabaseError.Wrap(err, "")
 	}
+	autoWriteTags(req, tracks, false)
 	hub, err := getWebsocketHub()
 	if err == nil {
 		evt := &LibraryEvent{
@@ -510,10 +569,10 @@ type SearchResponse struct {
 	ResultsPerPage int `json:"results_per_page"`
 	More bool `json:"more"`
 	Tracks []*musicdb.Track `json:"tracks"`
+	Hits *musicdb.SearchHits `json:"hits,omitempty"`
+	Highlights map[string]map[string][]musicdb.Highlight `json:"highlights,omitempty"`
 }
 
-var searchRe = regexp.MustCompile(`(?:^|\s+)(song:|album:|artist:|genre:|)("[^"]*(?:"|$)|'[^']*(?:'|$)|\S*)`)
-
 func constructSearch(req *http.Request) (musicdb.Search, int, int, error) {
 	q := musicdb.Search{}
 	search := &SearchParams{}
@@ -522,31 +581,7 @@ func constructSearch(req *http.Request) (musicdb.Search, int, int, error) {
 		return q, -1, -1, H.BadRequest.Wrap(err, "")
 	}
 	if search.Query != nil && *search.Query != "" {
-		ms := searchRe.FindAllStringSubmatch(*search.Query, -1)
-		any := []string{}
-		for _, m := range ms {
-			key := strings.ToLower(strings.TrimSuffix(m[1], `:`))
-			val := strings.TrimPrefix(m[2], `"`)
-			val = strings.TrimSuffix(val, `"`)
-			val = strings.TrimPrefix(val, `'`)
-			val = strings.TrimSuffix(val, `'`)
-			switch key {
-			case "song":
-				q.LooseName = &val
-			case "album":
-				q.LooseAlbum = &val
-			case "artist":
-				q.LooseArtist = &val
-			case "genre":
-				q.Genre = &val
-			default:
-				any = append(any, val)
-			}
-		}
-		if len(any) > 0 {
-			any_s := strings.Join(any, " ")
-			q.Any = &any_s
-		}
+		q.Terms = musicdb.ParseSearch(*search.Query)
 	}
 	if search.Genre != nil && *search.Genre != "" {
 		q.Genre = search.Genre
@@ -594,8 +629,53 @@ func SearchTracks(w http.ResponseWriter, req *http.Request) (interface{}, error)
 		ResultsPerPage: limit,
 		More: offset + len(tracks) < n,
 		Tracks: tracks,
+		Highlights: musicdb.SearchHighlights(q.Terms, tracks),
+	}
+	if offset == 0 {
+		// the artists, albums and playlists only go with the first page
+		res.Hits, err = db.SearchHits(q, getUser(req), 5)
+		if err != nil {
+			return nil, DatabaseError.Wrap(err, "")
+		}
 	}
 	cacheFor(w, time.Minute * 15)
 	return res, nil
 }
 
+type LyricsSearchResponse struct {
+	Query string `json:"q"`
+	TotalResults int `json:"total_results"`
+	ResultsPerPage int `json:"results_per_page"`
+	More bool `json:"more"`
+	Hits []*musicdb.LyricsHit `json:"hits"`
+}
+
+// SearchLyrics finds tracks by their lyrics, and gives the line of each
+// that matched
+func SearchLyrics(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	_, limit, offset, err := constructSearch(req)
+	if err != nil {
+		return nil, err
+	}
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+	if q == "" {
+		return nil, H.BadRequest.Wrap(nil, "no search query")
+	}
+	n, err := db.SearchLyricsCount(q)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	hits, err := db.SearchLyrics(q, limit, offset)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	res := &LyricsSearchResponse{
+		Query: q,
+		TotalResults: n,
+		ResultsPerPage: limit,
+		More: offset + len(hits) < n,
+		Hits: hits,
+	}
+	cacheFor(w, time.Minute * 15)
+	return res, nil
+}
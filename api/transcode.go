@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/transcode"
+)
+
+// transcodeFile returns the path of a file converted to another format
+// in the transcode cache, along with its content type.  files that are
+// already in the requested format come back as is, with no content type.
+func transcodeFile(fn string, format string, bitrate int, gain *float64) (string, string, error) {
+	tr, err := transcode.NewRequest(fn, strings.ToLower(format), bitrate, gain)
+	if err != nil {
+		return "", "", err
+	}
+	if gain == nil && bitrate == 0 && strings.EqualFold(filepath.Ext(fn), tr.Format.Ext) {
+		// already in the requested format
+		return fn, "", nil
+	}
+	cache, err := cfg.Transcode.Cache()
+	if err != nil {
+		return "", "", errors.Wrap(err, "can't open transcode cache")
+	}
+	out, err := cache.Get(tr)
+	if err != nil {
+		return "", "", errors.Wrap(err, "can't transcode track")
+	}
+	return out, tr.Format.ContentType, nil
+}
+
+// transcodeTrack serves a track converted to another format, from the
+// transcode cache so that range requests work.  bitrates may be given
+// in bits or kilobits per second.
+func transcodeTrack(w http.ResponseWriter, fn string, format string, bitrate string, gain *float64) (interface{}, error) {
+	br := 0
+	if bitrate != "" {
+		var err error
+		br, err = strconv.Atoi(bitrate)
+		if err != nil {
+			return nil, H.BadRequest.Wrapf(err, "bad bitrate %s", bitrate)
+		}
+		if br < 1000 {
+			br *= 1000
+		}
+	}
+	out, ct, err := transcodeFile(fn, format, br, gain)
+	if err != nil {
+		if errors.Is(err, transcode.ErrUnknownFormat) {
+			return nil, H.BadRequest.Wrap(err, "")
+		}
+		return nil, FilesystemError.Wrap(err, "")
+	}
+	if ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	return H.StaticFile(out), nil
+}
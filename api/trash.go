@@ -0,0 +1,168 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+func TrashAPI(router H.Router, authmw H.Middleware) {
+	router.GET("/trash", authmw(H.HandlerFunc(ListTrash)))
+	router.DELETE("/trash", authmw(H.HandlerFunc(EmptyTrash)))
+	router.POST("/trash/:kind/:id/restore", authmw(H.HandlerFunc(RestoreFromTrash)))
+	router.DELETE("/trash/:kind/:id", authmw(H.HandlerFunc(PurgeFromTrash)))
+}
+
+func trashError(err error) error {
+	switch err {
+	case musicdb.ErrNotInTrash:
+		return H.NotFound.Wrap(err, "")
+	case musicdb.ErrTrashConflict:
+		return H.Conflict.Wrap(err, "")
+	}
+	return DatabaseError.Wrap(err, "")
+}
+
+func getTrashKind(req *http.Request) (musicdb.TrashKind, error) {
+	kind := musicdb.TrashKind(pathVar(req, "kind"))
+	switch kind {
+	case musicdb.TrashTrack, musicdb.TrashPlaylist:
+		return kind, nil
+	}
+	return kind, H.BadRequest.Wrapf(nil, "unknown kind of trash %s", kind)
+}
+
+// trashChanged brings smart playlists and folders up to date after
+// tracks go in or come out of the trash
+func trashChanged(user *musicdb.User, trackIds []pid.PersistentID, deleted bool) {
+	user.UpdateLibrary(db)
+	pls, err := db.UpdateSmartTracksFor(trackIds, deleted)
+	if err != nil {
+		log.Println("error updating smart playlists:", err)
+	}
+	err = db.UpdateParentFolderTracks(pls)
+	if err != nil {
+		log.Println("error updating playlist folders:", err)
+	}
+	hub, err := getWebsocketHub()
+	if err == nil {
+		evt := &LibraryEvent{
+			Type: "library",
+			User: user.Clean(),
+			Playlists: pls,
+		}
+		hub.BroadcastEvent(evt)
+	}
+}
+
+func ListTrash(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	items, err := db.Trash(user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return items, nil
+}
+
+func RestoreFromTrash(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	kind, err := getTrashKind(req)
+	if err != nil {
+		return nil, err
+	}
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	if kind == musicdb.TrashPlaylist {
+		pl, err := db.RestorePlaylist(id, user)
+		if err != nil {
+			return nil, trashError(err)
+		}
+		err = db.UpdateParentFolderTracks([]*musicdb.Playlist{pl})
+		if err != nil {
+			log.Println("error updating playlist folders:", err)
+		}
+		return pl, nil
+	}
+	// the file coming back shouldn't look like a new one to the media
+	// folder watcher
+	scanLock.Lock()
+	tr, err := db.RestoreTrack(id, user)
+	scanLock.Unlock()
+	if err != nil {
+		return nil, trashError(err)
+	}
+	trashChanged(user, []pid.PersistentID{id}, false)
+	return tr, nil
+}
+
+func PurgeFromTrash(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	kind, err := getTrashKind(req)
+	if err != nil {
+		return nil, err
+	}
+	id, err := getPathId(req)
+	if err != nil {
+		return nil, err
+	}
+	err = db.PurgeTrashItem(kind, id, user)
+	if err != nil {
+		return nil, trashError(err)
+	}
+	return true, nil
+}
+
+func EmptyTrash(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	user := getUser(req)
+	if user == nil {
+		return nil, H.Forbidden
+	}
+	n, err := db.EmptyTrash(user)
+	if err != nil {
+		return nil, DatabaseError.Wrap(err, "")
+	}
+	return map[string]int{"purged": n}, nil
+}
+
+// PurgeTrash deletes whatever has been in the trash longer than the
+// configured number of days, every few hours until told to quit
+func PurgeTrash() chan bool {
+	quit := make(chan bool, 1)
+	days := cfg.Finder.TrashDays
+	if days <= 0 {
+		return quit
+	}
+	go func() {
+		ticker := time.NewTicker(6 * time.Hour)
+		defer ticker.Stop()
+		for {
+			n, err := db.PurgeTrash(time.Now().AddDate(0, 0, -days))
+			if err != nil {
+				log.Println("error purging trash:", err)
+			} else if n > 0 {
+				log.Printf("purged %d items from the trash", n)
+			}
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return quit
+}
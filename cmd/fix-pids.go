@@ -22,7 +22,7 @@ func main() {
 	if len(os.Args) > 1 {
 		dsn = strings.Join(os.Args[1:], " ")
 	}
-	db, err := musicdb.Open(dsn)
+	db, err := musicdb.Open("postgres", dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
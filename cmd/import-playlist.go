@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.com/rclancey/synos/api"
+)
+
+func main() {
+	api.ImportPlaylistMain()
+}
@@ -0,0 +1,438 @@
+package dlna
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/musicdb"
+)
+
+// object ids are paths from the root, so every object knows its parent:
+//
+//   0
+//   artists/<artist>/<album>/<track>
+//   albums/<album>/<track>
+//   genres/<genre>/<album>/<track>
+//   playlists/<playlist>/<track>
+//
+// artists, albums and genres are encoded sort names, since synos has
+// no ids for them.  an album's sort name includes its artist's.
+
+type topLevel struct {
+	id string
+	title string
+	// how many segments a track id has under this container
+	trackDepth int
+}
+
+var topLevels = []topLevel{
+	{"artists", "Artists", 4},
+	{"albums", "Albums", 3},
+	{"genres", "Genres", 4},
+	{"playlists", "Playlists", 3},
+}
+
+// depth tells how many segments deep an object is, and how deep the
+// tracks under its top level container are
+func depth(id string) (int, int) {
+	parts := strings.Split(id, "/")
+	for _, top := range topLevels {
+		if top.id == parts[0] {
+			return len(parts), top.trackDepth
+		}
+	}
+	return len(parts), 0
+}
+
+func encodeKey(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeKey(s string) (string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return "", false
+	}
+	return string(data), true
+}
+
+func albumKey(album *musicdb.Album) string {
+	key := ""
+	if album.Artist != nil {
+		key = album.Artist.SortName
+	}
+	return encodeKey(key + "\x00" + album.SortName)
+}
+
+func decodeAlbum(s string) *musicdb.Album {
+	key, ok := decodeKey(s)
+	if !ok {
+		return nil
+	}
+	parts := strings.SplitN(key, "\x00", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil
+	}
+	album := &musicdb.Album{SortName: parts[1], Names: map[string]int{}}
+	if parts[0] != "" {
+		album.Artist = &musicdb.Artist{SortName: parts[0], Names: map[string]int{}}
+	}
+	return album
+}
+
+func parentID(id string) string {
+	i := strings.LastIndex(id, "/")
+	if i < 0 {
+		return "0"
+	}
+	return id[:i]
+}
+
+func noSuchObject(id string) error {
+	return &UPnPError{Code: ErrNoSuchObject, Description: "No such object: " + id}
+}
+
+func firstName(names []string, def string) string {
+	if len(names) == 0 {
+		return def
+	}
+	return names[0]
+}
+
+func (s *Server) ownerID() *pid.PersistentID {
+	if s.Owner == nil {
+		return nil
+	}
+	return &s.Owner.PersistentID
+}
+
+func (s *Server) artistContainer(id string, artist *musicdb.Artist) *didlObject {
+	name := firstName(artist.Sorted(), artist.SortName)
+	obj := newContainer(id, parentID(id), classArtist, name)
+	obj.Artist = name
+	obj.AlbumArtURI = &didlArt{
+		URL: s.url("/api/art/artist", url.Values{"artist": []string{name}}),
+	}
+	return obj
+}
+
+func (s *Server) albumContainer(id string, album *musicdb.Album) *didlObject {
+	obj := newContainer(id, parentID(id), classAlbum, firstName(album.Sorted(), album.SortName))
+	q := url.Values{"album": []string{album.SortName}}
+	if album.Artist != nil {
+		obj.Artist = firstName(album.Artist.Sorted(), album.Artist.SortName)
+		obj.Creator = obj.Artist
+		q.Set("artist", album.Artist.SortName)
+	}
+	obj.AlbumArtURI = &didlArt{URL: s.url("/api/art/album", q)}
+	count := album.Count()
+	if count > 0 {
+		obj.ChildCount = &count
+	}
+	return obj
+}
+
+func (s *Server) genreContainer(id string, genre *musicdb.Genre) *didlObject {
+	return newContainer(id, parentID(id), classGenre, firstName(genre.Sorted(), genre.SortName))
+}
+
+func (s *Server) playlistContainer(id string, pl *musicdb.Playlist) *didlObject {
+	return newContainer(id, parentID(id), classPlaylist, pl.Name)
+}
+
+func (s *Server) playlists() ([]*musicdb.Playlist, error) {
+	tree, err := s.DB.GetPlaylistTree(nil, s.Owner)
+	if err != nil {
+		return nil, err
+	}
+	return flattenPlaylists(tree), nil
+}
+
+// flattenPlaylists lists the playlists in a tree, leaving out the
+// folders
+func flattenPlaylists(tree []*musicdb.Playlist) []*musicdb.Playlist {
+	pls := []*musicdb.Playlist{}
+	for _, pl := range tree {
+		if pl.Folder {
+			pls = append(pls, flattenPlaylists(pl.Children)...)
+		} else {
+			pls = append(pls, pl)
+		}
+	}
+	return pls
+}
+
+func (s *Server) getPlaylist(key string) (*musicdb.Playlist, error) {
+	p := new(pid.PersistentID)
+	err := p.Decode(key)
+	if err != nil {
+		return nil, nil
+	}
+	pl, err := s.DB.GetPlaylist(*p, s.Owner)
+	if err != nil || pl == nil || pl.Folder {
+		return nil, err
+	}
+	return pl, nil
+}
+
+func (s *Server) playlistTracks(pl *musicdb.Playlist) ([]*musicdb.Track, error) {
+	if pl.Smart != nil {
+		return s.DB.SmartTracks(pl.Smart)
+	}
+	return s.DB.PlaylistTracks(pl)
+}
+
+// containerTracks lists the tracks in an album or playlist container
+func (s *Server) containerTracks(id string) ([]*musicdb.Track, error) {
+	parts := strings.Split(id, "/")
+	last := parts[len(parts) - 1]
+	if parts[0] == "playlists" {
+		pl, err := s.getPlaylist(last)
+		if err != nil {
+			return nil, err
+		}
+		if pl == nil {
+			return nil, noSuchObject(id)
+		}
+		return s.playlistTracks(pl)
+	}
+	album := decodeAlbum(last)
+	if album == nil {
+		return nil, noSuchObject(id)
+	}
+	return s.DB.AlbumTracks(album, s.ownerID())
+}
+
+// children lists the objects directly inside a container
+func (s *Server) children(id string) ([]*didlObject, error) {
+	if id == "0" {
+		objs := make([]*didlObject, len(topLevels))
+		for i, top := range topLevels {
+			objs[i] = newContainer(top.id, "0", classFolder, top.title)
+		}
+		return objs, nil
+	}
+	parts := strings.Split(id, "/")
+	n, trackDepth := depth(id)
+	objs := []*didlObject{}
+	switch {
+	case id == "artists":
+		artists, err := s.DB.Artists(s.ownerID())
+		if err != nil {
+			return nil, err
+		}
+		for _, artist := range artists {
+			objs = append(objs, s.artistContainer(id + "/" + encodeKey(artist.SortName), artist))
+		}
+	case id == "albums":
+		albums, err := s.DB.Albums(s.ownerID())
+		if err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			objs = append(objs, s.albumContainer(id + "/" + albumKey(album), album))
+		}
+	case id == "genres":
+		genres, err := s.DB.Genres(s.ownerID())
+		if err != nil {
+			return nil, err
+		}
+		for _, genre := range genres {
+			objs = append(objs, s.genreContainer(id + "/" + encodeKey(genre.SortName), genre))
+		}
+	case id == "playlists":
+		pls, err := s.playlists()
+		if err != nil {
+			return nil, err
+		}
+		for _, pl := range pls {
+			objs = append(objs, s.playlistContainer(id + "/" + pl.PersistentID.String(), pl))
+		}
+	case len(parts) == 2 && (parts[0] == "artists" || parts[0] == "genres"):
+		key, ok := decodeKey(parts[1])
+		if !ok {
+			return nil, noSuchObject(id)
+		}
+		var albums []*musicdb.Album
+		var err error
+		if parts[0] == "artists" {
+			albums, err = s.DB.ArtistAlbums(&musicdb.Artist{SortName: key}, s.ownerID())
+		} else {
+			albums, err = s.DB.GenreAlbums(&musicdb.Genre{SortName: key}, s.ownerID())
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			objs = append(objs, s.albumContainer(id + "/" + albumKey(album), album))
+		}
+	case n == trackDepth - 1:
+		tracks, err := s.containerTracks(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, tr := range tracks {
+			objs = append(objs, s.trackItem(id + "/" + tr.PersistentID.String(), id, tr))
+		}
+	default:
+		return nil, noSuchObject(id)
+	}
+	return objs, nil
+}
+
+// metadata describes a single object.  containers other than the top
+// level ones are found by listing their parent, which is also how we
+// learn their display names.
+func (s *Server) metadata(id string) (*didlObject, error) {
+	if id == "0" {
+		obj := newContainer("0", "-1", classFolder, s.Name)
+		count := len(topLevels)
+		obj.ChildCount = &count
+		return obj, nil
+	}
+	parent := parentID(id)
+	last := id[len(parent) + 1:]
+	if parent == "0" {
+		last = id
+	}
+	n, trackDepth := depth(id)
+	if n == trackDepth {
+		// a track, which we can look up directly
+		p := new(pid.PersistentID)
+		if p.Decode(last) != nil {
+			return nil, noSuchObject(id)
+		}
+		tr, err := s.DB.GetTrack(*p)
+		if err != nil {
+			return nil, err
+		}
+		if tr == nil {
+			return nil, noSuchObject(id)
+		}
+		return s.trackItem(id, parent, tr), nil
+	}
+	siblings, err := s.children(parent)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range siblings {
+		if obj.ID == id {
+			return obj, nil
+		}
+	}
+	return nil, noSuchObject(id)
+}
+
+func intArg(args map[string]string, name string) (int, error) {
+	v, err := strconv.Atoi(args[name])
+	if err != nil || v < 0 {
+		return 0, &UPnPError{Code: ErrInvalidArgs, Description: "Invalid " + name}
+	}
+	return v, nil
+}
+
+func (s *Server) browse(args map[string]string) ([]Arg, error) {
+	id := args["ObjectID"]
+	if id == "" {
+		return nil, &UPnPError{Code: ErrInvalidArgs, Description: "Missing ObjectID"}
+	}
+	var objs []*didlObject
+	total := 0
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		obj, err := s.metadata(id)
+		if err != nil {
+			return nil, err
+		}
+		objs = []*didlObject{obj}
+		total = 1
+	case "BrowseDirectChildren":
+		start, err := intArg(args, "StartingIndex")
+		if err != nil {
+			return nil, err
+		}
+		count, err := intArg(args, "RequestedCount")
+		if err != nil {
+			return nil, err
+		}
+		objs, err = s.children(id)
+		if err != nil {
+			return nil, err
+		}
+		total = len(objs)
+		if start > total {
+			start = total
+		}
+		end := total
+		if count > 0 && start + count < total {
+			end = start + count
+		}
+		objs = objs[start:end]
+	default:
+		return nil, &UPnPError{Code: ErrInvalidArgs, Description: "Invalid BrowseFlag"}
+	}
+	result, err := didlDocument(objs)
+	if err != nil {
+		return nil, err
+	}
+	return []Arg{
+		{"Result", result},
+		{"NumberReturned", strconv.Itoa(len(objs))},
+		{"TotalMatches", strconv.Itoa(total)},
+		{"UpdateID", strconv.FormatUint(uint64(s.updateID), 10)},
+	}, nil
+}
+
+func (s *Server) contentDirectory() map[string]actionFunc {
+	return map[string]actionFunc{
+		"Browse": s.browse,
+		"GetSearchCapabilities": func(args map[string]string) ([]Arg, error) {
+			return []Arg{{"SearchCaps", ""}}, nil
+		},
+		"GetSortCapabilities": func(args map[string]string) ([]Arg, error) {
+			return []Arg{{"SortCaps", ""}}, nil
+		},
+		"GetSystemUpdateID": func(args map[string]string) ([]Arg, error) {
+			return []Arg{{"Id", strconv.FormatUint(uint64(s.updateID), 10)}}, nil
+		},
+	}
+}
+
+func (s *Server) connectionManager() map[string]actionFunc {
+	return map[string]actionFunc{
+		"GetProtocolInfo": func(args map[string]string) ([]Arg, error) {
+			return []Arg{{"Source", sourceProtocolInfo}, {"Sink", ""}}, nil
+		},
+		"GetCurrentConnectionIDs": func(args map[string]string) ([]Arg, error) {
+			return []Arg{{"ConnectionIDs", "0"}}, nil
+		},
+		"GetCurrentConnectionInfo": func(args map[string]string) ([]Arg, error) {
+			if args["ConnectionID"] != "0" {
+				return nil, &UPnPError{Code: 706, Description: "Invalid connection reference"}
+			}
+			return []Arg{
+				{"RcsID", "-1"},
+				{"AVTransportID", "-1"},
+				{"ProtocolInfo", ""},
+				{"PeerConnectionManager", ""},
+				{"PeerConnectionID", "-1"},
+				{"Direction", "Output"},
+				{"Status", "OK"},
+			}, nil
+		},
+	}
+}
+
+var sourceProtocolInfo = strings.Join([]string{
+	"http-get:*:audio/mpeg:*",
+	"http-get:*:audio/mp4:*",
+	"http-get:*:audio/x-flac:*",
+	"http-get:*:audio/ogg:*",
+	"http-get:*:audio/x-wav:*",
+	"http-get:*:audio/x-aac:*",
+	"http-get:*:audio/x-ms-wma:*",
+	"http-get:*:image/jpeg:*",
+}, ",")
@@ -0,0 +1,168 @@
+package dlna
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+const (
+	classFolder = "object.container.storageFolder"
+	classArtist = "object.container.person.musicArtist"
+	classAlbum = "object.container.album.musicAlbum"
+	classGenre = "object.container.genre.musicGenre"
+	classPlaylist = "object.container.playlistContainer"
+	classTrack = "object.item.audioItem.musicTrack"
+)
+
+type didlArt struct {
+	ProfileID string `xml:"dlna:profileID,attr,omitempty"`
+	URL string `xml:",chardata"`
+}
+
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Size uint64 `xml:"size,attr,omitempty"`
+	Duration string `xml:"duration,attr,omitempty"`
+	// bytes per second, not bits
+	Bitrate uint `xml:"bitrate,attr,omitempty"`
+	SampleFrequency uint `xml:"sampleFrequency,attr,omitempty"`
+	URL string `xml:",chardata"`
+}
+
+// didlObject is a container or an item, depending on its XMLName
+type didlObject struct {
+	XMLName xml.Name
+	ID string `xml:"id,attr"`
+	ParentID string `xml:"parentID,attr"`
+	Restricted string `xml:"restricted,attr"`
+	Searchable string `xml:"searchable,attr,omitempty"`
+	ChildCount *int `xml:"childCount,attr"`
+	Title string `xml:"dc:title"`
+	Creator string `xml:"dc:creator,omitempty"`
+	Date string `xml:"dc:date,omitempty"`
+	Class string `xml:"upnp:class"`
+	Artist string `xml:"upnp:artist,omitempty"`
+	Album string `xml:"upnp:album,omitempty"`
+	Genre string `xml:"upnp:genre,omitempty"`
+	TrackNumber int `xml:"upnp:originalTrackNumber,omitempty"`
+	AlbumArtURI *didlArt `xml:"upnp:albumArtURI,omitempty"`
+	Res *didlRes `xml:"res,omitempty"`
+}
+
+type didlLite struct {
+	XMLName xml.Name `xml:"DIDL-Lite"`
+	Xmlns string `xml:"xmlns,attr"`
+	DC string `xml:"xmlns:dc,attr"`
+	UPnP string `xml:"xmlns:upnp,attr"`
+	DLNA string `xml:"xmlns:dlna,attr"`
+	Objects []*didlObject
+}
+
+func didlDocument(objs []*didlObject) (string, error) {
+	doc := &didlLite{
+		Xmlns: "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/",
+		DC: "http://purl.org/dc/elements/1.1/",
+		UPnP: "urn:schemas-upnp-org:metadata-1-0/upnp/",
+		DLNA: "urn:schemas-dlna-org:metadata-1-0/",
+		Objects: objs,
+	}
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func newContainer(id, parent, class, title string) *didlObject {
+	return &didlObject{
+		XMLName: xml.Name{Local: "container"},
+		ID: id,
+		ParentID: parent,
+		Restricted: "1",
+		Searchable: "0",
+		Class: class,
+		Title: title,
+	}
+}
+
+// formatDuration gives a duration in milliseconds as H:MM:SS.mmm
+func formatDuration(ms uint) string {
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms / 3600000, (ms / 60000) % 60, (ms / 1000) % 60, ms % 1000)
+}
+
+func protocolInfo(tr *musicdb.Track) string {
+	mime := tr.ContentType()
+	pn := ""
+	switch mime {
+	case "audio/mpeg":
+		pn = "DLNA.ORG_PN=MP3;"
+	case "audio/mp4a-latm":
+		// renderers recognize the container type, not the codec
+		mime = "audio/mp4"
+	}
+	// byte seeking, streaming transfer mode
+	return "http-get:*:" + mime + ":" + pn + "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+}
+
+func (s *Server) url(path string, query url.Values) string {
+	u := &url.URL{Path: path}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return s.RootURL.ResolveReference(u).String()
+}
+
+func (s *Server) trackItem(id, parent string, tr *musicdb.Track) *didlObject {
+	obj := &didlObject{
+		XMLName: xml.Name{Local: "item"},
+		ID: id,
+		ParentID: parent,
+		Restricted: "1",
+		Class: classTrack,
+		AlbumArtURI: &didlArt{
+			ProfileID: "JPEG_TN",
+			URL: s.url("/api/art/track/" + tr.PersistentID.String(), nil),
+		},
+		Res: &didlRes{
+			ProtocolInfo: protocolInfo(tr),
+			URL: s.url("/api/track/" + tr.PersistentID.String() + strings.ToLower(tr.GetExt()), url.Values{"source": []string{string(musicdb.SourceDLNA)}}),
+		},
+	}
+	if tr.Name != nil {
+		obj.Title = *tr.Name
+	}
+	if tr.Artist != nil {
+		obj.Creator = *tr.Artist
+		obj.Artist = *tr.Artist
+	}
+	if tr.Album != nil {
+		obj.Album = *tr.Album
+	}
+	if tr.Genre != nil {
+		obj.Genre = *tr.Genre
+	}
+	if tr.TrackNumber != nil {
+		obj.TrackNumber = int(*tr.TrackNumber)
+	}
+	if tr.ReleaseDate != nil {
+		obj.Date = tr.ReleaseDate.Time().In(time.UTC).Format("2006-01-02")
+	}
+	if tr.Size != nil {
+		obj.Res.Size = *tr.Size
+	}
+	if tr.TotalTime != nil {
+		obj.Res.Duration = formatDuration(*tr.TotalTime)
+	}
+	if tr.BitRate != nil {
+		obj.Res.Bitrate = *tr.BitRate * 1000 / 8
+	}
+	if tr.SampleRate != nil {
+		obj.Res.SampleFrequency = *tr.SampleRate
+	}
+	return obj
+}
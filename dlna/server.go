@@ -0,0 +1,86 @@
+package dlna
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	H "github.com/rclancey/httpserver/v2"
+	"github.com/rclancey/synos/musicdb"
+)
+
+// Server is a UPnP MediaServer that lets DLNA renderers on the local
+// network browse the library by artist, album, genre and playlist.
+// renderers fetch the media itself from the regular track and artwork
+// urls, which is why RootURL has to be reachable from the network.
+type Server struct {
+	Name string
+	UUID string
+	Version string
+	RootURL *url.URL
+	DB *musicdb.DB
+	// whose library and playlists to serve; nil serves the shared
+	// library and no private playlists
+	Owner *musicdb.User
+	updateID uint32
+	ssdp *SSDP
+}
+
+func NewServer(name, version string, rootURL *url.URL, db *musicdb.DB, owner *musicdb.User) *Server {
+	return &Server{
+		Name: name,
+		UUID: DeviceUUID(name),
+		Version: version,
+		RootURL: rootURL,
+		DB: db,
+		Owner: owner,
+	}
+}
+
+// DeviceUUID derives a uuid from the host and server name, so that
+// renderers see the same device across restarts
+func DeviceUUID(name string) string {
+	host, _ := os.Hostname()
+	sum := sha1.Sum([]byte(host + "/synos/" + name))
+	// version 5, rfc 4122 variant
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func xmlHandler(body func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, body())
+	})
+}
+
+// Register adds the description and control urls to router, which
+// should be mounted at /dlna
+func (s *Server) Register(router H.Router) {
+	router.GET("/device.xml", xmlHandler(s.deviceDescription))
+	router.GET("/ContentDirectory.xml", xmlHandler(func() string { return contentDirectorySCPD }))
+	router.GET("/ConnectionManager.xml", xmlHandler(func() string { return connectionManagerSCPD }))
+	router.POST("/ContentDirectory/control", control(ContentDirectoryType, s.contentDirectory()))
+	router.POST("/ConnectionManager/control", control(ConnectionManagerType, s.connectionManager()))
+}
+
+// Start advertises the server on iface
+func (s *Server) Start(iface *net.Interface) error {
+	loc := s.RootURL.ResolveReference(&url.URL{Path: "/dlna/device.xml"})
+	s.ssdp = NewSSDP(iface, loc.String(), s.UUID, MediaServerType, []string{ContentDirectoryType, ConnectionManagerType})
+	return s.ssdp.Start()
+}
+
+func (s *Server) Close() error {
+	if s.ssdp == nil {
+		return nil
+	}
+	err := s.ssdp.Close()
+	s.ssdp = nil
+	return err
+}
@@ -0,0 +1,143 @@
+package dlna
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// upnp error codes
+const (
+	ErrInvalidAction = 401
+	ErrInvalidArgs = 402
+	ErrActionFailed = 501
+	ErrNoSuchObject = 701
+)
+
+type UPnPError struct {
+	Code int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Description
+}
+
+// Arg is an action argument.  responses keep their arguments in the
+// order the service description lists them.
+type Arg struct {
+	Name string
+	Value string
+}
+
+type action struct {
+	Name string
+	Args map[string]string
+}
+
+// readAction pulls the action name and its arguments out of a soap
+// request body
+func readAction(r io.Reader) (*action, error) {
+	dec := xml.NewDecoder(io.LimitReader(r, 1 << 20))
+	var act *action
+	var arg string
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "bad soap request")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			// envelope, body, action, argument
+			switch depth {
+			case 3:
+				act = &action{Name: t.Name.Local, Args: map[string]string{}}
+			case 4:
+				arg = t.Name.Local
+				act.Args[arg] = ""
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 3 {
+				arg = ""
+			}
+		case xml.CharData:
+			if depth == 4 && arg != "" {
+				act.Args[arg] += string(t)
+			}
+		}
+	}
+	if act == nil {
+		return nil, errors.New("no action in soap request")
+	}
+	return act, nil
+}
+
+func writeSOAP(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>` + body + `</s:Body></s:Envelope>`)
+}
+
+func writeResponse(w http.ResponseWriter, serviceType string, name string, args []Arg) {
+	body := `<u:` + name + `Response xmlns:u="` + serviceType + `">`
+	for _, arg := range args {
+		body += `<` + arg.Name + `>` + escape(arg.Value) + `</` + arg.Name + `>`
+	}
+	body += `</u:` + name + `Response>`
+	writeSOAP(w, http.StatusOK, body)
+}
+
+func writeFault(w http.ResponseWriter, err error) {
+	uerr, ok := errors.Cause(err).(*UPnPError)
+	if !ok {
+		uerr = &UPnPError{Code: ErrActionFailed, Description: err.Error()}
+	}
+	body := `<s:Fault>` +
+		`<faultcode>s:Client</faultcode>` +
+		`<faultstring>UPnPError</faultstring>` +
+		`<detail>` +
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">` +
+		`<errorCode>` + strconv.Itoa(uerr.Code) + `</errorCode>` +
+		`<errorDescription>` + escape(uerr.Description) + `</errorDescription>` +
+		`</UPnPError>` +
+		`</detail>` +
+		`</s:Fault>`
+	writeSOAP(w, http.StatusInternalServerError, body)
+}
+
+type actionFunc func(args map[string]string) ([]Arg, error)
+
+// control serves a service's control url, dispatching soap actions to
+// their handlers
+func control(serviceType string, actions map[string]actionFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		act, err := readAction(req.Body)
+		if err != nil {
+			writeFault(w, &UPnPError{Code: ErrInvalidAction, Description: err.Error()})
+			return
+		}
+		f, ok := actions[act.Name]
+		if !ok {
+			writeFault(w, &UPnPError{Code: ErrInvalidAction, Description: "Invalid Action"})
+			return
+		}
+		args, err := f(act.Args)
+		if err != nil {
+			writeFault(w, err)
+			return
+		}
+		writeResponse(w, serviceType, act.Name, args)
+	})
+}
@@ -0,0 +1,222 @@
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	ssdpMaxAge = 1800
+)
+
+// SSDP advertises a device on the local network: it multicasts alive
+// and byebye notifications, and answers M-SEARCH discovery requests
+// with a unicast reply pointing at the device description.
+type SSDP struct {
+	Location string
+	UUID string
+	DeviceType string
+	ServiceTypes []string
+	Server string
+	iface *net.Interface
+	conn *net.UDPConn
+	quit chan bool
+	wg sync.WaitGroup
+}
+
+func NewSSDP(iface *net.Interface, location, uuid, deviceType string, serviceTypes []string) *SSDP {
+	return &SSDP{
+		Location: location,
+		UUID: uuid,
+		DeviceType: deviceType,
+		ServiceTypes: serviceTypes,
+		Server: "Linux/1.0 UPnP/1.0 Synos/1.0",
+		iface: iface,
+	}
+}
+
+// targets lists the notification types we advertise, each paired with
+// its unique service name
+func (s *SSDP) targets() [][2]string {
+	udn := "uuid:" + s.UUID
+	targets := [][2]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+		{s.DeviceType, udn + "::" + s.DeviceType},
+	}
+	for _, st := range s.ServiceTypes {
+		targets = append(targets, [2]string{st, udn + "::" + st})
+	}
+	return targets
+}
+
+// Start joins the multicast group, announces the device and keeps
+// announcing it until Close is called
+func (s *SSDP) Start() error {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", s.iface, group)
+	if err != nil {
+		return errors.Wrap(err, "can't join ssdp multicast group")
+	}
+	s.conn = conn
+	s.quit = make(chan bool)
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.Serve(conn)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.notify("ssdp:alive")
+		ticker := time.NewTicker(ssdpMaxAge / 3 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.notify("ssdp:alive")
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close says goodbye to the network and stops listening
+func (s *SSDP) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	close(s.quit)
+	s.notify("ssdp:byebye")
+	err := s.conn.Close()
+	s.wg.Wait()
+	s.conn = nil
+	return err
+}
+
+func (s *SSDP) notify(nts string) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", s.localAddr(), group)
+	if err != nil {
+		log.Println("can't send ssdp notification:", err)
+		return
+	}
+	defer conn.Close()
+	for _, target := range s.targets() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"NT: " + target[0] + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + target[1] + "\r\n"
+		if nts == "ssdp:alive" {
+			msg += "CACHE-CONTROL: max-age=" + strconv.Itoa(ssdpMaxAge) + "\r\n" +
+				"LOCATION: " + s.Location + "\r\n" +
+				"SERVER: " + s.Server + "\r\n"
+		}
+		msg += "\r\n"
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			log.Println("can't send ssdp notification:", err)
+			return
+		}
+	}
+}
+
+// localAddr is our address on the configured interface, so that
+// notifications go out on the right network
+func (s *SSDP) localAddr() *net.UDPAddr {
+	if s.iface == nil {
+		return nil
+	}
+	addrs, err := s.iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipnet.IP}
+		}
+	}
+	return nil
+}
+
+// Serve answers discovery requests arriving on conn until it's closed.
+// Start runs it on the multicast socket, but any packet conn will do,
+// which lets a client on the loopback interface talk to it directly.
+func (s *SSDP) Serve(conn net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		go s.handle(conn, addr, data)
+	}
+}
+
+func (s *SSDP) handle(conn net.PacketConn, addr net.Addr, data []byte) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "M-SEARCH" {
+		return
+	}
+	if strings.Trim(req.Header.Get("MAN"), `"`) != "ssdp:discover" {
+		return
+	}
+	st := req.Header.Get("ST")
+	replies := [][2]string{}
+	for _, target := range s.targets() {
+		if st == "ssdp:all" || st == target[0] {
+			replies = append(replies, target)
+		}
+	}
+	if len(replies) == 0 {
+		return
+	}
+	// spread replies over the window the client asked for, so that
+	// everyone on the network doesn't answer at once
+	mx, err := strconv.Atoi(req.Header.Get("MX"))
+	if err == nil && mx > 0 {
+		if mx > 5 {
+			mx = 5
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(mx) * int64(time.Second))))
+	}
+	for _, target := range replies {
+		msg := fmt.Sprintf("HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=%d\r\n" +
+			"DATE: %s\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: %s\r\n" +
+			"SERVER: %s\r\n" +
+			"ST: %s\r\n" +
+			"USN: %s\r\n" +
+			"\r\n", ssdpMaxAge, time.Now().UTC().Format(http.TimeFormat), s.Location, s.Server, target[0], target[1])
+		_, err = conn.WriteTo([]byte(msg), addr)
+		if err != nil {
+			log.Println("can't send ssdp response:", err)
+			return
+		}
+	}
+}
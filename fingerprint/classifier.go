@@ -0,0 +1,163 @@
+package fingerprint
+
+import (
+	"math"
+)
+
+// integralImage holds running sums over the chroma rows, so that the sum
+// of any rectangle of the image can be read in constant time
+type integralImage struct {
+	width int
+	rows [][]float64
+}
+
+func newIntegralImage(width int) *integralImage {
+	return &integralImage{width: width}
+}
+
+func (img *integralImage) addRow(features []float64) {
+	row := make([]float64, img.width)
+	sum := 0.0
+	for i, v := range features {
+		sum += v
+		row[i] = sum
+	}
+	if len(img.rows) > 0 {
+		prev := img.rows[len(img.rows) - 1]
+		for i := range row {
+			row[i] += prev[i]
+		}
+	}
+	img.rows = append(img.rows, row)
+}
+
+func (img *integralImage) numRows() int {
+	return len(img.rows)
+}
+
+// area sums the rectangle of rows r1 to r2 and columns c1 to c2, not
+// including r2 and c2
+func (img *integralImage) area(r1, c1, r2, c2 int) float64 {
+	if r1 == r2 || c1 == c2 {
+		return 0
+	}
+	get := func(r, c int) float64 {
+		if r == 0 || c == 0 {
+			return 0
+		}
+		return img.rows[r - 1][c - 1]
+	}
+	return get(r2, c2) - get(r1, c2) - get(r2, c1) + get(r1, c1)
+}
+
+func subtractLog(a, b float64) float64 {
+	return math.Log((1.0 + a) / (1.0 + b))
+}
+
+// filter is one of chromaprint's six haar-like filters.  x runs along
+// time and y along the chroma bands.
+type filter struct {
+	kind int
+	y int
+	height int
+	width int
+}
+
+func (f filter) apply(img *integralImage, x int) float64 {
+	y := f.y
+	w := f.width
+	h := f.height
+	switch f.kind {
+	case 0:
+		return subtractLog(img.area(x, y, x + w, y + h), 0)
+	case 1:
+		h2 := h / 2
+		a := img.area(x, y + h2, x + w, y + h)
+		b := img.area(x, y, x + w, y + h2)
+		return subtractLog(a, b)
+	case 2:
+		w2 := w / 2
+		a := img.area(x + w2, y, x + w, y + h)
+		b := img.area(x, y, x + w2, y + h)
+		return subtractLog(a, b)
+	case 3:
+		w2 := w / 2
+		h2 := h / 2
+		a := img.area(x, y + h2, x + w2, y + h) + img.area(x + w2, y, x + w, y + h2)
+		b := img.area(x, y, x + w2, y + h2) + img.area(x + w2, y + h2, x + w, y + h)
+		return subtractLog(a, b)
+	case 4:
+		h3 := h / 3
+		a := img.area(x, y + h3, x + w, y + 2 * h3)
+		b := img.area(x, y, x + w, y + h3) + img.area(x, y + 2 * h3, x + w, y + h)
+		return subtractLog(a, b)
+	case 5:
+		w3 := w / 3
+		a := img.area(x + w3, y, x + 2 * w3, y + h)
+		b := img.area(x, y, x + w3, y + h) + img.area(x + 2 * w3, y, x + w, y + h)
+		return subtractLog(a, b)
+	}
+	return 0
+}
+
+type quantizer [3]float64
+
+func (q quantizer) quantize(v float64) uint32 {
+	if v < q[1] {
+		if v < q[0] {
+			return 0
+		}
+		return 1
+	}
+	if v < q[2] {
+		return 2
+	}
+	return 3
+}
+
+type classifier struct {
+	filter filter
+	quantizer quantizer
+}
+
+// the trained classifiers of chromaprint's default algorithm (TEST2)
+var classifiers = []classifier{
+	{filter{0, 4, 3, 15}, quantizer{1.98215, 2.35817, 2.63523}},
+	{filter{4, 4, 6, 15}, quantizer{-1.03809, -0.651211, -0.282167}},
+	{filter{1, 0, 4, 16}, quantizer{-0.298702, 0.119262, 0.558497}},
+	{filter{3, 8, 2, 12}, quantizer{-0.105439, 0.0153946, 0.135898}},
+	{filter{3, 4, 4, 8}, quantizer{-0.142891, 0.0258736, 0.200632}},
+	{filter{4, 0, 3, 5}, quantizer{-0.826319, -0.590612, -0.368214}},
+	{filter{1, 2, 2, 9}, quantizer{-0.557409, -0.233035, 0.0534525}},
+	{filter{2, 7, 3, 4}, quantizer{-0.0646826, 0.00620476, 0.0784847}},
+	{filter{2, 6, 2, 16}, quantizer{-0.192387, -0.029699, 0.215855}},
+	{filter{2, 1, 3, 2}, quantizer{-0.0397818, -0.00568076, 0.0292026}},
+	{filter{5, 10, 1, 15}, quantizer{-0.53823, -0.369934, -0.190235}},
+	{filter{3, 6, 2, 10}, quantizer{-0.124877, 0.0296483, 0.139239}},
+	{filter{2, 1, 1, 14}, quantizer{-0.101475, 0.0225617, 0.231971}},
+	{filter{3, 5, 6, 4}, quantizer{-0.0799915, -0.00729616, 0.063262}},
+	{filter{1, 9, 2, 12}, quantizer{-0.272556, 0.019424, 0.302559}},
+	{filter{3, 4, 2, 14}, quantizer{-0.164292, -0.0321188, 0.0846339}},
+}
+
+var grayCode = [4]uint32{0, 1, 3, 2}
+
+func maxFilterWidth() int {
+	w := 0
+	for _, c := range classifiers {
+		if c.filter.width > w {
+			w = c.filter.width
+		}
+	}
+	return w
+}
+
+// subFingerprint packs two bits from each classifier, applied to the
+// image at time offset x, into a single value
+func subFingerprint(img *integralImage, x int) uint32 {
+	var bits uint32
+	for _, c := range classifiers {
+		bits = bits << 2 | grayCode[c.quantizer.quantize(c.filter.apply(img, x))]
+	}
+	return bits
+}
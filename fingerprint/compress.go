@@ -0,0 +1,159 @@
+package fingerprint
+
+import (
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	normalBits = 3
+	exceptionBits = 5
+	maxNormalValue = 1 << normalBits - 1
+)
+
+var ErrBadFingerprint = errors.New("malformed fingerprint")
+
+type bitWriter struct {
+	data []byte
+	buf uint32
+	n uint
+}
+
+func (w *bitWriter) write(x uint32, bits uint) {
+	w.buf |= x << w.n
+	w.n += bits
+	for w.n >= 8 {
+		w.data = append(w.data, byte(w.buf))
+		w.buf >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *bitWriter) flush() {
+	if w.n > 0 {
+		w.data = append(w.data, byte(w.buf))
+	}
+	w.buf = 0
+	w.n = 0
+}
+
+type bitReader struct {
+	data []byte
+	pos int
+	buf uint32
+	n uint
+}
+
+func (r *bitReader) read(bits uint) (uint32, bool) {
+	for r.n < bits {
+		if r.pos >= len(r.data) {
+			return 0, false
+		}
+		r.buf |= uint32(r.data[r.pos]) << r.n
+		r.pos++
+		r.n += 8
+	}
+	x := r.buf & (1 << bits - 1)
+	r.buf >>= bits
+	r.n -= bits
+	return x, true
+}
+
+// align discards what's left of the current byte
+func (r *bitReader) align() {
+	r.buf = 0
+	r.n = 0
+}
+
+// Encode compresses a fingerprint into chromaprint's base64 format, as
+// printed by fpcalc and accepted by AcoustID
+func (fp *Fingerprint) Encode() string {
+	deltas := []uint32{}
+	var prev uint32
+	for _, v := range fp.Values {
+		x := v ^ prev
+		prev = v
+		var bit, last uint32 = 1, 0
+		for x != 0 {
+			if x & 1 != 0 {
+				deltas = append(deltas, bit - last)
+				last = bit
+			}
+			x >>= 1
+			bit++
+		}
+		deltas = append(deltas, 0)
+	}
+	n := len(fp.Values)
+	w := &bitWriter{data: []byte{byte(fp.Algorithm), byte(n >> 16), byte(n >> 8), byte(n)}}
+	for _, d := range deltas {
+		if d > maxNormalValue {
+			w.write(maxNormalValue, normalBits)
+		} else {
+			w.write(d, normalBits)
+		}
+	}
+	w.flush()
+	for _, d := range deltas {
+		if d >= maxNormalValue {
+			w.write(d - maxNormalValue, exceptionBits)
+		}
+	}
+	w.flush()
+	return base64.RawURLEncoding.EncodeToString(w.data)
+}
+
+// Decode parses a fingerprint in chromaprint's base64 format
+func Decode(s string) (*Fingerprint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(ErrBadFingerprint, err.Error())
+	}
+	if len(data) < 4 {
+		return nil, ErrBadFingerprint
+	}
+	fp := &Fingerprint{
+		Algorithm: int(data[0]),
+		Values: make([]uint32, int(data[1]) << 16 | int(data[2]) << 8 | int(data[3])),
+	}
+	r := &bitReader{data: data[4:]}
+	deltas := []uint32{}
+	for zeros := 0; zeros < len(fp.Values); {
+		d, ok := r.read(normalBits)
+		if !ok {
+			return nil, ErrBadFingerprint
+		}
+		if d == 0 {
+			zeros++
+		}
+		deltas = append(deltas, d)
+	}
+	r.align()
+	for i, d := range deltas {
+		if d == maxNormalValue {
+			x, ok := r.read(exceptionBits)
+			if !ok {
+				return nil, ErrBadFingerprint
+			}
+			deltas[i] += x
+		}
+	}
+	i := 0
+	var prev, last uint32
+	for _, d := range deltas {
+		if d == 0 {
+			fp.Values[i] ^= prev
+			prev = fp.Values[i]
+			last = 0
+			i++
+			continue
+		}
+		last += d
+		if last > 32 {
+			return nil, ErrBadFingerprint
+		}
+		fp.Values[i] |= 1 << (last - 1)
+	}
+	return fp, nil
+}
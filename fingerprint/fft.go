@@ -0,0 +1,66 @@
+package fingerprint
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// fft is a radix-2 transform of a fixed size, with the twiddle factors
+// and bit reversal table computed once up front
+type fft struct {
+	size int
+	twiddle []complex128
+	rev []int
+	buf []complex128
+}
+
+func newFFT(size int) *fft {
+	bits := 0
+	for 1 << bits < size {
+		bits++
+	}
+	f := &fft{
+		size: size,
+		twiddle: make([]complex128, size / 2),
+		rev: make([]int, size),
+		buf: make([]complex128, size),
+	}
+	for i := range f.twiddle {
+		f.twiddle[i] = cmplx.Exp(complex(0, -2 * math.Pi * float64(i) / float64(size)))
+	}
+	for i := range f.rev {
+		r := 0
+		for b := 0; b < bits; b++ {
+			if i & (1 << b) != 0 {
+				r |= 1 << (bits - 1 - b)
+			}
+		}
+		f.rev[i] = r
+	}
+	return f
+}
+
+// power computes the power spectrum of a frame of real samples into
+// out, which must have room for size/2+1 bins
+func (f *fft) power(in []float64, out []float64) {
+	for i, j := range f.rev {
+		f.buf[j] = complex(in[i], 0)
+	}
+	for n := 2; n <= f.size; n <<= 1 {
+		step := f.size / n
+		half := n / 2
+		for start := 0; start < f.size; start += n {
+			for k := 0; k < half; k++ {
+				t := f.twiddle[k * step] * f.buf[start + k + half]
+				u := f.buf[start + k]
+				f.buf[start + k] = u + t
+				f.buf[start + k + half] = u - t
+			}
+		}
+	}
+	for i := 0; i <= f.size / 2; i++ {
+		re := real(f.buf[i])
+		im := imag(f.buf[i])
+		out[i] = re * re + im * im
+	}
+}
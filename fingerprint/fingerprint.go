@@ -0,0 +1,223 @@
+// Package fingerprint computes chromaprint compatible acoustic
+// fingerprints, which identify a recording by its sound rather than its
+// tags or file contents.
+package fingerprint
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+	"os/exec"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// chromaprint's default algorithm, CHROMAPRINT_ALGORITHM_TEST2
+	Algorithm = 1
+	SampleRate = 11025
+	// fpcalc's default, and plenty to tell recordings apart
+	MaxDuration = 120
+	// masks off the bits of the least stable classifiers in lookup keys
+	HashMask = 0xfffffff0
+
+	frameSize = 4096
+	frameStep = frameSize / 3
+	minFreq = 28
+	maxFreq = 3520
+	numBands = 12
+)
+
+var chromaFilter = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+type Fingerprint struct {
+	Algorithm int
+	Values []uint32
+}
+
+// Calculate decodes up to MaxDuration seconds of an audio file with
+// ffmpeg and fingerprints it
+func Calculate(fn string) (*Fingerprint, error) {
+	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-i", fn, "-vn", "-ac", "1", "-ar", strconv.Itoa(SampleRate), "-t", strconv.Itoa(MaxDuration), "-f", "s16le", "-acodec", "pcm_s16le", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		stdout.Close()
+		return nil, errors.Wrap(err, "can't run ffmpeg")
+	}
+	samples, rerr := readSamples(bufio.NewReader(stdout))
+	err = cmd.Wait()
+	if rerr != nil {
+		return nil, rerr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode " + fn)
+	}
+	return Compute(samples)
+}
+
+func readSamples(r io.Reader) ([]int16, error) {
+	samples := make([]int16, 0, SampleRate * MaxDuration)
+	buf := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		samples = append(samples, int16(binary.LittleEndian.Uint16(buf)))
+	}
+}
+
+// Compute fingerprints mono 16 bit samples at SampleRate, following
+// chromaprint's pipeline: a hamming windowed fft, folded into 12 chroma
+// bands, smoothed over time and normalized, then fed through the
+// trained classifiers
+func Compute(samples []int16) (*Fingerprint, error) {
+	if len(samples) < frameSize {
+		return nil, errors.New("audio too short to fingerprint")
+	}
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = (0.54 - 0.46 * math.Cos(float64(i) * 2 * math.Pi / float64(frameSize - 1))) / math.MaxInt16
+	}
+	notes := make([]int, frameSize / 2 + 1)
+	minIndex := freqToIndex(minFreq)
+	if minIndex < 1 {
+		minIndex = 1
+	}
+	maxIndex := freqToIndex(maxFreq)
+	if maxIndex > frameSize / 2 {
+		maxIndex = frameSize / 2
+	}
+	for i := minIndex; i < maxIndex; i++ {
+		freq := float64(i) * SampleRate / frameSize
+		octave := math.Log2(freq / (440.0 / 16.0))
+		notes[i] = int(numBands * (octave - math.Floor(octave)))
+	}
+	f := newFFT(frameSize)
+	frame := make([]float64, frameSize)
+	spectrum := make([]float64, frameSize / 2 + 1)
+	chromas := [][]float64{}
+	img := newIntegralImage(numBands)
+	for start := 0; start + frameSize <= len(samples); start += frameStep {
+		for i := range frame {
+			frame[i] = float64(samples[start + i]) * window[i]
+		}
+		f.power(frame, spectrum)
+		chroma := make([]float64, numBands)
+		for i := minIndex; i < maxIndex; i++ {
+			chroma[notes[i]] += spectrum[i]
+		}
+		chromas = append(chromas, chroma)
+		if len(chromas) < len(chromaFilter) {
+			continue
+		}
+		chromas = chromas[len(chromas) - len(chromaFilter):]
+		row := make([]float64, numBands)
+		for i := range row {
+			for j, c := range chromaFilter {
+				row[i] += chromas[j][i] * c
+			}
+		}
+		normalize(row)
+		img.addRow(row)
+	}
+	width := maxFilterWidth()
+	if img.numRows() < width {
+		return nil, errors.New("audio too short to fingerprint")
+	}
+	fp := &Fingerprint{
+		Algorithm: Algorithm,
+		Values: make([]uint32, img.numRows() - width + 1),
+	}
+	for x := range fp.Values {
+		fp.Values[x] = subFingerprint(img, x)
+	}
+	return fp, nil
+}
+
+func freqToIndex(freq float64) int {
+	return int(math.Round(frameSize * freq / SampleRate))
+}
+
+func normalize(v []float64) {
+	sum := 0.0
+	for _, x := range v {
+		sum += x * x
+	}
+	norm := math.Sqrt(sum)
+	for i := range v {
+		if norm < 0.01 {
+			v[i] = 0
+		} else {
+			v[i] /= norm
+		}
+	}
+}
+
+// Compare scores how alike two fingerprints are, from 0 to 1, as the
+// fraction of matching bits at the best alignment of the two.  unrelated
+// recordings score around 0.5; the same recording in different encodings
+// usually scores above 0.9.
+func Compare(a, b *Fingerprint, maxOffset int) float64 {
+	if a.Algorithm != b.Algorithm {
+		return 0
+	}
+	best := 0.0
+	for offset := -maxOffset; offset <= maxOffset; offset++ {
+		errs := 0
+		n := 0
+		for i := range a.Values {
+			j := i + offset
+			if j < 0 || j >= len(b.Values) {
+				continue
+			}
+			errs += bits.OnesCount32(a.Values[i] ^ b.Values[j])
+			n++
+		}
+		// require a reasonable overlap, so a few lucky frames at the
+		// ends can't score highly
+		if n < 32 || n < len(a.Values) / 2 && n < len(b.Values) / 2 {
+			continue
+		}
+		score := 1 - float64(errs) / float64(32 * n)
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// Hashes returns the distinct, coarsened values from the early part of a
+// fingerprint, for use as lookup keys, so the same recording in
+// different encodings shares most of its keys.
+func (fp *Fingerprint) Hashes() []uint32 {
+	start := 16
+	end := start + 240
+	if end > len(fp.Values) {
+		end = len(fp.Values)
+	}
+	if start >= end {
+		start = 0
+	}
+	seen := map[uint32]bool{}
+	hashes := []uint32{}
+	for _, v := range fp.Values[start:end] {
+		h := v & HashMask
+		if h == 0 || seen[h] {
+			continue
+		}
+		seen[h] = true
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
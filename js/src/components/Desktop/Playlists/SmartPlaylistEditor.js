@@ -275,7 +275,6 @@ export const DurationMenu = ({
     { label: 'hours', value: 60 * 60 * 1000 },
     { label: 'minutes', value: 60 * 1000 },
     { label: 'seconds', value: 1000 },
-    { label: 'milliseconds', value: 1 },
   ];
   const myOnChange = useCallback((opt) => onChange(opt.value), [onChange]);
   return (
@@ -402,29 +401,38 @@ export const SmartPlaylistBooleanRule = ({
   );
 };
 
+const relativeUnits = [
+  { unit: 'months', ms: 30 * 24 * 60 * 60 * 1000 },
+  { unit: 'weeks', ms: 7 * 24 * 60 * 60 * 1000 },
+  { unit: 'days', ms: 24 * 60 * 60 * 1000 },
+  { unit: 'hours', ms: 60 * 60 * 1000 },
+  { unit: 'minutes', ms: 60 * 1000 },
+  { unit: 'seconds', ms: 1000 },
+];
+
 export const SmartPlaylistDateRule = ({
   op,
   times = [],
+  ints = [],
+  unit,
   onUpdate,
 }) => {
   switch (op) {
   case 'WITHIN':
-    const t = times.length > 0 ? times[0] : 0;
-    const m = [
-      30 * 24 * 60 * 60 * 1000,
-      7 * 24 * 60 * 60 * 1000,
-      24 * 60 * 60 * 1000,
-      60 * 60 * 1000,
-      60 * 1000,
-      1000,
-      1
-    ].find(x => t % x === 0);
+    // older rules only have a number of milliseconds
+    let n = ints.length > 0 ? ints[0] : 0;
+    let u = relativeUnits.find(x => x.unit === unit);
+    if (!u) {
+      const t = Math.abs(times.length > 0 ? times[0] : 0);
+      u = relativeUnits.find(x => t % x.ms === 0) || relativeUnits[relativeUnits.length - 1];
+      n = Math.floor(t / u.ms);
+    }
     return (
       <>
-        <IntegerInput value={t / m} min={0} max={999} onInput={(val) => onUpdate({ times: [val * m].concat(times.slice(1)) })} />
+        <IntegerInput value={n} min={0} max={999} onInput={(val) => onUpdate({ ints: [val], unit: u.unit, times: [] })} />
         <DurationMenu
-          value={m}
-          onChange={val => onUpdate({ times: [t * val / m].concat(times.slice(1)) })}
+          value={u.ms}
+          onChange={val => onUpdate({ ints: [n], unit: (relativeUnits.find(x => x.ms === val) || u).unit, times: [] })}
         />
       </>
     );
@@ -503,21 +511,20 @@ export const SmartPlaylistPlaylistRule = ({
   );
 };
 
-/*
 export const SmartPlaylistLoveRule = ({
-  love,
+  bool,
   onUpdate,
 }) => {
   const vals = [
-    { value: "LOVED", name: "Loved" },
-    { value: "DISLIKED", name: "Disliked" },
-    { value: "NONE", name: "None" },
+    { value: "LOVED", name: "Loved", bool: true },
+    { value: "DISLIKED", name: "Disliked", bool: false },
+    { value: "NONE", name: "None", bool: null },
   ];
+  const love = vals.find(x => x.bool === (bool === undefined ? null : bool)).value;
   return (
-    <ValueMenu options={vals} value={love} onChange={val => onUpdate({ love: val })} />
+    <ValueMenu options={vals} value={love} onChange={val => onUpdate({ bool: vals.find(x => x.value === val).bool })} />
   );
 };
-*/
 
 /*
 export const SmartPlaylistCloudRule = ({
@@ -580,9 +587,9 @@ const SmartPlaylistRuleData = ({
     return (<SmartPlaylistMediaKindRule {...props} />);
   case "playlist":
     return (<SmartPlaylistPlaylistRule {...props} />);
-  /*
   case "love":
     return (<SmartPlaylistLoveRule {...props} />);
+  /*
   case "cloud":
     return (<SmartPlaylistCloudRule {...props} />);
   case "location":
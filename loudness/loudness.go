@@ -0,0 +1,198 @@
+// Package loudness measures the loudness of audio files according to
+// ITU-R BS.1770 and EBU R128, for computing ReplayGain 2.0 style gains.
+package loudness
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the ReplayGain 2.0 reference level, in LUFS
+	Reference = -18.0
+
+	sampleRate = 48000
+	channels = 2
+	// loudness is measured over 400ms blocks overlapping by 75%, which
+	// we build from 100ms sub-blocks
+	subBlock = sampleRate / 10
+	blockSubBlocks = 4
+
+	absoluteGate = -70.0
+	relativeGate = -10.0
+)
+
+// Result holds the measurements of one file.  the block energies are
+// kept so that several results can be pooled into an album loudness.
+type Result struct {
+	Blocks []float64
+	Peak float64
+}
+
+// biquad is a second order IIR filter in direct form II transposed
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2 float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0 * x + f.z1
+	f.z1 = f.b1 * x - f.a1 * y + f.z2
+	f.z2 = f.b2 * x - f.a2 * y
+	return y
+}
+
+// kWeighting returns the two stage K-weighting filter of BS.1770 at
+// 48kHz: a high shelf modelling the head, then a high pass
+func kWeighting() []*biquad {
+	return []*biquad{
+		&biquad{b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285, a1: -1.69065929318241, a2: 0.73248077421585},
+		&biquad{b0: 1.0, b1: -2.0, b2: 1.0, a1: -1.99004745483398, a2: 0.99007225036621},
+	}
+}
+
+// Analyze decodes an audio file with ffmpeg and measures it.  mono
+// files are measured as though played on both speakers, and surround
+// files are folded down to stereo.
+func Analyze(fn string) (*Result, error) {
+	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-i", fn, "-vn", "-ac", strconv.Itoa(channels), "-ar", strconv.Itoa(sampleRate), "-f", "f32le", "-acodec", "pcm_f32le", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		stdout.Close()
+		return nil, errors.Wrap(err, "can't run ffmpeg")
+	}
+	res, rerr := Measure(bufio.NewReader(stdout))
+	if rerr != nil {
+		io.Copy(io.Discard, stdout)
+	}
+	err = cmd.Wait()
+	if rerr != nil {
+		return nil, rerr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode " + fn)
+	}
+	return res, nil
+}
+
+// Measure reads interleaved stereo 32 bit float samples at 48kHz
+func Measure(r io.Reader) (*Result, error) {
+	filters := make([][]*biquad, channels)
+	for i := range filters {
+		filters[i] = kWeighting()
+	}
+	res := &Result{Blocks: []float64{}}
+	subs := []float64{}
+	sum := 0.0
+	n := 0
+	buf := make([]byte, 4 * channels)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for c := 0; c < channels; c++ {
+			x := float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[c * 4:])))
+			if math.Abs(x) > res.Peak {
+				res.Peak = math.Abs(x)
+			}
+			for _, f := range filters[c] {
+				x = f.process(x)
+			}
+			sum += x * x
+		}
+		n++
+		if n < subBlock {
+			continue
+		}
+		subs = append(subs, sum / subBlock)
+		sum = 0
+		n = 0
+		if len(subs) < blockSubBlocks {
+			continue
+		}
+		subs = subs[len(subs) - blockSubBlocks:]
+		z := 0.0
+		for _, s := range subs {
+			z += s
+		}
+		res.Blocks = append(res.Blocks, z / blockSubBlocks)
+	}
+	if len(res.Blocks) == 0 {
+		return nil, errors.New("audio too short to measure")
+	}
+	return res, nil
+}
+
+func energyToLoudness(z float64) float64 {
+	return -0.691 + 10 * math.Log10(z)
+}
+
+// Integrated computes the gated integrated loudness of a set of block
+// energies, in LUFS
+func Integrated(blocks []float64) float64 {
+	mean := func(threshold float64) float64 {
+		sum := 0.0
+		n := 0
+		for _, z := range blocks {
+			if z > 0 && energyToLoudness(z) > threshold {
+				sum += z
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return sum / float64(n)
+	}
+	z := mean(absoluteGate)
+	if z == 0 {
+		return math.Inf(-1)
+	}
+	z = mean(energyToLoudness(z) + relativeGate)
+	return energyToLoudness(z)
+}
+
+// Loudness is the integrated loudness of the file, in LUFS
+func (res *Result) Loudness() float64 {
+	return Integrated(res.Blocks)
+}
+
+// Gain is the adjustment in dB that brings the file to the reference
+// level.  silent files get no adjustment.
+func (res *Result) Gain() float64 {
+	return gain(res.Loudness())
+}
+
+func gain(lufs float64) float64 {
+	if math.IsInf(lufs, -1) {
+		return 0
+	}
+	return Reference - lufs
+}
+
+// Album pools the measurements of the tracks of an album, so the album
+// keeps its internal dynamics when played at the album gain
+func Album(results []*Result) *Result {
+	album := &Result{Blocks: []float64{}}
+	for _, res := range results {
+		album.Blocks = append(album.Blocks, res.Blocks...)
+		if res.Peak > album.Peak {
+			album.Peak = res.Peak
+		}
+	}
+	return album
+}
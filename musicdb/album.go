@@ -0,0 +1,491 @@
+package musicdb
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type ReleaseType string
+
+const (
+	ReleaseAlbum       = ReleaseType("album")
+	ReleaseEP          = ReleaseType("ep")
+	ReleaseSingle      = ReleaseType("single")
+	ReleaseCompilation = ReleaseType("compilation")
+	ReleaseLive        = ReleaseType("live")
+	ReleaseSoundtrack  = ReleaseType("soundtrack")
+)
+
+func (rt ReleaseType) Valid() bool {
+	switch rt {
+	case ReleaseAlbum, ReleaseEP, ReleaseSingle, ReleaseCompilation, ReleaseLive, ReleaseSoundtrack:
+		return true
+	}
+	return false
+}
+
+// Album is a release that tracks are on.  Artist and Names are filled
+// in with the number of tracks on it when it's loaded.  without an
+// ArtworkTrackID, the album's artwork is its first track's.
+type Album struct {
+	PersistentID   pid.PersistentID  `json:"persistent_id,omitempty" db:"id"`
+	OwnerID        pid.PersistentID  `json:"owner_id,omitempty" db:"owner_id"`
+	Name           string            `json:"name,omitempty" db:"name"`
+	SortName       string            `json:"sort" db:"sort_name"`
+	ArtistName     *string           `json:"artist_name,omitempty" db:"artist"`
+	SortArtist     string            `json:"sort_artist,omitempty" db:"sort_artist"`
+	Year           *int              `json:"year,omitempty" db:"year"`
+	ReleaseType    *ReleaseType      `json:"release_type,omitempty" db:"release_type"`
+	DiscCount      *uint8            `json:"disc_count,omitempty" db:"disc_count"`
+	ArtworkTrackID *pid.PersistentID `json:"artwork_track_id,omitempty" db:"artwork_track_id"`
+	Rating         *uint8            `json:"rating,omitempty" db:"rating"`
+	DateAdded      *Time             `json:"date_added,omitempty" db:"date_added"`
+	DateModified   *Time             `json:"date_modified,omitempty" db:"date_modified"`
+	Artist         *Artist           `json:"artist" db:"-"`
+	Names          map[string]int    `json:"names" db:"-"`
+	db *DB
+}
+
+func (a *Album) ID() pid.PersistentID {
+	return a.PersistentID
+}
+
+func (a *Album) SetID(p pid.PersistentID) {
+	a.PersistentID = p
+}
+
+func (a *Album) Sorted() []string {
+	return sortNames(a.Names)
+}
+
+func (a *Album) Count() int {
+	count := 0
+	for _, v := range a.Names {
+		count += v
+	}
+	return count
+}
+
+func (a *Album) setCount(n int) {
+	a.Names = map[string]int{a.Name: n}
+	a.Artist = nil
+	if a.ArtistName != nil && a.SortArtist != "" {
+		a.Artist = &Artist{
+			SortName: a.SortArtist,
+			Names: map[string]int{*a.ArtistName: n},
+			db: a.db,
+		}
+	}
+}
+
+// albumKey is what makes tracks the same album: the owner, and the sort
+// names of the album and its artist
+type albumKey struct {
+	OwnerID pid.PersistentID
+	Artist  string
+	Album   string
+}
+
+func (a *Album) key() albumKey {
+	return albumKey{OwnerID: a.OwnerID, Artist: a.SortArtist, Album: a.SortName}
+}
+
+func albumSortName(name string) string {
+	s := MakeSort(name)
+	if s == "" {
+		// names with nothing but punctuation, like !!!
+		s = strings.ToLower(strings.TrimSpace(name))
+	}
+	return s
+}
+
+func albumSortArtist(name string) string {
+	s := MakeSortArtist(name)
+	if s == "" {
+		s = strings.ToLower(strings.TrimSpace(name))
+	}
+	return s
+}
+
+// trackAlbumArtist is who a track's album is filed under: its album
+// artist, or its artist if it doesn't have one
+func trackAlbumArtist(tr *Track) (string, string) {
+	if tr.AlbumArtist != nil && strings.TrimSpace(*tr.AlbumArtist) != "" {
+		name := strings.TrimSpace(*tr.AlbumArtist)
+		if tr.SortAlbumArtist != nil && *tr.SortAlbumArtist != "" {
+			return name, *tr.SortAlbumArtist
+		}
+		return name, albumSortArtist(name)
+	}
+	if tr.Artist != nil && strings.TrimSpace(*tr.Artist) != "" {
+		name := strings.TrimSpace(*tr.Artist)
+		if tr.SortArtist != nil && *tr.SortArtist != "" {
+			return name, *tr.SortArtist
+		}
+		return name, albumSortArtist(name)
+	}
+	return "", ""
+}
+
+// trackAlbumKey is the album a track's tags put it on, or false if they
+// don't name one
+func trackAlbumKey(tr *Track) (albumKey, bool) {
+	key := albumKey{OwnerID: tr.OwnerID}
+	if tr.Album == nil || strings.TrimSpace(*tr.Album) == "" {
+		return key, false
+	}
+	if tr.SortAlbum != nil && *tr.SortAlbum != "" {
+		key.Album = *tr.SortAlbum
+	} else {
+		key.Album = albumSortName(*tr.Album)
+	}
+	_, key.Artist = trackAlbumArtist(tr)
+	return key, true
+}
+
+// newTrackAlbum makes an album for the first track found on it
+func newTrackAlbum(tr *Track) *Album {
+	key, _ := trackAlbumKey(tr)
+	album := &Album{
+		OwnerID: tr.OwnerID,
+		Name: strings.TrimSpace(*tr.Album),
+		SortName: key.Album,
+		SortArtist: key.Artist,
+		DiscCount: tr.DiscCount,
+		Rating: tr.AlbumRating,
+		DateAdded: tr.DateAdded,
+	}
+	artist, _ := trackAlbumArtist(tr)
+	if artist != "" {
+		album.ArtistName = &artist
+	}
+	if tr.ReleaseDate != nil {
+		year := tr.ReleaseDate.Time().In(time.UTC).Year()
+		album.Year = &year
+	}
+	if tr.Compilation {
+		rt := ReleaseCompilation
+		album.ReleaseType = &rt
+	}
+	if album.DateAdded == nil {
+		now := Now()
+		album.DateAdded = &now
+	}
+	album.DateModified = album.DateAdded
+	return album
+}
+
+func (db *DB) findAlbum(tx *Tx, key albumKey) (*Album, error) {
+	qs := `SELECT * FROM album WHERE owner_id = ? AND sort_artist = ? AND sort_name = ?`
+	row := tx.QueryRow(qs, key.OwnerID, key.Artist, key.Album)
+	album := &Album{}
+	err := row.StructScan(album)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	album.db = db
+	return album, nil
+}
+
+// assignAlbum puts a track on the album its tags say it's on, making
+// the album if it's the first track on it, and dropping the album it
+// was on before if it was the last
+func (db *DB) assignAlbum(tx *Tx, tr *Track) error {
+	var album *Album
+	key, ok := trackAlbumKey(tr)
+	if ok {
+		var err error
+		album, err = db.findAlbum(tx, key)
+		if err != nil {
+			return err
+		}
+		if album == nil {
+			album = newTrackAlbum(tr)
+			album.PersistentID = pid.NewPersistentID()
+			err = db.insertStruct(tx, album)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	prev := tr.AlbumID
+	if album == nil {
+		tr.AlbumID = nil
+	} else {
+		id := album.PersistentID
+		tr.AlbumID = &id
+	}
+	if prev != nil && (tr.AlbumID == nil || *prev != *tr.AlbumID) {
+		return db.pruneAlbum(tx, *prev, tr.PersistentID)
+	}
+	return nil
+}
+
+// pruneAlbum deletes an album if it has no tracks but the given one
+func (db *DB) pruneAlbum(tx *Tx, id, trackId pid.PersistentID) error {
+	qs := `DELETE FROM album WHERE id = ? AND NOT EXISTS (SELECT 1 FROM track WHERE track.album_id = ? AND track.id != ?)`
+	_, err := tx.Exec(qs, id, id, trackId)
+	return err
+}
+
+type albumRow struct {
+	Album
+	TrackCount   int               `db:"track_count"`
+	FirstTrackID *pid.PersistentID `db:"first_track_id"`
+}
+
+// queryAlbums gets the albums of the tracks that match a filter on the
+// track table, ordered by artist then name
+func (db *DB) queryAlbums(filter string, args []interface{}) ([]*Album, error) {
+	qs := `SELECT album.*, t.track_count, (SELECT track.id FROM track WHERE track.album_id = album.id ORDER BY track.disc_number, track.track_number, track.sort_name LIMIT 1) AS first_track_id FROM album JOIN (SELECT album_id, COUNT(*) AS track_count FROM track WHERE album_id IS NOT NULL`
+	if filter != "" {
+		qs += ` AND (` + filter + `)`
+	}
+	qs += ` GROUP BY album_id) AS t ON t.album_id = album.id ORDER BY album.sort_artist = '', album.sort_artist, album.sort_name`
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	albums := []*Album{}
+	for rows.Next() {
+		row := &albumRow{}
+		err = rows.StructScan(row)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan album")
+		}
+		album := &row.Album
+		album.db = db
+		if album.ArtworkTrackID == nil {
+			album.ArtworkTrackID = row.FirstTrackID
+		}
+		album.setCount(row.TrackCount)
+		albums = append(albums, album)
+	}
+	return albums, nil
+}
+
+func (db *DB) GetAlbum(id pid.PersistentID) (*Album, error) {
+	albums, err := db.queryAlbums(`album_id = ?`, []interface{}{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(albums) == 0 {
+		return nil, nil
+	}
+	return albums[0], nil
+}
+
+// SaveAlbum saves changes to an album, and passes its name, artist and
+// rating on to its tracks.  renaming an album to the name of another of
+// the owner's albums merges the two.
+func (db *DB) SaveAlbum(album *Album) error {
+	album.Name = strings.TrimSpace(album.Name)
+	if album.Name == "" {
+		return errors.New("album has no name")
+	}
+	album.SortName = albumSortName(album.Name)
+	album.SortArtist = ""
+	if album.ArtistName != nil {
+		name := strings.TrimSpace(*album.ArtistName)
+		if name == "" {
+			album.ArtistName = nil
+		} else {
+			album.ArtistName = &name
+			album.SortArtist = albumSortArtist(name)
+		}
+	}
+	if album.ReleaseType != nil && !album.ReleaseType.Valid() {
+		return errors.Errorf("unknown release type %s", *album.ReleaseType)
+	}
+	now := Now()
+	album.DateModified = &now
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	other, err := db.findAlbum(tx, album.key())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if other != nil && other.PersistentID != album.PersistentID {
+		qs := `UPDATE track SET album_id = ? WHERE album_id = ?`
+		_, err = tx.Exec(qs, other.PersistentID, album.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		qs = `DELETE FROM album WHERE id = ?`
+		_, err = tx.Exec(qs, album.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		album.PersistentID = other.PersistentID
+		album.DateAdded = other.DateAdded
+	}
+	err = db.updateStruct(tx, album)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	qs := `UPDATE track SET album = ?, sort_album = ?, album_rating = ?, date_modified = ?`
+	args := []interface{}{album.Name, album.SortName, album.Rating, now}
+	if album.ArtistName != nil {
+		qs += `, album_artist = ?, sort_album_artist = ?`
+		args = append(args, *album.ArtistName, album.SortArtist)
+	}
+	qs += ` WHERE album_id = ?`
+	args = append(args, album.PersistentID)
+	_, err = tx.Exec(qs, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type albumGroup struct {
+	OwnerID         pid.PersistentID `db:"owner_id"`
+	Album           *string          `db:"album"`
+	SortAlbum       *string          `db:"sort_album"`
+	AlbumArtist     *string          `db:"album_artist"`
+	SortAlbumArtist *string          `db:"sort_album_artist"`
+	Artist          *string          `db:"artist"`
+	SortArtist      *string          `db:"sort_artist"`
+	Count           int              `db:"n"`
+	Year            *float64         `db:"year"`
+	DiscCount       *uint8           `db:"disc_count"`
+	AlbumRating     *uint8           `db:"album_rating"`
+	Compilation     bool             `db:"compilation"`
+	DateAdded       *Time            `db:"date_added"`
+}
+
+// linkAlbums puts every track that isn't on an album yet on one, making
+// albums as needed
+func (db *DB) linkAlbums(tx *Tx) error {
+	qs := `SELECT owner_id, album, sort_album, album_artist, sort_album_artist, artist, sort_artist, COUNT(*) AS n, MAX(date_part('year', release_date)) AS year, MAX(disc_count) AS disc_count, MAX(album_rating) AS album_rating, COALESCE(BOOL_OR(compilation), false) AS compilation, MIN(date_added) AS date_added FROM track WHERE album_id IS NULL AND album IS NOT NULL AND TRIM(album) != '' GROUP BY owner_id, album, sort_album, album_artist, sort_album_artist, artist, sort_artist`
+	rows, err := tx.Query(qs)
+	if err != nil {
+		return err
+	}
+	groups := []*albumGroup{}
+	for rows.Next() {
+		g := &albumGroup{}
+		err = rows.StructScan(g)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "can't scan album group")
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	albums := map[albumKey]*Album{}
+	names := map[albumKey]map[string]int{}
+	artists := map[albumKey]map[string]int{}
+	for _, g := range groups {
+		tr := &Track{
+			OwnerID: g.OwnerID,
+			Album: g.Album,
+			SortAlbum: g.SortAlbum,
+			AlbumArtist: g.AlbumArtist,
+			SortAlbumArtist: g.SortAlbumArtist,
+			Artist: g.Artist,
+			SortArtist: g.SortArtist,
+			DiscCount: g.DiscCount,
+			AlbumRating: g.AlbumRating,
+			Compilation: g.Compilation,
+			DateAdded: g.DateAdded,
+		}
+		key, _ := trackAlbumKey(tr)
+		album, ok := albums[key]
+		if !ok {
+			album, err = db.findAlbum(tx, key)
+			if err != nil {
+				return err
+			}
+			if album == nil {
+				album = newTrackAlbum(tr)
+			}
+			albums[key] = album
+			names[key] = map[string]int{}
+			artists[key] = map[string]int{}
+		}
+		names[key][strings.TrimSpace(*g.Album)] += g.Count
+		artist, _ := trackAlbumArtist(tr)
+		if artist != "" {
+			artists[key][artist] += g.Count
+		}
+		if album.PersistentID != 0 {
+			continue
+		}
+		// a new album takes the most of what its tracks say
+		if g.Year != nil && (album.Year == nil || int(*g.Year) > *album.Year) {
+			year := int(*g.Year)
+			album.Year = &year
+		}
+		if g.DiscCount != nil && (album.DiscCount == nil || *g.DiscCount > *album.DiscCount) {
+			album.DiscCount = g.DiscCount
+		}
+		if g.AlbumRating != nil && (album.Rating == nil || *g.AlbumRating > *album.Rating) {
+			album.Rating = g.AlbumRating
+		}
+		if g.Compilation {
+			rt := ReleaseCompilation
+			album.ReleaseType = &rt
+		}
+		if g.DateAdded != nil && album.DateAdded != nil && *g.DateAdded < *album.DateAdded {
+			album.DateAdded = g.DateAdded
+		}
+	}
+	for key, album := range albums {
+		if album.PersistentID != 0 {
+			continue
+		}
+		album.Name = sortNames(names[key])[0]
+		if len(artists[key]) > 0 {
+			artist := sortNames(artists[key])[0]
+			album.ArtistName = &artist
+		}
+		album.PersistentID = pid.NewPersistentID()
+		err = db.insertStruct(tx, album)
+		if err != nil {
+			return err
+		}
+	}
+	for _, g := range groups {
+		tr := &Track{
+			OwnerID: g.OwnerID,
+			Album: g.Album,
+			SortAlbum: g.SortAlbum,
+			AlbumArtist: g.AlbumArtist,
+			SortAlbumArtist: g.SortAlbumArtist,
+			Artist: g.Artist,
+			SortArtist: g.SortArtist,
+		}
+		key, _ := trackAlbumKey(tr)
+		qs = `UPDATE track SET album_id = ? WHERE album_id IS NULL AND owner_id = ? AND album = ? AND sort_album IS NOT DISTINCT FROM ? AND album_artist IS NOT DISTINCT FROM ? AND sort_album_artist IS NOT DISTINCT FROM ? AND artist IS NOT DISTINCT FROM ? AND sort_artist IS NOT DISTINCT FROM ?`
+		_, err = tx.Exec(qs, albums[key].PersistentID, g.OwnerID, *g.Album, g.SortAlbum, g.AlbumArtist, g.SortAlbumArtist, g.Artist, g.SortArtist)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillAlbums makes albums for the tracks already in the library,
+// for the migration that adds them.  tracks saved since are put on
+// albums as they're saved.
+func BackfillAlbums(tx *sqlx.Tx) error {
+	db := &DB{}
+	return db.linkAlbums(&Tx{tx: tx})
+}
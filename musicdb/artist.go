@@ -0,0 +1,676 @@
+package musicdb
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type ArtistRole string
+
+const (
+	RoleArtist      = ArtistRole("artist")
+	RoleFeatured    = ArtistRole("featured")
+	RoleAlbumArtist = ArtistRole("album_artist")
+	RoleComposer    = ArtistRole("composer")
+)
+
+var ErrArtistAliasTaken = errors.New("alias belongs to another artist")
+
+// Artist is a performer or composer that tracks are credited to.  the
+// SortName is the key tracks' credits are matched on; SortAs is what
+// the artist is filed under, if it's not that.  Names is filled in with
+// the number of tracks credited to the artist when it's loaded.
+type Artist struct {
+	PersistentID  pid.PersistentID `json:"persistent_id,omitempty" db:"id"`
+	OwnerID       pid.PersistentID `json:"owner_id,omitempty" db:"owner_id"`
+	Name          string           `json:"name,omitempty" db:"name"`
+	SortName      string           `json:"sort" db:"sort_name"`
+	SortAs        *string          `json:"sort_as,omitempty" db:"sort_as"`
+	MusicBrainzID *string          `json:"musicbrainz_id,omitempty" db:"musicbrainz_id"`
+	SpotifyID     *string          `json:"spotify_id,omitempty" db:"spotify_id"`
+	Biography     *string          `json:"biography,omitempty" db:"biography"`
+	ImageURL      *string          `json:"image_url,omitempty" db:"image_url"`
+	DateAdded     *Time            `json:"date_added,omitempty" db:"date_added"`
+	DateModified  *Time            `json:"date_modified,omitempty" db:"date_modified"`
+	Aliases       []string         `json:"aliases,omitempty" db:"-"`
+	Names         map[string]int   `json:"names" db:"-"`
+	db *DB
+}
+
+func (a *Artist) ID() pid.PersistentID {
+	return a.PersistentID
+}
+
+func (a *Artist) SetID(p pid.PersistentID) {
+	a.PersistentID = p
+}
+
+func (a *Artist) Sorted() []string {
+	return sortNames(a.Names)
+}
+
+func (a *Artist) Count() int {
+	count := 0
+	for _, v := range a.Names {
+		count += v
+	}
+	return count
+}
+
+var invertedArtistRe = regexp.MustCompile(`(?i)^(.+),\s*(the|a|an)$`)
+var featuredRe = regexp.MustCompile(`(?i)(?:\s+|\s*[\(\[]\s*)(?:feat\.?|ft\.?|featuring|with)\s+(.+?)\s*[\)\]]?\s*$`)
+var creditSepRe = regexp.MustCompile(`(?i)\s*,\s*|\s+(?:&|\+|and|x|vs\.?)\s+`)
+var composerSepRe = regexp.MustCompile(`\s*[/;]\s*`)
+
+// artistKey is the sort name an artist credit is matched on.  "Beatles,
+// The" is the same artist as "The Beatles".
+func artistKey(name string) string {
+	name = strings.TrimSpace(name)
+	if m := invertedArtistRe.FindStringSubmatch(name); m != nil {
+		name = m[2] + " " + m[1]
+	}
+	return albumSortArtist(name)
+}
+
+func splitNames(re *regexp.Regexp, s string) []string {
+	names := []string{}
+	for _, name := range re.Split(s, -1) {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// splitArtists splits a credit like "Jay-Z & Kanye West" into its
+// artists, but only if every one of them is known on its own, so that
+// "Simon & Garfunkel" and "Crosby, Stills, Nash & Young" stay whole
+func splitArtists(credit string, known func(string) bool) []string {
+	if known(artistKey(credit)) {
+		return []string{credit}
+	}
+	parts := splitNames(creditSepRe, credit)
+	if len(parts) < 2 {
+		return []string{credit}
+	}
+	for _, part := range parts {
+		if !known(artistKey(part)) {
+			return []string{credit}
+		}
+	}
+	return parts
+}
+
+// splitCredit splits an artist tag into its main artists and the ones
+// it features
+func splitCredit(credit string, known func(string) bool) ([]string, []string) {
+	credit = strings.TrimSpace(credit)
+	if credit == "" {
+		return nil, nil
+	}
+	if known(artistKey(credit)) {
+		return []string{credit}, nil
+	}
+	featured := []string{}
+	m := featuredRe.FindStringSubmatchIndex(credit)
+	if m != nil && m[0] > 0 {
+		// featured artists are usually listed one by one
+		list := credit[m[2]:m[3]]
+		if known(artistKey(list)) {
+			featured = append(featured, list)
+		} else {
+			featured = splitNames(creditSepRe, list)
+		}
+		credit = strings.TrimSpace(credit[:m[0]])
+	}
+	return splitArtists(credit, known), featured
+}
+
+type artistCredit struct {
+	Name     string
+	Key      string
+	Role     ArtistRole
+	Position int
+}
+
+// trackCredits is everyone a track's tags credit, in the order they're
+// credited
+func trackCredits(tr *Track, known func(string) bool) []*artistCredit {
+	credits := []*artistCredit{}
+	seen := map[string]bool{}
+	positions := map[ArtistRole]int{}
+	add := func(name string, role ArtistRole) {
+		key := artistKey(name)
+		if key == "" || seen[string(role) + "\t" + key] {
+			return
+		}
+		seen[string(role) + "\t" + key] = true
+		credits = append(credits, &artistCredit{
+			Name: name,
+			Key: key,
+			Role: role,
+			Position: positions[role],
+		})
+		positions[role] += 1
+	}
+	if tr.Artist != nil {
+		main, featured := splitCredit(*tr.Artist, known)
+		for _, name := range main {
+			add(name, RoleArtist)
+		}
+		for _, name := range featured {
+			add(name, RoleFeatured)
+		}
+	}
+	if tr.AlbumArtist != nil {
+		main, featured := splitCredit(*tr.AlbumArtist, known)
+		for _, name := range main {
+			add(name, RoleAlbumArtist)
+		}
+		for _, name := range featured {
+			add(name, RoleFeatured)
+		}
+	}
+	if tr.Composer != nil {
+		for _, credit := range splitNames(composerSepRe, *tr.Composer) {
+			for _, name := range splitArtists(credit, known) {
+				add(name, RoleComposer)
+			}
+		}
+	}
+	return credits
+}
+
+func (db *DB) aliasArtist(tx *Tx, ownerId pid.PersistentID, key string) (*pid.PersistentID, error) {
+	qs := `SELECT artist_id FROM artist_alias WHERE owner_id = ? AND sort_name = ?`
+	var id pid.PersistentID
+	err := tx.QueryRow(qs, ownerId, key).Scan(&id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &id, nil
+}
+
+func (db *DB) insertAlias(tx *Tx, artistId, ownerId pid.PersistentID, name, key string) error {
+	qs := `INSERT INTO artist_alias (artist_id, owner_id, name, sort_name) VALUES (?, ?, ?, ?)`
+	_, err := tx.Exec(qs, artistId, ownerId, name, key)
+	return err
+}
+
+// newArtist makes an artist, and an alias for the name it's made with
+func (db *DB) newArtist(tx *Tx, ownerId pid.PersistentID, name, key string) (*Artist, error) {
+	now := Now()
+	artist := &Artist{
+		PersistentID: pid.NewPersistentID(),
+		OwnerID: ownerId,
+		Name: name,
+		SortName: key,
+		DateAdded: &now,
+		DateModified: &now,
+	}
+	err := db.insertStruct(tx, artist)
+	if err != nil {
+		return nil, err
+	}
+	err = db.insertAlias(tx, artist.PersistentID, ownerId, name, key)
+	if err != nil {
+		return nil, err
+	}
+	return artist, nil
+}
+
+// assignArtists links a track to each artist its tags credit, making
+// artists for names that aren't anyone's alias yet.  the track has to
+// be saved first.
+func (db *DB) assignArtists(tx *Tx, tr *Track) error {
+	var err error
+	ids := map[string]*pid.PersistentID{}
+	known := func(key string) bool {
+		id, ok := ids[key]
+		if !ok && err == nil {
+			id, err = db.aliasArtist(tx, tr.OwnerID, key)
+			ids[key] = id
+		}
+		return id != nil
+	}
+	credits := trackCredits(tr, known)
+	if err != nil {
+		return err
+	}
+	qs := `DELETE FROM track_artist WHERE track_id = ?`
+	_, err = tx.Exec(qs, tr.PersistentID)
+	if err != nil {
+		return err
+	}
+	main := []pid.PersistentID{}
+	for _, c := range credits {
+		if !known(c.Key) {
+			if err != nil {
+				return err
+			}
+			artist, err := db.newArtist(tx, tr.OwnerID, c.Name, c.Key)
+			if err != nil {
+				return err
+			}
+			ids[c.Key] = &artist.PersistentID
+		}
+		id := *ids[c.Key]
+		qs = `INSERT INTO track_artist (track_id, artist_id, role, position) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`
+		_, err = tx.Exec(qs, tr.PersistentID, id, c.Role, c.Position)
+		if err != nil {
+			return err
+		}
+		if c.Role == RoleArtist {
+			main = append(main, id)
+		}
+	}
+	// spotify's artist id is only for the main artist
+	if len(main) == 1 && tr.SpotifyArtistID != nil && *tr.SpotifyArtistID != "" {
+		qs = `UPDATE artist SET spotify_id = ? WHERE id = ? AND spotify_id IS NULL`
+		_, err = tx.Exec(qs, *tr.SpotifyArtistID, main[0])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type artistRow struct {
+	Artist
+	TrackCount int `db:"track_count"`
+}
+
+// queryArtists gets the artists and album artists of the tracks that
+// match a filter on the track table, in the order they're filed
+func (db *DB) queryArtists(filter string, args []interface{}) ([]*Artist, error) {
+	qs := `SELECT artist.*, t.track_count FROM artist JOIN (SELECT track_artist.artist_id, COUNT(DISTINCT track.id) AS track_count FROM track JOIN track_artist ON track_artist.track_id = track.id WHERE track_artist.role IN ('artist', 'album_artist')`
+	if filter != "" {
+		qs += ` AND (` + filter + `)`
+	}
+	qs += ` GROUP BY track_artist.artist_id) AS t ON t.artist_id = artist.id ORDER BY lower(COALESCE(artist.sort_as, artist.sort_name)), artist.sort_name`
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	artists := []*Artist{}
+	for rows.Next() {
+		row := &artistRow{}
+		err = rows.StructScan(row)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan artist")
+		}
+		artist := &row.Artist
+		artist.db = db
+		artist.Names = map[string]int{artist.Name: row.TrackCount}
+		artists = append(artists, artist)
+	}
+	return artists, nil
+}
+
+func (db *DB) GetArtist(id pid.PersistentID) (*Artist, error) {
+	qs := `SELECT * FROM artist WHERE id = ?`
+	artist := &Artist{}
+	err := db.QueryRow(qs, id).StructScan(artist)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	artist.db = db
+	qs = `SELECT COUNT(DISTINCT track_id) FROM track_artist WHERE artist_id = ?`
+	var n int
+	err = db.QueryRow(qs, id).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	artist.Names = map[string]int{artist.Name: n}
+	qs = `SELECT name FROM artist_alias WHERE artist_id = ? ORDER BY sort_name`
+	rows, err := db.Query(qs, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	artist.Aliases = []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan artist alias")
+		}
+		artist.Aliases = append(artist.Aliases, name)
+	}
+	return artist, nil
+}
+
+// resolveArtist is the id of the artist an artist from the old name
+// based index is an alias of, if there is one
+func (db *DB) resolveArtist(artist *Artist, ownerId *pid.PersistentID) (*pid.PersistentID, error) {
+	if artist.PersistentID != 0 {
+		return &artist.PersistentID, nil
+	}
+	if ownerId == nil {
+		return nil, nil
+	}
+	qs := `SELECT artist_id FROM artist_alias WHERE owner_id = ? AND sort_name = ?`
+	var id pid.PersistentID
+	err := db.QueryRow(qs, *ownerId, artist.SortName).Scan(&id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &id, nil
+}
+
+// SaveArtist saves changes to an artist and its aliases.  the artist's
+// name is always one of its aliases, and an alias can't belong to
+// another of the owner's artists.
+func (db *DB) SaveArtist(artist *Artist) error {
+	artist.Name = strings.TrimSpace(artist.Name)
+	if artist.Name == "" {
+		return errors.New("artist has no name")
+	}
+	if artist.SortAs != nil {
+		sortAs := strings.TrimSpace(*artist.SortAs)
+		if sortAs == "" {
+			artist.SortAs = nil
+		} else {
+			artist.SortAs = &sortAs
+		}
+	}
+	aliases := map[string]string{}
+	if artist.Aliases != nil {
+		for _, name := range artist.Aliases {
+			name = strings.TrimSpace(name)
+			key := artistKey(name)
+			if key != "" {
+				aliases[key] = name
+			}
+		}
+	}
+	artist.SortName = artistKey(artist.Name)
+	aliases[artist.SortName] = artist.Name
+	now := Now()
+	artist.DateModified = &now
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	current := map[string]bool{}
+	qs := `SELECT sort_name FROM artist_alias WHERE artist_id = ?`
+	rows, err := tx.Query(qs, artist.PersistentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return errors.Wrap(err, "can't scan artist alias")
+		}
+		current[key] = true
+	}
+	rows.Close()
+	for key, name := range aliases {
+		if current[key] {
+			qs = `UPDATE artist_alias SET name = ? WHERE artist_id = ? AND sort_name = ?`
+			_, err = tx.Exec(qs, name, artist.PersistentID, key)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			continue
+		}
+		id, err := db.aliasArtist(tx, artist.OwnerID, key)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if id != nil {
+			tx.Rollback()
+			return errors.Wrapf(ErrArtistAliasTaken, "%s", name)
+		}
+		err = db.insertAlias(tx, artist.PersistentID, artist.OwnerID, name, key)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if artist.Aliases != nil {
+		for key := range current {
+			if _, ok := aliases[key]; ok {
+				continue
+			}
+			qs = `DELETE FROM artist_alias WHERE artist_id = ? AND sort_name = ?`
+			_, err = tx.Exec(qs, artist.PersistentID, key)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	err = db.updateStruct(tx, artist)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// MergeArtists folds other artists into one: their aliases and track
+// credits move to it, and it takes any external ids, biography or image
+// it doesn't have of its own
+func (db *DB) MergeArtists(artist *Artist, others []*Artist) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if other.PersistentID == artist.PersistentID {
+			continue
+		}
+		if artist.MusicBrainzID == nil {
+			artist.MusicBrainzID = other.MusicBrainzID
+		}
+		if artist.SpotifyID == nil {
+			artist.SpotifyID = other.SpotifyID
+		}
+		if artist.Biography == nil {
+			artist.Biography = other.Biography
+		}
+		if artist.ImageURL == nil {
+			artist.ImageURL = other.ImageURL
+		}
+		qs := `UPDATE artist_alias SET artist_id = ? WHERE artist_id = ?`
+		_, err = tx.Exec(qs, artist.PersistentID, other.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		qs = `INSERT INTO track_artist (track_id, artist_id, role, position) SELECT track_id, ?, role, position FROM track_artist WHERE artist_id = ? ON CONFLICT DO NOTHING`
+		_, err = tx.Exec(qs, artist.PersistentID, other.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		qs = `DELETE FROM track_artist WHERE artist_id = ?`
+		_, err = tx.Exec(qs, other.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		qs = `DELETE FROM artist WHERE id = ?`
+		_, err = tx.Exec(qs, other.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	now := Now()
+	artist.DateModified = &now
+	err = db.updateStruct(tx, artist)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type creditRow struct {
+	ID              pid.PersistentID `db:"id"`
+	OwnerID         pid.PersistentID `db:"owner_id"`
+	Artist          *string          `db:"artist"`
+	AlbumArtist     *string          `db:"album_artist"`
+	Composer        *string          `db:"composer"`
+	SpotifyArtistID *string          `db:"spotify_artist_id"`
+}
+
+// linkArtists makes artists for everyone credited on the tracks in the
+// library, and links the tracks to them.  a name that's credited on its
+// own anywhere in the owner's library is known, so credits of several
+// known names are split into them.
+func (db *DB) linkArtists(tx *Tx) error {
+	qs := `SELECT id, owner_id, artist, album_artist, composer, spotify_artist_id FROM track WHERE id NOT IN (SELECT track_id FROM track_artist)`
+	rows, err := tx.Query(qs)
+	if err != nil {
+		return err
+	}
+	tracks := []*creditRow{}
+	for rows.Next() {
+		row := &creditRow{}
+		err = rows.StructScan(row)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "can't scan track credits")
+		}
+		tracks = append(tracks, row)
+	}
+	rows.Close()
+	artists := map[pid.PersistentID]map[string]pid.PersistentID{}
+	qs = `SELECT owner_id, sort_name, artist_id FROM artist_alias`
+	rows, err = tx.Query(qs)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ownerId, artistId pid.PersistentID
+		var key string
+		err = rows.Scan(&ownerId, &key, &artistId)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "can't scan artist alias")
+		}
+		if artists[ownerId] == nil {
+			artists[ownerId] = map[string]pid.PersistentID{}
+		}
+		artists[ownerId][key] = artistId
+	}
+	rows.Close()
+	standalone := map[pid.PersistentID]map[string]bool{}
+	for _, tr := range tracks {
+		if standalone[tr.OwnerID] == nil {
+			standalone[tr.OwnerID] = map[string]bool{}
+		}
+		names := []string{}
+		if tr.Artist != nil {
+			names = append(names, *tr.Artist)
+		}
+		if tr.AlbumArtist != nil {
+			names = append(names, *tr.AlbumArtist)
+		}
+		if tr.Composer != nil {
+			names = append(names, splitNames(composerSepRe, *tr.Composer)...)
+		}
+		for _, name := range names {
+			if !creditSepRe.MatchString(name) && !featuredRe.MatchString(name) {
+				standalone[tr.OwnerID][artistKey(name)] = true
+			}
+		}
+	}
+	spotify := map[pid.PersistentID]map[string]int{}
+	links := []interface{}{}
+	flush := func() error {
+		if len(links) == 0 {
+			return nil
+		}
+		n := len(links) / 4
+		qs := `INSERT INTO track_artist (track_id, artist_id, role, position) VALUES ` + strings.TrimSuffix(strings.Repeat(`(?, ?, ?, ?), `, n), `, `) + ` ON CONFLICT DO NOTHING`
+		_, err := tx.Exec(qs, links...)
+		links = []interface{}{}
+		return err
+	}
+	for _, tr := range tracks {
+		owned := artists[tr.OwnerID]
+		if owned == nil {
+			owned = map[string]pid.PersistentID{}
+			artists[tr.OwnerID] = owned
+		}
+		known := func(key string) bool {
+			return standalone[tr.OwnerID][key] || owned[key] != 0
+		}
+		credits := trackCredits(&Track{Artist: tr.Artist, AlbumArtist: tr.AlbumArtist, Composer: tr.Composer}, known)
+		main := []pid.PersistentID{}
+		for _, c := range credits {
+			id, ok := owned[c.Key]
+			if !ok {
+				artist, err := db.newArtist(tx, tr.OwnerID, c.Name, c.Key)
+				if err != nil {
+					return err
+				}
+				id = artist.PersistentID
+				owned[c.Key] = id
+			}
+			links = append(links, tr.ID, id, c.Role, c.Position)
+			if c.Role == RoleArtist {
+				main = append(main, id)
+			}
+		}
+		if len(links) >= 2000 {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+		if len(main) == 1 && tr.SpotifyArtistID != nil && *tr.SpotifyArtistID != "" {
+			if spotify[main[0]] == nil {
+				spotify[main[0]] = map[string]int{}
+			}
+			spotify[main[0]][*tr.SpotifyArtistID] += 1
+		}
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	for id, ids := range spotify {
+		qs = `UPDATE artist SET spotify_id = ? WHERE id = ? AND spotify_id IS NULL`
+		_, err = tx.Exec(qs, sortNames(ids)[0], id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillArtists makes artists for the tracks already in the library,
+// for the migration that adds them.  tracks saved since are linked to
+// artists as they're saved.
+func BackfillArtists(tx *sqlx.Tx) error {
+	db := &DB{}
+	return db.linkArtists(&Tx{tx: tx})
+}
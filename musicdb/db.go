@@ -69,10 +69,15 @@ type DB struct {
 	userChan chan *User
 }
 
-func Open(connstr string) (*DB, error) {
-	conn, err := sqlx.Connect("postgres", connstr)
+// Open connects to a database of the named type: postgres, or sqlite
+func Open(dbtype, connstr string) (*DB, error) {
+	d, err := GetDialect(dbtype)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't connect to postgres with " + connstr)
+		return nil, err
+	}
+	conn, err := Connect(d, connstr)
+	if err != nil {
+		return nil, err
 	}
 	return &DB{ conn: conn }, nil
 }
@@ -92,6 +97,7 @@ type Search struct {
 	Name *string
 	LooseName *string
 	Any *string
+	Terms []*SearchTerm
 	OwnerID *pid.PersistentID
 }
 
@@ -104,8 +110,8 @@ func searchSort(field, val string) (string, []interface{}) {
 func searchLoose(field, val string) (string, []interface{}) {
 	qs := fmt.Sprintf("(%s ILIKE ? OR sort_%s ILIKE ?)", field, field)
 	vals := []interface{}{
-		"%" + strings.TrimPrefix(strings.TrimSuffix(strings.ReplaceAll(val, "*", "%"), "%"), "%") + "%",
-		"%" + strings.TrimPrefix(strings.TrimSuffix(strings.ReplaceAll(MakeSort(val), "*", "%"), "%"), "%") + "%",
+		"%" + strings.ReplaceAll(likeEscape(strings.TrimPrefix(strings.TrimSuffix(val, "*"), "*")), "*", "%") + "%",
+		"%" + strings.ReplaceAll(likeEscape(strings.TrimPrefix(strings.TrimSuffix(MakeSort(val), "*"), "*")), "*", "%") + "%",
 	}
 	return qs, vals
 }
@@ -163,10 +169,10 @@ func searchFilters(s Search) (string, []interface{}) {
 		vals = append(vals, vs...)
 	}
 	if s.Any != nil {
-		qs := `to_tsvector(coalesce(name, '') || ' ' || coalesce(artist, '') || ' ' || coalesce(album_artist, '') || ' ' || coalesce(album, '') || ' ' || coalesce(composer, '')) @@ to_tsquery(?)`
+		qs := searchVectorMatch(TextPrefix)
 		filters = append(filters, qs)
-		words := strings.Fields(*s.Any)
-		vals = append(vals, strings.Join(words, " & "))
+		words := strings.Join(strings.Fields(*s.Any), " & ")
+		vals = append(vals, words, words)
 		/*
 		any := []string{}
 		for _, field := range []string{"artist", "album_artist", "composer", "album", "name"} {
@@ -177,6 +183,13 @@ func searchFilters(s Search) (string, []interface{}) {
 		filters = append(filters, "(" + strings.Join(any, " OR ") + ")")
 		*/
 	}
+	for _, term := range s.Terms {
+		qs, vs := term.where()
+		if qs != "" {
+			filters = append(filters, qs)
+			vals = append(vals, vs...)
+		}
+	}
 	if s.OwnerID != nil {
 		filters = append(filters, `owner_id = ?`)
 		vals = append(vals, *s.OwnerID)
@@ -204,7 +217,13 @@ func (db *DB) SearchTracks(s Search, limit int, offset int) ([]*Track, error) {
 	if len(filters) == 0 {
 		return nil, errors.New("no search params")
 	}
-	qs := `SELECT track.*, xuser.homedir FROM track, xuser WHERE track.owner_id = xuser.id AND ` + filters + ` ORDER BY COALESCE(rating, 1) * COALESCE(play_count, 1) / EXTRACT(EPOCH FROM AGE(COALESCE(track.date_added, '1970-01-01 00:00:00Z'))) DESC, sort_album_artist, sort_album, disc_number, track_number, sort_name`;
+	order := ""
+	rank, rankVals := searchRank(s.Terms)
+	if rank != "" {
+		order = rank + ` DESC, `
+		vals = append(vals, rankVals...)
+	}
+	qs := `SELECT track.*, xuser.homedir FROM track, xuser WHERE track.owner_id = xuser.id AND ` + filters + ` ORDER BY ` + order + `COALESCE(rating, 1) * COALESCE(play_count, 1) / ` + dialect.Age(`COALESCE(track.date_added, '1970-01-01 00:00:00Z')`) + ` DESC, sort_album_artist, sort_album, disc_number, track_number, sort_name`;
 	if limit > 0 {
 		qs += ` LIMIT ?`
 		vals = append(vals, limit)
@@ -279,9 +298,9 @@ func (db *DB) RecentPlaylists(user *User, since Time) ([]*Playlist, error) {
 	qs := `SELECT * FROM playlist WHERE (folder IS NULL OR folder = ?) AND date_added >= ?`
 	args := []interface{}{false, since}
 	if user == nil {
-		qs += ` AND shared = 't'`
+		qs += ` AND shared = true`
 	} else {
-		qs += ` AND (shared = 't' OR owner_id = ?)`
+		qs += ` AND (shared = true OR owner_id = ?)`
 		args = append(args, user.PersistentID)
 	}
 	qs += ` ORDER BY date_added DESC`
@@ -399,9 +418,9 @@ func (db *DB) GetPlaylist(p pid.PersistentID, user *User) (*Playlist, error) {
 	qs := `SELECT * FROM playlist WHERE id = ?`
 	args := []interface{}{p}
 	if user == nil {
-		qs += ` AND shared = 't'`
+		qs += ` AND shared = true`
 	} else {
-		qs += ` AND (owner_id = ? OR shared = 't')`
+		qs += ` AND (owner_id = ? OR shared = true)`
 		args = append(args, user.PersistentID)
 	}
 	//log.Println("GetPlaylist:", qs, args)
@@ -422,10 +441,10 @@ func (db *DB) GetPlaylistTree(root *pid.PersistentID, user *User) ([]*Playlist,
 	args := []interface{}{}
 	var me pid.PersistentID
 	if user == nil {
-		qs += ` WHERE shared = 't'`
+		qs += ` WHERE shared = true`
 		me = pid.PersistentID(0)
 	} else {
-		qs += ` WHERE owner_id = ? OR shared = 't'`
+		qs += ` WHERE owner_id = ? OR shared = true`
 		args = append(args, user.PersistentID)
 		me = user.PersistentID
 	}
@@ -756,50 +775,7 @@ func (db *DB) Artists(ownerId *pid.PersistentID) ([]*Artist, error) {
 }
 
 func (db *DB) searchArtists(filter string, args []interface{}) ([]*Artist, error) {
-	qs := `SELECT (CASE album_artist WHEN NULL THEN artist ELSE album_artist END) AS art, (CASE album_artist WHEN NULL THEN sort_artist ELSE sort_album_artist END) AS sart, COUNT(*) FROM track`
-	if filter != "" {
-		qs += ` WHERE `+ filter
-	}
-	qs += ` GROUP BY art, sart ORDER BY sart`
-	rows, err := db.Query(qs, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	amap := map[string]*Artist{}
-	keys := []string{}
-	for rows.Next() {
-		var a, sa *string
-		var c int
-		err = rows.Scan(&a, &sa, &c)
-		if err != nil {
-			return nil, errors.Wrap(err, "can't scan artist info")
-		}
-		if a == nil || *a == "" {
-			continue
-		}
-		if sa == nil {
-			sa = stringp(MakeSortArtist(*a))
-			if sa == nil {
-				continue
-			}
-		}
-		artist, ok := amap[*sa]
-		if ok {
-			artist.Names[*a] = c
-		} else {
-			amap[*sa] = &Artist{
-				SortName: *sa,
-				Names: map[string]int{*a: c},
-			}
-			keys = append(keys, *sa)
-		}
-	}
-	artists := make([]*Artist, len(keys))
-	for i, key := range keys {
-		artists[i] = amap[key]
-	}
-	return artists, nil
+	return db.queryArtists(filter, args)
 }
 
 func (db *DB) GenreArtists(genre *Genre, ownerId *pid.PersistentID) ([]*Artist, error) {
@@ -817,93 +793,24 @@ func (db *DB) GenreArtists(genre *Genre, ownerId *pid.PersistentID) ([]*Artist,
 }
 
 func (db *DB) searchAlbums(filter string, args []interface{}) ([]*Album, error) {
-	qs := `SELECT album_artist, sort_album_artist, artist, sort_artist, album, sort_album, COUNT(*) FROM track WHERE album IS NOT NULL`
-	if filter != "" {
-		qs += ` AND (` + filter + `)`
-	}
-	qs += ` GROUP BY album_artist, sort_album_artist, artist, sort_artist, album, sort_album ORDER BY sort_album`
-	rows, err := db.Query(qs, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	artmap := map[string]*Artist{}
-	albmap := map[string]*Album{}
-	keys := []string{}
-	for rows.Next() {
-		var aart, saart, art, sart, alb, salb *string
-		var key string
-		var c int
-		err = rows.Scan(&aart, &saart, &art, &sart, &alb, &salb, &c)
-		if err != nil {
-			return nil, errors.Wrap(err, "can't scan album info")
-		}
-		if alb == nil || *alb == "" {
-			continue
-		}
-		if salb == nil {
-			salb = stringp(MakeSort(*alb))
-			if salb == nil {
-				continue
-			}
-		}
-		var artist *Artist
-		var ok bool
-		if aart != nil && saart != nil {
-			artist, ok = artmap[*saart]
-			if ok {
-				artist.Names[*aart] += c
-			} else {
-				artist = &Artist{
-					SortName: *saart,
-					Names: map[string]int{*aart: c},
-					db: db,
-				}
-				artmap[*saart] = artist
-			}
-			key = *saart + " || " + *salb
-		} else if art != nil && sart != nil {
-			artist, ok = artmap[*sart]
-			if ok {
-				artist.Names[*art] += c
-			} else {
-				artist = &Artist{
-					SortName: *sart,
-					Names: map[string]int{*art: c},
-					db: db,
-				}
-				artmap[*sart] = artist
-			}
-			key = *sart + " || " + *salb
-		} else {
-			key = "~~~ || " + *salb
-		}
-		album, ok := albmap[key]
-		if ok {
-			album.Names[*alb] += c
-		} else {
-			albmap[key] = &Album{
-				Artist: artist,
-				SortName: *salb,
-				Names: map[string]int{*alb: c},
-			}
-			keys = append(keys, key)
-		}
-	}
-	sort.Strings(keys)
-	albums := make([]*Album, len(keys))
-	for i, key := range keys {
-		albums[i] = albmap[key]
-	}
-	return albums, nil
+	return db.queryAlbums(filter, args)
 }
 
 func (db *DB) GetAlbums(artist *Artist, genre *Genre, ownerId *pid.PersistentID) ([]*Album, error) {
 	filters := []string{}
 	args := []interface{}{}
 	if artist != nil {
-		filters = append(filters,  "(sort_artist = ? OR sort_album_artist = ?)")// OR sort_composer = ?)")
-		args = append(args, artist.SortName, artist.SortName)//, artist.SortName)
+		artistId, err := db.resolveArtist(artist, ownerId)
+		if err != nil {
+			return nil, err
+		}
+		if artistId != nil {
+			filters = append(filters, "id IN (SELECT track_id FROM track_artist WHERE artist_id = ? AND role IN ('artist', 'album_artist'))")
+			args = append(args, *artistId)
+		} else {
+			filters = append(filters,  "(sort_artist = ? OR sort_album_artist = ?)")// OR sort_composer = ?)")
+			args = append(args, artist.SortName, artist.SortName)//, artist.SortName)
+		}
 	}
 	if genre != nil {
 		filters = append(filters, "sort_genre = ?")
@@ -930,11 +837,18 @@ func (db *DB) GenreAlbums(genre *Genre, ownerId *pid.PersistentID) ([]*Album, er
 }
 
 func (db *DB) AlbumTracks(album *Album, ownerId *pid.PersistentID) ([]*Track, error) {
-	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE sort_album = ?`
-	args := []interface{}{album.SortName}
-	if album.Artist != nil {
-		qs += ` AND ((sort_album_artist IS NULL AND sort_artist = ?) OR sort_album_artist = ?)`
-		args = append(args, album.Artist.SortName, album.Artist.SortName)
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE `
+	args := []interface{}{}
+	if album.PersistentID != 0 {
+		qs += `track.album_id = ?`
+		args = append(args, album.PersistentID)
+	} else {
+		qs += `sort_album = ?`
+		args = append(args, album.SortName)
+		if album.Artist != nil {
+			qs += ` AND ((sort_album_artist IS NULL AND sort_artist = ?) OR sort_album_artist = ?)`
+			args = append(args, album.Artist.SortName, album.Artist.SortName)
+		}
 	}
 	if ownerId != nil {
 		qs += ` AND track.owner_id = ?`
@@ -959,11 +873,22 @@ func (db *DB) AlbumTracks(album *Album, ownerId *pid.PersistentID) ([]*Track, er
 }
 
 func (db *DB) ArtistTracks(artist *Artist, ownerId *pid.PersistentID) ([]*Track, error) {
-	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE (sort_artist = ? OR sort_album_artist = ? OR sort_composer = ?)`
-	args := []interface{}{
-		artist.SortName,
-		artist.SortName,
-		artist.SortName,
+	artistId, err := db.resolveArtist(artist, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	var qs string
+	var args []interface{}
+	if artistId != nil {
+		qs = `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.id IN (SELECT track_id FROM track_artist WHERE artist_id = ?)`
+		args = []interface{}{*artistId}
+	} else {
+		qs = `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE (sort_artist = ? OR sort_album_artist = ? OR sort_composer = ?)`
+		args = []interface{}{
+			artist.SortName,
+			artist.SortName,
+			artist.SortName,
+		}
 	}
 	if ownerId != nil {
 		qs += ` AND track.owner_id = ?`
@@ -1134,7 +1059,7 @@ func (st sortableTracksByName) Less(i, j int) bool {
 }
 
 func (db *DB) UpdateFolderTracks() error {
-	qs := "SELECT * FROM playlist WHERE folder = 't'"
+	qs := "SELECT * FROM playlist WHERE folder = true"
 	rows, err := db.Query(qs)
 	if err != nil {
 		return err
@@ -1206,9 +1131,251 @@ func (db *DB) UpdateSmartTracks() error {
 	return nil
 }
 
+func idPlaceholders(ids []pid.PersistentID) (string, []interface{}) {
+	qms := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		qms[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(qms, ", "), args
+}
+
+func (db *DB) smartAffected(pl *Playlist, trackIds []pid.PersistentID, deleted bool, affected map[pid.PersistentID]bool) (bool, error) {
+	for _, rule := range db.playlistRules(pl.Smart.RuleSet) {
+		plid := rule.playlistID()
+		if plid != nil && affected[*plid] {
+			return true, nil
+		}
+	}
+	if pl.Smart.Limit != nil && deleted {
+		// a deleted track may have freed up room for another track
+		return true, nil
+	}
+	if len(trackIds) == 0 {
+		return false, nil
+	}
+	qms, idargs := idPlaceholders(trackIds)
+	qs, args := db.smartQuery(pl.Smart)
+	qs = `SELECT DISTINCT track.id FROM (` + qs + `) AS track WHERE track.id IN (` + qms + `)`
+	args = append(args, idargs...)
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return false, err
+	}
+	matches := map[pid.PersistentID]bool{}
+	for rows.Next() {
+		var id pid.PersistentID
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		matches[id] = true
+	}
+	rows.Close()
+	qs = `SELECT DISTINCT track_id FROM playlist_track WHERE playlist_id = ? AND track_id IN (` + qms + `)`
+	rows, err = db.Query(qs, append([]interface{}{pl.PersistentID}, idargs...)...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	members := map[pid.PersistentID]bool{}
+	for rows.Next() {
+		var id pid.PersistentID
+		err = rows.Scan(&id)
+		if err != nil {
+			return false, err
+		}
+		members[id] = true
+	}
+	if pl.Smart.Limit != nil && (len(matches) > 0 || len(members) > 0) {
+		// sort order may have changed
+		return true, nil
+	}
+	for _, id := range trackIds {
+		if matches[id] != members[id] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateSmartTracksFor refreshes only the live smart playlists whose
+// contents could change as a result of changes to the given tracks
+func (db *DB) UpdateSmartTracksFor(trackIds []pid.PersistentID, deleted bool) ([]*Playlist, error) {
+	qs := "SELECT * FROM playlist WHERE smart IS NOT NULL"
+	rows, err := db.Query(qs)
+	if err != nil {
+		return nil, err
+	}
+	pls := []*Playlist{}
+	for rows.Next() {
+		var pl Playlist
+		err = rows.StructScan(&pl)
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "can't scan row into playlist")
+		}
+		if pl.Smart == nil || !pl.Smart.LiveUpdating {
+			continue
+		}
+		pl.db = db
+		pls = append(pls, &pl)
+	}
+	rows.Close()
+	parents, err := db.playlistParents()
+	if err != nil {
+		return nil, err
+	}
+	// playlists that depend on other playlists go after them, so that
+	// they see the updated contents of the playlists they depend on
+	pls = db.sortSmartPlaylists(pls, parents)
+	affected := map[pid.PersistentID]bool{}
+	updated := []*Playlist{}
+	for _, pl := range pls {
+		ok, err := db.smartAffected(pl, trackIds, deleted, affected)
+		if err != nil {
+			return updated, err
+		}
+		if !ok {
+			continue
+		}
+		// so are the folders it's in, for rules about a folder
+		id, hasParent := pl.PersistentID, true
+		for hasParent && !affected[id] {
+			affected[id] = true
+			id, hasParent = parents[id]
+		}
+		tracks, err := db.SmartTracks(pl.Smart)
+		if err != nil {
+			return updated, err
+		}
+		log.Printf("%6d tracks in smart playlist %s %s", len(tracks), pl.PersistentID.String(), pl.Name)
+		ids := make([]pid.PersistentID, len(tracks))
+		for i, track := range tracks {
+			ids[i] = track.PersistentID
+		}
+		pl.TrackIDs = ids
+		err = db.SavePlaylistTracks(pl)
+		if err != nil {
+			return updated, err
+		}
+		updated = append(updated, pl)
+	}
+	return updated, nil
+}
+
+// playlistParents maps each playlist in a folder to its folder
+func (db *DB) playlistParents() (map[pid.PersistentID]pid.PersistentID, error) {
+	qs := `SELECT id, parent_id FROM playlist WHERE parent_id IS NOT NULL`
+	rows, err := db.Query(qs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	parents := map[pid.PersistentID]pid.PersistentID{}
+	for rows.Next() {
+		var id, parentId pid.PersistentID
+		err = rows.Scan(&id, &parentId)
+		if err != nil {
+			return nil, err
+		}
+		parents[id] = parentId
+	}
+	return parents, nil
+}
+
+// sortSmartPlaylists orders smart playlists so that each one comes
+// after the ones its playlist rules read, directly or through a folder
+// they're in.  rules that read each other in a cycle can't be put in
+// order, so the cycle is broken wherever it's found.
+func (db *DB) sortSmartPlaylists(pls []*Playlist, parents map[pid.PersistentID]pid.PersistentID) []*Playlist {
+	// the smart playlists in each playlist or folder
+	within := map[pid.PersistentID][]*Playlist{}
+	for _, pl := range pls {
+		id, hasParent := pl.PersistentID, true
+		seen := map[pid.PersistentID]bool{}
+		for hasParent && !seen[id] {
+			seen[id] = true
+			within[id] = append(within[id], pl)
+			id, hasParent = parents[id]
+		}
+	}
+	const (
+		visiting = 1
+		visited = 2
+	)
+	state := map[pid.PersistentID]int{}
+	sorted := make([]*Playlist, 0, len(pls))
+	var visit func(pl *Playlist)
+	visit = func(pl *Playlist) {
+		switch state[pl.PersistentID] {
+		case visiting:
+			log.Printf("smart playlist rules form a cycle at %s %s", pl.PersistentID.String(), pl.Name)
+			return
+		case visited:
+			return
+		}
+		state[pl.PersistentID] = visiting
+		for _, rule := range db.playlistRules(pl.Smart.RuleSet) {
+			plid := rule.playlistID()
+			if plid == nil {
+				continue
+			}
+			for _, dep := range within[*plid] {
+				if dep != pl {
+					visit(dep)
+				}
+			}
+		}
+		state[pl.PersistentID] = visited
+		sorted = append(sorted, pl)
+	}
+	for _, pl := range pls {
+		visit(pl)
+	}
+	return sorted
+}
+
+// UpdateParentFolderTracks refreshes the folders containing the given
+// playlists
+func (db *DB) UpdateParentFolderTracks(pls []*Playlist) error {
+	seen := map[pid.PersistentID]bool{}
+	for _, pl := range pls {
+		parentId := pl.ParentPersistentID
+		for parentId != nil && !seen[*parentId] {
+			seen[*parentId] = true
+			folder, err := db.GetPlaylist(*parentId, &User{PersistentID: pl.OwnerID})
+			if err != nil {
+				return err
+			}
+			if folder == nil || !folder.Folder {
+				break
+			}
+			tracks, err := db.FolderTracks(folder)
+			if err != nil {
+				return err
+			}
+			sort.Sort(sortableTracksByName(tracks))
+			ids := make([]pid.PersistentID, len(tracks))
+			for i, track := range tracks {
+				ids[i] = track.PersistentID
+			}
+			folder.TrackIDs = ids
+			err = db.SavePlaylistTracks(folder)
+			if err != nil {
+				return err
+			}
+			parentId = folder.ParentPersistentID
+		}
+	}
+	return nil
+}
+
 func (db *DB) hasPlaylistRule(rs *RuleSet) bool {
 	for _, rule := range rs.Rules {
-		if rule.RuleType == PlaylistRule {
+		if rule.IsPlaylistRule() {
 			return true
 		}
 		if rule.RuleType == RulesetRule && db.hasPlaylistRule(rule.RuleSet) {
@@ -1221,7 +1388,7 @@ func (db *DB) hasPlaylistRule(rs *RuleSet) bool {
 func (db *DB) playlistRules(rs *RuleSet) []*Rule {
 	rules := []*Rule{}
 	for _, rule := range rs.Rules {
-		if rule.RuleType == PlaylistRule {
+		if rule.IsPlaylistRule() {
 			rules = append(rules, rule)
 		} else if rule.RuleType == RulesetRule {
 			rules = append(rules, db.playlistRules(rule.RuleSet)...)
@@ -1230,50 +1397,21 @@ func (db *DB) playlistRules(rs *RuleSet) []*Rule {
 	return rules
 }
 
-const queryKeys = "abcdefghijklmnopqrstuvwxyz"
-func queryKey(i int) string {
-	l := len(queryKeys)
-	if i >= l {
-		j := i / l
-		if j >= l {
-			return ""
-		}
-		k := i % l
-		return queryKeys[j:j+1] + queryKeys[k:k+1]
+func (db *DB) smartQuery(spl *Smart) (string, []interface{}) {
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id`
+	where, args := spl.RuleSet.Where()
+	if where == "" {
+		qs += ` WHERE track.location IS NOT NULL`
+	} else {
+		qs += ` WHERE track.location IS NOT NULL AND (` + where + ")"
 	}
-	return queryKeys[i:i+1]
+	return qs, args
 }
 
 func (db *DB) SmartTracks(spl *Smart) ([]*Track, error) {
-	maxs := int64(math.MaxInt64)
-	maxt := int64(math.MaxInt64)
-	var qs string
-	xargs := []interface{}{}
-	if db.hasPlaylistRule(spl.RuleSet) {
-		qs = `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id`
-		for i, rule := range db.playlistRules(spl.RuleSet) {
-			key := queryKey(i)
-			rule.playlistKey = key
-			qs += ` LEFT OUTER JOIN playlist_track pt` + key + ` ON track.id = pt` + key + `.track_id`
-			if rule.PlaylistValue != nil {
-				qs += ` AND pt` + key + `.playlist_id = ?`
-				xargs = append(xargs, rule.PlaylistValue)
-			}
-		}
-	} else {
-		qs = `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id`
-	}
-	where, args := spl.RuleSet.Where()
-	qs += ` WHERE track.location IS NOT NULL AND (` + where + ")"
-	args = append(xargs, args...)
+	qs, args := db.smartQuery(spl)
 	if spl.Limit != nil {
 		qs += spl.Limit.Order()
-		if spl.Limit.MaxSize != nil {
-			maxs = int64(*spl.Limit.MaxSize)
-		}
-		if spl.Limit.MaxTime != nil {
-			maxt = int64(*spl.Limit.MaxTime)
-		}
 	}
 	seen := map[pid.PersistentID]bool{}
 	//log.Println("SmartTracks:", qs, args)
@@ -1284,9 +1422,7 @@ func (db *DB) SmartTracks(spl *Smart) ([]*Track, error) {
 	}
 	defer rows.Close()
 	tracks := []*Track{}
-	i := 0
 	for rows.Next() {
-		i += 1
 		var track Track
 		err = rows.StructScan(&track)
 		if err != nil {
@@ -1296,25 +1432,11 @@ func (db *DB) SmartTracks(spl *Smart) ([]*Track, error) {
 			continue
 		}
 		seen[track.PersistentID] = true
-		if track.Size != nil {
-			maxs -= int64(*track.Size)
-		}
-		if track.TotalTime != nil {
-			maxt -= int64(*track.TotalTime)
-		}
-		if maxs < 0 || maxt < 0 {
-			break
-		}
 		track.db = db
 		tracks = append(tracks, &track)
-		/*
-		if i % 100 == 0 {
-			log.Printf("%d tracks...", i)
-		}
-		*/
 	}
 	//log.Printf("%d tracks", len(tracks))
-	return tracks, nil
+	return spl.Limit.Apply(tracks), nil
 }
 
 type IDable interface {
@@ -1468,11 +1590,21 @@ func (db *DB) SaveTrack(track *Track) error {
 		return err
 	}
 	db.extractTrackArtwork(tx, track)
+	err = db.assignAlbum(tx, track)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	err = db.saveStruct(tx, track)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
+	err = db.assignArtists(tx, track)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1489,16 +1621,33 @@ func (db *DB) SaveTracks(tracks []*Track) error {
 	}
 	for _, track := range tracks {
 		db.extractTrackArtwork(tx, track)
+		err = db.assignAlbum(tx, track)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 		err = db.saveStruct(tx, track)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
+		err = db.assignArtists(tx, track)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	return tx.Commit()
 }
 
 func (db *DB) SavePlaylist(playlist *Playlist) error {
+	return db.savePlaylist(playlist, &playlist.OwnerID, nil)
+}
+
+// savePlaylist saves a playlist as a new revision by a user.  given a
+// base revision, the save only goes through if the playlist is still at
+// it.
+func (db *DB) savePlaylist(playlist *Playlist, userId *pid.PersistentID, base *int) error {
 	err := playlist.Validate()
 	if err != nil {
 		return err
@@ -1540,13 +1689,18 @@ func (db *DB) SavePlaylist(playlist *Playlist) error {
 			return ParentNotAFolder
 		}
 	}
-	if playlist.TrackIDs != nil && len(playlist.TrackIDs) > 0 {
+	if playlist.TrackIDs != nil {
 		err = db.savePlaylistTracksWithTx(playlist, tx)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
 	}
+	err = db.recordPlaylistRevision(tx, playlist, userId, base)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1583,6 +1737,15 @@ func (db *DB) SavePlaylistTracks(playlist *Playlist) error {
 		tx.Rollback()
 		return err
 	}
+	// the tracks of smart playlists and folders are kept up to date
+	// automatically, so those aren't revisions
+	if !playlist.Folder && playlist.Smart == nil {
+		err = db.recordPlaylistRevision(tx, playlist, &playlist.OwnerID, nil)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	return tx.Commit()
 }
 
@@ -1655,17 +1818,36 @@ func (db *DB) DeleteTracksFromPlaylistAt(playlist *Playlist, refs []PlaylistTrac
 	return db.SavePlaylistTracks(playlist)
 }
 
-func (db *DB) DeleteTrack(tr *Track) error {
+// DeleteTrack moves a track to the trash, and its file to the trash
+// folder
+func (db *DB) DeleteTrack(tr *Track, user *User) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	err = db.deleteTrackId(tx, tr.PersistentID)
+	mv, err := db.trashTrack(tx, tr.PersistentID, user, TrashedByUser, true)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	return tx.Commit()
+	if mv != nil {
+		err = moveFile(mv.From, mv.To, false)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		if mv != nil {
+			moveFile(mv.To, mv.From, false)
+		}
+		return err
+	}
+	if mv != nil {
+		pruneDirs(filepath.Dir(mv.From), mv.Root)
+	}
+	return nil
 }
 
 func (db *DB) deleteTrackId(tx *Tx, id pid.PersistentID) error {
@@ -1674,46 +1856,48 @@ func (db *DB) deleteTrackId(tx *Tx, id pid.PersistentID) error {
 	if err != nil {
 		return err
 	}
-	qs = `DELETE FROM track WHERE id = ?`;
-	_, err = tx.Exec(qs, id)
-	return err
-}
-
-func (db *DB) DeletePlaylist(pl *Playlist) error {
-	tx, err := db.Begin()
+	err = db.deleteFingerprint(tx, id)
 	if err != nil {
 		return err
 	}
-	err = db.deletePlaylistId(tx, pl.PersistentID)
+	err = db.deleteHistory(tx, id)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	return tx.Commit()
-}
-
-func (db *DB) deletePlaylistId(tx *Tx, id pid.PersistentID) error {
-	qs := `DELETE FROM playlist_track WHERE playlist_id = ?`
-	_, err := tx.Exec(qs, id)
+	qs = `DELETE FROM track_artist WHERE track_id = ?`
+	_, err = tx.Exec(qs, id)
 	if err != nil {
 		return err
 	}
-	qs = `DELETE FROM playlist WHERE id = ?`
+	var albumId *pid.PersistentID
+	qs = `SELECT album_id FROM track WHERE id = ?`
+	err = tx.QueryRow(qs, id).Scan(&albumId)
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		return err
+	}
+	qs = `DELETE FROM track WHERE id = ?`;
 	_, err = tx.Exec(qs, id)
 	if err != nil {
 		return err
 	}
-	qs = `SELECT COUNT(*) FROM playlist WHERE parent_id = ?`
-	row := tx.QueryRow(qs, id)
-	var c int
-	err = row.Scan(&c)
+	if albumId != nil {
+		return db.pruneAlbum(tx, *albumId, id)
+	}
+	return nil
+}
+
+// DeletePlaylist moves a playlist to the trash
+func (db *DB) DeletePlaylist(pl *Playlist, user *User) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	if c != 0 {
-		return PlaylistFolderNotEmpty
+	err = db.trashPlaylist(tx, pl.PersistentID, user, TrashedByUser)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
 func (db *DB) UpdateITunesTrack(tr *loader.Track, user *User) (bool, error) {
@@ -1736,12 +1920,22 @@ func (db *DB) UpdateITunesTrack(tr *loader.Track, user *User) (bool, error) {
 			if err != nil {
 				return true, err
 			}
+			err = db.assignAlbum(tx, track)
+			if err != nil {
+				tx.Rollback()
+				return true, err
+			}
 			err = db.insertStruct(tx, track)
 			if err != nil {
 				log.Printf("difficulty with track %s", track.PersistentID.String())
 				tx.Rollback()
 				return true, err
 			}
+			err = db.assignArtists(tx, track)
+			if err != nil {
+				tx.Rollback()
+				return true, err
+			}
 			qs = `INSERT INTO itunes_track (id, data, mod_date, owner_id) VALUES(?, ?, ?, ?)`
 			_, err = tx.Exec(qs, id, serializeGob(tr), time.Now().In(time.UTC), user.PersistentID)
 			if err != nil {
@@ -1786,12 +1980,22 @@ func (db *DB) UpdateITunesTrack(tr *loader.Track, user *User) (bool, error) {
 	if err != nil {
 		return true, err
 	}
+	err = db.assignAlbum(tx, track)
+	if err != nil {
+		tx.Rollback()
+		return true, err
+	}
 	err = db.updateStruct(tx, track)
 	if err != nil {
 		log.Printf("difficulty with track %s", track.PersistentID.String())
 		tx.Rollback()
 		return true, err
 	}
+	err = db.assignArtists(tx, track)
+	if err != nil {
+		tx.Rollback()
+		return true, err
+	}
 	qs = `UPDATE itunes_track SET data = ?, mod_date = ? WHERE id = ? AND owner_id = ?`
 	_, err = tx.Exec(qs, mydata, time.Now().In(time.UTC), id, user.PersistentID)
 	if err != nil {
@@ -1837,6 +2041,11 @@ func (db *DB) UpdateITunesPlaylist(pl *loader.Playlist, user *User) (bool, error
 				tx.Rollback()
 				return true, err
 			}
+			err = db.recordPlaylistRevision(tx, playlist, &user.PersistentID, nil)
+			if err != nil {
+				tx.Rollback()
+				return true, err
+			}
 			qs = `INSERT INTO itunes_playlist (id, data, mod_date, owner_id) VALUES(?, ?, ?, ?)`
 			_, err = tx.Exec(qs, id, serializeGob(pl), time.Now().In(time.UTC), user.PersistentID)
 			if err != nil {
@@ -1895,6 +2104,11 @@ func (db *DB) UpdateITunesPlaylist(pl *loader.Playlist, user *User) (bool, error
 		tx.Rollback()
 		return true, err
 	}
+	err = db.recordPlaylistRevision(tx, playlist, &user.PersistentID, nil)
+	if err != nil {
+		tx.Rollback()
+		return true, err
+	}
 	qs = `UPDATE itunes_playlist SET data = ?, mod_date = ? WHERE id = ? AND owner_id = ?`
 	_, err = tx.Exec(qs, mydata, time.Now().In(time.UTC), id, user.PersistentID)
 	if err != nil {
@@ -1950,12 +2164,12 @@ func (db *DB) DeleteITunesTracks(ids map[string]bool, user *User) error {
 			continue
 		}
 		log.Println("deleting itunes track", id)
-		_, err = tx.Exec(qs, id, user.PersistentID)
+		_, err = db.trashTrack(tx, *pid, user, TrashedByITunes, false)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		err = db.deleteTrackId(tx, *pid)
+		_, err = tx.Exec(qs, id, user.PersistentID)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -1978,12 +2192,12 @@ func (db *DB) DeleteITunesPlaylists(ids map[string]bool, user *User) error {
 			continue
 		}
 		log.Println("deleting itunes playlist", id)
-		_, err = tx.Exec(qs, id, user.PersistentID)
+		err = db.trashPlaylist(tx, *pid, user, TrashedByITunes)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		err = db.deletePlaylistId(tx, *pid)
+		_, err = tx.Exec(qs, id, user.PersistentID)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -2038,6 +2252,18 @@ func (db *DB) FindTrack(tr *Track) {
 	err := row.StructScan(&xtr)
 	if err == nil {
 		*tr = xtr
+		return
+	}
+	// the tags don't match anything, but if we have the file we can
+	// listen to it
+	if tr.Location != nil {
+		fn := tr.Path()
+		if _, err := os.Stat(fn); err == nil {
+			ftr, err := db.FindTrackByAudio(fn, nil)
+			if err == nil && ftr != nil {
+				*tr = *ftr
+			}
+		}
 	}
 }
 
@@ -2061,7 +2287,7 @@ func (db *DB) saveTrackArtwork(tx *Tx, tr *Track, ext string, data []byte) (stri
 	dn := filepath.Dir(*tr.Location)
 	qs := `SELECT COUNT(*) FROM track WHERE location LIKE ?`
 	args := []interface{}{
-		filepath.Join(dn, "%"),
+		filepath.Join(likeEscape(dn), "%"),
 	}
 	if tr.Album == nil {
 		qs += ` AND (album IS NOT NULL`
@@ -2204,7 +2430,7 @@ func (db *DB) GetSocialUser(driver, id, username string) (auth.AuthUser, error)
 }
 
 func (db *DB) ListUsers() ([]*User, error) {
-	query := `SELECT id, username, first_name, last_name, avatar, homedir FROM xuser WHERE active = 't' ORDER BY last_name, first_name`
+	query := `SELECT id, username, first_name, last_name, avatar, homedir FROM xuser WHERE active = true ORDER BY last_name, first_name`
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -2262,7 +2488,7 @@ func (db *DB) FindSpotifyTrack(st *spotify.Track) (*Track, error) {
 func (db *DB) MixArtistTracks(artist string, ownerId *pid.PersistentID, minRating int, n int) ([]*Track, error) {
 	query := `SELECT * FROM track WHERE (LOWER(artist) LIKE ? OR SIMILARITY(artist, ?) > 0.6)`
 	args := []interface{}{
-		"%" + strings.ToLower(artist) + "%",
+		"%" + likeEscape(strings.ToLower(artist)) + "%",
 		artist,
 	}
 	if minRating > 0 {
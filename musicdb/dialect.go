@@ -0,0 +1,151 @@
+package musicdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// TextQuery is how the words of a full text query are taken
+type TextQuery string
+
+const (
+	// words ending in :* joined by &, as made by tsWords
+	TextPrefix = TextQuery("prefix")
+	// plain words, all of which have to match
+	TextPlain = TextQuery("plain")
+	// words that have to match in order
+	TextPhrase = TextQuery("phrase")
+	// words, "quoted phrases", -excluded words and or, like a search engine
+	TextWeb = TextQuery("web")
+)
+
+// Dialect is the flavor of SQL spoken by the database the library is
+// kept in.  queries are written for postgres, and a dialect rewrites
+// what it does differently, or gives the SQL for things that can't
+// just be rewritten.
+type Dialect interface {
+	Name() string
+	DriverName() string
+	// Rewrite fixes up a query written for postgres
+	Rewrite(qs string) string
+	// Age is the number of seconds since a time
+	Age(expr string) string
+	// Ago is the time some number of units before now
+	Ago(n int64, unit Unit) string
+	// TimeBucket is the hour of the day a time is in, or the start of
+	// its day, week or month, in a time zone
+	TimeBucket(expr, interval, tz string) (string, []interface{})
+	// TextMatch matches a full text index against a query parameter
+	TextMatch(index string, q TextQuery) string
+	// TextRank scores how well a full text index matches a query
+	// parameter
+	TextRank(index string, q TextQuery) string
+	// TextEmpty is true for a query parameter with nothing in it to
+	// look for
+	TextEmpty(q TextQuery) string
+	// TextConcat joins two full text indexes, the second of which may be
+	// null
+	TextConcat(a, b string) string
+}
+
+var dialects = map[string]Dialect{}
+
+func registerDialect(d Dialect) {
+	dialects[d.Name()] = d
+}
+
+// GetDialect finds a dialect by name.  no name is postgres.
+func GetDialect(name string) (Dialect, error) {
+	if name == "" {
+		name = "postgres"
+	}
+	d, ok := dialects[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.Errorf("unknown database type %s", name)
+	}
+	return d, nil
+}
+
+// DriverDialect is the dialect of a database/sql driver, or postgres if
+// it's not one we know
+func DriverDialect(driverName string) Dialect {
+	for _, d := range dialects {
+		if d.DriverName() == driverName {
+			return d
+		}
+	}
+	return dialects["postgres"]
+}
+
+// the dialect queries are rewritten for
+var dialect Dialect = postgresDialect{}
+
+// Connect opens a database, and makes its dialect the one queries are
+// rewritten for
+func Connect(d Dialect, dsn string) (*sqlx.DB, error) {
+	conn, err := sqlx.Connect(d.DriverName(), dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't connect to %s with %s", d.Name(), dsn)
+	}
+	dialect = d
+	return conn, nil
+}
+
+type postgresDialect struct{}
+
+func init() {
+	registerDialect(postgresDialect{})
+}
+
+func (d postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (d postgresDialect) DriverName() string {
+	return "postgres"
+}
+
+func (d postgresDialect) Rewrite(qs string) string {
+	return qs
+}
+
+func (d postgresDialect) Age(expr string) string {
+	return `EXTRACT(EPOCH FROM AGE(` + expr + `))`
+}
+
+func (d postgresDialect) Ago(n int64, unit Unit) string {
+	return fmt.Sprintf("NOW() - interval '%d %s'", n, unit)
+}
+
+func (d postgresDialect) TimeBucket(expr, interval, tz string) (string, []interface{}) {
+	if interval == "hour" {
+		return `EXTRACT(hour FROM ` + expr + ` AT TIME ZONE ?)`, []interface{}{tz}
+	}
+	return `date_trunc('` + interval + `', ` + expr + ` AT TIME ZONE ?) AT TIME ZONE ?`, []interface{}{tz, tz}
+}
+
+var postgresTextQueries = map[TextQuery]string{
+	TextPrefix: `to_tsquery('english', ?)`,
+	TextPlain:  `plainto_tsquery('english', ?)`,
+	TextPhrase: `phraseto_tsquery('english', ?)`,
+	TextWeb:    `websearch_to_tsquery('english', ?)`,
+}
+
+func (d postgresDialect) TextMatch(index string, q TextQuery) string {
+	return index + ` @@ ` + postgresTextQueries[q]
+}
+
+func (d postgresDialect) TextRank(index string, q TextQuery) string {
+	return `ts_rank(` + index + `, ` + postgresTextQueries[q] + `)`
+}
+
+func (d postgresDialect) TextEmpty(q TextQuery) string {
+	return `numnode(` + postgresTextQueries[q] + `) = 0`
+}
+
+func (d postgresDialect) TextConcat(a, b string) string {
+	return a + ` || coalesce(` + b + `, ''::tsvector)`
+}
@@ -0,0 +1,532 @@
+package musicdb
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// tracks whose durations differ by more than this aren't considered the
+// same recording, even if the names match
+const duplicateTimeSlop = 3000
+
+var ErrNotDuplicates = errors.New("tracks can't be merged")
+
+type DuplicateGroup struct {
+	Reasons []string `json:"reasons"`
+	Tracks  []*Track `json:"tracks"`
+}
+
+// duplicateSets is a union-find over track ids, so that tracks matched
+// by different criteria end up in a single group
+type duplicateSets struct {
+	parent map[pid.PersistentID]pid.PersistentID
+	reasons map[pid.PersistentID]map[string]bool
+}
+
+func (ds *duplicateSets) find(id pid.PersistentID) pid.PersistentID {
+	p, ok := ds.parent[id]
+	if !ok || p == id {
+		return id
+	}
+	root := ds.find(p)
+	ds.parent[id] = root
+	return root
+}
+
+func (ds *duplicateSets) union(tracks []*Track, reason string) {
+	if len(tracks) < 2 {
+		return
+	}
+	root := ds.find(tracks[0].PersistentID)
+	ds.parent[root] = root
+	if ds.reasons[root] == nil {
+		ds.reasons[root] = map[string]bool{}
+	}
+	for _, tr := range tracks[1:] {
+		other := ds.find(tr.PersistentID)
+		if other != root {
+			ds.parent[other] = root
+			for r := range ds.reasons[other] {
+				ds.reasons[root][r] = true
+			}
+			delete(ds.reasons, other)
+		}
+	}
+	ds.reasons[root][reason] = true
+}
+
+func duplicateKey(tr *Track) string {
+	var artist, album, name string
+	if tr.Artist != nil {
+		artist = MakeSortArtist(*tr.Artist)
+	}
+	if tr.Album != nil {
+		album = MakeSort(*tr.Album)
+	}
+	if tr.Name != nil {
+		name = MakeSort(*tr.Name)
+	}
+	if name == "" {
+		return ""
+	}
+	return strings.Join([]string{artist, album, name}, "\x00")
+}
+
+// splitByDuration breaks a set of same-named tracks into runs whose
+// lengths are close to one another
+func splitByDuration(tracks []*Track) [][]*Track {
+	dur := func(tr *Track) uint {
+		if tr.TotalTime == nil {
+			return 0
+		}
+		return *tr.TotalTime
+	}
+	sort.Slice(tracks, func(i, j int) bool { return dur(tracks[i]) < dur(tracks[j]) })
+	runs := [][]*Track{}
+	run := []*Track{tracks[0]}
+	for _, tr := range tracks[1:] {
+		if dur(tr) - dur(run[len(run) - 1]) > duplicateTimeSlop {
+			runs = append(runs, run)
+			run = []*Track{}
+		}
+		run = append(run, tr)
+	}
+	return append(runs, run)
+}
+
+func fileHash(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindDuplicates groups a user's tracks that are likely the same
+// recording: matching normalized artist, album and name with similar
+// durations, matching acoustic fingerprints, or files with identical
+// contents.  only files of equal size are hashed, so this doesn't read
+// the whole library.
+func (db *DB) FindDuplicates(user *User) ([]*DuplicateGroup, error) {
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.owner_id = ?`
+	rows, err := db.Query(qs, user.PersistentID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query tracks")
+	}
+	defer rows.Close()
+	tracks := map[pid.PersistentID]*Track{}
+	byKey := map[string][]*Track{}
+	bySize := map[int64][]*Track{}
+	for rows.Next() {
+		tr := &Track{}
+		err = rows.StructScan(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan track")
+		}
+		tr.db = db
+		tracks[tr.PersistentID] = tr
+		key := duplicateKey(tr)
+		if key != "" {
+			byKey[key] = append(byKey[key], tr)
+		}
+		if tr.Location != nil {
+			st, err := os.Stat(tr.Path())
+			if err == nil && st.Size() > 0 {
+				bySize[st.Size()] = append(bySize[st.Size()], tr)
+			}
+		}
+	}
+	ds := &duplicateSets{
+		parent: map[pid.PersistentID]pid.PersistentID{},
+		reasons: map[pid.PersistentID]map[string]bool{},
+	}
+	for _, group := range byKey {
+		if len(group) < 2 {
+			continue
+		}
+		for _, run := range splitByDuration(group) {
+			ds.union(run, "metadata")
+		}
+	}
+	for _, group := range bySize {
+		if len(group) < 2 {
+			continue
+		}
+		byHash := map[string][]*Track{}
+		for _, tr := range group {
+			h, err := fileHash(tr.Path())
+			if err == nil {
+				byHash[h] = append(byHash[h], tr)
+			}
+		}
+		for _, same := range byHash {
+			ds.union(same, "file_hash")
+		}
+	}
+	pairs, err := db.fingerprintPairs(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		a, aok := tracks[pair[0]]
+		b, bok := tracks[pair[1]]
+		if aok && bok {
+			ds.union([]*Track{a, b}, "fingerprint")
+		}
+	}
+	members := map[pid.PersistentID][]*Track{}
+	for id, tr := range tracks {
+		if _, ok := ds.parent[id]; !ok {
+			continue
+		}
+		root := ds.find(id)
+		members[root] = append(members[root], tr)
+	}
+	groups := []*DuplicateGroup{}
+	for root, trs := range members {
+		if len(trs) < 2 {
+			continue
+		}
+		sort.Slice(trs, func(i, j int) bool { return BetterDuplicate(trs[i], trs[j]) })
+		group := &DuplicateGroup{Reasons: []string{}, Tracks: trs}
+		for r := range ds.reasons[root] {
+			group.Reasons = append(group.Reasons, r)
+		}
+		sort.Strings(group.Reasons)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Tracks[0].GetSortName() < groups[j].Tracks[0].GetSortName()
+	})
+	return groups, nil
+}
+
+// BetterDuplicate orders duplicates by which file is worth keeping
+func BetterDuplicate(a, b *Track) bool {
+	var abr, bbr uint
+	if a.BitRate != nil {
+		abr = *a.BitRate
+	}
+	if b.BitRate != nil {
+		bbr = *b.BitRate
+	}
+	if abr != bbr {
+		return abr > bbr
+	}
+	var ar, br uint8
+	if a.Rating != nil {
+		ar = *a.Rating
+	}
+	if b.Rating != nil {
+		br = *b.Rating
+	}
+	if ar != br {
+		return ar > br
+	}
+	if a.PlayCount != b.PlayCount {
+		return a.PlayCount > b.PlayCount
+	}
+	return a.PersistentID < b.PersistentID
+}
+
+func laterTime(a, b *Time) *Time {
+	if a == nil || (b != nil && *b > *a) {
+		return b
+	}
+	return a
+}
+
+func earlierTime(a, b *Time) *Time {
+	if a == nil || (b != nil && *b < *a) {
+		return b
+	}
+	return a
+}
+
+// mergeInto folds the play history and ratings of dup into survivor,
+// and fills in anything the survivor is missing
+func mergeInto(survivor, dup *Track) {
+	survivor.PlayCount += dup.PlayCount
+	survivor.SkipCount += dup.SkipCount
+	survivor.PlayDate = laterTime(survivor.PlayDate, dup.PlayDate)
+	survivor.SkipDate = laterTime(survivor.SkipDate, dup.SkipDate)
+	survivor.DateAdded = earlierTime(survivor.DateAdded, dup.DateAdded)
+	if dup.Rating != nil && (survivor.Rating == nil || *dup.Rating > *survivor.Rating) {
+		survivor.Rating = dup.Rating
+	}
+	if dup.AlbumRating != nil && (survivor.AlbumRating == nil || *dup.AlbumRating > *survivor.AlbumRating) {
+		survivor.AlbumRating = dup.AlbumRating
+	}
+	if dup.Loved != nil && *dup.Loved {
+		survivor.Loved = dup.Loved
+	}
+	if survivor.LyricsID == nil {
+		survivor.LyricsID = dup.LyricsID
+	}
+	if survivor.JookiID == nil {
+		survivor.JookiID = dup.JookiID
+	}
+	if survivor.SpotifyTrackID == nil {
+		survivor.SpotifyTrackID = dup.SpotifyTrackID
+		survivor.SpotifyAlbumID = dup.SpotifyAlbumID
+		survivor.SpotifyArtistID = dup.SpotifyArtistID
+		survivor.SpotifyAlbumArtistID = dup.SpotifyAlbumArtistID
+	}
+}
+
+// takeFile points survivor at dup's file, for when dup has the better
+// copy of the audio
+func takeFile(survivor, dup *Track) {
+	survivor.Location = dup.Location
+	survivor.Size = dup.Size
+	survivor.BitRate = dup.BitRate
+	survivor.SampleRate = dup.SampleRate
+	survivor.TotalTime = dup.TotalTime
+	survivor.FileType = dup.FileType
+	survivor.Kind = dup.Kind
+	survivor.TrackGain = dup.TrackGain
+	survivor.TrackPeak = dup.TrackPeak
+	survivor.AlbumGain = dup.AlbumGain
+	survivor.AlbumPeak = dup.AlbumPeak
+	survivor.Homedir = dup.Homedir
+}
+
+// MergeDuplicates merges tracks into a single surviving track, which
+// keeps its id so that anything referring to it stays valid.  play and
+// skip counts are summed, the best rating is kept, the highest bitrate
+// file is kept, and playlists that contained any of the duplicates are
+// rewritten to contain the survivor instead.  the duplicates go to the
+// trash, along with the files the survivor doesn't keep.
+func (db *DB) MergeDuplicates(survivorId pid.PersistentID, ids []pid.PersistentID, user *User) (*Track, error) {
+	survivor, err := db.GetTrack(survivorId)
+	if err != nil {
+		return nil, err
+	}
+	if survivor == nil {
+		return nil, errors.Wrapf(ErrNotDuplicates, "track %s does not exist", survivorId)
+	}
+	dups := []*Track{}
+	dupIds := []pid.PersistentID{}
+	for _, id := range ids {
+		if id == survivorId {
+			continue
+		}
+		tr, err := db.GetTrack(id)
+		if err != nil {
+			return nil, err
+		}
+		if tr == nil {
+			return nil, errors.Wrapf(ErrNotDuplicates, "track %s does not exist", id)
+		}
+		if tr.OwnerID != survivor.OwnerID {
+			return nil, errors.Wrap(ErrNotDuplicates, "tracks belong to different users")
+		}
+		dups = append(dups, tr)
+		dupIds = append(dupIds, id)
+	}
+	if len(dups) == 0 {
+		return survivor, nil
+	}
+	var fileFrom *Track
+	for _, dup := range dups {
+		mergeInto(survivor, dup)
+		best := survivor
+		if fileFrom != nil {
+			best = fileFrom
+		}
+		if dup.Location != nil && (survivor.Location == nil || betterBitRate(dup, best)) {
+			fileFrom = dup
+		}
+	}
+	oldLocation := survivor.Location
+	if fileFrom != nil {
+		takeFile(survivor, fileFrom)
+	}
+	now := Now()
+	survivor.DateModified = &now
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var userId *pid.PersistentID
+	if user != nil {
+		userId = &user.PersistentID
+	}
+	err = db.rewritePlaylistTracks(tx, survivor.PersistentID, dupIds, userId)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if fileFrom != nil {
+		err = db.swapScanFile(tx, survivor.PersistentID, fileFrom.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = db.moveFingerprint(tx, fileFrom.PersistentID, survivor.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		// the duplicate goes to the trash with the survivor's old file,
+		// to match the scan records
+		qs := `UPDATE track SET location = ? WHERE id = ?`
+		_, err = tx.Exec(qs, oldLocation, fileFrom.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	for _, id := range dupIds {
+		err = db.moveHistory(tx, id, survivor.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = db.updateStruct(tx, survivor)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	mvs := []*FileMove{}
+	for _, id := range dupIds {
+		mv, err := db.trashTrack(tx, id, user, TrashedByUser, true)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if mv != nil {
+			mvs = append(mvs, mv)
+		}
+	}
+	for i, mv := range mvs {
+		err = moveFile(mv.From, mv.To, false)
+		if err != nil {
+			for _, done := range mvs[:i] {
+				moveFile(done.To, done.From, false)
+			}
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		for _, mv := range mvs {
+			moveFile(mv.To, mv.From, false)
+		}
+		return nil, err
+	}
+	for _, mv := range mvs {
+		pruneDirs(filepath.Dir(mv.From), mv.Root)
+	}
+	return survivor, nil
+}
+
+func betterBitRate(a, b *Track) bool {
+	if a.BitRate == nil {
+		return false
+	}
+	return b.BitRate == nil || *a.BitRate > *b.BitRate
+}
+
+// swapScanFile exchanges the scan records of two tracks when the
+// survivor of a merge takes over a duplicate's file.  the survivor's old
+// file keeps a record under the deleted duplicate's id, which tells the
+// scanner not to add it back to the library.
+func (db *DB) swapScanFile(tx *Tx, survivorId, dupId pid.PersistentID) error {
+	qs := `UPDATE scan_file SET track_id = 0 WHERE track_id = ?`
+	_, err := tx.Exec(qs, survivorId)
+	if err != nil {
+		return err
+	}
+	qs = `UPDATE scan_file SET track_id = ? WHERE track_id = ?`
+	_, err = tx.Exec(qs, survivorId, dupId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(qs, dupId, 0)
+	return err
+}
+
+// rewritePlaylistTracks replaces duplicates with the survivor in every
+// playlist.  playlists are saved as a new revision by the user, so the
+// merge can be undone there like any other edit.  smart playlists and
+// folders have no revisions, so their tracks are just switched over.
+func (db *DB) rewritePlaylistTracks(tx *Tx, survivorId pid.PersistentID, dupIds []pid.PersistentID, userId *pid.PersistentID) error {
+	isDup := map[pid.PersistentID]bool{}
+	for _, id := range dupIds {
+		isDup[id] = true
+	}
+	qms, args := idPlaceholders(dupIds)
+	qs := `SELECT * FROM playlist WHERE id IN (SELECT playlist_id FROM playlist_track WHERE track_id IN (` + qms + `))`
+	rows, err := tx.Query(qs, args...)
+	if err != nil {
+		return err
+	}
+	pls := []*Playlist{}
+	for rows.Next() {
+		pl := &Playlist{}
+		err = rows.StructScan(pl)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pls = append(pls, pl)
+	}
+	rows.Close()
+	for _, pl := range pls {
+		if pl.Folder || pl.Smart != nil {
+			continue
+		}
+		qs = `SELECT track_id FROM playlist_track WHERE playlist_id = ? ORDER BY position`
+		rows, err = tx.Query(qs, pl.PersistentID)
+		if err != nil {
+			return err
+		}
+		pl.TrackIDs = []pid.PersistentID{}
+		for rows.Next() {
+			var id pid.PersistentID
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if isDup[id] {
+				id = survivorId
+			}
+			pl.TrackIDs = append(pl.TrackIDs, id)
+		}
+		rows.Close()
+		err = db.savePlaylistTracksWithTx(pl, tx)
+		if err != nil {
+			return err
+		}
+		err = db.recordPlaylistRevision(tx, pl, userId, nil)
+		if err != nil {
+			return err
+		}
+	}
+	qs = `UPDATE playlist_track SET track_id = ? WHERE track_id IN (` + qms + `)`
+	_, err = tx.Exec(qs, append([]interface{}{survivorId}, args...)...)
+	if err != nil {
+		return err
+	}
+	qs = `UPDATE playlist SET genius_track_id = ? WHERE genius_track_id IN (` + qms + `)`
+	_, err = tx.Exec(qs, append([]interface{}{survivorId}, args...)...)
+	return err
+}
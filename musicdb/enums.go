@@ -397,6 +397,11 @@ const (
 	Hours   = Unit(4)
 	MB      = Unit(2)
 	GB      = Unit(5)
+	// for relative dates
+	Seconds = Unit(16)
+	Days    = Unit(17)
+	Weeks   = Unit(18)
+	Months  = Unit(19)
 )
 
 var unitNames = map[Unit]string{
@@ -405,6 +410,10 @@ var unitNames = map[Unit]string{
 	Hours:   "hours",
 	MB:      "MB",
 	GB:      "GB",
+	Seconds: "seconds",
+	Days:    "days",
+	Weeks:   "weeks",
+	Months:  "months",
 }
 
 var unitValues = map[string]Unit{
@@ -413,6 +422,10 @@ var unitValues = map[string]Unit{
 	"hours":   Hours,
 	"MB":      MB,
 	"GB":      GB,
+	"seconds": Seconds,
+	"days":    Days,
+	"weeks":   Weeks,
+	"months":  Months,
 }
 
 func (u Unit) String() string {
@@ -851,7 +864,7 @@ var fieldColumns = map[Field]string{
 	BPM:                  "track.bpm",
 	BitRate:              "track.bitrate",
 	Compilation:          "track.compilation",
-	DiskNumber:           "track.disk_number",
+	DiskNumber:           "track.disc_number",
 	PlayCount:            "track.play_count",
 	Rating:               "track.rating",
 	SampleRate:           "track.sample_rate",
@@ -188,3 +188,17 @@ func (ff *FileFinder) GetMediaFolder() string {
 	return ""
 }
 
+
+func (ff *FileFinder) UserMediaFolder(homedir *string) string {
+	if homedir == nil || *homedir == "" {
+		return ""
+	}
+	for _, f := range ff.MediaFolder {
+		dn := filepath.Join(*homedir, f)
+		st, err := os.Stat(dn)
+		if err == nil && st.IsDir() {
+			return dn
+		}
+	}
+	return ""
+}
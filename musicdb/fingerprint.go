@@ -0,0 +1,289 @@
+package musicdb
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/fingerprint"
+)
+
+// fingerprints scoring at least this well are taken to be the same
+// recording.  unrelated music scores around 0.5, but noise and silence
+// can score surprisingly well against each other.
+const FingerprintMatchThreshold = 0.85
+
+// how far apart, in fingerprint frames (about 1/8 second each), two
+// recordings of the same thing may start
+const fingerprintMaxOffset = 80
+
+// a candidate needs this many lookup keys in common before its
+// fingerprint is worth comparing
+const fingerprintMinHits = 2
+
+type FingerprintMatch struct {
+	Track *Track  `json:"track"`
+	Score float64 `json:"score"`
+}
+
+// GetFingerprint returns the stored fingerprint of a track, or nil if it
+// hasn't been fingerprinted or couldn't be
+func (db *DB) GetFingerprint(trackId pid.PersistentID) (*fingerprint.Fingerprint, error) {
+	qs := `SELECT fingerprint FROM track_fingerprint WHERE track_id = ?`
+	row := db.QueryRow(qs, trackId)
+	var s string
+	err := row.Scan(&s)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if s == "" {
+		return nil, nil
+	}
+	return fingerprint.Decode(s)
+}
+
+// SaveFingerprint stores a track's fingerprint and its lookup keys.  a
+// nil fingerprint records that the track's file can't be fingerprinted,
+// so it isn't tried again until the file changes.
+func (db *DB) SaveFingerprint(trackId pid.PersistentID, fp *fingerprint.Fingerprint) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = db.deleteFingerprint(tx, trackId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	s := ""
+	if fp != nil {
+		s = fp.Encode()
+	}
+	qs := `INSERT INTO track_fingerprint (track_id, fingerprint, date_added) VALUES(?, ?, ?)`
+	_, err = tx.Exec(qs, trackId, s, Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if fp != nil {
+		qs = `INSERT INTO fingerprint_hash (hash, track_id) VALUES(?, ?)`
+		for _, h := range fp.Hashes() {
+			_, err = tx.Exec(qs, int32(h), trackId)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// FingerprintTrack computes and stores the fingerprint of a track's file
+func (db *DB) FingerprintTrack(tr *Track) (*fingerprint.Fingerprint, error) {
+	fp, err := fingerprint.Calculate(tr.Path())
+	if err != nil {
+		serr := db.SaveFingerprint(tr.PersistentID, nil)
+		if serr != nil {
+			return nil, serr
+		}
+		return nil, err
+	}
+	return fp, db.SaveFingerprint(tr.PersistentID, fp)
+}
+
+func (db *DB) deleteFingerprint(tx *Tx, trackId pid.PersistentID) error {
+	qs := `DELETE FROM fingerprint_hash WHERE track_id = ?`
+	_, err := tx.Exec(qs, trackId)
+	if err != nil {
+		return err
+	}
+	qs = `DELETE FROM track_fingerprint WHERE track_id = ?`
+	_, err = tx.Exec(qs, trackId)
+	return err
+}
+
+// moveFingerprint gives one track the fingerprint of another, for when
+// it takes over the other's file
+func (db *DB) moveFingerprint(tx *Tx, fromId, toId pid.PersistentID) error {
+	err := db.deleteFingerprint(tx, toId)
+	if err != nil {
+		return err
+	}
+	qs := `UPDATE fingerprint_hash SET track_id = ? WHERE track_id = ?`
+	_, err = tx.Exec(qs, toId, fromId)
+	if err != nil {
+		return err
+	}
+	qs = `UPDATE track_fingerprint SET track_id = ? WHERE track_id = ?`
+	_, err = tx.Exec(qs, toId, fromId)
+	return err
+}
+
+// TracksWithoutFingerprint lists tracks with files that haven't been
+// fingerprinted yet
+func (db *DB) TracksWithoutFingerprint(user *User, limit int) ([]*Track, error) {
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id LEFT OUTER JOIN track_fingerprint ON track.id = track_fingerprint.track_id WHERE track.owner_id = ? AND track.location IS NOT NULL AND track_fingerprint.track_id IS NULL LIMIT ?`
+	rows, err := db.Query(qs, user.PersistentID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query tracks")
+	}
+	defer rows.Close()
+	tracks := []*Track{}
+	for rows.Next() {
+		tr := &Track{}
+		err = rows.StructScan(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan track")
+		}
+		tr.db = db
+		tracks = append(tracks, tr)
+	}
+	return tracks, nil
+}
+
+// FindTracksByFingerprint looks up tracks that sound like the given
+// fingerprint, best match first.  if user is nil, every library is
+// searched.
+func (db *DB) FindTracksByFingerprint(fp *fingerprint.Fingerprint, user *User) ([]*FingerprintMatch, error) {
+	hashes := fp.Hashes()
+	if len(hashes) == 0 {
+		return []*FingerprintMatch{}, nil
+	}
+	qms := make([]string, len(hashes))
+	args := make([]interface{}, len(hashes))
+	for i, h := range hashes {
+		qms[i] = "?"
+		args[i] = int32(h)
+	}
+	qs := `SELECT fingerprint_hash.track_id, COUNT(*) AS hits FROM fingerprint_hash`
+	if user != nil {
+		qs += ` JOIN track ON fingerprint_hash.track_id = track.id`
+	}
+	qs += ` WHERE hash IN (` + strings.Join(qms, ", ") + `)`
+	if user != nil {
+		qs += ` AND track.owner_id = ?`
+		args = append(args, user.PersistentID)
+	}
+	qs += ` GROUP BY fingerprint_hash.track_id HAVING COUNT(*) >= ? ORDER BY hits DESC LIMIT 20`
+	args = append(args, fingerprintMinHits)
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query fingerprints")
+	}
+	ids := []pid.PersistentID{}
+	for rows.Next() {
+		var id pid.PersistentID
+		var hits int
+		err = rows.Scan(&id, &hits)
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "can't scan fingerprint")
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	matches := []*FingerprintMatch{}
+	for _, id := range ids {
+		score, err := db.compareFingerprint(fp, id)
+		if err != nil {
+			return nil, err
+		}
+		if score < FingerprintMatchThreshold {
+			continue
+		}
+		tr, err := db.GetTrack(id)
+		if err != nil {
+			return nil, err
+		}
+		if tr != nil {
+			matches = append(matches, &FingerprintMatch{Track: tr, Score: score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches, nil
+}
+
+func (db *DB) compareFingerprint(fp *fingerprint.Fingerprint, trackId pid.PersistentID) (float64, error) {
+	other, err := db.GetFingerprint(trackId)
+	if err != nil {
+		return 0, err
+	}
+	if other == nil {
+		return 0, nil
+	}
+	return fingerprint.Compare(fp, other, fingerprintMaxOffset), nil
+}
+
+// FindTrackByAudio fingerprints a file and returns the best matching
+// track in the library, if any
+func (db *DB) FindTrackByAudio(fn string, user *User) (*Track, error) {
+	fp, err := fingerprint.Calculate(fn)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := db.FindTracksByFingerprint(fp, user)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return matches[0].Track, nil
+}
+
+// fingerprintPairs finds pairs of a user's tracks that sound alike, for
+// duplicate detection
+func (db *DB) fingerprintPairs(user *User) ([][2]pid.PersistentID, error) {
+	qs := `SELECT a.track_id, b.track_id FROM fingerprint_hash a JOIN fingerprint_hash b ON a.hash = b.hash AND a.track_id < b.track_id JOIN track ta ON a.track_id = ta.id JOIN track tb ON b.track_id = tb.id WHERE ta.owner_id = ? AND tb.owner_id = ? GROUP BY a.track_id, b.track_id HAVING COUNT(*) >= ?`
+	rows, err := db.Query(qs, user.PersistentID, user.PersistentID, fingerprintMinHits)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query fingerprints")
+	}
+	candidates := [][2]pid.PersistentID{}
+	for rows.Next() {
+		var pair [2]pid.PersistentID
+		err = rows.Scan(&pair[0], &pair[1])
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "can't scan fingerprint")
+		}
+		candidates = append(candidates, pair)
+	}
+	rows.Close()
+	fps := map[pid.PersistentID]*fingerprint.Fingerprint{}
+	get := func(id pid.PersistentID) (*fingerprint.Fingerprint, error) {
+		fp, ok := fps[id]
+		if ok {
+			return fp, nil
+		}
+		fp, err := db.GetFingerprint(id)
+		if err != nil {
+			return nil, err
+		}
+		fps[id] = fp
+		return fp, nil
+	}
+	pairs := [][2]pid.PersistentID{}
+	for _, pair := range candidates {
+		a, err := get(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := get(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || b == nil {
+			continue
+		}
+		if fingerprint.Compare(a, b, fingerprintMaxOffset) >= FingerprintMatchThreshold {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs, nil
+}
@@ -0,0 +1,267 @@
+package musicdb
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// PlaySource says what a track was played through
+type PlaySource string
+
+const (
+	SourceUnknown  = PlaySource("")
+	SourceWeb      = PlaySource("web")
+	SourceSonos    = PlaySource("sonos")
+	SourceRadio    = PlaySource("radio")
+	SourceJooki    = PlaySource("jooki")
+	SourceDLNA     = PlaySource("dlna")
+	SourceSubsonic = PlaySource("subsonic")
+)
+
+var playSources = map[PlaySource]bool{
+	SourceWeb: true,
+	SourceSonos: true,
+	SourceRadio: true,
+	SourceJooki: true,
+	SourceDLNA: true,
+	SourceSubsonic: true,
+}
+
+// ParsePlaySource turns a client supplied source into a PlaySource,
+// giving SourceUnknown for anything we don't recognize
+func ParsePlaySource(s string) PlaySource {
+	src := PlaySource(strings.ToLower(s))
+	if playSources[src] {
+		return src
+	}
+	return SourceUnknown
+}
+
+// PlayEvent is a single listen.  the track's play and skip counts are
+// kept as running totals of these, on top of whatever was imported
+// from itunes.
+type PlayEvent struct {
+	PersistentID pid.PersistentID  `json:"persistent_id" db:"id"`
+	UserID       *pid.PersistentID `json:"user_id,omitempty" db:"user_id"`
+	TrackID      pid.PersistentID  `json:"track_id" db:"track_id"`
+	PlayDate     Time              `json:"play_date" db:"play_date"`
+	// milliseconds listened, when the client tells us
+	Duration     *uint             `json:"duration,omitempty" db:"duration"`
+	Source       PlaySource        `json:"source" db:"source"`
+	Skipped      bool              `json:"skipped" db:"skipped"`
+}
+
+func NewPlayEvent(user *User, tr *Track, src PlaySource) *PlayEvent {
+	ev := &PlayEvent{
+		TrackID: tr.PersistentID,
+		PlayDate: Now(),
+		Source: src,
+	}
+	if user != nil {
+		id := user.PersistentID
+		ev.UserID = &id
+	}
+	return ev
+}
+
+func (db *DB) insertPlayEvent(tx *Tx, ev *PlayEvent) error {
+	if ev.PersistentID == 0 {
+		ev.PersistentID = pid.NewPersistentID()
+	}
+	qs := `INSERT INTO play_event (id, user_id, track_id, play_date, duration, source, skipped) VALUES(?, ?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(qs, ev.PersistentID, ev.UserID, ev.TrackID, ev.PlayDate, ev.Duration, ev.Source, ev.Skipped)
+	return err
+}
+
+// RecordPlay adds a play to the history and bumps the track's play
+// count and date to match
+func (db *DB) RecordPlay(tr *Track, ev *PlayEvent) error {
+	ev.TrackID = tr.PersistentID
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = db.insertPlayEvent(tx, ev)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	qs := `UPDATE track SET play_count = COALESCE(play_count, 0) + 1, play_date = GREATEST(play_date, ?) WHERE id = ?`
+	_, err = tx.Exec(qs, ev.PlayDate, tr.PersistentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	tr.PlayCount += 1
+	if tr.PlayDate == nil || *tr.PlayDate < ev.PlayDate {
+		t := ev.PlayDate
+		tr.PlayDate = &t
+	}
+	return nil
+}
+
+// RecordStreamedPlay is RecordPlay for a track being fetched by a
+// player, which can happen several times in one listen as it seeks or
+// fetches the track again.  if the user has a play of the track within
+// the length of the track, this is the same play, and isn't recorded.
+func (db *DB) RecordStreamedPlay(tr *Track, ev *PlayEvent) (bool, error) {
+	window := time.Hour
+	if tr.TotalTime != nil && *tr.TotalTime > 0 {
+		window = time.Duration(*tr.TotalTime) * time.Millisecond
+	}
+	since := FromTime(ev.PlayDate.Time().Add(-window))
+	qs := `SELECT COUNT(*) FROM play_event WHERE track_id = ? AND user_id IS NOT DISTINCT FROM ? AND play_date >= ?`
+	var n int
+	err := db.QueryRow(qs, tr.PersistentID, ev.UserID, since).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return false, nil
+	}
+	return true, db.RecordPlay(tr, ev)
+}
+
+// RecordSkip marks the user's current play of a track as skipped.  the
+// play was already recorded when the track started streaming, so we
+// look for it within the length of the track, and only add a new event
+// if there isn't one.
+func (db *DB) RecordSkip(tr *Track, ev *PlayEvent) error {
+	ev.TrackID = tr.PersistentID
+	ev.Skipped = true
+	window := time.Hour
+	if tr.TotalTime != nil && *tr.TotalTime > 0 {
+		window = time.Duration(*tr.TotalTime) * time.Millisecond + time.Minute
+	}
+	since := FromTime(ev.PlayDate.Time().Add(-window))
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	qs := `SELECT id, play_date, source FROM play_event WHERE track_id = ? AND user_id IS NOT DISTINCT FROM ? AND skipped = false AND play_date >= ? ORDER BY play_date DESC LIMIT 1`
+	var id pid.PersistentID
+	var playDate Time
+	var src PlaySource
+	err = tx.QueryRow(qs, tr.PersistentID, ev.UserID, since).Scan(&id, &playDate, &src)
+	if err == nil {
+		qs = `UPDATE play_event SET skipped = true, duration = ? WHERE id = ?`
+		_, err = tx.Exec(qs, ev.Duration, id)
+		ev.PersistentID = id
+		ev.PlayDate = playDate
+		if ev.Source == SourceUnknown {
+			ev.Source = src
+		}
+	} else if errors.Cause(err) == sql.ErrNoRows {
+		err = db.insertPlayEvent(tx, ev)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := Now()
+	qs = `UPDATE track SET skip_count = COALESCE(skip_count, 0) + 1, skip_date = ? WHERE id = ?`
+	_, err = tx.Exec(qs, now, tr.PersistentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	tr.SkipCount += 1
+	tr.SkipDate = &now
+	return nil
+}
+
+type PlayHistoryQuery struct {
+	UserID  *pid.PersistentID
+	TrackID *pid.PersistentID
+	Source  *PlaySource
+	Skipped *bool
+	Since   *Time
+	Until   *Time
+	Limit   int
+	Offset  int
+}
+
+// PlayHistory lists play events, most recent first
+func (db *DB) PlayHistory(q PlayHistoryQuery) ([]*PlayEvent, error) {
+	// plays of tracks in the trash are kept, but not shown
+	where := []string{"EXISTS (SELECT 1 FROM track WHERE track.id = play_event.track_id)"}
+	args := []interface{}{}
+	if q.UserID != nil {
+		where = append(where, "user_id = ?")
+		args = append(args, *q.UserID)
+	}
+	if q.TrackID != nil {
+		where = append(where, "track_id = ?")
+		args = append(args, *q.TrackID)
+	}
+	if q.Source != nil {
+		where = append(where, "source = ?")
+		args = append(args, *q.Source)
+	}
+	if q.Skipped != nil {
+		where = append(where, "skipped = ?")
+		args = append(args, *q.Skipped)
+	}
+	if q.Since != nil {
+		where = append(where, "play_date >= ?")
+		args = append(args, *q.Since)
+	}
+	if q.Until != nil {
+		where = append(where, "play_date < ?")
+		args = append(args, *q.Until)
+	}
+	qs := `SELECT id, user_id, track_id, play_date, duration, source, skipped FROM play_event`
+	if len(where) > 0 {
+		qs += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	qs += ` ORDER BY play_date DESC`
+	if q.Limit > 0 {
+		qs += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	if q.Offset > 0 {
+		qs += ` OFFSET ?`
+		args = append(args, q.Offset)
+	}
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*PlayEvent{}
+	for rows.Next() {
+		ev := &PlayEvent{}
+		err = rows.StructScan(ev)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// moveHistory gives one track's plays to another, when duplicates are
+// merged
+func (db *DB) moveHistory(tx *Tx, fromId, toId pid.PersistentID) error {
+	qs := `UPDATE play_event SET track_id = ? WHERE track_id = ?`
+	_, err := tx.Exec(qs, toId, fromId)
+	return err
+}
+
+func (db *DB) deleteHistory(tx *Tx, trackId pid.PersistentID) error {
+	qs := `DELETE FROM play_event WHERE track_id = ?`
+	_, err := tx.Exec(qs, trackId)
+	return err
+}
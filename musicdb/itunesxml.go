@@ -0,0 +1,377 @@
+package musicdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// seconds from the start of 1904, where mac time begins, to the start
+// of 1970
+const macEpochOffset = 2082844800
+
+// plistWriter writes an xml property list the way itunes lays its
+// library file out, one key and value to a line
+type plistWriter struct {
+	w     *bufio.Writer
+	depth int
+}
+
+func plistEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func (pw *plistWriter) line(s string) {
+	pw.w.WriteString(strings.Repeat("\t", pw.depth) + s + "\n")
+}
+
+func (pw *plistWriter) key(k string) string {
+	return "<key>" + plistEscape(k) + "</key>"
+}
+
+func (pw *plistWriter) begin(k, tag string) {
+	if k == "" {
+		pw.line("<" + tag + ">")
+	} else {
+		pw.line(pw.key(k) + "<" + tag + ">")
+	}
+	pw.depth++
+}
+
+func (pw *plistWriter) end(tag string) {
+	pw.depth--
+	pw.line("</" + tag + ">")
+}
+
+func (pw *plistWriter) str(k, v string) {
+	pw.line(pw.key(k) + "<string>" + plistEscape(v) + "</string>")
+}
+
+func (pw *plistWriter) strptr(k string, v *string) {
+	if v != nil && *v != "" {
+		pw.str(k, *v)
+	}
+}
+
+func (pw *plistWriter) integer(k string, v int64) {
+	pw.line(pw.key(k) + "<integer>" + strconv.FormatInt(v, 10) + "</integer>")
+}
+
+func (pw *plistWriter) boolean(k string, v bool) {
+	if v {
+		pw.line(pw.key(k) + "<true/>")
+	} else {
+		pw.line(pw.key(k) + "<false/>")
+	}
+}
+
+func (pw *plistWriter) date(k string, t time.Time) {
+	pw.line(pw.key(k) + "<date>" + t.UTC().Format("2006-01-02T15:04:05Z") + "</date>")
+}
+
+func (pw *plistWriter) dateptr(k string, t *Time) {
+	if t != nil {
+		pw.date(k, t.Time())
+	}
+}
+
+func (pw *plistWriter) persistentID(k string, id pid.PersistentID) {
+	pw.str(k, strings.ToUpper(id.String()))
+}
+
+func fileURL(fn string) string {
+	u := &url.URL{Scheme: "file", Path: fn}
+	return u.String()
+}
+
+func (pw *plistWriter) track(id int64, t *Track) {
+	pw.integer("Track ID", id)
+	pw.strptr("Name", t.Name)
+	pw.strptr("Artist", t.Artist)
+	pw.strptr("Album Artist", t.AlbumArtist)
+	pw.strptr("Composer", t.Composer)
+	pw.strptr("Album", t.Album)
+	pw.strptr("Grouping", t.Grouping)
+	pw.strptr("Work", t.Work)
+	if t.MovementNumber != nil {
+		pw.integer("Movement Number", int64(*t.MovementNumber))
+	}
+	if t.MovementCount != nil {
+		pw.integer("Movement Count", int64(*t.MovementCount))
+	}
+	pw.strptr("Movement Name", t.MovementName)
+	pw.strptr("Genre", t.Genre)
+	pw.strptr("Kind", t.Kind)
+	if t.Size != nil {
+		pw.integer("Size", int64(*t.Size))
+	}
+	if t.TotalTime != nil {
+		pw.integer("Total Time", int64(*t.TotalTime))
+	}
+	if t.DiscNumber != nil {
+		pw.integer("Disc Number", int64(*t.DiscNumber))
+	}
+	if t.DiscCount != nil {
+		pw.integer("Disc Count", int64(*t.DiscCount))
+	}
+	if t.TrackNumber != nil {
+		pw.integer("Track Number", int64(*t.TrackNumber))
+	}
+	if t.TrackCount != nil {
+		pw.integer("Track Count", int64(*t.TrackCount))
+	}
+	if t.ReleaseDate != nil {
+		pw.integer("Year", int64(t.ReleaseDate.Time().In(time.UTC).Year()))
+	}
+	if t.BPM != nil {
+		pw.integer("BPM", int64(*t.BPM))
+	}
+	pw.dateptr("Date Modified", t.DateModified)
+	pw.dateptr("Date Added", t.DateAdded)
+	if t.BitRate != nil {
+		pw.integer("Bit Rate", int64(*t.BitRate))
+	}
+	if t.SampleRate != nil {
+		pw.integer("Sample Rate", int64(*t.SampleRate))
+	}
+	pw.strptr("Comments", t.Comments)
+	if t.PlayCount > 0 {
+		pw.integer("Play Count", int64(t.PlayCount))
+	}
+	if t.PlayDate != nil {
+		pw.integer("Play Date", t.PlayDate.Time().Unix() + macEpochOffset)
+		pw.date("Play Date UTC", t.PlayDate.Time())
+	}
+	if t.SkipCount > 0 {
+		pw.integer("Skip Count", int64(t.SkipCount))
+	}
+	pw.dateptr("Skip Date", t.SkipDate)
+	pw.dateptr("Release Date", t.ReleaseDate)
+	if t.Rating != nil {
+		pw.integer("Rating", int64(*t.Rating))
+	}
+	if t.AlbumRating != nil {
+		pw.integer("Album Rating", int64(*t.AlbumRating))
+	}
+	if t.Loved != nil {
+		if *t.Loved {
+			pw.boolean("Loved", true)
+		} else {
+			pw.boolean("Disliked", true)
+		}
+	}
+	if t.Compilation {
+		pw.boolean("Compilation", true)
+	}
+	if t.Purchased {
+		pw.boolean("Purchased", true)
+	}
+	pw.dateptr("Purchase Date", t.PurchaseDate)
+	switch t.MediaKind {
+	case Movie:
+		pw.boolean("Movie", true)
+	case Podcast:
+		pw.boolean("Podcast", true)
+	case TVShow:
+		pw.boolean("TV Show", true)
+	case MusicVideo:
+		pw.boolean("Music Video", true)
+	}
+	pw.persistentID("Persistent ID", t.PersistentID)
+	pw.str("Track Type", "File")
+	pw.strptr("Sort Album", t.SortAlbum)
+	pw.strptr("Sort Album Artist", t.SortAlbumArtist)
+	pw.strptr("Sort Artist", t.SortArtist)
+	pw.strptr("Sort Composer", t.SortComposer)
+	pw.strptr("Sort Name", t.SortName)
+	if t.Location != nil {
+		pw.str("Location", fileURL(t.Path()))
+	}
+}
+
+// playlist writes a playlist.  itunes keeps smart playlist criteria in
+// its own binary format, which can't be made from synos rules, so smart
+// playlists go out with the tracks they have now, and their rules in
+// the synos query language.
+func (pw *plistWriter) playlist(id int64, pl *Playlist, trackIds []int64) {
+	pw.str("Name", pl.Name)
+	switch pl.Kind {
+	case MasterPlaylist:
+		pw.boolean("Master", true)
+		pw.boolean("Visible", false)
+	case MusicPlaylist, MoviesPlaylist, TVShowsPlaylist, AudiobooksPlaylist, PodcastsPlaylist, PurchasedMusicPlaylist:
+		pw.integer("Distinguished Kind", int64(pl.Kind))
+	}
+	pw.integer("Playlist ID", id)
+	pw.persistentID("Playlist Persistent ID", pl.PersistentID)
+	if pl.ParentPersistentID != nil {
+		pw.persistentID("Parent Persistent ID", *pl.ParentPersistentID)
+	}
+	pw.boolean("All Items", true)
+	if pl.Folder {
+		pw.boolean("Folder", true)
+		return
+	}
+	if pl.Smart != nil {
+		pw.str("Synos Smart Query", pl.Smart.String())
+	}
+	if len(trackIds) > 0 {
+		pw.begin("Playlist Items", "array")
+		for _, tid := range trackIds {
+			pw.begin("", "dict")
+			pw.integer("Track ID", tid)
+			pw.end("dict")
+		}
+		pw.end("array")
+	}
+}
+
+// WriteITunesLibrary writes a user's tracks and playlists as an itunes
+// library xml file, for other programs that read those
+func (db *DB) WriteITunesLibrary(w io.Writer, user *User) error {
+	pw := &plistWriter{w: bufio.NewWriter(w)}
+	pw.w.WriteString(xml.Header)
+	pw.w.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple Computer//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	pw.line(`<plist version="1.0">`)
+	pw.begin("", "dict")
+	pw.integer("Major Version", 1)
+	pw.integer("Minor Version", 1)
+	pw.date("Date", time.Now())
+	pw.str("Application Version", "Synos")
+	pw.integer("Features", 5)
+	pw.boolean("Show Content Ratings", true)
+	if finder := GetGlobalFinder(); finder != nil {
+		dn := finder.UserMediaFolder(user.HomeDirectory)
+		if dn == "" {
+			dn = finder.GetMediaFolder()
+		}
+		if dn != "" {
+			pw.str("Music Folder", fileURL(dn + "/"))
+		}
+	}
+	pw.persistentID("Library Persistent ID", user.PersistentID)
+
+	nextId := int64(1000)
+	trackIds := map[pid.PersistentID]int64{}
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.owner_id = ? ORDER BY track.id`
+	rows, err := db.Query(qs, user.PersistentID)
+	if err != nil {
+		return err
+	}
+	pw.begin("Tracks", "dict")
+	for rows.Next() {
+		var t Track
+		err = rows.StructScan(&t)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "can't scan row into track")
+		}
+		t.db = db
+		trackIds[t.PersistentID] = nextId
+		pw.begin(strconv.FormatInt(nextId, 10), "dict")
+		pw.track(nextId, &t)
+		pw.end("dict")
+		nextId++
+	}
+	rows.Close()
+	pw.end("dict")
+	lastTrackId := nextId
+
+	qs = `SELECT * FROM playlist WHERE owner_id = ? ORDER BY kind, name`
+	rows, err = db.Query(qs, user.PersistentID)
+	if err != nil {
+		return err
+	}
+	pls := []*Playlist{}
+	for rows.Next() {
+		var pl Playlist
+		err = rows.StructScan(&pl)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "can't scan row into playlist")
+		}
+		pl.db = db
+		pls = append(pls, &pl)
+	}
+	rows.Close()
+	// itunes wants folders before what's in them
+	pls = foldersFirst(pls)
+	pw.begin("Playlists", "array")
+	for _, pl := range pls {
+		var ids []int64
+		if pl.Kind == MasterPlaylist {
+			ids = make([]int64, 0, len(trackIds))
+			for id := int64(1000); id < lastTrackId; id++ {
+				ids = append(ids, id)
+			}
+		} else if !pl.Folder {
+			var members []pid.PersistentID
+			if pl.Smart != nil {
+				tracks, err := db.SmartTracks(pl.Smart)
+				if err != nil {
+					return err
+				}
+				members = make([]pid.PersistentID, len(tracks))
+				for i, t := range tracks {
+					members[i] = t.PersistentID
+				}
+			} else {
+				members, err = db.PlaylistTrackIDs(pl)
+				if err != nil {
+					return err
+				}
+			}
+			ids = make([]int64, 0, len(members))
+			for _, tid := range members {
+				if id, ok := trackIds[tid]; ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+		pw.begin("", "dict")
+		pw.playlist(nextId, pl, ids)
+		pw.end("dict")
+		nextId++
+	}
+	pw.end("array")
+	pw.end("dict")
+	pw.line("</plist>")
+	return errors.Wrap(pw.w.Flush(), "can't write itunes library")
+}
+
+func foldersFirst(pls []*Playlist) []*Playlist {
+	byId := map[pid.PersistentID]*Playlist{}
+	for _, pl := range pls {
+		byId[pl.PersistentID] = pl
+	}
+	out := make([]*Playlist, 0, len(pls))
+	done := map[pid.PersistentID]bool{}
+	var add func(pl *Playlist)
+	add = func(pl *Playlist) {
+		if done[pl.PersistentID] {
+			return
+		}
+		done[pl.PersistentID] = true
+		if pl.ParentPersistentID != nil {
+			if parent, ok := byId[*pl.ParentPersistentID]; ok {
+				add(parent)
+			}
+		}
+		out = append(out, pl)
+	}
+	for _, pl := range pls {
+		add(pl)
+	}
+	return out
+}
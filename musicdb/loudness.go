@@ -0,0 +1,175 @@
+package musicdb
+
+import (
+	"log"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/loudness"
+)
+
+type GainMode string
+
+const (
+	GainNone  = GainMode("")
+	GainTrack = GainMode("track")
+	GainAlbum = GainMode("album")
+)
+
+// PlaybackGain is the adjustment in dB to play a track at, or nil if
+// it hasn't been analyzed.  album mode falls back to the track gain for
+// tracks that aren't part of an album.  the gain is limited so that the
+// loudest sample doesn't clip.
+func (t *Track) PlaybackGain(mode GainMode, preamp float64) *float64 {
+	var gain, peak *float64
+	switch mode {
+	case GainAlbum:
+		gain, peak = t.AlbumGain, t.AlbumPeak
+		if gain == nil {
+			gain, peak = t.TrackGain, t.TrackPeak
+		}
+	case GainTrack:
+		gain, peak = t.TrackGain, t.TrackPeak
+	}
+	if gain == nil {
+		return nil
+	}
+	g := *gain + preamp
+	if peak != nil && *peak > 0 {
+		max := -20 * math.Log10(*peak)
+		if g > max {
+			g = max
+		}
+	}
+	return &g
+}
+
+// loudnessAlbumKey identifies the album a track belongs to for album
+// gain, or "" if it stands alone
+func loudnessAlbumKey(tr *Track) string {
+	if tr.Album == nil || *tr.Album == "" {
+		return ""
+	}
+	artist := ""
+	if tr.AlbumArtist != nil {
+		artist = *tr.AlbumArtist
+	} else if !tr.Compilation && tr.Artist != nil {
+		artist = *tr.Artist
+	}
+	return MakeSortArtist(artist) + "\x00" + MakeSort(*tr.Album)
+}
+
+// LoudnessGroups finds the albums (and lone tracks) in a user's library
+// with tracks that haven't been analyzed yet.  the whole album is
+// returned, since album gain has to be measured over all of it.
+func (db *DB) LoudnessGroups(user *User) ([][]*Track, error) {
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.owner_id = ? AND track.location IS NOT NULL`
+	rows, err := db.Query(qs, user.PersistentID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query tracks")
+	}
+	defer rows.Close()
+	albums := map[string][]*Track{}
+	pending := map[string]bool{}
+	groups := [][]*Track{}
+	for rows.Next() {
+		tr := &Track{}
+		err = rows.StructScan(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan track")
+		}
+		tr.db = db
+		key := loudnessAlbumKey(tr)
+		if key == "" {
+			if tr.TrackGain == nil {
+				groups = append(groups, []*Track{tr})
+			}
+			continue
+		}
+		albums[key] = append(albums[key], tr)
+		if tr.TrackGain == nil || tr.AlbumGain == nil {
+			pending[key] = true
+		}
+	}
+	for key := range pending {
+		groups = append(groups, albums[key])
+	}
+	return groups, nil
+}
+
+// AnalyzeLoudness measures a group of tracks and stores their track
+// gains, and if they're an album, their album gain.  tracks that
+// can't be measured are left out of the album and returned.
+func (db *DB) AnalyzeLoudness(tracks []*Track) ([]pid.PersistentID, error) {
+	results := []*loudness.Result{}
+	measured := []*Track{}
+	failed := []pid.PersistentID{}
+	for _, tr := range tracks {
+		res, err := loudness.Analyze(tr.Path())
+		if err != nil {
+			log.Println("can't measure loudness of", tr.PersistentID, err)
+			failed = append(failed, tr.PersistentID)
+			continue
+		}
+		gain := res.Gain()
+		peak := res.Peak
+		tr.TrackGain = &gain
+		tr.TrackPeak = &peak
+		results = append(results, res)
+		measured = append(measured, tr)
+	}
+	if len(measured) == 0 {
+		return failed, nil
+	}
+	var albumGain, albumPeak *float64
+	if loudnessAlbumKey(tracks[0]) != "" {
+		album := loudness.Album(results)
+		gain := album.Gain()
+		albumGain = &gain
+		albumPeak = &album.Peak
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return failed, err
+	}
+	qs := `UPDATE track SET track_gain = ?, track_peak = ?, album_gain = ?, album_peak = ? WHERE id = ?`
+	for _, tr := range measured {
+		tr.AlbumGain = albumGain
+		tr.AlbumPeak = albumPeak
+		_, err = tx.Exec(qs, tr.TrackGain, tr.TrackPeak, tr.AlbumGain, tr.AlbumPeak, tr.PersistentID)
+		if err != nil {
+			tx.Rollback()
+			return failed, err
+		}
+	}
+	return failed, tx.Commit()
+}
+
+// LoudnessAlbum returns the tracks that share an album with a track, for
+// loudness analysis
+func (db *DB) LoudnessAlbum(tr *Track) ([]*Track, error) {
+	key := loudnessAlbumKey(tr)
+	if key == "" {
+		return []*Track{tr}, nil
+	}
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.owner_id = ? AND track.album = ? AND track.location IS NOT NULL`
+	rows, err := db.Query(qs, tr.OwnerID, *tr.Album)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query tracks")
+	}
+	defer rows.Close()
+	tracks := []*Track{}
+	for rows.Next() {
+		xtr := &Track{}
+		err = rows.StructScan(xtr)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan track")
+		}
+		xtr.db = db
+		if loudnessAlbumKey(xtr) == key {
+			tracks = append(tracks, xtr)
+		}
+	}
+	return tracks, nil
+}
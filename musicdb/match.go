@@ -0,0 +1,301 @@
+package musicdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// Match evaluates the rule against a track in memory, the same way the
+// sql from Where() would.  the track is taken to be in no playlists; use
+// MatchIn when playlist rules matter.
+func (r *Rule) Match(tr *Track) bool {
+	return r.MatchIn(tr, nil)
+}
+
+// MatchIn is Match for a track that's in the given playlists, and in
+// the folders they're in
+func (r *Rule) MatchIn(tr *Track, playlists map[pid.PersistentID]bool) bool {
+	if r.IsPlaylistRule() {
+		return r.matchPlaylist(playlists)
+	}
+	switch r.RuleType {
+	case RulesetRule:
+		return r.RuleSet.MatchIn(tr, playlists)
+	case StringRule:
+		return r.matchString(tr)
+	case IntRule:
+		return r.matchInt(tr)
+	case BooleanRule, LoveRule:
+		return r.matchBool(tr)
+	case DateRule:
+		return r.matchDate(tr)
+	case MediaKindRule:
+		return r.matchMediaKind(tr)
+	}
+	return true
+}
+
+func (rs *RuleSet) Match(tr *Track) bool {
+	return rs.MatchIn(tr, nil)
+}
+
+// MatchIn evaluates each of the rules against the track.  a comparison
+// against a NULL column is never true in sql, and since negation only
+// happens within a single rule, treating it as false here gives the
+// same answer.
+func (rs *RuleSet) MatchIn(tr *Track, playlists map[pid.PersistentID]bool) bool {
+	if rs == nil || len(rs.Rules) == 0 {
+		return true
+	}
+	if rs.Conjunction == OR {
+		for _, r := range rs.Rules {
+			if r.MatchIn(tr, playlists) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range rs.Rules {
+		if !r.MatchIn(tr, playlists) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match says whether a track belongs in the smart playlist, ignoring
+// any limit, which depends on the rest of the library
+func (spl *Smart) Match(tr *Track) bool {
+	return spl.MatchIn(tr, nil)
+}
+
+func (spl *Smart) MatchIn(tr *Track, playlists map[pid.PersistentID]bool) bool {
+	if tr.Location == nil {
+		return false
+	}
+	return spl.RuleSet.MatchIn(tr, playlists)
+}
+
+// columnValue gives the value the field's column would have for the
+// track: a string, int64, bool or Time, or false if it would be NULL
+func (f Field) columnValue(tr *Track) (interface{}, bool) {
+	switch f {
+	case Year:
+		// date_part('year', track.release_date)
+		if tr.ReleaseDate == nil {
+			return nil, false
+		}
+		return int64(tr.ReleaseDate.Time().In(time.UTC).Year()), true
+	case DiskNumber:
+		if tr.DiscNumber == nil {
+			return nil, false
+		}
+		return int64(*tr.DiscNumber), true
+	}
+	idx := f.Index()
+	if idx < 0 {
+		return nil, false
+	}
+	rf := reflect.ValueOf(*tr).Field(idx)
+	if rf.Kind() == reflect.Ptr {
+		if rf.IsNil() {
+			return nil, false
+		}
+		rf = rf.Elem()
+	}
+	t, isa := rf.Interface().(Time)
+	if isa {
+		return t, true
+	}
+	switch rf.Kind() {
+	case reflect.String:
+		return rf.String(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rf.Uint()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rf.Int(), true
+	case reflect.Bool:
+		return rf.Bool(), true
+	}
+	return nil, false
+}
+
+func (r *Rule) matchString(tr *Track) bool {
+	val, ok := r.Field.columnValue(tr)
+	var s string
+	if ok {
+		s, ok = val.(string)
+		if !ok {
+			s = fmt.Sprint(val)
+			ok = true
+		}
+	}
+	if len(r.StringValues) == 0 {
+		if r.Not() {
+			return ok && s != ""
+		}
+		return !ok || s == ""
+	}
+	if !ok {
+		return false
+	}
+	v := r.StringValues[0]
+	var m bool
+	switch r.Operator {
+	case CONTAINS:
+		m = strings.Contains(strings.ToLower(s), strings.ToLower(v))
+	case STARTSWITH:
+		m = strings.HasPrefix(strings.ToLower(s), strings.ToLower(v))
+	case ENDSWITH:
+		m = strings.HasSuffix(strings.ToLower(s), strings.ToLower(v))
+	case GREATERTHAN:
+		m = s > v
+	case LESSTHAN:
+		m = s < v
+	case BETWEEN:
+		var v2 string
+		if len(r.StringValues) > 1 {
+			v2 = r.StringValues[1]
+		}
+		if v > v2 {
+			v, v2 = v2, v
+		}
+		m = s >= v && s <= v2
+	default:
+		m = s == v
+	}
+	return m != r.Not()
+}
+
+func (r *Rule) matchInt(tr *Track) bool {
+	val, ok := r.Field.columnValue(tr)
+	var n int64
+	if ok {
+		switch v := val.(type) {
+		case int64:
+			n = v
+		case bool:
+			if v {
+				n = 1
+			}
+		case Time:
+			n = int64(v)
+		default:
+			ok = false
+		}
+	}
+	if len(r.IntValues) == 0 {
+		return ok == r.Not()
+	}
+	if !ok {
+		return false
+	}
+	v := r.IntValues[0]
+	var m bool
+	switch r.Operator {
+	case GREATERTHAN:
+		m = n > v
+	case LESSTHAN:
+		m = n < v
+	case BETWEEN:
+		var v2 int64
+		if len(r.IntValues) > 1 {
+			v2 = r.IntValues[1]
+		}
+		if v > v2 {
+			v, v2 = v2, v
+		}
+		m = n >= v && n <= v2
+	default:
+		m = n == v
+	}
+	return m != r.Not()
+}
+
+func (r *Rule) matchBool(tr *Track) bool {
+	val, ok := r.boolField().columnValue(tr)
+	if r.BoolValue == nil {
+		return ok == r.Not()
+	}
+	if !ok {
+		// IS DISTINCT FROM
+		return r.Not()
+	}
+	var b bool
+	switch v := val.(type) {
+	case bool:
+		b = v
+	case int64:
+		b = v != 0
+	default:
+		return false
+	}
+	return (b == *r.BoolValue) != r.Not()
+}
+
+func (r *Rule) matchDate(tr *Track) bool {
+	val, ok := r.Field.columnValue(tr)
+	var t Time
+	if ok {
+		t, ok = val.(Time)
+	}
+	if r.Operator == WITHIN && (len(r.TimeValues) > 0 || r.Unit != nil) {
+		cutoff := FromTime(r.relativeCutoff(time.Now()))
+		if r.LogicSign == POS || r.LogicSign == STRPOS {
+			return ok && t >= cutoff
+		}
+		return !ok || t < cutoff
+	}
+	if len(r.TimeValues) == 0 {
+		return ok == r.Not()
+	}
+	if !ok {
+		return false
+	}
+	v := r.TimeValues[0]
+	switch r.Operator {
+	case GREATERTHAN:
+		return (t > v) != r.Not()
+	case LESSTHAN:
+		return (t < v) != r.Not()
+	case BETWEEN:
+		var v2 Time
+		if len(r.TimeValues) > 1 {
+			v2 = r.TimeValues[1]
+		}
+		if v > v2 {
+			v, v2 = v2, v
+		}
+		return (t >= v && t <= v2) != r.Not()
+	}
+	return (t == v) != r.Not()
+}
+
+func (r *Rule) matchMediaKind(tr *Track) bool {
+	if r.MediaKindValue == nil {
+		// the column is never NULL on a track
+		return r.Not()
+	}
+	var m bool
+	switch r.Operator {
+	case BITWISE:
+		m = tr.MediaKind & *r.MediaKindValue != 0
+	default:
+		m = tr.MediaKind == *r.MediaKindValue
+	}
+	return m != r.Not()
+}
+
+// matchPlaylist follows Where: with a playlist, the rule is about
+// membership in it; without one, about membership in any playlist at all
+func (r *Rule) matchPlaylist(playlists map[pid.PersistentID]bool) bool {
+	plid := r.playlistID()
+	if plid == nil {
+		return (len(playlists) > 0) == r.Not()
+	}
+	return playlists[*plid] != r.Not()
+}
@@ -0,0 +1,416 @@
+package musicdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// smartFixtureTracks covers NULLs, case, wildcard characters and the
+// edges of each kind of column
+func smartFixtureTracks(now time.Time) []*Track {
+	empty := ""
+	day := 24 * time.Hour
+	return []*Track{
+		&Track{
+			Name: stringp("Blue in Green"),
+			Artist: stringp("Miles Davis"),
+			Album: stringp("Kind of Blue"),
+			Genre: stringp("Jazz"),
+			Comments: stringp("100% modal_jazz"),
+			Rating: uint8p(100),
+			PlayCount: 12,
+			TotalTime: uintp(337000),
+			TrackNumber: uint8p(3),
+			DiscNumber: uint8p(1),
+			Compilation: false,
+			Loved: boolp(true),
+			MediaKind: Music,
+			ReleaseDate: Timep(FromTime(time.Date(1959, 8, 17, 12, 0, 0, 0, time.UTC))),
+			DateAdded: Timep(FromTime(now.Add(-3 * day))),
+			PlayDate: Timep(FromTime(now.Add(-1 * day))),
+		},
+		&Track{
+			Name: stringp("blue train"),
+			Artist: stringp("John Coltrane"),
+			Album: stringp("Blue Train"),
+			Genre: stringp("jazz"),
+			Comments: &empty,
+			Rating: uint8p(60),
+			PlayCount: 0,
+			TotalTime: uintp(643000),
+			TrackNumber: uint8p(1),
+			Compilation: true,
+			Loved: boolp(false),
+			MediaKind: Music | MusicVideo,
+			ReleaseDate: Timep(FromTime(time.Date(1957, 6, 1, 12, 0, 0, 0, time.UTC))),
+			DateAdded: Timep(FromTime(now.Add(-400 * day))),
+		},
+		&Track{
+			Name: stringp("Untitled"),
+			Genre: stringp("Podcast"),
+			PlayCount: 3,
+			MediaKind: Podcast,
+			DateAdded: Timep(FromTime(now.Add(-30 * day))),
+		},
+	}
+}
+
+func smartFixtureRules(now time.Time, plid, folderid pid.PersistentID) []*Rule {
+	str := func(f Field, sign LogicSign, op Operator, vals ...string) *Rule {
+		return &Rule{RuleType: StringRule, Field: &f, LogicSign: sign, Operator: op, StringValues: vals}
+	}
+	num := func(f Field, sign LogicSign, op Operator, vals ...int64) *Rule {
+		return &Rule{RuleType: IntRule, Field: &f, LogicSign: sign, Operator: op, IntValues: vals}
+	}
+	date := func(f Field, sign LogicSign, op Operator, vals ...time.Time) *Rule {
+		tvs := make([]Time, len(vals))
+		for i, v := range vals {
+			tvs[i] = FromTime(v)
+		}
+		return &Rule{RuleType: DateRule, Field: &f, LogicSign: sign, Operator: op, TimeValues: tvs}
+	}
+	boolean := func(f Field, sign LogicSign, val *bool) *Rule {
+		return &Rule{RuleType: BooleanRule, Field: &f, LogicSign: sign, Operator: IS, BoolValue: val}
+	}
+	media := func(sign LogicSign, op Operator, mk MediaKind) *Rule {
+		return &Rule{RuleType: MediaKindRule, LogicSign: sign, Operator: op, MediaKindValue: &mk}
+	}
+	within := func(sign LogicSign, d time.Duration) *Rule {
+		f := DateAdded
+		return &Rule{RuleType: DateRule, Field: &f, LogicSign: sign, Operator: WITHIN, TimeValues: []Time{Time(-d.Milliseconds())}}
+	}
+	withinUnit := func(f Field, sign LogicSign, n int64, unit Unit) *Rule {
+		return &Rule{RuleType: DateRule, Field: &f, LogicSign: sign, Operator: WITHIN, IntValues: []int64{n}, Unit: &unit}
+	}
+	love := func(sign LogicSign, val *bool) *Rule {
+		return &Rule{RuleType: LoveRule, LogicSign: sign, Operator: IS, BoolValue: val}
+	}
+	playlist := func(sign LogicSign, id *pid.PersistentID) *Rule {
+		return &Rule{RuleType: PlaylistRule, LogicSign: sign, Operator: IS, PlaylistValue: id}
+	}
+	playlistField := func(sign LogicSign, id pid.PersistentID) *Rule {
+		f := PlaylistPersistentID
+		return &Rule{RuleType: IntRule, Field: &f, LogicSign: sign, Operator: IS, IntValues: []int64{int64(id)}}
+	}
+	set := func(conj Conjunction, rules ...*Rule) *Rule {
+		return &Rule{RuleType: RulesetRule, RuleSet: &RuleSet{Conjunction: conj, Rules: rules}}
+	}
+	day := 24 * time.Hour
+	return []*Rule{
+		str(Name, STRPOS, CONTAINS, "BLUE"),
+		str(Name, STRNEG, CONTAINS, "blue"),
+		str(Name, STRPOS, STARTSWITH, "blue"),
+		str(AlbumField, STRPOS, ENDSWITH, "train"),
+		str(ArtistField, STRNEG, ENDSWITH, "Davis"),
+		str(GenreField, STRPOS, IS, "jazz"),
+		str(GenreField, STRNEG, IS, "jazz"),
+		str(Comments, STRPOS, CONTAINS, "0% m"),
+		str(Comments, STRPOS, CONTAINS, "l_j"),
+		str(Comments, STRPOS, CONTAINS, "l%j"),
+		str(Comments, STRPOS, IS),
+		str(Comments, STRNEG, IS),
+		str(ArtistField, STRPOS, GREATERTHAN, "K"),
+		str(ArtistField, STRNEG, LESSTHAN, "K"),
+		str(AlbumField, STRPOS, BETWEEN, "Kind", "Blue"),
+		num(Rating, POS, GREATERTHAN, 60),
+		num(Rating, NEG, GREATERTHAN, 60),
+		num(Rating, POS, IS),
+		num(Rating, NEG, IS),
+		num(PlayCount, POS, LESSTHAN, 3),
+		num(PlayCount, POS, BETWEEN, 12, 3),
+		num(PlayCount, NEG, BETWEEN, 3, 12),
+		num(Year, POS, IS, 1959),
+		num(Year, NEG, LESSTHAN, 1958),
+		num(DiskNumber, POS, IS, 1),
+		num(TotalTime, POS, GREATERTHAN, 400000),
+		boolean(Compilation, POS, boolp(true)),
+		boolean(Compilation, NEG, boolp(true)),
+		boolean(Loved, POS, boolp(false)),
+		boolean(Loved, NEG, boolp(false)),
+		boolean(Loved, POS, nil),
+		boolean(Loved, NEG, nil),
+		date(PlayDate, POS, GREATERTHAN, now.Add(-2 * day)),
+		date(PlayDate, NEG, GREATERTHAN, now.Add(-2 * day)),
+		date(DateAdded, POS, LESSTHAN, now.Add(-10 * day)),
+		date(DateAdded, POS, BETWEEN, now, now.Add(-40 * day)),
+		date(DateAdded, NEG, BETWEEN, now.Add(-40 * day), now),
+		date(PlayDate, POS, IS),
+		date(PlayDate, NEG, IS),
+		within(POS, 7 * day),
+		within(NEG, 7 * day),
+		within(POS, 60 * day),
+		withinUnit(DateAdded, POS, 2, Weeks),
+		withinUnit(DateAdded, POS, 2, Months),
+		withinUnit(PlayDate, POS, 36, Hours),
+		withinUnit(PlayDate, NEG, 12, Hours),
+		love(POS, boolp(true)),
+		love(NEG, boolp(true)),
+		love(POS, nil),
+		media(POS, IS, Music),
+		media(NEG, IS, Music),
+		media(POS, BITWISE, MusicVideo),
+		media(NEG, BITWISE, Music),
+		playlist(POS, &plid),
+		playlist(NEG, &plid),
+		playlist(POS, nil),
+		playlist(NEG, nil),
+		playlist(POS, &folderid),
+		playlist(NEG, &folderid),
+		playlistField(POS, plid),
+		playlistField(NEG, folderid),
+		set(AND, str(GenreField, STRPOS, IS, "Jazz"), num(Rating, POS, GREATERTHAN, 80)),
+		set(OR, str(GenreField, STRPOS, IS, "Podcast"), num(Rating, POS, GREATERTHAN, 80)),
+		set(OR, num(Rating, POS, LESSTHAN, 10), set(AND, str(Name, STRPOS, CONTAINS, "train"), boolean(Compilation, POS, boolp(true)))),
+		set(AND, num(Rating, NEG, IS, 100), str(GenreField, STRNEG, CONTAINS, "pod")),
+	}
+}
+
+type matchCase struct {
+	name string
+	rule func(plid, folderid pid.PersistentID) *Rule
+	// whether each of smartFixtureTracks matches
+	want []bool
+}
+
+func matchCases(now time.Time) []matchCase {
+	day := 24 * time.Hour
+	str := func(f Field, sign LogicSign, op Operator, vals ...string) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			return &Rule{RuleType: StringRule, Field: &f, LogicSign: sign, Operator: op, StringValues: vals}
+		}
+	}
+	num := func(f Field, sign LogicSign, op Operator, vals ...int64) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			return &Rule{RuleType: IntRule, Field: &f, LogicSign: sign, Operator: op, IntValues: vals}
+		}
+	}
+	boolean := func(f Field, sign LogicSign, val *bool) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			return &Rule{RuleType: BooleanRule, Field: &f, LogicSign: sign, Operator: IS, BoolValue: val}
+		}
+	}
+	date := func(f Field, sign LogicSign, op Operator, vals ...time.Time) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			tvs := make([]Time, len(vals))
+			for i, v := range vals {
+				tvs[i] = FromTime(v)
+			}
+			return &Rule{RuleType: DateRule, Field: &f, LogicSign: sign, Operator: op, TimeValues: tvs}
+		}
+	}
+	within := func(f Field, sign LogicSign, n int64, unit Unit) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			return &Rule{RuleType: DateRule, Field: &f, LogicSign: sign, Operator: WITHIN, IntValues: []int64{n}, Unit: &unit}
+		}
+	}
+	media := func(sign LogicSign, op Operator, mk MediaKind) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			return &Rule{RuleType: MediaKindRule, LogicSign: sign, Operator: op, MediaKindValue: &mk}
+		}
+	}
+	inPlaylist := func(plid, folderid pid.PersistentID) *Rule {
+		return &Rule{RuleType: PlaylistRule, LogicSign: POS, Operator: IS, PlaylistValue: &plid}
+	}
+	inFolder := func(plid, folderid pid.PersistentID) *Rule {
+		return &Rule{RuleType: PlaylistRule, LogicSign: POS, Operator: IS, PlaylistValue: &folderid}
+	}
+	set := func(conj Conjunction, rules ...func(plid, folderid pid.PersistentID) *Rule) func(plid, folderid pid.PersistentID) *Rule {
+		return func(plid, folderid pid.PersistentID) *Rule {
+			rs := &RuleSet{Conjunction: conj}
+			for _, rule := range rules {
+				rs.Rules = append(rs.Rules, rule(plid, folderid))
+			}
+			return &Rule{RuleType: RulesetRule, RuleSet: rs}
+		}
+	}
+	return []matchCase{
+		{"name contains, any case", str(Name, STRPOS, CONTAINS, "BLUE"), []bool{true, true, false}},
+		{"name doesn't contain", str(Name, STRNEG, CONTAINS, "blue"), []bool{false, false, true}},
+		{"genre is, exact case", str(GenreField, STRPOS, IS, "jazz"), []bool{false, true, false}},
+		{"contains an underscore", str(Comments, STRPOS, CONTAINS, "l_j"), []bool{true, false, false}},
+		{"contains a percent", str(Comments, STRPOS, CONTAINS, "l%j"), []bool{false, false, false}},
+		{"comments empty or null", str(Comments, STRPOS, IS), []bool{false, true, true}},
+		{"rating over", num(Rating, POS, GREATERTHAN, 60), []bool{true, false, false}},
+		{"rating not over, not null", num(Rating, NEG, GREATERTHAN, 60), []bool{false, true, false}},
+		{"rating null", num(Rating, POS, IS), []bool{false, false, true}},
+		{"play count between, reversed", num(PlayCount, POS, BETWEEN, 12, 3), []bool{true, false, true}},
+		{"year", num(Year, POS, IS, 1959), []bool{true, false, false}},
+		{"compilation", boolean(Compilation, POS, boolp(true)), []bool{false, true, false}},
+		{"not unloved, null included", boolean(Loved, NEG, boolp(false)), []bool{true, false, true}},
+		{"played since", date(PlayDate, POS, GREATERTHAN, now.Add(-2 * day)), []bool{true, false, false}},
+		{"added between, reversed", date(DateAdded, POS, BETWEEN, now, now.Add(-40 * day)), []bool{true, false, true}},
+		{"added within", within(DateAdded, POS, 1, Weeks), []bool{true, false, false}},
+		{"not added within, null included", within(PlayDate, NEG, 2, Days), []bool{false, true, true}},
+		{"media kind is", media(POS, IS, Music), []bool{true, false, false}},
+		{"media kind has", media(POS, BITWISE, MusicVideo), []bool{false, true, false}},
+		{"in playlist", inPlaylist, []bool{true, false, false}},
+		{"in folder", inFolder, []bool{true, false, false}},
+		{"all of", set(AND, str(GenreField, STRPOS, IS, "Jazz"), num(Rating, POS, GREATERTHAN, 80)), []bool{true, false, false}},
+		{"any of", set(OR, str(GenreField, STRPOS, IS, "Podcast"), num(Rating, POS, GREATERTHAN, 80)), []bool{true, false, true}},
+		{"nested", set(OR, num(Rating, POS, LESSTHAN, 10), set(AND, str(Name, STRPOS, CONTAINS, "train"), boolean(Compilation, POS, boolp(true)))), []bool{false, true, false}},
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	now := time.Now()
+	tracks := smartFixtureTracks(now)
+	plid := pid.NewPersistentID()
+	folderid := pid.NewPersistentID()
+	playlists := []map[pid.PersistentID]bool{
+		map[pid.PersistentID]bool{plid: true, folderid: true},
+		nil,
+		nil,
+	}
+	for _, c := range matchCases(now) {
+		rule := c.rule(plid, folderid)
+		for i, tr := range tracks {
+			got := rule.MatchIn(tr, playlists[i])
+			if got != c.want[i] {
+				t.Errorf("%s: track %d: got %t, want %t", c.name, i, got, c.want[i])
+			}
+		}
+	}
+}
+
+// testColumnType is about the type the installer gives a column
+func testColumnType(rt reflect.Type) string {
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt == reflect.TypeOf(Time(0)) {
+		return "timestamp"
+	}
+	switch rt.Kind() {
+	case reflect.String:
+		return "text"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Float32, reflect.Float64:
+		return "double precision"
+	}
+	return "bigint"
+}
+
+// openTestDB makes an in-memory sqlite database with as much of the
+// schema as smart playlist queries use
+func openTestDB(t *testing.T) *DB {
+	db, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: gets a database of its own
+	db.conn.SetMaxOpenConns(1)
+	cols := []string{}
+	rt := reflect.TypeOf(Track{})
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" || strings.Contains(f.Tag.Get("dbignore"), "insert") {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("db"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if name == "-" {
+			continue
+		}
+		cols = append(cols, name + " " + testColumnType(f.Type))
+	}
+	schema := []string{
+		`CREATE TABLE xuser (id bigint PRIMARY KEY, homedir text)`,
+		`CREATE TABLE track (` + strings.Join(cols, ", ") + `)`,
+		`CREATE TABLE playlist (id bigint PRIMARY KEY, parent_id bigint, kind integer, folder boolean, name text)`,
+		`CREATE TABLE playlist_track (playlist_id bigint, track_id bigint, position integer)`,
+	}
+	for _, qs := range schema {
+		_, err = db.Exec(qs)
+		if err != nil {
+			db.Close()
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// TestRuleMatchSQL runs the rules through the sql from Where in sqlite,
+// and checks that Match agrees about every track
+func TestRuleMatchSQL(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	now := time.Now()
+	tracks := smartFixtureTracks(now)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	ids := make([]pid.PersistentID, len(tracks))
+	for i, tr := range tracks {
+		tr.PersistentID = pid.NewPersistentID()
+		loc := "/smartcheck/" + tr.PersistentID.String() + ".mp3"
+		tr.Location = &loc
+		err = db.insertStruct(tx, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = tr.PersistentID
+	}
+	// the first track goes in a playlist in a folder, for the playlist
+	// rules
+	folderid := pid.NewPersistentID()
+	plid := pid.NewPersistentID()
+	_, err = tx.Exec(`INSERT INTO playlist (id, kind, folder, name) VALUES (?, ?, true, 'smartcheck')`, folderid, FolderPlaylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec(`INSERT INTO playlist (id, parent_id, kind, folder, name) VALUES (?, ?, ?, false, 'smartcheck')`, plid, folderid, StandardPlaylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec(`INSERT INTO playlist_track (playlist_id, track_id, position) VALUES (?, ?, 0)`, plid, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlists := []map[pid.PersistentID]bool{
+		map[pid.PersistentID]bool{plid: true, folderid: true},
+		nil,
+		nil,
+	}
+	rules := smartFixtureRules(now, plid, folderid)
+	for _, c := range matchCases(now) {
+		rules = append(rules, c.rule(plid, folderid))
+	}
+	qms, idargs := idPlaceholders(ids)
+	for _, rule := range rules {
+		spl := &Smart{RuleSet: &RuleSet{Conjunction: AND, Rules: []*Rule{rule}}}
+		qs, args := db.smartQuery(spl)
+		qs = `SELECT DISTINCT track.id FROM (` + qs + `) AS track WHERE track.id IN (` + qms + `)`
+		rows, err := tx.Query(qs, append(args, idargs...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches := map[pid.PersistentID]bool{}
+		for rows.Next() {
+			var id pid.PersistentID
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				t.Fatal(err)
+			}
+			matches[id] = true
+		}
+		rows.Close()
+		for i, tr := range tracks {
+			m := spl.MatchIn(tr, playlists[i])
+			if m != matches[ids[i]] {
+				data, _ := json.Marshal(rule)
+				t.Errorf("%s on track %d: sql %t, match %t", data, i, matches[ids[i]], m)
+			}
+		}
+	}
+}
@@ -2,51 +2,191 @@ package musicdb
 
 import (
 	"log"
-	"strings"
 
 	"github.com/rclancey/itunes/persistentId"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
-func pidsToText(pids []pid.PersistentID) string {
-	lines := make([]string, len(pids))
-	for i, p := range pids {
-		lines[i] = p.String()
+// trackRunes stands a character for each distinct track in some lists,
+// so the lists can be diffed a whole track at a time
+type trackRunes struct {
+	runes map[pid.PersistentID]rune
+	ids   []pid.PersistentID
+}
+
+func newTrackRunes() *trackRunes {
+	return &trackRunes{runes: map[pid.PersistentID]rune{}}
+}
+
+func (tr *trackRunes) encode(ids []pid.PersistentID) []rune {
+	rs := make([]rune, len(ids))
+	for i, id := range ids {
+		r, ok := tr.runes[id]
+		if !ok {
+			// past the surrogates, so every track is one valid rune
+			r = rune(0x10000 + len(tr.ids))
+			tr.runes[id] = r
+			tr.ids = append(tr.ids, id)
+		}
+		rs[i] = r
+	}
+	return rs
+}
+
+func (tr *trackRunes) decode(s string) []pid.PersistentID {
+	ids := []pid.PersistentID{}
+	for _, r := range s {
+		ids = append(ids, tr.ids[r - 0x10000])
+	}
+	return ids
+}
+
+// trackHunk is a run of tracks in a base list, from start up to end,
+// that another list replaces with other tracks
+type trackHunk struct {
+	start int
+	end   int
+	ids   []pid.PersistentID
+}
+
+func (h trackHunk) insert() bool {
+	return h.start == h.end
+}
+
+func (h trackHunk) same(o trackHunk) bool {
+	if h.start != o.start || h.end != o.end || len(h.ids) != len(o.ids) {
+		return false
+	}
+	for i, id := range h.ids {
+		if o.ids[i] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// overlaps is true for hunks that change the same tracks, or add
+// tracks in the middle of the others' changes, so they can't both be
+// applied
+func (h trackHunk) overlaps(o trackHunk) bool {
+	if h.insert() && o.insert() {
+		return h.same(o)
+	}
+	if h.insert() {
+		return o.start < h.start && h.start < o.end
+	}
+	if o.insert() {
+		return h.start < o.start && o.start < h.end
 	}
-	return strings.Join(lines, "\n")
+	return h.start < o.end && o.start < h.end
 }
 
+// before is true if h goes before o.  tracks added where the other
+// removes some go first.
+func (h trackHunk) before(o trackHunk) bool {
+	if h.start != o.start {
+		return h.start < o.start
+	}
+	return h.insert() && !o.insert()
+}
+
+func trackHunks(enc *trackRunes, base, other []pid.PersistentID) []trackHunk {
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(enc.encode(base), enc.encode(other), false)
+	hunks := []trackHunk{}
+	var cur *trackHunk
+	pos := 0
+	for _, d := range diffs {
+		ids := enc.decode(d.Text)
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			if cur != nil {
+				hunks = append(hunks, *cur)
+				cur = nil
+			}
+			pos += len(ids)
+		case diffmatchpatch.DiffDelete:
+			if cur == nil {
+				cur = &trackHunk{start: pos, end: pos}
+			}
+			pos += len(ids)
+			cur.end = pos
+		case diffmatchpatch.DiffInsert:
+			if cur == nil {
+				cur = &trackHunk{start: pos, end: pos}
+			}
+			cur.ids = append(cur.ids, ids...)
+		}
+	}
+	if cur != nil {
+		hunks = append(hunks, *cur)
+	}
+	return hunks
+}
+
+// TrackChange is a run of tracks removed from a playlist at some
+// position, and the tracks added in their place
+type TrackChange struct {
+	Position int                `json:"position"`
+	Removed  []pid.PersistentID `json:"removed,omitempty"`
+	Added    []pid.PersistentID `json:"added,omitempty"`
+}
+
+// DiffTrackIDs lists the changes that turn one list of tracks into
+// another.  positions are in the first list.
+func DiffTrackIDs(from, to []pid.PersistentID) []TrackChange {
+	hunks := trackHunks(newTrackRunes(), from, to)
+	changes := make([]TrackChange, len(hunks))
+	for i, h := range hunks {
+		changes[i] = TrackChange{
+			Position: h.start,
+			Removed: from[h.start:h.end],
+			Added: h.ids,
+		}
+	}
+	return changes
+}
+
+// ThreeWayMerge applies the changes from base to delta_one to
+// delta_two.  if both change the same tracks differently, the merge
+// fails, and delta_two is returned as it is.  tracks both add in the
+// same place are kept, delta_two's first.
 func ThreeWayMerge(base, delta_one, delta_two []pid.PersistentID) (out []pid.PersistentID, ok bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("recovering from", r)
-			out = delta_one
-			ok = false
-		}
-	}()
-	base_s := pidsToText(base)
-	delta_one_s := pidsToText(delta_one)
-	delta_two_s := pidsToText(delta_two)
-	dmp := diffmatchpatch.New()
-	patches := dmp.PatchMake(base_s, delta_one_s)
-	res, applied := dmp.PatchApply(patches, delta_two_s)
-	for _, app := range applied {
-		if !app {
 			out = delta_two
 			ok = false
-			return
 		}
+	}()
+	enc := newTrackRunes()
+	h1 := trackHunks(enc, base, delta_one)
+	h2 := trackHunks(enc, base, delta_two)
+	out = []pid.PersistentID{}
+	pos := 0
+	apply := func(h trackHunk) {
+		out = append(out, base[pos:h.start]...)
+		out = append(out, h.ids...)
+		pos = h.end
 	}
-	lines := strings.Split(res, "\n")
-	pids := make([]pid.PersistentID, len(lines))
-	for i, line := range lines {
-		var p pid.PersistentID
-		if (&p).Decode(line) == nil {
-			pids[i] = p
+	i, j := 0, 0
+	for i < len(h1) || j < len(h2) {
+		if i < len(h1) && j < len(h2) && h1[i].overlaps(h2[j]) {
+			if !h1[i].same(h2[j]) {
+				return delta_two, false
+			}
+			apply(h1[i])
+			i++
+			j++
+		} else if j >= len(h2) || (i < len(h1) && h1[i].before(h2[j])) {
+			apply(h1[i])
+			i++
+		} else {
+			apply(h2[j])
+			j++
 		}
 	}
-	out = pids
+	out = append(out, base[pos:]...)
 	ok = true
 	return
 }
-
@@ -34,6 +34,7 @@ type Playlist struct {
 	Children             []*Playlist    `json:"children,omitempty" db:"-"`
 	PlaylistItems        []*Track       `json:"items" db:"-"`
 	SortField            string         `json:"sort_field,omitempty" db:"sort_field"`
+	Revision             int            `json:"revision" db:"revision" dbignore:"insert update"`
 	db *DB
 }
 
@@ -0,0 +1,624 @@
+package musicdb
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+type PlaylistFormat string
+
+const (
+	PlaylistM3U  = PlaylistFormat("m3u")
+	PlaylistPLS  = PlaylistFormat("pls")
+	PlaylistXSPF = PlaylistFormat("xspf")
+)
+
+// PlaylistFormatFor guesses the format of a playlist file from its name
+// or content type.  it's empty if neither says.
+func PlaylistFormatFor(name, contentType string) PlaylistFormat {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u", ".m3u8":
+		return PlaylistM3U
+	case ".pls":
+		return PlaylistPLS
+	case ".xspf":
+		return PlaylistXSPF
+	}
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch ct {
+	case "audio/x-mpegurl", "audio/mpegurl", "application/x-mpegurl", "application/vnd.apple.mpegurl":
+		return PlaylistM3U
+	case "audio/x-scpls":
+		return PlaylistPLS
+	case "application/xspf+xml":
+		return PlaylistXSPF
+	}
+	return PlaylistFormat("")
+}
+
+// PlaylistEntry is an item in a playlist file from another player.
+// some formats only have a location, some have tags too.
+type PlaylistEntry struct {
+	Index    int    `json:"index"`
+	Location string `json:"location,omitempty"`
+	Artist   string `json:"artist,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Album    string `json:"album,omitempty"`
+	// milliseconds
+	Duration int    `json:"duration,omitempty"`
+}
+
+type PlaylistFile struct {
+	Name    string
+	Entries []*PlaylistEntry
+}
+
+// ParsePlaylistFile reads an m3u, pls or xspf playlist.  without a
+// format, it goes by what the file looks like.
+func ParsePlaylistFile(data []byte, format PlaylistFormat) (*PlaylistFile, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if format == "" {
+		head := data
+		if len(head) > 512 {
+			head = head[:512]
+		}
+		sniff := strings.ToLower(string(bytes.TrimSpace(head)))
+		if strings.HasPrefix(sniff, "<?xml") || strings.HasPrefix(sniff, "<playlist") {
+			format = PlaylistXSPF
+		} else if strings.HasPrefix(sniff, "[playlist]") {
+			format = PlaylistPLS
+		} else {
+			format = PlaylistM3U
+		}
+	}
+	var pf *PlaylistFile
+	var err error
+	switch format {
+	case PlaylistM3U:
+		pf = parseM3U(playlistText(data))
+	case PlaylistPLS:
+		pf = parsePLS(playlistText(data))
+	case PlaylistXSPF:
+		pf, err = parseXSPF(data)
+	default:
+		return nil, errors.Errorf("unknown playlist format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, ent := range pf.Entries {
+		ent.Index = i
+	}
+	return pf, nil
+}
+
+// playlistText decodes the text of a playlist.  m3u8 files are utf-8,
+// but plain m3u and pls files are usually in the windows code page.
+func playlistText(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	dec, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(dec)
+}
+
+// splitArtistTitle splits the "Artist - Title" players put in the
+// title of an entry
+func splitArtistTitle(ent *PlaylistEntry, s string) {
+	s = strings.TrimSpace(s)
+	parts := strings.SplitN(s, " - ", 2)
+	if len(parts) == 2 {
+		ent.Artist = strings.TrimSpace(parts[0])
+		ent.Title = strings.TrimSpace(parts[1])
+	} else {
+		ent.Title = s
+	}
+}
+
+var extInfRe = regexp.MustCompile(`^\s*(-?\d+(?:\.\d+)?)[^,]*,(.*)$`)
+var synosExtInfRe = regexp.MustCompile(`^<(.*)><(.*)><(.*)>$`)
+
+func parseExtInf(s string) *PlaylistEntry {
+	ent := &PlaylistEntry{}
+	m := extInfRe.FindStringSubmatch(s)
+	if m == nil {
+		splitArtistTitle(ent, s)
+		return ent
+	}
+	secs, err := strconv.ParseFloat(m[1], 64)
+	if err == nil && secs > 0 {
+		ent.Duration = int(secs * 1000)
+	}
+	// the m3u playlists we make for sonos
+	if sm := synosExtInfRe.FindStringSubmatch(strings.TrimSpace(m[2])); sm != nil {
+		ent.Artist = html.UnescapeString(sm[1])
+		ent.Album = html.UnescapeString(sm[2])
+		ent.Title = html.UnescapeString(sm[3])
+		return ent
+	}
+	splitArtistTitle(ent, m[2])
+	return ent
+}
+
+func parseM3U(text string) *PlaylistFile {
+	pf := &PlaylistFile{Entries: []*PlaylistEntry{}}
+	var info *PlaylistEntry
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, "#EXTINF:") {
+				info = parseExtInf(strings.TrimPrefix(line, "#EXTINF:"))
+			} else if strings.HasPrefix(line, "#PLAYLIST:") {
+				pf.Name = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+			} else if strings.HasPrefix(line, "#EXTALB:") && info != nil {
+				info.Album = strings.TrimSpace(strings.TrimPrefix(line, "#EXTALB:"))
+			}
+			continue
+		}
+		ent := info
+		if ent == nil {
+			ent = &PlaylistEntry{}
+		}
+		ent.Location = line
+		pf.Entries = append(pf.Entries, ent)
+		info = nil
+	}
+	return pf
+}
+
+var plsKeyRe = regexp.MustCompile(`^(?i)(file|title|length)(\d+)$`)
+
+func parsePLS(text string) *PlaylistFile {
+	pf := &PlaylistFile{Entries: []*PlaylistEntry{}}
+	entries := map[int]*PlaylistEntry{}
+	for _, line := range strings.Split(text, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		m := plsKeyRe.FindStringSubmatch(strings.TrimSpace(parts[0]))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		ent, ok := entries[n]
+		if !ok {
+			ent = &PlaylistEntry{}
+			entries[n] = ent
+		}
+		val := strings.TrimSpace(parts[1])
+		switch strings.ToLower(m[1]) {
+		case "file":
+			ent.Location = val
+		case "title":
+			splitArtistTitle(ent, val)
+		case "length":
+			secs, err := strconv.Atoi(val)
+			if err == nil && secs > 0 {
+				ent.Duration = secs * 1000
+			}
+		}
+	}
+	nums := make([]int, 0, len(entries))
+	for n := range entries {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	for _, n := range nums {
+		if entries[n].Location != "" {
+			pf.Entries = append(pf.Entries, entries[n])
+		}
+	}
+	return pf
+}
+
+type xspfTrack struct {
+	Location []string `xml:"location"`
+	Title    string   `xml:"title,omitempty"`
+	Creator  string   `xml:"creator,omitempty"`
+	Album    string   `xml:"album,omitempty"`
+	Duration string   `xml:"duration,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Xmlns   string      `xml:"xmlns,attr,omitempty"`
+	Version string      `xml:"version,attr,omitempty"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func parseXSPF(data []byte) (*PlaylistFile, error) {
+	xpl := &xspfPlaylist{}
+	err := xml.Unmarshal(data, xpl)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse xspf playlist")
+	}
+	pf := &PlaylistFile{Name: strings.TrimSpace(xpl.Title), Entries: []*PlaylistEntry{}}
+	for _, xtr := range xpl.Tracks {
+		ent := &PlaylistEntry{
+			Artist: strings.TrimSpace(xtr.Creator),
+			Title: strings.TrimSpace(xtr.Title),
+			Album: strings.TrimSpace(xtr.Album),
+		}
+		ms, err := strconv.Atoi(strings.TrimSpace(xtr.Duration))
+		if err == nil && ms > 0 {
+			ent.Duration = ms
+		}
+		if len(xtr.Location) > 0 {
+			ent.Location = strings.TrimSpace(xtr.Location[0])
+			if !urlSchemeRe.MatchString(ent.Location) {
+				// relative locations are uri references too
+				if loc, err := url.PathUnescape(ent.Location); err == nil {
+					ent.Location = loc
+				}
+			}
+		}
+		pf.Entries = append(pf.Entries, ent)
+	}
+	return pf, nil
+}
+
+var urlSchemeRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]+://`)
+var driveLetterRe = regexp.MustCompile(`^/?[A-Za-z]:/`)
+var trackURLRe = regexp.MustCompile(`/api/track/([0-9A-Fa-f]{16})(\.[A-Za-z0-9]+)?(\?.*)?$`)
+
+// entryPath turns the location of a playlist entry into a path.  file
+// urls and windows paths become unix paths, and relative paths are
+// taken from the directory of the playlist, if it's known.  other urls
+// aren't paths at all.
+func entryPath(loc, dir string) string {
+	if loc == "" {
+		return ""
+	}
+	if urlSchemeRe.MatchString(loc) {
+		u, err := url.Parse(loc)
+		if err != nil || u.Scheme != "file" {
+			return ""
+		}
+		loc = u.Path
+	}
+	loc = strings.Replace(loc, `\`, "/", -1)
+	if driveLetterRe.MatchString(loc) {
+		loc = "/" + strings.TrimPrefix(loc[strings.Index(loc, ":") + 1:], "/")
+	}
+	if !strings.HasPrefix(loc, "/") && dir != "" {
+		loc = filepath.Join(dir, loc)
+	}
+	return path.Clean(loc)
+}
+
+// PlaylistImport is what became of a playlist file brought into the
+// library
+type PlaylistImport struct {
+	Playlist  *Playlist        `json:"playlist"`
+	Entries   int              `json:"entries"`
+	Matched   int              `json:"matched"`
+	Unmatched []*PlaylistEntry `json:"unmatched"`
+}
+
+// trackByLocation finds the track a playlist entry's file is, first by
+// its place in the media folder, then, since the playlist may have been
+// made on another computer, by the end of its path if that's unique
+func (db *DB) trackByLocation(user *User, fn string) (*pid.PersistentID, error) {
+	locs := []string{fn}
+	finder := GetGlobalFinder()
+	if finder != nil {
+		if loc := finder.Clean(fn); loc != fn {
+			locs = append(locs, loc)
+		}
+	}
+	qs := `SELECT id FROM track WHERE owner_id = ? AND location = ?`
+	for _, loc := range locs {
+		var id pid.PersistentID
+		err := db.QueryRow(qs, user.PersistentID, loc).Scan(&id)
+		if err == nil {
+			return &id, nil
+		}
+		if errors.Cause(err) != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	parts := strings.Split(strings.Trim(fn, "/"), "/")
+	qs = `SELECT id FROM track WHERE owner_id = ? AND (location = ? OR location LIKE ?) LIMIT 2`
+	for n := 3; n >= 2; n-- {
+		if len(parts) < n {
+			continue
+		}
+		suffix := strings.Join(parts[len(parts) - n:], "/")
+		rows, err := db.Query(qs, user.PersistentID, suffix, "%/" + likeEscape(suffix))
+		if err != nil {
+			return nil, err
+		}
+		ids := []pid.PersistentID{}
+		for rows.Next() {
+			var id pid.PersistentID
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 1 {
+			return &ids[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// trackByTags finds the track a playlist entry is by its title and
+// artist.  when there's more than one, the one closest in length wins,
+// and a track more than 10 seconds off isn't the same one.
+func (db *DB) trackByTags(user *User, ent *PlaylistEntry) (*pid.PersistentID, error) {
+	if ent.Title == "" {
+		return nil, nil
+	}
+	qs := `SELECT id, total_time FROM track WHERE owner_id = ? AND sort_name = ?`
+	args := []interface{}{user.PersistentID, MakeSort(ent.Title)}
+	if ent.Artist != "" {
+		qs += ` AND (sort_artist = ? OR sort_album_artist = ?)`
+		args = append(args, MakeSortArtist(ent.Artist), MakeSortArtist(ent.Artist))
+	}
+	qs += ` ORDER BY COALESCE(rating, 0) DESC, COALESCE(play_count, 0) DESC`
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var best *pid.PersistentID
+	bestDiff := -1
+	for rows.Next() {
+		var id pid.PersistentID
+		var totalTime *int
+		err = rows.Scan(&id, &totalTime)
+		if err != nil {
+			return nil, err
+		}
+		if ent.Duration <= 0 || totalTime == nil {
+			if best == nil {
+				best = &id
+			}
+			continue
+		}
+		diff := *totalTime - ent.Duration
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= 10000 && (bestDiff < 0 || diff < bestDiff) {
+			best = &id
+			bestDiff = diff
+		}
+	}
+	return best, nil
+}
+
+// MatchPlaylistEntries finds the user's tracks for the entries of a
+// playlist file, and gives back the entries it couldn't find
+func (db *DB) MatchPlaylistEntries(user *User, entries []*PlaylistEntry, dir string) ([]pid.PersistentID, []*PlaylistEntry, error) {
+	trackIds := []pid.PersistentID{}
+	unmatched := []*PlaylistEntry{}
+	for _, ent := range entries {
+		var id *pid.PersistentID
+		var err error
+		if m := trackURLRe.FindStringSubmatch(ent.Location); m != nil {
+			var tid pid.PersistentID
+			if (&tid).Decode(m[1]) == nil {
+				tr, err := db.GetTrack(tid)
+				if err == nil && tr != nil && tr.OwnerID == user.PersistentID {
+					id = &tid
+				}
+			}
+		}
+		if id == nil {
+			if fn := entryPath(ent.Location, dir); fn != "" {
+				id, err = db.trackByLocation(user, fn)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		if id == nil {
+			id, err = db.trackByTags(user, ent)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if id == nil {
+			unmatched = append(unmatched, ent)
+		} else {
+			trackIds = append(trackIds, *id)
+		}
+	}
+	return trackIds, unmatched, nil
+}
+
+// ImportPlaylist makes a playlist for a user from a playlist file.  dir
+// is where the file was, for entries with relative paths.
+func (db *DB) ImportPlaylist(user *User, pf *PlaylistFile, dir string, name string, parent *pid.PersistentID) (*PlaylistImport, error) {
+	trackIds, unmatched, err := db.MatchPlaylistEntries(user, pf.Entries, dir)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = pf.Name
+	}
+	if name == "" {
+		name = "Imported Playlist"
+	}
+	pl := NewPlaylist()
+	pl.OwnerID = user.PersistentID
+	pl.Kind = StandardPlaylist
+	pl.Name = name
+	pl.ParentPersistentID = parent
+	pl.TrackIDs = trackIds
+	err = db.SavePlaylist(pl)
+	if err != nil {
+		return nil, err
+	}
+	return &PlaylistImport{
+		Playlist: pl,
+		Entries: len(pf.Entries),
+		Matched: len(trackIds),
+		Unmatched: unmatched,
+	}, nil
+}
+
+// exportLocation is where a playlist file says a track is.  relative
+// paths are from the media folder, which is where such a playlist file
+// would go.
+func exportLocation(t *Track, absolute bool) string {
+	if t.Location == nil {
+		return ""
+	}
+	if absolute {
+		return t.Path()
+	}
+	fn := *t.Location
+	if filepath.IsAbs(fn) {
+		if finder := GetGlobalFinder(); finder != nil {
+			fn = finder.Clean(fn)
+		}
+	}
+	return filepath.ToSlash(fn)
+}
+
+func exportTitle(t *Track) string {
+	var artist, name string
+	if t.Artist != nil {
+		artist = *t.Artist
+	}
+	if t.Name != nil {
+		name = *t.Name
+	}
+	if artist == "" {
+		return name
+	}
+	return artist + " - " + name
+}
+
+func exportSeconds(t *Track) int {
+	if t.TotalTime == nil {
+		return -1
+	}
+	return int((*t.TotalTime + 500) / 1000)
+}
+
+// WritePlaylistFile writes tracks as an m3u8, pls or xspf playlist.
+// tracks that aren't files are left out.
+func WritePlaylistFile(w io.Writer, format PlaylistFormat, name string, tracks []*Track, absolute bool) error {
+	var data []byte
+	switch format {
+	case PlaylistM3U:
+		data = m3uPlaylist(name, tracks, absolute)
+	case PlaylistPLS:
+		data = plsPlaylist(tracks, absolute)
+	case PlaylistXSPF:
+		var err error
+		data, err = xspfData(name, tracks, absolute)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown playlist format %s", format)
+	}
+	_, err := w.Write(data)
+	return errors.Wrap(err, "can't write playlist file")
+}
+
+func m3uPlaylist(name string, tracks []*Track, absolute bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	if name != "" {
+		buf.WriteString("#PLAYLIST:" + name + "\n")
+	}
+	for _, t := range tracks {
+		loc := exportLocation(t, absolute)
+		if loc == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s\n", exportSeconds(t), exportTitle(t))
+		buf.WriteString(loc + "\n")
+	}
+	return buf.Bytes()
+}
+
+func plsPlaylist(tracks []*Track, absolute bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[playlist]\n")
+	n := 0
+	for _, t := range tracks {
+		loc := exportLocation(t, absolute)
+		if loc == "" {
+			continue
+		}
+		n++
+		fmt.Fprintf(&buf, "File%d=%s\n", n, loc)
+		fmt.Fprintf(&buf, "Title%d=%s\n", n, exportTitle(t))
+		fmt.Fprintf(&buf, "Length%d=%d\n", n, exportSeconds(t))
+	}
+	fmt.Fprintf(&buf, "NumberOfEntries=%d\nVersion=2\n", n)
+	return buf.Bytes()
+}
+
+func xspfData(name string, tracks []*Track, absolute bool) ([]byte, error) {
+	xpl := &xspfPlaylist{
+		Xmlns: "http://xspf.org/ns/0/",
+		Version: "1",
+		Title: name,
+		Tracks: []xspfTrack{},
+	}
+	for _, t := range tracks {
+		loc := exportLocation(t, absolute)
+		if loc == "" {
+			continue
+		}
+		u := &url.URL{Path: loc}
+		if absolute {
+			u.Scheme = "file"
+		}
+		xtr := xspfTrack{Location: []string{u.String()}}
+		if t.Name != nil {
+			xtr.Title = *t.Name
+		}
+		if t.Artist != nil {
+			xtr.Creator = *t.Artist
+		}
+		if t.Album != nil {
+			xtr.Album = *t.Album
+		}
+		if t.TotalTime != nil {
+			xtr.Duration = strconv.FormatUint(uint64(*t.TotalTime), 10)
+		}
+		xpl.Tracks = append(xpl.Tracks, xtr)
+	}
+	data, err := xml.MarshalIndent(xpl, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode xspf playlist")
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
@@ -0,0 +1,412 @@
+package musicdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+var ErrReorganizeInProgress = errors.New("an unfinished reorganization journal exists; roll it back first")
+
+// FileMove is one step of a library reorganization.  moves without a
+// track id carry cover art along with the tracks.
+type FileMove struct {
+	TrackID pid.PersistentID `json:"track_id,omitempty"`
+	Root    string           `json:"root"`
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Copy    bool             `json:"copy,omitempty"`
+}
+
+type ReorganizePlan struct {
+	Moves     []*FileMove `json:"moves"`
+	Unchanged int         `json:"unchanged"`
+	Errors    []string    `json:"errors,omitempty"`
+}
+
+type ReorganizeResult struct {
+	Moved  []*FileMove `json:"moved"`
+	Errors []string    `json:"errors,omitempty"`
+}
+
+type journalEntry struct {
+	Op   string    `json:"op"`
+	Move *FileMove `json:"move,omitempty"`
+}
+
+func (plan *ReorganizePlan) addError(fn string, err error) {
+	log.Println("reorganize error:", fn, err)
+	plan.Errors = append(plan.Errors, fmt.Sprintf("%s: %s", fn, err))
+}
+
+func (res *ReorganizeResult) addError(fn string, err error) {
+	log.Println("reorganize error:", fn, err)
+	res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", fn, err))
+}
+
+// reorganizeRoot picks the media folder a track's file should be
+// organized under: whichever one already holds it, or the user's own
+// media folder if it's somewhere else entirely
+func reorganizeRoot(finder *FileFinder, user *User, fn string) string {
+	roots := []string{}
+	if dn := finder.UserMediaFolder(user.HomeDirectory); dn != "" {
+		roots = append(roots, dn)
+	}
+	if dn := finder.GetMediaFolder(); dn != "" {
+		roots = append(roots, dn)
+	}
+	for _, root := range roots {
+		if pathAfter(fn, root) != "" {
+			return root
+		}
+	}
+	if len(roots) > 0 {
+		return roots[0]
+	}
+	return ""
+}
+
+// freePath finds a name for dst that isn't in use by a file other than
+// src or already claimed by an earlier move, by adding _2, _3, etc.
+func freePath(dst string, src os.FileInfo, claimed map[string]bool) string {
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+	for i := 1; ; i++ {
+		fn := dst
+		if i > 1 {
+			fn = fmt.Sprintf("%s_%d%s", base, i, ext)
+		}
+		if claimed[strings.ToLower(fn)] {
+			continue
+		}
+		st, err := os.Stat(fn)
+		if err == nil && (src == nil || !os.SameFile(st, src)) {
+			continue
+		}
+		return fn
+	}
+}
+
+// sidecarMoves brings along the cover art that GetAlbumArtFilename
+// would find next to the track's file
+func sidecarMoves(tr *Track, root, src, dst string, claimed map[string]bool) []*FileMove {
+	moves := []*FileMove{}
+	srcdir := filepath.Dir(src)
+	dstdir := filepath.Dir(dst)
+	srcbase := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	dstbase := strings.TrimSuffix(filepath.Base(dst), filepath.Ext(dst))
+	names := [][2]string{
+		{"cover_" + tr.PersistentID.String(), "cover_" + tr.PersistentID.String()},
+		{"cover_" + srcbase, "cover_" + dstbase},
+		{srcbase, dstbase},
+	}
+	for _, x := range []string{".jpg", ".png", ".gif"} {
+		for _, name := range names {
+			from := filepath.Join(srcdir, name[0] + x)
+			if _, err := os.Stat(from); err != nil {
+				continue
+			}
+			to := freePath(filepath.Join(dstdir, name[1] + x), nil, claimed)
+			claimed[strings.ToLower(to)] = true
+			moves = append(moves, &FileMove{Root: root, From: from, To: to})
+		}
+		// shared folder art is copied rather than moved, since other
+		// tracks in the old folder may still need it
+		from := filepath.Join(srcdir, "cover" + x)
+		to := filepath.Join(dstdir, "cover" + x)
+		if srcdir == dstdir || claimed[strings.ToLower(to)] {
+			continue
+		}
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		claimed[strings.ToLower(to)] = true
+		moves = append(moves, &FileMove{Root: root, From: from, To: to, Copy: true})
+	}
+	return moves
+}
+
+// PlanReorganize works out where each of a user's tracks would go under
+// Track.CanonicalPath, without touching anything
+func (db *DB) PlanReorganize(user *User) (*ReorganizePlan, error) {
+	finder := GetGlobalFinder()
+	if finder == nil {
+		return nil, errors.New("no file finder configured")
+	}
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.owner_id = ? AND track.location IS NOT NULL ORDER BY track.id`
+	rows, err := db.Query(qs, user.PersistentID)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query tracks")
+	}
+	defer rows.Close()
+	plan := &ReorganizePlan{Moves: []*FileMove{}}
+	claimed := map[string]bool{}
+	for rows.Next() {
+		tr := &Track{}
+		err = rows.StructScan(tr)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan track")
+		}
+		tr.db = db
+		src := tr.Path()
+		st, err := os.Stat(src)
+		if err != nil {
+			plan.addError(*tr.Location, err)
+			continue
+		}
+		root := reorganizeRoot(finder, user, src)
+		if root == "" {
+			plan.addError(src, errors.New("no media folder"))
+			continue
+		}
+		dst := freePath(filepath.Join(root, tr.CanonicalPath()), st, claimed)
+		claimed[strings.ToLower(dst)] = true
+		if dst == src {
+			plan.Unchanged++
+			continue
+		}
+		plan.Moves = append(plan.Moves, &FileMove{TrackID: tr.PersistentID, Root: root, From: src, To: dst})
+		plan.Moves = append(plan.Moves, sidecarMoves(tr, root, src, dst, claimed)...)
+	}
+	return plan, nil
+}
+
+func moveFile(src, dst string, copy bool) error {
+	st, err := os.Stat(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// rename would silently replace whatever showed up at dst since we
+	// made the plan, unless it's just a change of case
+	dstSt, err := os.Stat(dst)
+	if err == nil && !os.SameFile(st, dstSt) {
+		return errors.Wrap(os.ErrExist, dst)
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0775)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !copy {
+		err = os.Rename(src, dst)
+		if err == nil {
+			return nil
+		}
+		le, ok := err.(*os.LinkError)
+		if !ok || le.Err != syscall.EXDEV {
+			return errors.WithStack(err)
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_EXCL, st.Mode())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(dst)
+		return errors.WithStack(err)
+	}
+	// keep the mod time so the scanner still recognizes the file
+	os.Chtimes(dst, st.ModTime(), st.ModTime())
+	if !copy {
+		return errors.WithStack(os.Remove(src))
+	}
+	return nil
+}
+
+// pruneDirs removes dn and its parents, up to but not including root,
+// for as long as they're empty
+func pruneDirs(dn, root string) {
+	for dn != root && pathAfter(dn, root) != "" {
+		if os.Remove(dn) != nil {
+			return
+		}
+		dn = filepath.Dir(dn)
+	}
+}
+
+func (db *DB) relocateTrack(id pid.PersistentID, fn string) error {
+	loc := GetGlobalFinder().Clean(fn)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	qs := `UPDATE track SET location = ?, date_modified = ? WHERE id = ?`
+	_, err = tx.Exec(qs, loc, Now(), id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	qs = `UPDATE scan_file SET path = ? WHERE track_id = ?`
+	_, err = tx.Exec(qs, loc, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeJournal(j *os.File, op string, mv *FileMove) error {
+	data, err := json.Marshal(&journalEntry{Op: op, Move: mv})
+	if err != nil {
+		return err
+	}
+	_, err = j.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return j.Sync()
+}
+
+// Reorganize carries out a plan.  each move is recorded in the journal
+// once it's done, so that RollbackReorganize can put things back if
+// we're interrupted, and never touches files from moves that failed.
+// a finished journal is kept alongside with a .done suffix so a
+// completed run can be undone too.
+func (db *DB) Reorganize(plan *ReorganizePlan, journal string) (*ReorganizeResult, error) {
+	j, err := os.OpenFile(journal, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrReorganizeInProgress
+		}
+		return nil, errors.Wrap(err, "can't create reorganize journal")
+	}
+	defer j.Close()
+	res := &ReorganizeResult{Moved: []*FileMove{}}
+	for _, mv := range plan.Moves {
+		err = moveFile(mv.From, mv.To, mv.Copy)
+		if err != nil {
+			res.addError(mv.From, err)
+			continue
+		}
+		if mv.TrackID != 0 {
+			err = db.relocateTrack(mv.TrackID, mv.To)
+			if err != nil {
+				res.addError(mv.From, err)
+				moveFile(mv.To, mv.From, false)
+				continue
+			}
+		}
+		err = writeJournal(j, "move", mv)
+		if err != nil {
+			return res, errors.Wrap(err, "can't write reorganize journal")
+		}
+		if !mv.Copy {
+			pruneDirs(filepath.Dir(mv.From), mv.Root)
+		}
+		res.Moved = append(res.Moved, mv)
+	}
+	err = writeJournal(j, "complete", nil)
+	if err != nil {
+		return res, errors.Wrap(err, "can't write reorganize journal")
+	}
+	j.Close()
+	err = os.Rename(journal, journal + ".done")
+	if err != nil {
+		return res, errors.Wrap(err, "can't close out reorganize journal")
+	}
+	return res, nil
+}
+
+func readJournal(fn string) ([]*FileMove, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	moves := []*FileMove{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+	for scanner.Scan() {
+		entry := &journalEntry{}
+		err = json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			// a partial line from being killed mid-write
+			break
+		}
+		if entry.Op == "move" && entry.Move != nil {
+			moves = append(moves, entry.Move)
+		}
+	}
+	return moves, scanner.Err()
+}
+
+// RollbackReorganize undoes the moves recorded in a journal, newest
+// first.  it uses the unfinished journal if there is one, otherwise the
+// one from the last completed run.
+func (db *DB) RollbackReorganize(journal string) (*ReorganizeResult, error) {
+	fn := journal
+	moves, err := readJournal(fn)
+	if os.IsNotExist(err) {
+		fn = journal + ".done"
+		moves, err = readJournal(fn)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("no reorganize journal to roll back")
+		}
+		return nil, errors.Wrap(err, "can't read reorganize journal")
+	}
+	res := &ReorganizeResult{Moved: []*FileMove{}}
+	for i := len(moves) - 1; i >= 0; i-- {
+		mv := moves[i]
+		_, toErr := os.Stat(mv.To)
+		_, fromErr := os.Stat(mv.From)
+		if mv.Copy {
+			if toErr == nil && fromErr == nil {
+				err = os.Remove(mv.To)
+				if err != nil {
+					res.addError(mv.To, err)
+					continue
+				}
+				pruneDirs(filepath.Dir(mv.To), mv.Root)
+				res.Moved = append(res.Moved, mv)
+			}
+			continue
+		}
+		if toErr == nil && os.IsNotExist(fromErr) {
+			err = moveFile(mv.To, mv.From, false)
+			if err != nil {
+				res.addError(mv.To, err)
+				continue
+			}
+			pruneDirs(filepath.Dir(mv.To), mv.Root)
+			res.Moved = append(res.Moved, &FileMove{TrackID: mv.TrackID, Root: mv.Root, From: mv.To, To: mv.From})
+		} else if fromErr != nil {
+			// neither file is where we expect; leave it for a rescan
+			continue
+		}
+		if mv.TrackID != 0 {
+			err = db.relocateTrack(mv.TrackID, mv.From)
+			if err != nil {
+				res.addError(mv.From, err)
+			}
+		}
+	}
+	err = os.Rename(fn, journal + ".rolledback")
+	if err != nil {
+		return res, errors.Wrap(err, "can't close out reorganize journal")
+	}
+	return res, nil
+}
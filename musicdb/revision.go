@@ -0,0 +1,396 @@
+package musicdb
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+var ErrNoSuchRevision = errors.New("playlist revision does not exist")
+var ErrPlaylistChanged = errors.New("playlist changed while it was being saved")
+
+// TrackIDList is the tracks of a playlist revision, kept in the
+// database as one id per line
+type TrackIDList []pid.PersistentID
+
+func (tl TrackIDList) Value() (driver.Value, error) {
+	if tl == nil {
+		return nil, nil
+	}
+	lines := make([]string, len(tl))
+	for i, id := range tl {
+		lines[i] = id.String()
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (tl *TrackIDList) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		*tl = nil
+		return nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return errors.Errorf("can't scan %T into track id list", value)
+	}
+	ids := TrackIDList{}
+	for _, line := range strings.Fields(s) {
+		var id pid.PersistentID
+		err := (&id).Decode(line)
+		if err != nil {
+			return errors.Wrap(err, "can't decode track id " + line)
+		}
+		ids = append(ids, id)
+	}
+	*tl = ids
+	return nil
+}
+
+// PlaylistRevision is how a playlist was after one of the times it was
+// saved.  smart playlists and folders don't keep their tracks, since
+// they come from the rules or the playlists in them.
+type PlaylistRevision struct {
+	PlaylistID         pid.PersistentID  `json:"playlist_id" db:"playlist_id"`
+	Revision           int               `json:"revision" db:"revision"`
+	UserID             *pid.PersistentID `json:"user_id,omitempty" db:"user_id"`
+	Name               string            `json:"name" db:"name"`
+	ParentPersistentID *pid.PersistentID `json:"parent_persistent_id,omitempty" db:"parent_id"`
+	SortField          string            `json:"sort_field,omitempty" db:"sort_field"`
+	Smart              *Smart            `json:"smart,omitempty" db:"smart"`
+	TrackIDs           TrackIDList       `json:"track_ids,omitempty" db:"track_ids"`
+	TrackCount         int               `json:"track_count" db:"-"`
+	DateAdded          Time              `json:"date_added" db:"date_added"`
+}
+
+// PlaylistConflict is an edit that couldn't be merged with the changes
+// made to a playlist since the revision the edit was made to
+type PlaylistConflict struct {
+	BaseRevision    int               `json:"base_revision"`
+	CurrentRevision int               `json:"current_revision"`
+	// the fields both changed differently
+	Fields          []string          `json:"fields"`
+	Current         *PlaylistRevision `json:"current"`
+	// how the tracks were changed since the base revision, and how the
+	// edit changes them
+	Theirs          []TrackChange     `json:"theirs"`
+	Yours           []TrackChange     `json:"yours"`
+}
+
+// recordPlaylistRevision bumps the revision of a playlist being saved,
+// and keeps a copy of it.  given a base revision, it fails with
+// ErrPlaylistChanged if the playlist isn't at that revision anymore.
+func (db *DB) recordPlaylistRevision(tx *Tx, pl *Playlist, userId *pid.PersistentID, base *int) error {
+	qs := `UPDATE playlist SET revision = revision + 1 WHERE id = ?`
+	args := []interface{}{pl.PersistentID}
+	if base != nil {
+		qs += ` AND revision = ?`
+		args = append(args, *base)
+	}
+	var rev int
+	err := tx.QueryRow(qs + ` RETURNING revision`, args...).Scan(&rev)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return ErrPlaylistChanged
+		}
+		return err
+	}
+	var trackIds TrackIDList
+	if !pl.Folder && pl.Smart == nil {
+		trackIds = TrackIDList(pl.TrackIDs)
+		if trackIds == nil {
+			qs = `SELECT track_id FROM playlist_track WHERE playlist_id = ? ORDER BY position`
+			rows, err := tx.Query(qs, pl.PersistentID)
+			if err != nil {
+				return err
+			}
+			trackIds = TrackIDList{}
+			for rows.Next() {
+				var id pid.PersistentID
+				err = rows.Scan(&id)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				trackIds = append(trackIds, id)
+			}
+			rows.Close()
+		}
+	}
+	qs = `INSERT INTO playlist_revision (playlist_id, revision, user_id, name, parent_id, sort_field, smart, track_ids, date_added) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(qs, pl.PersistentID, rev, userId, pl.Name, pl.ParentPersistentID, pl.SortField, pl.Smart, trackIds, Now())
+	if err != nil {
+		return err
+	}
+	pl.Revision = rev
+	return nil
+}
+
+// PlaylistRevisions lists the revisions of a playlist, newest first,
+// with how many tracks each had instead of the tracks
+func (db *DB) PlaylistRevisions(pl *Playlist) ([]*PlaylistRevision, error) {
+	qs := `SELECT * FROM playlist_revision WHERE playlist_id = ? ORDER BY revision DESC`
+	rows, err := db.Query(qs, pl.PersistentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revs := []*PlaylistRevision{}
+	for rows.Next() {
+		rev := &PlaylistRevision{}
+		err = rows.StructScan(rev)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan playlist revision")
+		}
+		rev.TrackCount = len(rev.TrackIDs)
+		rev.TrackIDs = nil
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+// GetPlaylistRevision gets one revision of a playlist, or nil if there
+// isn't one by that number
+func (db *DB) GetPlaylistRevision(pl *Playlist, revision int) (*PlaylistRevision, error) {
+	qs := `SELECT * FROM playlist_revision WHERE playlist_id = ? AND revision = ?`
+	rev := &PlaylistRevision{}
+	err := db.QueryRow(qs, pl.PersistentID, revision).StructScan(rev)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rev.TrackCount = len(rev.TrackIDs)
+	return rev, nil
+}
+
+func samePID(a, b *pid.PersistentID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameSmart(a, b *Smart) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(serializeGob(a), serializeGob(b))
+}
+
+// mergePlaylistEdit merges an edit made to the base revision of a
+// playlist with the changes made to it since.  a field the edit didn't
+// change takes its current value, and tracks are merged a track at a
+// time.  it gives the fields that both changed differently.
+func mergePlaylistEdit(base *PlaylistRevision, cur, edit *Playlist) []string {
+	conflicts := []string{}
+	if edit.Name == base.Name {
+		edit.Name = cur.Name
+	} else if cur.Name != base.Name && cur.Name != edit.Name {
+		conflicts = append(conflicts, "name")
+	}
+	if samePID(edit.ParentPersistentID, base.ParentPersistentID) {
+		edit.ParentPersistentID = cur.ParentPersistentID
+	} else if !samePID(cur.ParentPersistentID, base.ParentPersistentID) && !samePID(cur.ParentPersistentID, edit.ParentPersistentID) {
+		conflicts = append(conflicts, "parent_persistent_id")
+	}
+	if edit.SortField == base.SortField {
+		edit.SortField = cur.SortField
+	} else if cur.SortField != base.SortField && cur.SortField != edit.SortField {
+		conflicts = append(conflicts, "sort_field")
+	}
+	if cur.Smart != nil {
+		if sameSmart(edit.Smart, base.Smart) {
+			edit.Smart = cur.Smart
+		} else if !sameSmart(cur.Smart, base.Smart) && !sameSmart(cur.Smart, edit.Smart) {
+			conflicts = append(conflicts, "smart")
+		}
+	} else if !cur.Folder {
+		trackIds, ok := ThreeWayMerge(base.TrackIDs, edit.TrackIDs, cur.TrackIDs)
+		if ok {
+			edit.TrackIDs = trackIds
+		} else {
+			conflicts = append(conflicts, "track_ids")
+		}
+	}
+	return conflicts
+}
+
+// SavePlaylistEdit saves an edit made to a playlist as it was at a base
+// revision.  if the playlist has been saved since, the edit is merged
+// with the changes; if they can't be merged, nothing is saved and the
+// conflict is returned.
+func (db *DB) SavePlaylistEdit(edit *Playlist, base int, user *User) (*PlaylistConflict, error) {
+	orig := *edit
+	owner := &User{PersistentID: edit.OwnerID}
+	for attempt := 0; attempt < 3; attempt++ {
+		*edit = orig
+		cur, err := db.GetPlaylist(edit.PersistentID, owner)
+		if err != nil {
+			return nil, err
+		}
+		if cur == nil {
+			return nil, errors.Errorf("playlist %s does not exist", edit.PersistentID)
+		}
+		if !cur.Folder && cur.Smart == nil {
+			cur.TrackIDs, err = db.PlaylistTrackIDs(cur)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cur.Revision != base {
+			baseRev, err := db.GetPlaylistRevision(cur, base)
+			if err != nil {
+				return nil, err
+			}
+			if baseRev == nil {
+				return nil, ErrNoSuchRevision
+			}
+			fields := mergePlaylistEdit(baseRev, cur, edit)
+			if len(fields) > 0 {
+				curRev, err := db.GetPlaylistRevision(cur, cur.Revision)
+				if err != nil {
+					return nil, err
+				}
+				return &PlaylistConflict{
+					BaseRevision: base,
+					CurrentRevision: cur.Revision,
+					Fields: fields,
+					Current: curRev,
+					Theirs: DiffTrackIDs(baseRev.TrackIDs, cur.TrackIDs),
+					Yours: DiffTrackIDs(baseRev.TrackIDs, orig.TrackIDs),
+				}, nil
+			}
+		}
+		err = db.savePlaylist(edit, &user.PersistentID, &cur.Revision)
+		if err != ErrPlaylistChanged {
+			return nil, err
+		}
+	}
+	return nil, ErrPlaylistChanged
+}
+
+// RestorePlaylistRevision puts a playlist back the way it was at a
+// revision.  the restore is saved as a new revision, so it can be undone
+// the same way.  tracks that have since been deleted stay gone.
+func (db *DB) RestorePlaylistRevision(pl *Playlist, revision int, user *User) error {
+	rev, err := db.GetPlaylistRevision(pl, revision)
+	if err != nil {
+		return err
+	}
+	if rev == nil {
+		return ErrNoSuchRevision
+	}
+	pl.Name = rev.Name
+	pl.ParentPersistentID = rev.ParentPersistentID
+	pl.SortField = rev.SortField
+	if pl.Smart != nil && rev.Smart != nil {
+		pl.Smart = rev.Smart
+	}
+	if !pl.Folder && pl.Smart == nil {
+		pl.TrackIDs, err = db.existingTrackIDs(rev.TrackIDs)
+		if err != nil {
+			return err
+		}
+	}
+	return db.savePlaylist(pl, &user.PersistentID, nil)
+}
+
+// existingTrackIDs drops the ids of tracks that have been deleted
+func (db *DB) existingTrackIDs(ids []pid.PersistentID) ([]pid.PersistentID, error) {
+	out := []pid.PersistentID{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	qms, args := idPlaceholders(ids)
+	qs := `SELECT id FROM track WHERE id IN (` + qms + `)`
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	exists := map[pid.PersistentID]bool{}
+	for rows.Next() {
+		var id pid.PersistentID
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		exists[id] = true
+	}
+	rows.Close()
+	for _, id := range ids {
+		if exists[id] {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+// BackfillPlaylistRevisions keeps the existing playlists as their first
+// revisions, so edits made to them can be merged
+func BackfillPlaylistRevisions(tx *sqlx.Tx) error {
+	wtx := &Tx{tx: tx}
+	qs := `SELECT * FROM playlist`
+	rows, err := wtx.Query(qs)
+	if err != nil {
+		return err
+	}
+	pls := []*Playlist{}
+	for rows.Next() {
+		pl := &Playlist{}
+		err = rows.StructScan(pl)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "can't scan row into playlist")
+		}
+		pls = append(pls, pl)
+	}
+	rows.Close()
+	qs = `SELECT playlist_id, track_id FROM playlist_track ORDER BY playlist_id, position`
+	rows, err = wtx.Query(qs)
+	if err != nil {
+		return err
+	}
+	tracks := map[pid.PersistentID]TrackIDList{}
+	for rows.Next() {
+		var plId, trId pid.PersistentID
+		err = rows.Scan(&plId, &trId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tracks[plId] = append(tracks[plId], trId)
+	}
+	rows.Close()
+	now := Now()
+	qs = `INSERT INTO playlist_revision (playlist_id, revision, user_id, name, parent_id, sort_field, smart, track_ids, date_added) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, pl := range pls {
+		var trackIds TrackIDList
+		if !pl.Folder && pl.Smart == nil {
+			trackIds = tracks[pl.PersistentID]
+			if trackIds == nil {
+				trackIds = TrackIDList{}
+			}
+		}
+		date := now
+		if pl.DateModified != nil {
+			date = *pl.DateModified
+		}
+		_, err = wtx.Exec(qs, pl.PersistentID, pl.Revision, nil, pl.Name, pl.ParentPersistentID, pl.SortField, pl.Smart, trackIds, date)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
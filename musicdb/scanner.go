@@ -0,0 +1,685 @@
+package musicdb
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+	"github.com/rclancey/synos/fingerprint"
+)
+
+var scanExts = map[string]bool{
+	".mp3": true,
+	".m4a": true,
+	".m4b": true,
+	".mp4": true,
+	".aac": true,
+	".flac": true,
+	".ogg": true,
+	".oga": true,
+	".opus": true,
+	".wav": true,
+}
+
+// ErrTooManyMissing is what a scan returns when so many known files
+// have gone that the media folder is more likely unmounted than
+// emptied.  the tracks of the missing files are kept unless the scan
+// is forced.
+var ErrTooManyMissing = errors.New("too many files missing from the media folder")
+
+// a scan that isn't forced only deletes the tracks of missing files
+// while there are no more than scanMaxMissing of them, or they're no
+// more than scanMaxMissingShare of the files in the library
+const scanMaxMissing = 20
+const scanMaxMissingShare = 0.1
+
+func IsAudioFile(fn string) bool {
+	return scanExts[strings.ToLower(filepath.Ext(fn))]
+}
+
+type ScanFile struct {
+	TrackID pid.PersistentID `db:"track_id"`
+	OwnerID pid.PersistentID `db:"owner_id"`
+	Path    string           `db:"path"`
+	Size    int64            `db:"size"`
+	ModDate Time             `db:"mod_date"`
+	Data    []byte           `db:"data"`
+}
+
+func (sf *ScanFile) signature() string {
+	return fmt.Sprintf("%d:%d", sf.Size, sf.ModDate)
+}
+
+func (sf *ScanFile) Matches(st os.FileInfo) bool {
+	return sf.Size == st.Size() && sf.ModDate == FromTime(st.ModTime())
+}
+
+type ScanResult struct {
+	Added   []*Track           `json:"added,omitempty"`
+	Updated []*Track           `json:"updated,omitempty"`
+	Moved   []*Track           `json:"moved,omitempty"`
+	Deleted []pid.PersistentID `json:"deleted,omitempty"`
+	Errors  []string           `json:"errors,omitempty"`
+}
+
+func (res *ScanResult) Changed() bool {
+	return len(res.Added) > 0 || len(res.Updated) > 0 || len(res.Moved) > 0 || len(res.Deleted) > 0
+}
+
+func (res *ScanResult) TrackIDs() []pid.PersistentID {
+	ids := []pid.PersistentID{}
+	for _, tr := range res.Tracks() {
+		ids = append(ids, tr.PersistentID)
+	}
+	return append(ids, res.Deleted...)
+}
+
+func (res *ScanResult) Tracks() []*Track {
+	tracks := []*Track{}
+	tracks = append(tracks, res.Added...)
+	tracks = append(tracks, res.Updated...)
+	tracks = append(tracks, res.Moved...)
+	return tracks
+}
+
+func (res *ScanResult) addError(fn string, err error) {
+	log.Printf("error scanning %s: %s", fn, err)
+	res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", fn, err))
+}
+
+type scanEntry struct {
+	fn string
+	st os.FileInfo
+}
+
+func (db *DB) LoadScanFiles(user *User) (map[string]*ScanFile, error) {
+	qs := `SELECT * FROM scan_file WHERE owner_id = ?`
+	rows, err := db.Query(qs, user.PersistentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := map[string]*ScanFile{}
+	for rows.Next() {
+		sf := &ScanFile{}
+		err = rows.StructScan(sf)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan scan_file row")
+		}
+		files[sf.Path] = sf
+	}
+	return files, nil
+}
+
+func (db *DB) GetScanFile(trackId pid.PersistentID) (*ScanFile, error) {
+	qs := `SELECT * FROM scan_file WHERE track_id = ?`
+	row := db.QueryRow(qs, trackId)
+	sf := &ScanFile{}
+	err := row.StructScan(sf)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return sf, nil
+}
+
+// ScanLibrary brings the library up to date with the user's media
+// folder.  with force, tracks are deleted for missing files even when
+// ErrTooManyMissing would otherwise hold them back.
+func (db *DB) ScanLibrary(user *User, force bool) (*ScanResult, error) {
+	finder := GetGlobalFinder()
+	if finder == nil {
+		return nil, errors.New("no file finder configured")
+	}
+	root := finder.UserMediaFolder(user.HomeDirectory)
+	if root == "" {
+		return nil, errors.Errorf("no media folder for %s", user.Username)
+	}
+	return db.ScanFolder(user, root, force)
+}
+
+func (db *DB) ScanFolder(user *User, root string, force bool) (*ScanResult, error) {
+	known, err := db.LoadScanFiles(user)
+	if err != nil {
+		return nil, err
+	}
+	res := &ScanResult{}
+	found := map[string]*scanEntry{}
+	err = db.walkFolder(root, found, res)
+	if err != nil {
+		return nil, err
+	}
+	// an empty media folder is almost certainly one that isn't mounted
+	if len(found) == 0 && len(known) > 0 && !force {
+		return res, errors.Wrapf(ErrTooManyMissing, "no files found in %s", root)
+	}
+	err = db.reconcile(user, known, found, len(known), force, res)
+	log.Printf("scanned %s for %s: %d added, %d updated, %d moved, %d deleted, %d errors", root, user.Username, len(res.Added), len(res.Updated), len(res.Moved), len(res.Deleted), len(res.Errors))
+	return res, err
+}
+
+func (db *DB) countScanFiles(user *User) (int, error) {
+	var n int
+	qs := `SELECT COUNT(*) FROM scan_file WHERE owner_id = ?`
+	err := db.QueryRow(qs, user.PersistentID).Scan(&n)
+	return n, err
+}
+
+func (db *DB) loadScanFilesUnder(user *User, loc string) ([]*ScanFile, error) {
+	prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(loc + sep)
+	qs := `SELECT * FROM scan_file WHERE owner_id = ? AND (path = ? OR path LIKE ?)`
+	rows, err := db.Query(qs, user.PersistentID, loc, prefix + "%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := []*ScanFile{}
+	for rows.Next() {
+		sf := &ScanFile{}
+		err = rows.StructScan(sf)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan scan_file row")
+		}
+		files = append(files, sf)
+	}
+	return files, nil
+}
+
+// ScanPaths applies just the changes to the given files or directories,
+// rather than rescanning the user's whole media folder
+func (db *DB) ScanPaths(user *User, fns []string) (*ScanResult, error) {
+	finder := GetGlobalFinder()
+	if finder == nil {
+		return nil, errors.New("no file finder configured")
+	}
+	root := finder.UserMediaFolder(user.HomeDirectory)
+	known := map[string]*ScanFile{}
+	found := map[string]*scanEntry{}
+	res := &ScanResult{}
+	for _, fn := range fns {
+		if filepath.Clean(fn) == root {
+			return db.ScanFolder(user, root, false)
+		}
+		if inHiddenFolder(fn, root) {
+			continue
+		}
+		loc := finder.Clean(fn)
+		sfs, err := db.loadScanFilesUnder(user, loc)
+		if err != nil {
+			return nil, err
+		}
+		for _, sf := range sfs {
+			known[sf.Path] = sf
+		}
+		st, err := os.Stat(fn)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				res.addError(fn, err)
+			}
+			continue
+		}
+		if st.IsDir() {
+			err = db.walkFolder(fn, found, res)
+			if err != nil {
+				return nil, err
+			}
+		} else if st.Mode().IsRegular() && IsAudioFile(fn) {
+			found[loc] = &scanEntry{fn: fn, st: st}
+		}
+	}
+	total, err := db.countScanFiles(user)
+	if err != nil {
+		return nil, err
+	}
+	err = db.reconcile(user, known, found, total, false, res)
+	return res, err
+}
+
+// inHiddenFolder tells whether a file is, or is in, a dot folder under
+// root, which walkFolder would skip
+func inHiddenFolder(fn, root string) bool {
+	rel := pathAfter(fn, root)
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) walkFolder(root string, found map[string]*scanEntry, res *ScanResult) error {
+	finder := GetGlobalFinder()
+	if finder == nil {
+		return errors.New("no file finder configured")
+	}
+	err := filepath.Walk(root, func(fn string, st os.FileInfo, err error) error {
+		if err != nil {
+			res.addError(fn, err)
+			return nil
+		}
+		if strings.HasPrefix(st.Name(), ".") && fn != root {
+			if st.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !st.Mode().IsRegular() || !IsAudioFile(fn) {
+			return nil
+		}
+		found[finder.Clean(fn)] = &scanEntry{fn: fn, st: st}
+		return nil
+	})
+	return errors.Wrap(err, "can't walk media folder " + root)
+}
+
+// reconcile applies the differences between the files we knew of and
+// the ones found.  total is how many files the library has in all, to
+// judge whether the missing ones are too many to be deleted.
+func (db *DB) reconcile(user *User, known map[string]*ScanFile, found map[string]*scanEntry, total int, force bool, res *ScanResult) error {
+	added := []string{}
+	for loc, ent := range found {
+		sf, ok := known[loc]
+		if !ok {
+			added = append(added, loc)
+			continue
+		}
+		delete(known, loc)
+		if sf.Matches(ent.st) {
+			continue
+		}
+		tr, err := db.scanUpdate(user, sf, ent)
+		if err != nil {
+			res.addError(ent.fn, err)
+		} else if tr != nil {
+			res.Updated = append(res.Updated, tr)
+		}
+	}
+	// anything left in known has disappeared from its old path.  if a
+	// new file has the same size and mod time, assume it was moved.
+	missing := map[string][]*ScanFile{}
+	for _, sf := range known {
+		sig := sf.signature()
+		missing[sig] = append(missing[sig], sf)
+	}
+	var fps map[pid.PersistentID]*fingerprint.Fingerprint
+	for _, loc := range added {
+		ent := found[loc]
+		sig := (&ScanFile{Size: ent.st.Size(), ModDate: FromTime(ent.st.ModTime())}).signature()
+		if cands := missing[sig]; len(cands) > 0 {
+			sf := cands[0]
+			if len(cands) > 1 {
+				if fps == nil {
+					fps = db.missingFingerprints(missing)
+				}
+				sf = db.pickMove(ent.fn, cands, fps)
+			}
+			removeMissing(missing, sf)
+			delete(known, sf.Path)
+			tr, err := db.scanMove(user, sf, loc)
+			if err != nil {
+				res.addError(ent.fn, err)
+			} else if tr != nil {
+				res.Moved = append(res.Moved, tr)
+			}
+			continue
+		}
+		if fps == nil {
+			fps = db.missingFingerprints(missing)
+		}
+		sf, fp := db.audioMove(ent.fn, missing, fps)
+		if sf != nil {
+			removeMissing(missing, sf)
+			delete(known, sf.Path)
+			delete(fps, sf.TrackID)
+			tr, err := db.scanMove(user, sf, loc)
+			if err == nil {
+				// the file has changed as well as moved
+				sf.Path = loc
+				tr, err = db.scanUpdate(user, sf, ent)
+			}
+			if err == nil {
+				err = db.SaveFingerprint(sf.TrackID, fp)
+			}
+			if err != nil {
+				res.addError(ent.fn, err)
+			} else if tr != nil {
+				res.Moved = append(res.Moved, tr)
+			}
+			continue
+		}
+		tr, err := db.scanAdd(user, loc, ent)
+		if err != nil {
+			res.addError(ent.fn, err)
+		} else {
+			res.Added = append(res.Added, tr)
+		}
+	}
+	if !force && len(known) > scanMaxMissing && float64(len(known)) > scanMaxMissingShare * float64(total) {
+		return errors.Wrapf(ErrTooManyMissing, "%d of %d files missing", len(known), total)
+	}
+	for _, sf := range known {
+		err := db.scanDelete(sf)
+		if err != nil {
+			res.addError(sf.Path, err)
+		} else {
+			res.Deleted = append(res.Deleted, sf.TrackID)
+		}
+	}
+	return nil
+}
+
+func removeMissing(missing map[string][]*ScanFile, sf *ScanFile) {
+	sig := sf.signature()
+	cands := missing[sig]
+	for i, x := range cands {
+		if x == sf {
+			cands = append(cands[:i], cands[i+1:]...)
+			break
+		}
+	}
+	if len(cands) == 0 {
+		delete(missing, sig)
+	} else {
+		missing[sig] = cands
+	}
+}
+
+// pickMove decides which of several missing files with the same size
+// and mod time a new file was moved from: the only one with the same
+// name, or else the one that sounds like it, or else the first
+func (db *DB) pickMove(fn string, cands []*ScanFile, fps map[pid.PersistentID]*fingerprint.Fingerprint) *ScanFile {
+	var named *ScanFile
+	for _, sf := range cands {
+		if strings.EqualFold(filepath.Base(sf.Path), filepath.Base(fn)) {
+			if named != nil {
+				named = nil
+				break
+			}
+			named = sf
+		}
+	}
+	if named != nil {
+		return named
+	}
+	sf, _ := db.audioMove(fn, map[string][]*ScanFile{"": cands}, fps)
+	if sf != nil {
+		return sf
+	}
+	return cands[0]
+}
+
+// missingFingerprints loads what we know of how missing files sounded
+func (db *DB) missingFingerprints(missing map[string][]*ScanFile) map[pid.PersistentID]*fingerprint.Fingerprint {
+	fps := map[pid.PersistentID]*fingerprint.Fingerprint{}
+	for _, cands := range missing {
+		for _, sf := range cands {
+			fp, err := db.GetFingerprint(sf.TrackID)
+			if err != nil {
+				log.Println("can't load fingerprint for", sf.TrackID, err)
+			} else if fp != nil {
+				fps[sf.TrackID] = fp
+			}
+		}
+	}
+	return fps
+}
+
+// audioMove looks for a missing file that sounds like a new one, for
+// files that were re-encoded or retagged on their way to a new path.
+// new files are only fingerprinted while there's something to match.
+func (db *DB) audioMove(fn string, missing map[string][]*ScanFile, fps map[pid.PersistentID]*fingerprint.Fingerprint) (*ScanFile, *fingerprint.Fingerprint) {
+	if len(fps) == 0 {
+		return nil, nil
+	}
+	fp, err := fingerprint.Calculate(fn)
+	if err != nil {
+		log.Println("can't fingerprint", fn, err)
+		return nil, nil
+	}
+	var match *ScanFile
+	best := FingerprintMatchThreshold
+	for _, cands := range missing {
+		for _, sf := range cands {
+			other, ok := fps[sf.TrackID]
+			if !ok {
+				continue
+			}
+			score := fingerprint.Compare(fp, other, fingerprintMaxOffset)
+			if score >= best {
+				match = sf
+				best = score
+			}
+		}
+	}
+	if match == nil {
+		return nil, nil
+	}
+	return match, fp
+}
+
+func (db *DB) scanTrack(user *User, loc string, ent *scanEntry) (*Track, error) {
+	tr, err := TrackFromAudioFile(ent.fn)
+	if tr == nil {
+		return nil, err
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	tr.Location = &loc
+	tr.OwnerID = user.PersistentID
+	tr.Homedir = user.HomeDirectory
+	if tr.Name == nil {
+		tr.Name = stringp(strings.TrimSuffix(filepath.Base(ent.fn), filepath.Ext(ent.fn)))
+	}
+	err = tr.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+func (db *DB) scanAdd(user *User, loc string, ent *scanEntry) (*Track, error) {
+	cur, err := db.scanTrack(user, loc, ent)
+	if err != nil {
+		return nil, err
+	}
+	tr := &Track{}
+	*tr = *cur
+	tr.db = db
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// the track may already be in the library from an itunes import
+	// or an upload, in which case we just start tracking its file
+	qs := `SELECT id FROM track WHERE owner_id = ? AND location = ?`
+	row := tx.QueryRow(qs, user.PersistentID, loc)
+	var id pid.PersistentID
+	err = row.Scan(&id)
+	if err == nil {
+		tr.PersistentID = id
+	} else if errors.Cause(err) == sql.ErrNoRows {
+		err = db.assignAlbum(tx, tr)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = db.saveStruct(tx, tr)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = db.assignArtists(tx, tr)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	} else {
+		tx.Rollback()
+		return nil, err
+	}
+	qs = `INSERT INTO scan_file (track_id, owner_id, path, size, mod_date, data) VALUES(?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(qs, tr.PersistentID, user.PersistentID, loc, ent.st.Size(), FromTime(ent.st.ModTime()), serializeGob(cur))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if id != 0 {
+		return db.GetTrack(id)
+	}
+	return tr, nil
+}
+
+func (db *DB) scanUpdate(user *User, sf *ScanFile, ent *scanEntry) (*Track, error) {
+	cur, err := db.scanTrack(user, sf.Path, ent)
+	if err != nil {
+		return nil, err
+	}
+	orig := &Track{}
+	if len(sf.Data) > 0 {
+		err = deserializeGob(sf.Data, orig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	track, err := db.GetTrack(sf.TrackID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if track != nil {
+		// only fields that changed in the file since the last scan are
+		// copied, so edits made in synos itself aren't clobbered
+		track.Update(orig, cur)
+		track.Size = cur.Size
+		track.TotalTime = cur.TotalTime
+		track.FileType = cur.FileType
+		// the audio may have changed, so measure it again
+		track.TrackGain = nil
+		track.TrackPeak = nil
+		track.AlbumGain = nil
+		track.AlbumPeak = nil
+		track.Validate()
+		err = db.assignAlbum(tx, track)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = db.updateStruct(tx, track)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = db.assignArtists(tx, track)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	// and fingerprint it again
+	err = db.deleteFingerprint(tx, sf.TrackID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	qs := `UPDATE scan_file SET size = ?, mod_date = ?, data = ? WHERE track_id = ?`
+	_, err = tx.Exec(qs, ent.st.Size(), FromTime(ent.st.ModTime()), serializeGob(cur), sf.TrackID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return track, tx.Commit()
+}
+
+func (db *DB) scanMove(user *User, sf *ScanFile, loc string) (*Track, error) {
+	track, err := db.GetTrack(sf.TrackID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if track != nil {
+		track.Location = &loc
+		err = db.updateStruct(tx, track)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	qs := `UPDATE scan_file SET path = ? WHERE track_id = ?`
+	_, err = tx.Exec(qs, loc, sf.TrackID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return track, tx.Commit()
+}
+
+func (db *DB) scanDelete(sf *ScanFile) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	log.Println("deleting scanned track", sf.TrackID, sf.Path)
+	_, err = db.trashTrack(tx, sf.TrackID, nil, TrashedByScanner, false)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	qs := `DELETE FROM scan_file WHERE track_id = ?`
+	_, err = tx.Exec(qs, sf.TrackID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RefreshScanFile records the current state of a track's file after
+// synos itself has rewritten it, so the next scan doesn't mistake the
+// change for an outside edit
+func (db *DB) RefreshScanFile(tr *Track) error {
+	sf, err := db.GetScanFile(tr.PersistentID)
+	if err != nil {
+		return err
+	}
+	fn := tr.Path()
+	st, err := os.Stat(fn)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	size := uint64(st.Size())
+	tr.Size = &size
+	qs := `UPDATE track SET size = ? WHERE id = ?`
+	_, err = db.Exec(qs, tr.Size, tr.PersistentID)
+	if err != nil {
+		return err
+	}
+	if sf == nil {
+		return nil
+	}
+	user := &User{PersistentID: tr.OwnerID, HomeDirectory: tr.Homedir}
+	cur, err := db.scanTrack(user, sf.Path, &scanEntry{fn: fn, st: st})
+	if err != nil {
+		return err
+	}
+	qs = `UPDATE scan_file SET size = ?, mod_date = ?, data = ? WHERE track_id = ?`
+	_, err = db.Exec(qs, st.Size(), FromTime(st.ModTime()), serializeGob(cur), sf.TrackID)
+	return err
+}
@@ -0,0 +1,90 @@
+package musicdb
+
+import (
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// QueuedScrobble is a play waiting to be submitted to a scrobbling
+// service.  scrobbles wait in the queue until the track has played long
+// enough to count, and stay there while the service is unreachable.
+type QueuedScrobble struct {
+	PersistentID pid.PersistentID  `json:"persistent_id" db:"id"`
+	UserID       pid.PersistentID  `json:"user_id" db:"user_id"`
+	Service      string            `json:"service" db:"service"`
+	PlayEventID  *pid.PersistentID `json:"play_event_id,omitempty" db:"play_event_id"`
+	PlayDate     Time              `json:"play_date" db:"play_date"`
+	// the listen to submit, as json
+	Data         string            `json:"data" db:"data"`
+	Attempts     int               `json:"attempts" db:"attempts"`
+	NextAttempt  Time              `json:"next_attempt" db:"next_attempt"`
+	LastError    *string           `json:"last_error,omitempty" db:"last_error"`
+}
+
+func (db *DB) QueueScrobble(q *QueuedScrobble) error {
+	if q.PersistentID == 0 {
+		q.PersistentID = pid.NewPersistentID()
+	}
+	qs := `INSERT INTO scrobble_queue (id, user_id, service, play_event_id, play_date, data, attempts, next_attempt, last_error) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(qs, q.PersistentID, q.UserID, q.Service, q.PlayEventID, q.PlayDate, q.Data, q.Attempts, q.NextAttempt, q.LastError)
+	return err
+}
+
+// DueScrobbles lists the scrobbles ready to be submitted, grouped by
+// user and service so they can go in batches
+func (db *DB) DueScrobbles(now Time, limit int) ([]*QueuedScrobble, error) {
+	qs := `SELECT * FROM scrobble_queue WHERE next_attempt <= ? ORDER BY user_id, service, play_date LIMIT ?`
+	rows, err := db.Query(qs, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	queue := []*QueuedScrobble{}
+	for rows.Next() {
+		q := &QueuedScrobble{}
+		err = rows.StructScan(q)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, q)
+	}
+	return queue, nil
+}
+
+// QueuedScrobbleCount says how many of a user's scrobbles haven't been
+// submitted yet
+func (db *DB) QueuedScrobbleCount(userId pid.PersistentID) (int, error) {
+	qs := `SELECT COUNT(*) FROM scrobble_queue WHERE user_id = ?`
+	var n int
+	err := db.QueryRow(qs, userId).Scan(&n)
+	return n, err
+}
+
+func (db *DB) DeleteScrobble(id pid.PersistentID) error {
+	qs := `DELETE FROM scrobble_queue WHERE id = ?`
+	_, err := db.Exec(qs, id)
+	return err
+}
+
+// RetryScrobble saves a failed scrobble's attempt count, error and
+// next attempt time
+func (db *DB) RetryScrobble(q *QueuedScrobble) error {
+	qs := `UPDATE scrobble_queue SET attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?`
+	_, err := db.Exec(qs, q.Attempts, q.NextAttempt, q.LastError, q.PersistentID)
+	return err
+}
+
+// CancelScrobbles drops scrobbles of a play that turned out not to
+// count, because it was skipped too soon
+func (db *DB) CancelScrobbles(playEventId pid.PersistentID) error {
+	qs := `DELETE FROM scrobble_queue WHERE play_event_id = ? AND attempts = 0`
+	_, err := db.Exec(qs, playEventId)
+	return err
+}
+
+// ClearScrobbles drops a user's queued scrobbles for a service, when
+// they disconnect from it
+func (db *DB) ClearScrobbles(userId pid.PersistentID, service string) error {
+	qs := `DELETE FROM scrobble_queue WHERE user_id = ? AND service = ?`
+	_, err := db.Exec(qs, userId, service)
+	return err
+}
@@ -0,0 +1,708 @@
+package musicdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// how close a word has to be to count as a typo of another, in
+// trigram word similarity.  this is pg_trgm's own default, and is enough
+// for a swapped pair of letters in a word of 6 or more.
+const searchFuzziness = 0.3
+
+// words shorter than this have too few trigrams to be matched loosely
+const searchFuzzyLength = 4
+
+// the text the free part of a search query is matched loosely against
+const searchText = `coalesce(track.name, '') || ' ' || coalesce(track.artist, '') || ' ' || coalesce(track.album_artist, '') || ' ' || coalesce(track.album, '') || ' ' || coalesce(track.composer, '')`
+
+// the weighted search index kept by the database for the track's
+// fields, and the one for its lyrics, if it has any
+const searchVector = `track.search_vector`
+const searchLyricsVector = `(SELECT lyrics.search_vector FROM lyrics WHERE lyrics.id = track.lyrics_id)`
+
+// searchVectorMatch matches a full text query against the track and its
+// lyrics.  the query is used twice, so it needs to be given twice.
+func searchVectorMatch(q TextQuery) string {
+	return `(` + dialect.TextMatch(searchVector, q) + ` OR ` + dialect.TextMatch(searchLyricsVector, q) + `)`
+}
+
+// SearchTerm is one part of a search box query: a word or quoted phrase
+// to look for anywhere, or a value for a field.  numeric fields have an
+// inclusive range instead of a value.
+type SearchTerm struct {
+	Field  string `json:"field,omitempty"`
+	Value  string `json:"value"`
+	Phrase bool   `json:"phrase,omitempty"`
+	Not    bool   `json:"not,omitempty"`
+	Min    *int64 `json:"min,omitempty"`
+	Max    *int64 `json:"max,omitempty"`
+}
+
+// columns searched by each text qualifier
+var searchTextFields = map[string][]string{
+	"artist":       []string{"artist", "album_artist", "composer"},
+	"album":        []string{"album"},
+	"album_artist": []string{"album_artist"},
+	"albumartist":  []string{"album_artist"},
+	"composer":     []string{"composer"},
+	"song":         []string{"name"},
+	"name":         []string{"name"},
+	"title":        []string{"name"},
+	"grouping":     []string{"grouping"},
+	"comment":      []string{"comments"},
+	"comments":     []string{"comments"},
+}
+
+var searchNumericFields = map[string]string{
+	"year":   "date_part('year', track.release_date)",
+	"rating": "track.rating",
+	"plays":  "track.play_count",
+	"bpm":    "track.bpm",
+}
+
+// columns with a sort_ counterpart
+var searchSortColumns = map[string]bool{
+	"artist":       true,
+	"album_artist": true,
+	"composer":     true,
+	"album":        true,
+	"name":         true,
+	"genre":        true,
+}
+
+// ParseSearch splits a search box query into terms.  words and "quoted
+// phrases" are looked for anywhere; field:value looks in one field, as
+// do field:"quoted value", year:1990..1999 and rating:>=4.  a leading -
+// excludes what follows.  anything that doesn't make sense as a
+// qualifier is taken as text to look for.
+func ParseSearch(q string) []*SearchTerm {
+	terms := []*SearchTerm{}
+	rs := []rune(q)
+	i := 0
+	for i < len(rs) {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+		start := i
+		term := &SearchTerm{}
+		if rs[i] == '-' {
+			term.Not = true
+			i++
+		}
+		// field:
+		j := i
+		for j < len(rs) && (unicode.IsLetter(rs[j]) || rs[j] == '_') {
+			j++
+		}
+		if j > i && j < len(rs) && rs[j] == ':' {
+			field := strings.ToLower(string(rs[i:j]))
+			_, isText := searchTextFields[field]
+			_, isNum := searchNumericFields[field]
+			if isText || isNum || field == "genre" || field == "lyrics" {
+				term.Field = field
+				i = j + 1
+			}
+		}
+		// value
+		if i < len(rs) && (rs[i] == '"' || rs[i] == '\'') {
+			quote := rs[i]
+			j = i + 1
+			for j < len(rs) && rs[j] != quote {
+				j++
+			}
+			term.Value = string(rs[i+1:j])
+			term.Phrase = term.Field == ""
+			if j < len(rs) {
+				j++
+			}
+		} else {
+			j = i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) {
+				j++
+			}
+			term.Value = string(rs[i:j])
+		}
+		i = j
+		if _, ok := searchNumericFields[term.Field]; ok {
+			if !term.parseRange() {
+				// not a number after all
+				term.Field = ""
+				term.Value = string(rs[start:i])
+				term.Not = false
+				term.Min = nil
+				term.Max = nil
+			}
+		}
+		term.Value = strings.TrimSpace(term.Value)
+		if term.Value == "" {
+			continue
+		}
+		if term.Phrase && strings.IndexFunc(term.Value, unicode.IsSpace) < 0 {
+			term.Phrase = false
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// parseRange reads n, a..b, a.., ..b, >n, >=n, <n and <=n into Min and
+// Max.  ratings are in stars.
+func (t *SearchTerm) parseRange() bool {
+	scale := 1.0
+	if t.Field == "rating" {
+		scale = 20
+	}
+	num := func(s string) (int64, bool) {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, false
+		}
+		return int64(math.Round(v * scale)), true
+	}
+	s := t.Value
+	var ok bool
+	var n int64
+	switch {
+	case strings.Contains(s, ".."):
+		parts := strings.SplitN(s, "..", 2)
+		if parts[0] == "" && parts[1] == "" {
+			return false
+		}
+		if parts[0] != "" {
+			n, ok = num(parts[0])
+			if !ok {
+				return false
+			}
+			t.Min = &n
+		}
+		if parts[1] != "" {
+			m, ok := num(parts[1])
+			if !ok {
+				return false
+			}
+			t.Max = &m
+		}
+		return true
+	case strings.HasPrefix(s, ">="):
+		n, ok = num(s[2:])
+		t.Min = &n
+	case strings.HasPrefix(s, "<="):
+		n, ok = num(s[2:])
+		t.Max = &n
+	case strings.HasPrefix(s, ">"):
+		n, ok = num(s[1:])
+		n += 1
+		t.Min = &n
+	case strings.HasPrefix(s, "<"):
+		n, ok = num(s[1:])
+		n -= 1
+		t.Max = &n
+	default:
+		n, ok = num(strings.TrimPrefix(s, "="))
+		m := n
+		t.Min = &n
+		t.Max = &m
+	}
+	return ok
+}
+
+// tsWords turns a word from the query into a prefix tsquery, dropping
+// the punctuation that means something to to_tsquery
+func tsWords(w string) string {
+	parts := strings.FieldsFunc(w, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, p := range parts {
+		parts[i] = p + ":*"
+	}
+	return strings.Join(parts, " & ")
+}
+
+// where gives the filter for a term, or "" if there's nothing to it
+func (t *SearchTerm) where() (string, []interface{}) {
+	var qs string
+	args := []interface{}{}
+	if col, ok := searchNumericFields[t.Field]; ok {
+		conds := []string{}
+		if t.Min != nil {
+			conds = append(conds, col + " >= ?")
+			args = append(args, *t.Min)
+		}
+		if t.Max != nil {
+			conds = append(conds, col + " <= ?")
+			args = append(args, *t.Max)
+		}
+		if len(conds) == 0 {
+			return "", nil
+		}
+		qs = "(" + strings.Join(conds, " AND ") + ")"
+	} else if t.Field == "genre" {
+		qs, args = searchSort("genre", t.Value)
+	} else if t.Field == "lyrics" {
+		qs = dialect.TextMatch(searchLyricsVector, TextPlain)
+		args = append(args, t.Value)
+	} else if cols, ok := searchTextFields[t.Field]; ok {
+		any := []string{}
+		for _, col := range cols {
+			if searchSortColumns[col] {
+				q, vs := searchLoose(col, t.Value)
+				any = append(any, q)
+				args = append(args, vs...)
+			} else {
+				any = append(any, col + " ILIKE ?")
+				args = append(args, "%" + likeEscape(t.Value) + "%")
+			}
+			if !t.Not && len([]rune(t.Value)) >= searchFuzzyLength {
+				any = append(any, fmt.Sprintf("word_similarity(?, %s) >= %g", col, searchFuzziness))
+				args = append(args, t.Value)
+			}
+		}
+		qs = "(" + strings.Join(any, " OR ") + ")"
+	} else if t.Phrase {
+		qs = `(` + searchVectorMatch(TextPhrase) + ` OR ` + searchText + ` ILIKE ?)`
+		args = append(args, t.Value, t.Value, "%" + likeEscape(t.Value) + "%")
+	} else {
+		tsq := tsWords(t.Value)
+		if tsq == "" {
+			return "", nil
+		}
+		if t.Not {
+			qs = searchVectorMatch(TextPrefix)
+			args = append(args, tsq, tsq)
+		} else {
+			// a query of only stop words would otherwise match nothing
+			any := []string{dialect.TextEmpty(TextPrefix), searchVectorMatch(TextPrefix)}
+			args = append(args, tsq, tsq, tsq)
+			if len([]rune(t.Value)) >= searchFuzzyLength {
+				any = append(any, fmt.Sprintf(`word_similarity(?, %s) >= %g`, searchText, searchFuzziness))
+				args = append(args, t.Value)
+			}
+			qs = "(" + strings.Join(any, " OR ") + ")"
+		}
+	}
+	if t.Not {
+		// tracks without the field aren't excluded
+		qs = "NOT COALESCE(" + qs + ", false)"
+	}
+	return qs, args
+}
+
+// searchWords is the free text of the query that's looked for, rather
+// than excluded
+func searchWords(terms []*SearchTerm) []string {
+	words := []string{}
+	for _, t := range terms {
+		if t.Field == "" && !t.Not {
+			words = append(words, t.Value)
+		}
+	}
+	return words
+}
+
+// searchRank scores tracks by how well they match the free text of the
+// query, or gives "" if there isn't any
+func searchRank(terms []*SearchTerm) (string, []interface{}) {
+	words := searchWords(terms)
+	if len(words) == 0 {
+		return "", nil
+	}
+	tsqs := []string{}
+	for _, w := range words {
+		tsq := tsWords(w)
+		if tsq != "" {
+			tsqs = append(tsqs, tsq)
+		}
+	}
+	qs := dialect.TextRank(dialect.TextConcat(searchVector, searchLyricsVector), TextPrefix) + ` + word_similarity(?, ` + searchText + `)`
+	return qs, []interface{}{strings.Join(tsqs, " & "), strings.Join(words, " ")}
+}
+
+// trigrams are the pg_trgm trigrams of a lowercase word
+func trigrams(w string) map[string]bool {
+	rs := append(append([]rune("  "), []rune(w)...), ' ')
+	tgs := map[string]bool{}
+	for i := 0; i + 3 <= len(rs); i++ {
+		tgs[string(rs[i:i+3])] = true
+	}
+	return tgs
+}
+
+func trigramSimilarity(a, b string) float64 {
+	ta := trigrams(a)
+	tb := trigrams(b)
+	common := 0
+	for tg := range ta {
+		if tb[tg] {
+			common++
+		}
+	}
+	total := len(ta) + len(tb) - common
+	if total == 0 {
+		return 0
+	}
+	return float64(common) / float64(total)
+}
+
+// Highlight is a run of runes in a name that matched the search
+type Highlight [2]int
+
+// searchMatch looks for each of the words in the texts: as a phrase, a
+// prefix of a word or a likely typo of one.  it gives the runs that
+// matched in each text, and a score, or false if some word can't be
+// found anywhere.
+func searchMatch(words []string, texts ...string) ([][]Highlight, float64, bool) {
+	type textWord struct {
+		word       string
+		start, end int
+	}
+	lowers := make([][]rune, len(texts))
+	split := make([][]textWord, len(texts))
+	hls := make([][]Highlight, len(texts))
+	for i, text := range texts {
+		rs := []rune(text)
+		for j, r := range rs {
+			rs[j] = unicode.ToLower(r)
+		}
+		lowers[i] = rs
+		hls[i] = []Highlight{}
+		start := -1
+		for j := 0; j <= len(rs); j++ {
+			if j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j])) {
+				if start < 0 {
+					start = j
+				}
+			} else if start >= 0 {
+				split[i] = append(split[i], textWord{string(rs[start:j]), start, j})
+				start = -1
+			}
+		}
+	}
+	total := 0.0
+	for _, w := range words {
+		lw := []rune(strings.ToLower(w))
+		best := 0.0
+		if strings.IndexFunc(w, unicode.IsSpace) >= 0 {
+			for i, rs := range lowers {
+				idx := strings.Index(string(rs), string(lw))
+				if idx >= 0 {
+					start := len([]rune(string(rs)[:idx]))
+					hls[i] = append(hls[i], Highlight{start, start + len(lw)})
+					best = 1
+				}
+			}
+		} else {
+			for i, tws := range split {
+				for _, tw := range tws {
+					var score float64
+					switch {
+					case tw.word == string(lw):
+						score = 1
+					case strings.HasPrefix(tw.word, string(lw)):
+						score = 0.8
+					case len(lw) >= searchFuzzyLength:
+						sim := trigramSimilarity(string(lw), tw.word)
+						if sim >= searchFuzziness {
+							score = 0.7 * sim
+						}
+					}
+					if score > 0 {
+						hls[i] = append(hls[i], Highlight{tw.start, tw.end})
+						if score > best {
+							best = score
+						}
+					}
+				}
+			}
+		}
+		if best == 0 {
+			return nil, 0, false
+		}
+		total += best
+	}
+	for _, hl := range hls {
+		sort.Slice(hl, func(a, b int) bool { return hl[a][0] < hl[b][0] })
+	}
+	if len(words) == 0 {
+		return hls, 0, true
+	}
+	return hls, total / float64(len(words)), true
+}
+
+// SearchHit is an artist, album or playlist whose name matches the
+// free text of a search
+type SearchHit struct {
+	Name         string            `json:"name"`
+	SortName     string            `json:"sort,omitempty"`
+	Artist       *string           `json:"artist,omitempty"`
+	PersistentID *pid.PersistentID `json:"persistent_id,omitempty"`
+	Count        int               `json:"count,omitempty"`
+	Score        float64           `json:"score"`
+	Highlights   []Highlight       `json:"highlights"`
+}
+
+type SearchHits struct {
+	Artists   []*SearchHit `json:"artists"`
+	Albums    []*SearchHit `json:"albums"`
+	Playlists []*SearchHit `json:"playlists"`
+}
+
+type sortableHits []*SearchHit
+
+func (s sortableHits) Len() int { return len(s) }
+func (s sortableHits) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sortableHits) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].Count > s[j].Count
+}
+
+func topHits(hits []*SearchHit, n int) []*SearchHit {
+	sort.Stable(sortableHits(hits))
+	if n > 0 && len(hits) > n {
+		return hits[:n]
+	}
+	return hits
+}
+
+// SearchHits groups what a search finds into artists, albums and
+// playlists whose names match its free text, up to n of each.  the
+// qualifiers in the search narrow down the artists and albums, but
+// playlists are only matched by name.
+func (db *DB) SearchHits(s Search, user *User, n int) (*SearchHits, error) {
+	hits := &SearchHits{
+		Artists: []*SearchHit{},
+		Albums: []*SearchHit{},
+		Playlists: []*SearchHit{},
+	}
+	words := searchWords(s.Terms)
+	if len(words) == 0 {
+		return hits, nil
+	}
+	artists, err := db.SearchArtists(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, art := range artists {
+		name := art.Sorted()[0]
+		hls, score, ok := searchMatch(words, name)
+		if ok {
+			var id *pid.PersistentID
+			if art.PersistentID != 0 {
+				id = &art.PersistentID
+			}
+			hits.Artists = append(hits.Artists, &SearchHit{
+				Name: name,
+				PersistentID: id,
+				SortName: art.SortName,
+				Count: art.Count(),
+				Score: score,
+				Highlights: hls[0],
+			})
+		}
+	}
+	hits.Artists = topHits(hits.Artists, n)
+	albums, err := db.SearchAlbums(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, alb := range albums {
+		name := alb.Sorted()[0]
+		var artist *string
+		artistName := ""
+		if alb.Artist != nil {
+			artistName = alb.Artist.Sorted()[0]
+			artist = &artistName
+		}
+		hls, score, ok := searchMatch(words, name, artistName)
+		if ok && len(hls[0]) > 0 {
+			var id *pid.PersistentID
+			if alb.PersistentID != 0 {
+				id = &alb.PersistentID
+			}
+			hits.Albums = append(hits.Albums, &SearchHit{
+				Name: name,
+				PersistentID: id,
+				SortName: alb.SortName,
+				Artist: artist,
+				Count: alb.Count(),
+				Score: score,
+				Highlights: hls[0],
+			})
+		}
+	}
+	hits.Albums = topHits(hits.Albums, n)
+	qs := `SELECT * FROM playlist WHERE`
+	args := []interface{}{}
+	if user == nil {
+		qs += ` shared = true`
+	} else {
+		qs += ` (owner_id = ? OR shared = true)`
+		args = append(args, user.PersistentID)
+	}
+	for _, w := range words {
+		qs += fmt.Sprintf(` AND (name ILIKE ? OR word_similarity(?, name) >= %g)`, searchFuzziness)
+		args = append(args, "%" + likeEscape(w) + "%", w)
+	}
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pl Playlist
+		err = rows.StructScan(&pl)
+		if err != nil {
+			return nil, err
+		}
+		hls, score, ok := searchMatch(words, pl.Name)
+		if ok {
+			id := pl.PersistentID
+			hits.Playlists = append(hits.Playlists, &SearchHit{
+				Name: pl.Name,
+				PersistentID: &id,
+				Score: score,
+				Highlights: hls[0],
+			})
+		}
+	}
+	hits.Playlists = topHits(hits.Playlists, n)
+	return hits, nil
+}
+
+// SearchHighlights finds where the free text of a search matched in the
+// name, artist and album of each track
+func SearchHighlights(terms []*SearchTerm, tracks []*Track) map[string]map[string][]Highlight {
+	words := searchWords(terms)
+	res := map[string]map[string][]Highlight{}
+	if len(words) == 0 {
+		return res
+	}
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	for _, tr := range tracks {
+		fields := []string{"name", "artist", "album"}
+		hls, _, _ := searchMatch(words, str(tr.Name), str(tr.Artist), str(tr.Album))
+		if hls == nil {
+			continue
+		}
+		m := map[string][]Highlight{}
+		for i, hl := range hls {
+			if len(hl) > 0 {
+				m[fields[i]] = hl
+			}
+		}
+		if len(m) > 0 {
+			res[tr.PersistentID.String()] = m
+		}
+	}
+	return res
+}
+
+// LyricsHit is a track whose lyrics match a search, with the line that
+// matches best
+type LyricsHit struct {
+	Track      *Track      `json:"track"`
+	Line       string      `json:"line"`
+	LineNumber int         `json:"line_number"`
+	Highlights []Highlight `json:"highlights"`
+}
+
+// lyricsLine finds the line of the lyrics where the most of the words
+// can be found, and the first such line if there's a tie
+func lyricsLine(words []string, lyrics string) (int, string, []Highlight) {
+	bestN := -1
+	bestLine := 0
+	bestHls := []Highlight{}
+	lines := strings.Split(strings.ReplaceAll(lyrics, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := 0
+		hls := []Highlight{}
+		for _, w := range words {
+			hl, _, ok := searchMatch([]string{w}, line)
+			if ok {
+				n++
+				hls = append(hls, hl[0]...)
+			}
+		}
+		if n > bestN {
+			bestN = n
+			bestLine = i
+			bestHls = hls
+		}
+	}
+	if bestN < 0 {
+		return 0, "", bestHls
+	}
+	sort.Slice(bestHls, func(a, b int) bool { return bestHls[a][0] < bestHls[b][0] })
+	return bestLine + 1, lines[bestLine], bestHls
+}
+
+type lyricsSearchRow struct {
+	Track
+	LyricsText string `db:"lyrics_text"`
+}
+
+// SearchLyricsCount is the number of tracks SearchLyrics would find
+func (db *DB) SearchLyricsCount(q string) (int, error) {
+	qs := `SELECT COUNT(*) FROM track JOIN lyrics ON lyrics.id = track.lyrics_id WHERE ` + dialect.TextMatch(`lyrics.search_vector`, TextWeb)
+	var n int
+	err := db.QueryRow(qs, q).Scan(&n)
+	if err != nil {
+		return -1, err
+	}
+	return n, nil
+}
+
+// SearchLyrics finds tracks whose lyrics match a web search style query
+// (words, "quoted phrases", or and -excluded words), best matches first,
+// along with the line of each that matched
+func (db *DB) SearchLyrics(q string, limit, offset int) ([]*LyricsHit, error) {
+	qs := `SELECT track.*, xuser.homedir, lyrics.lyrics AS lyrics_text FROM track JOIN lyrics ON lyrics.id = track.lyrics_id JOIN xuser ON track.owner_id = xuser.id WHERE ` + dialect.TextMatch(`lyrics.search_vector`, TextWeb) + ` ORDER BY ` + dialect.TextRank(`lyrics.search_vector`, TextWeb) + ` DESC, track.sort_artist, track.sort_name`
+	args := []interface{}{q, q}
+	if limit > 0 {
+		qs += ` LIMIT ?`
+		args = append(args, limit)
+		if offset > 0 {
+			qs += ` OFFSET ?`
+			args = append(args, offset)
+		}
+	}
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	words := searchWords(ParseSearch(q))
+	hits := []*LyricsHit{}
+	for rows.Next() {
+		var row lyricsSearchRow
+		err = rows.StructScan(&row)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan row into track")
+		}
+		tr := &row.Track
+		tr.db = db
+		tr.Lyrics = &row.LyricsText
+		hit := &LyricsHit{Track: tr}
+		hit.LineNumber, hit.Line, hit.Highlights = lyricsLine(words, row.LyricsText)
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
@@ -6,7 +6,10 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -37,17 +40,110 @@ type Rule struct {
 	BoolValue      *bool         `json:"bool"`
 	MediaKindValue *MediaKind    `json:"media_kind,omitempty"`
 	PlaylistValue  *pid.PersistentID `json:"playlist,omitempty"`
-	playlistKey    string
+	// with IntValues, for relative dates
+	Unit           *Unit         `json:"unit,omitempty"`
 }
 
+// likeEscape keeps wildcards in a value from matching as wildcards
+func likeEscape(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func (r *Rule) Not() bool {
 	return r.LogicSign == NEG || r.LogicSign == STRNEG
 }
 
+// IsPlaylistRule says whether the rule is about playlist membership,
+// either as a playlist rule or a rule on the playlist id field
+func (r *Rule) IsPlaylistRule() bool {
+	if r.RuleType == PlaylistRule {
+		return true
+	}
+	return r.Field != nil && *r.Field == PlaylistPersistentID && (r.RuleType == IntRule || r.RuleType == StringRule)
+}
+
+func (r *Rule) playlistID() *pid.PersistentID {
+	if r.RuleType == PlaylistRule {
+		return r.PlaylistValue
+	}
+	if len(r.IntValues) > 0 {
+		p := pid.PersistentID(r.IntValues[0])
+		return &p
+	}
+	if len(r.StringValues) > 0 && r.StringValues[0] != "" {
+		p := new(pid.PersistentID)
+		if p.Decode(r.StringValues[0]) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+func (r *Rule) boolField() Field {
+	if r.RuleType == LoveRule || r.Field == nil {
+		return Loved
+	}
+	return *r.Field
+}
+
+// Relative gives how far back a WITHIN rule reaches.  older rules only
+// have a number of milliseconds in TimeValues, which can be negative as
+// they come from iTunes.
+func (r *Rule) Relative() (int64, Unit) {
+	if r.Unit != nil && len(r.IntValues) > 0 {
+		n := r.IntValues[0]
+		if n < 0 {
+			n = -n
+		}
+		switch *r.Unit {
+		case Seconds, Minutes, Hours, Days, Weeks, Months:
+			return n, *r.Unit
+		}
+		return n, Days
+	}
+	if len(r.TimeValues) == 0 {
+		return 0, Seconds
+	}
+	ms := int64(r.TimeValues[0])
+	if ms < 0 {
+		ms = -ms
+	}
+	return ms / 1000, Seconds
+}
+
+// relativeCutoff is the time a WITHIN rule reaches back to from now
+func (r *Rule) relativeCutoff(now time.Time) time.Time {
+	n, unit := r.Relative()
+	switch unit {
+	case Minutes:
+		return now.Add(-time.Duration(n) * time.Minute)
+	case Hours:
+		return now.Add(-time.Duration(n) * time.Hour)
+	case Days:
+		return now.AddDate(0, 0, -int(n))
+	case Weeks:
+		return now.AddDate(0, 0, -7 * int(n))
+	case Months:
+		return now.AddDate(0, -int(n), 0)
+	}
+	return now.Add(-time.Duration(n) * time.Second)
+}
+
 func (r *Rule) Where() (string, []interface{}) {
 	if r.RuleType == RulesetRule {
 		return r.RuleSet.Where()
 	}
+	if r.RuleType != PlaylistRule && r.IsPlaylistRule() {
+		pr := &Rule{
+			RuleType: PlaylistRule,
+			LogicSign: r.LogicSign,
+			Operator: IS,
+			PlaylistValue: r.playlistID(),
+		}
+		return pr.Where()
+	}
 	var qs string
 	args := []interface{}{}
 	switch r.RuleType {
@@ -56,7 +152,7 @@ func (r *Rule) Where() (string, []interface{}) {
 			if r.Not() {
 				qs = fmt.Sprintf("(%s IS NOT NULL AND %s != ?)", r.Field.Column(), r.Field.Column())
 			} else {
-				qs = fmt.Sprintf("(%s IS NULL OR %s == ?)", r.Field.Column(), r.Field.Column())
+				qs = fmt.Sprintf("(%s IS NULL OR %s = ?)", r.Field.Column(), r.Field.Column())
 			}
 			args = append(args, "")
 			return qs, args
@@ -69,21 +165,21 @@ func (r *Rule) Where() (string, []interface{}) {
 			} else {
 				qs += " ILIKE ?"
 			}
-			args = append(args, "%" + r.StringValues[0] + "%")
+			args = append(args, "%" + likeEscape(r.StringValues[0]) + "%")
 		case STARTSWITH:
 			if r.Not() {
 				qs += " NOT ILIKE ?"
 			} else {
 				qs += " ILIKE ?"
 			}
-			args = append(args, r.StringValues[0] + "%")
+			args = append(args, likeEscape(r.StringValues[0]) + "%")
 		case ENDSWITH:
 			if r.Not() {
 				qs += " NOT ILIKE ?"
 			} else {
 				qs += " ILIKE ?"
 			}
-			args = append(args, "%" + r.StringValues[0])
+			args = append(args, "%" + likeEscape(r.StringValues[0]))
 		case GREATERTHAN:
 			if r.Not() {
 				qs += " <= ?"
@@ -171,8 +267,8 @@ func (r *Rule) Where() (string, []interface{}) {
 			}
 			args = append(args, r.IntValues[0])
 		}
-	case BooleanRule:
-		qs = r.Field.Column()
+	case BooleanRule, LoveRule:
+		qs = r.boolField().Column()
 		if r.BoolValue == nil {
 			if r.Not() {
 				qs += " IS NOT NULL"
@@ -180,8 +276,10 @@ func (r *Rule) Where() (string, []interface{}) {
 				qs += " IS NULL"
 			}
 		} else {
+			// "not loved" includes tracks that are neither loved nor
+			// disliked
 			if r.Not() {
-				qs += " != ?"
+				qs += " IS DISTINCT FROM ?"
 			} else {
 				qs += " = ?"
 			}
@@ -189,7 +287,7 @@ func (r *Rule) Where() (string, []interface{}) {
 		}
 	case DateRule:
 		qs = r.Field.Column()
-		if len(r.TimeValues) == 0 {
+		if len(r.TimeValues) == 0 && !(r.Operator == WITHIN && r.Unit != nil) {
 			if r.Not() {
 				qs += " IS NOT NULL"
 			} else {
@@ -229,14 +327,14 @@ func (r *Rule) Where() (string, []interface{}) {
 				qs = fmt.Sprintf("(%s >= ? AND %s <= ?)", r.Field.Column(), r.Field.Column())
 			}
 		case WITHIN:
+			n, unit := r.Relative()
+			cutoff := dialect.Ago(n, unit)
 			if r.LogicSign == POS || r.LogicSign == STRPOS {
-				qs += " >= "
+				qs += " >= " + cutoff
 			} else {
-				qs += " < "
+				// never played is not played recently
+				qs = fmt.Sprintf("(%s IS NULL OR %s < %s)", qs, qs, cutoff)
 			}
-			qs += fmt.Sprintf("NOW() - interval '%d seconds'", r.TimeValues[0] / -1000)
-			//qs += "NOW() - interval ?"
-			//args = append(args, strconv.FormatInt(int64(r.TimeValues[0]) / -1000, 10))
 		default:
 			if r.Not() {
 				qs += " != ?"
@@ -271,36 +369,19 @@ func (r *Rule) Where() (string, []interface{}) {
 		}
 		args = append(args, *r.MediaKindValue)
 	case PlaylistRule:
-		qs = "pt" + r.playlistKey + ".playlist_id"
-		if r.Not() {
-			if r.PlaylistValue == nil {
-				qs += " IS NOT NULL"
-			} else {
-				qs += " IS NULL"
-			}
-		} else {
-			if r.PlaylistValue == nil {
-				qs += " IS NULL"
-			} else {
-				qs += " IS NOT NULL"
-			}
+		// membership in a folder is membership in anything under it
+		qs = "EXISTS (SELECT 1 FROM playlist_track WHERE playlist_track.track_id = track.id"
+		plid := r.playlistID()
+		if plid != nil {
+			qs += " AND playlist_track.playlist_id IN (WITH RECURSIVE pl(id) AS (SELECT CAST(? AS bigint) UNION SELECT playlist.id FROM playlist, pl WHERE playlist.parent_id = pl.id) SELECT id FROM pl)"
+			args = append(args, *plid)
 		}
-		/*
-		if r.PlaylistValue == nil {
-			if r.Not() {
-				qs += " IS NOT NULL"
-			} else {
-				qs += " IS NULL"
-			}
-			return qs, args
+		qs += ")"
+		// with no playlist, the rule is about being in any playlist at
+		// all, and the positive rule means in none
+		if r.Not() == (plid != nil) {
+			qs = "NOT " + qs
 		}
-		if r.Not() {
-			qs += " != ?"
-		} else {
-			qs += " = ?"
-		}
-		args = append(args, *r.PlaylistValue)
-		*/
 	default:
 		qs = "1 = 1"
 	}
@@ -361,14 +442,43 @@ func (rs *RuleSet) Where() (string, []interface{}) {
 	return s, args
 }
 
+// Order sorts tracks the way the limit picks them, unplayed and unrated
+// tracks last either way.  MaxSize and MaxTime are up to Apply.
 func (sl *SmartLimit) Order() string {
-	s := " ORDER BY " + sl.Field.Column(sl.Descending)
+	s := " ORDER BY " + sl.Field.Column(sl.Descending) + " NULLS LAST, track.id"
 	if sl.MaxItems != nil {
 		s += " LIMIT " + strconv.FormatUint(*sl.MaxItems, 10)
 	}
 	return s
 }
 
+// Apply trims tracks, in the order from Order, to what fits within the
+// limit: iTunes stops at the first track that won't fit
+func (sl *SmartLimit) Apply(tracks []*Track) []*Track {
+	if sl == nil {
+		return tracks
+	}
+	var size, dur uint64
+	for i, tr := range tracks {
+		if sl.MaxItems != nil && uint64(i) >= *sl.MaxItems {
+			return tracks[:i]
+		}
+		if tr.Size != nil {
+			size += *tr.Size
+		}
+		if tr.TotalTime != nil {
+			dur += uint64(*tr.TotalTime)
+		}
+		if sl.MaxSize != nil && size > *sl.MaxSize {
+			return tracks[:i]
+		}
+		if sl.MaxTime != nil && dur > *sl.MaxTime {
+			return tracks[:i]
+		}
+	}
+	return tracks
+}
+
 func SmartPlaylistFromITunes(ispl *itunes.SmartPlaylist) *Smart {
 	return &Smart{
 		RuleSet: ruleSetFromITunes(ispl.Criteria),
@@ -382,12 +492,14 @@ func ruleSetFromITunes(icrit *itunes.SmartPlaylistCriteria) *RuleSet {
 	for _, irule := range icrit.Rules {
 		r := ruleFromITunes(irule)
 		if r == nil {
+			log.Printf("unsupported smart playlist rule %T", irule)
 			continue
 		}
 		if r.Field != nil && r.Field.Column() == "" {
+			log.Printf("unsupported smart playlist field %s", r.Field)
 			continue
 		}
-		rules = append(rules, ruleFromITunes(irule))
+		rules = append(rules, r)
 	}
 	return &RuleSet{
 		Conjunction: Conjunction(icrit.Conjunction),
@@ -448,7 +560,9 @@ func ruleFromITunes(irule itunes.SmartRule) *Rule {
 			Operator: Operator(ir.Operator),
 		}
 		if ir.Operator == itunes.LogicRule_WITHIN {
-			r.TimeValues = []Time{Time(ir.Relative)}
+			n, unit := relativeFromITunes(int64(ir.Relative))
+			r.IntValues = []int64{n}
+			r.Unit = &unit
 		} else {
 			r.TimeValues = make([]Time, len(ir.Values))
 			for i, it := range ir.Values {
@@ -477,7 +591,7 @@ func ruleFromITunes(irule itunes.SmartRule) *Rule {
 		}
 		f := Loved
 		return &Rule{
-			RuleType: BooleanRule,
+			RuleType: LoveRule,
 			Field: &f,
 			LogicSign: LogicSign(ir.Sign),
 			Operator: Operator(ir.Operator),
@@ -487,6 +601,34 @@ func ruleFromITunes(irule itunes.SmartRule) *Rule {
 	return nil
 }
 
+// iTunes stores "in the last" as milliseconds back from now, counting
+// a month as 2628000 seconds
+var iTunesRelativeUnits = []struct{
+	ms   int64
+	unit Unit
+}{
+	{2628000000, Months},
+	{604800000, Weeks},
+	{86400000, Days},
+	{3600000, Hours},
+	{60000, Minutes},
+}
+
+func relativeFromITunes(ms int64) (int64, Unit) {
+	if ms < 0 {
+		ms = -ms
+	}
+	if ms == 0 {
+		return 0, Days
+	}
+	for _, u := range iTunesRelativeUnits {
+		if ms % u.ms == 0 {
+			return ms / u.ms, u.unit
+		}
+	}
+	return ms / 1000, Seconds
+}
+
 func swapUint32ByteOrder(i uint32) uint32 {
 	b := []uint32{
 		i >> 24,
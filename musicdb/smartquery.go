@@ -0,0 +1,936 @@
+package musicdb
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// a small text language for smart playlists, eg
+//
+//   genre = "Jazz" and rating >= 4 and not played in last 30 days limit 2h by random
+//
+// rules are a field, an operator and a value, joined with and, or, not
+// and parentheses.  and binds tighter than or.  after the rules there
+// can be a limit, with the order tracks get picked in, and "static" for
+// a playlist that doesn't update live.
+//
+//   name = "x"  name != "x"  name contains "x"  name starts with "x"
+//   name ends with "x"  play_count > 3  rating <= 2  year between 1960 and 1969
+//   comments is empty  comments is not empty  compilation  loved  disliked
+//   date_added after 2020-01-01  played in last 2 weeks  media_kind has music
+//   in playlist 0123456789ABCDEF  in any playlist
+//   limit 25  limit 2h  limit 500MB  limit 1GB by play_count desc
+//
+// ratings are in stars, total_time is a duration like 4m30s and size can
+// have a KB, MB or GB suffix.  negated operators can also be written
+// with not after the field, as in name not contains "live".
+
+type SmartQueryError struct {
+	Pos     int    `json:"pos"`
+	Message string `json:"message"`
+}
+
+func (e *SmartQueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+}
+
+var smartQueryFields = map[string]Field{
+	"title":       Name,
+	"disc_number": DiskNumber,
+	"added":       DateAdded,
+	"modified":    DateModified,
+	"played":      PlayDate,
+	"skipped":     SkipDate,
+	"plays":       PlayCount,
+	"skips":       SkipCount,
+	"time":        TotalTime,
+	"duration":    TotalTime,
+	"playlist":    PlaylistPersistentID,
+}
+
+var smartQueryOperators = map[RuleType][]Operator{
+	StringRule:    []Operator{IS, CONTAINS, STARTSWITH, ENDSWITH, GREATERTHAN, LESSTHAN, BETWEEN},
+	IntRule:       []Operator{IS, GREATERTHAN, LESSTHAN, BETWEEN},
+	BooleanRule:   []Operator{IS},
+	LoveRule:      []Operator{IS},
+	DateRule:      []Operator{IS, GREATERTHAN, LESSTHAN, BETWEEN, WITHIN},
+	MediaKindRule: []Operator{IS, BITWISE},
+	PlaylistRule:  []Operator{IS},
+}
+
+var timeType = reflect.TypeOf(Time(0))
+
+// ruleType is the kind of rule that compares the field, or 0 if there
+// isn't one
+func (f Field) ruleType() RuleType {
+	switch f {
+	case Loved:
+		return LoveRule
+	case MediaKindField:
+		return MediaKindRule
+	case PlaylistPersistentID:
+		return PlaylistRule
+	case Year, DiskNumber:
+		return IntRule
+	}
+	t := f.Type()
+	if t == nil {
+		return 0
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return DateRule
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return StringRule
+	case reflect.Bool:
+		return BooleanRule
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return IntRule
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IntRule
+	}
+	return 0
+}
+
+func smartQueryField(name string) (Field, bool) {
+	name = strings.ToLower(name)
+	f, ok := fieldValues[name]
+	if !ok {
+		f, ok = smartQueryFields[name]
+	}
+	if !ok || f.ruleType() == 0 {
+		return 0, false
+	}
+	return f, true
+}
+
+type sqTokenKind int
+
+const (
+	sqEOF = sqTokenKind(iota)
+	sqWord
+	sqString
+	sqSymbol
+)
+
+type sqToken struct {
+	kind sqTokenKind
+	text string
+	pos  int
+}
+
+func (t sqToken) String() string {
+	switch t.kind {
+	case sqEOF:
+		return "end of query"
+	case sqString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+func lexSmartQuery(s string) ([]sqToken, error) {
+	toks := []sqToken{}
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, &SmartQueryError{Pos: i, Message: "unterminated string"}
+			}
+			v, err := strconv.Unquote(s[i:j+1])
+			if err != nil {
+				return nil, &SmartQueryError{Pos: i, Message: "bad string"}
+			}
+			toks = append(toks, sqToken{kind: sqString, text: v, pos: i})
+			i = j + 1
+		case c == '(' || c == ')' || c == ',':
+			toks = append(toks, sqToken{kind: sqSymbol, text: s[i:i+1], pos: i})
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			if s[i:j] == "!" {
+				return nil, &SmartQueryError{Pos: i, Message: "unexpected '!'"}
+			}
+			toks = append(toks, sqToken{kind: sqSymbol, text: s[i:j], pos: i})
+			i = j
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n\"(),=!<>", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, sqToken{kind: sqWord, text: s[i:j], pos: i})
+			i = j
+		}
+	}
+	toks = append(toks, sqToken{kind: sqEOF, pos: len(s)})
+	return toks, nil
+}
+
+type smartQueryParser struct {
+	toks []sqToken
+	i    int
+}
+
+func (p *smartQueryParser) peek() sqToken {
+	return p.toks[p.i]
+}
+
+func (p *smartQueryParser) next() sqToken {
+	t := p.toks[p.i]
+	if t.kind != sqEOF {
+		p.i++
+	}
+	return t
+}
+
+// keyword consumes the next token if it's one of the words
+func (p *smartQueryParser) keyword(words ...string) bool {
+	t := p.peek()
+	if t.kind != sqWord {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			p.i++
+			return true
+		}
+	}
+	return false
+}
+
+// symbol consumes the next token if it's one of the symbols
+func (p *smartQueryParser) symbol(syms ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != sqSymbol {
+		return "", false
+	}
+	for _, s := range syms {
+		if t.text == s {
+			p.i++
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func (p *smartQueryParser) errorf(t sqToken, format string, args ...interface{}) error {
+	return &SmartQueryError{Pos: t.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *smartQueryParser) expect(words ...string) error {
+	t := p.peek()
+	if !p.keyword(words...) {
+		return p.errorf(t, "expected '%s', found %s", words[0], t)
+	}
+	return nil
+}
+
+// ParseSmart turns a query into a smart playlist.  errors are
+// *SmartQueryError, with the position in the query where things went
+// wrong.
+func ParseSmart(query string) (*Smart, error) {
+	toks, err := lexSmartQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &smartQueryParser{toks: toks}
+	spl := &Smart{
+		RuleSet: &RuleSet{Conjunction: AND, Rules: []*Rule{}},
+		LiveUpdating: true,
+	}
+	t := p.peek()
+	if t.kind != sqEOF && !(t.kind == sqWord && (strings.EqualFold(t.text, "limit") || strings.EqualFold(t.text, "static"))) {
+		r, err := p.parseConj(OR)
+		if err != nil {
+			return nil, err
+		}
+		if r.RuleType == RulesetRule {
+			spl.RuleSet = r.RuleSet
+		} else {
+			spl.RuleSet.Rules = append(spl.RuleSet.Rules, r)
+		}
+	}
+	for {
+		t := p.peek()
+		if t.kind == sqEOF {
+			break
+		}
+		if p.keyword("limit") {
+			if spl.Limit != nil {
+				return nil, p.errorf(t, "more than one limit")
+			}
+			spl.Limit, err = p.parseLimit()
+			if err != nil {
+				return nil, err
+			}
+		} else if p.keyword("static") {
+			spl.LiveUpdating = false
+		} else {
+			return nil, p.errorf(t, "unexpected %s", t)
+		}
+	}
+	return spl, nil
+}
+
+// parseConj reads rules joined by or, each of which is rules joined by
+// and
+func (p *smartQueryParser) parseConj(conj Conjunction) (*Rule, error) {
+	rules := []*Rule{}
+	for {
+		var r *Rule
+		var err error
+		if conj == OR {
+			r, err = p.parseConj(AND)
+		} else {
+			r, err = p.parseUnary()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.RuleType == RulesetRule && r.RuleSet.Conjunction == conj {
+			rules = append(rules, r.RuleSet.Rules...)
+		} else {
+			rules = append(rules, r)
+		}
+		if !p.keyword(strings.ToLower(conj.String())) {
+			break
+		}
+	}
+	if len(rules) == 1 {
+		return rules[0], nil
+	}
+	return &Rule{RuleType: RulesetRule, RuleSet: &RuleSet{Conjunction: conj, Rules: rules}}, nil
+}
+
+func (p *smartQueryParser) parseUnary() (*Rule, error) {
+	if p.keyword("not") {
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		r.negate()
+		return r, nil
+	}
+	t := p.peek()
+	if _, ok := p.symbol("("); ok {
+		r, err := p.parseConj(OR)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.symbol(")"); !ok {
+			return nil, p.errorf(p.peek(), "expected ')' to match the one at position %d, found %s", t.pos, p.peek())
+		}
+		return r, nil
+	}
+	return p.parseRule()
+}
+
+// negate flips a rule, and the rules in a rule set along with its
+// conjunction
+func (r *Rule) negate() {
+	if r.RuleType == RulesetRule {
+		if r.RuleSet.Conjunction == AND {
+			r.RuleSet.Conjunction = OR
+		} else {
+			r.RuleSet.Conjunction = AND
+		}
+		for _, child := range r.RuleSet.Rules {
+			child.negate()
+		}
+		return
+	}
+	switch r.LogicSign {
+	case POS:
+		r.LogicSign = NEG
+	case NEG:
+		r.LogicSign = POS
+	case STRPOS:
+		r.LogicSign = STRNEG
+	case STRNEG:
+		r.LogicSign = STRPOS
+	}
+}
+
+func (p *smartQueryParser) parseRule() (*Rule, error) {
+	t := p.next()
+	if t.kind != sqWord {
+		return nil, p.errorf(t, "expected a rule, found %s", t)
+	}
+	if strings.EqualFold(t.text, "in") {
+		r := &Rule{RuleType: PlaylistRule, LogicSign: POS, Operator: IS}
+		if p.keyword("any") {
+			// iTunes has the positive rule mean in no playlist
+			r.LogicSign = NEG
+			return r, p.expect("playlist")
+		}
+		err := p.expect("playlist")
+		if err != nil {
+			return nil, err
+		}
+		r.PlaylistValue, err = p.parsePlaylistID()
+		return r, err
+	}
+	if strings.EqualFold(t.text, "disliked") {
+		f := Loved
+		return &Rule{RuleType: LoveRule, Field: &f, LogicSign: POS, Operator: IS, BoolValue: boolp(false)}, nil
+	}
+	f, ok := smartQueryField(t.text)
+	if !ok {
+		return nil, p.errorf(t, "unknown field %s", t)
+	}
+	r := &Rule{RuleType: f.ruleType(), Field: &f, LogicSign: POS, Operator: IS}
+	if r.RuleType == StringRule {
+		r.LogicSign = STRPOS
+	}
+	if r.RuleType == PlaylistRule {
+		r.Field = nil
+	}
+	if r.RuleType == BooleanRule || r.RuleType == LoveRule {
+		// a bare boolean field means it's true
+		nt := p.peek()
+		if !(nt.kind == sqSymbol && strings.Contains(nt.text, "=")) && !(nt.kind == sqWord && (strings.EqualFold(nt.text, "is") || strings.EqualFold(nt.text, "not"))) {
+			r.BoolValue = boolp(true)
+			return r, nil
+		}
+	}
+	neg := p.keyword("not")
+	op := p.peek()
+	empty := false
+	if sym, ok := p.symbol("=", "==", "!=", ">", ">=", "<", "<="); ok {
+		switch sym {
+		case "!=":
+			neg = !neg
+		case ">":
+			r.Operator = GREATERTHAN
+		case ">=":
+			r.Operator = LESSTHAN
+			neg = !neg
+		case "<":
+			r.Operator = LESSTHAN
+		case "<=":
+			r.Operator = GREATERTHAN
+			neg = !neg
+		}
+	} else if p.keyword("is") {
+		if p.keyword("not") {
+			neg = !neg
+		}
+		empty = p.keyword("empty")
+	} else if p.keyword("contains") {
+		r.Operator = CONTAINS
+	} else if p.keyword("starts") {
+		r.Operator = STARTSWITH
+		if err := p.expect("with"); err != nil {
+			return nil, err
+		}
+	} else if p.keyword("ends") {
+		r.Operator = ENDSWITH
+		if err := p.expect("with"); err != nil {
+			return nil, err
+		}
+	} else if p.keyword("between") {
+		r.Operator = BETWEEN
+	} else if p.keyword("after") {
+		r.Operator = GREATERTHAN
+	} else if p.keyword("before") {
+		r.Operator = LESSTHAN
+	} else if p.keyword("has") {
+		r.Operator = BITWISE
+	} else if p.keyword("in") {
+		r.Operator = WITHIN
+		p.keyword("the")
+		if err := p.expect("last"); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, p.errorf(op, "expected an operator after %s, found %s", t, op)
+	}
+	if neg {
+		r.negate()
+	}
+	allowed := false
+	for _, o := range smartQueryOperators[r.RuleType] {
+		if o == r.Operator {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, p.errorf(op, "%s can't be used with %s", op, f)
+	}
+	if empty {
+		if r.RuleType == MediaKindRule || r.RuleType == PlaylistRule {
+			return nil, p.errorf(op, "%s is never empty", f)
+		}
+		return r, nil
+	}
+	if r.RuleType == PlaylistRule {
+		var err error
+		r.PlaylistValue, err = p.parsePlaylistID()
+		return r, err
+	}
+	if r.Operator == WITHIN {
+		return r, p.parseRelative(r)
+	}
+	err := p.parseValue(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Operator == BETWEEN {
+		if err = p.expect("and"); err != nil {
+			return nil, err
+		}
+		err = p.parseValue(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (p *smartQueryParser) parseValue(r *Rule) error {
+	t := p.next()
+	if t.kind != sqWord && t.kind != sqString {
+		return p.errorf(t, "expected a value, found %s", t)
+	}
+	switch r.RuleType {
+	case StringRule:
+		r.StringValues = append(r.StringValues, t.text)
+	case IntRule:
+		v, err := parseSmartInt(*r.Field, t.text)
+		if err != nil {
+			return p.errorf(t, "bad %s value %s", r.Field, t)
+		}
+		r.IntValues = append(r.IntValues, v)
+	case DateRule:
+		v, err := parseSmartDate(t.text)
+		if err != nil {
+			return p.errorf(t, "bad date %s", t)
+		}
+		r.TimeValues = append(r.TimeValues, v)
+	case BooleanRule, LoveRule:
+		v, err := strconv.ParseBool(strings.ToLower(t.text))
+		if err != nil {
+			return p.errorf(t, "expected true or false, found %s", t)
+		}
+		r.BoolValue = &v
+	case MediaKindRule:
+		v, ok := mediaKindValues[strings.ToLower(t.text)]
+		if !ok {
+			return p.errorf(t, "unknown media kind %s", t)
+		}
+		r.MediaKindValue = &v
+	}
+	return nil
+}
+
+func (p *smartQueryParser) parsePlaylistID() (*pid.PersistentID, error) {
+	t := p.next()
+	id := new(pid.PersistentID)
+	if (t.kind != sqWord && t.kind != sqString) || id.Decode(t.text) != nil {
+		return nil, p.errorf(t, "expected a playlist id, found %s", t)
+	}
+	return id, nil
+}
+
+// parseRelative reads the "30 days" of "in last 30 days"
+func (p *smartQueryParser) parseRelative(r *Rule) error {
+	t := p.next()
+	n, err := strconv.ParseInt(t.text, 10, 64)
+	if t.kind != sqWord || err != nil || n < 0 {
+		return p.errorf(t, "expected a number, found %s", t)
+	}
+	t = p.next()
+	name := strings.ToLower(t.text)
+	if !strings.HasSuffix(name, "s") {
+		name += "s"
+	}
+	unit, ok := unitValues[name]
+	switch unit {
+	case Seconds, Minutes, Hours, Days, Weeks, Months:
+	default:
+		ok = false
+	}
+	if t.kind != sqWord || !ok {
+		return p.errorf(t, "expected days, weeks, months, hours, minutes or seconds, found %s", t)
+	}
+	r.IntValues = []int64{n}
+	r.Unit = &unit
+	return nil
+}
+
+func (p *smartQueryParser) parseLimit() (*SmartLimit, error) {
+	lim := &SmartLimit{Field: LimitRandom}
+	for {
+		t := p.peek()
+		if t.kind != sqWord || strings.EqualFold(t.text, "by") {
+			break
+		}
+		p.next()
+		n, err := strconv.ParseUint(t.text, 10, 64)
+		if err == nil {
+			if p.keyword("items", "item", "tracks", "track", "songs", "song") {
+				lim.MaxItems = &n
+			} else if p.keyword("minutes", "minute", "mins", "min") {
+				n *= 60 * 1000
+				lim.MaxTime = &n
+			} else if p.keyword("hours", "hour") {
+				n *= 60 * 60 * 1000
+				lim.MaxTime = &n
+			} else if p.keyword("mb") {
+				n *= 1024 * 1024
+				lim.MaxSize = &n
+			} else if p.keyword("gb") {
+				n *= 1024 * 1024 * 1024
+				lim.MaxSize = &n
+			} else {
+				lim.MaxItems = &n
+			}
+		} else if d, err := time.ParseDuration(t.text); err == nil && d > 0 {
+			n = uint64(d / time.Millisecond)
+			lim.MaxTime = &n
+		} else if sz, err := parseSmartSize(t.text); err == nil && sz > 0 {
+			n = uint64(sz)
+			lim.MaxSize = &n
+		} else {
+			return nil, p.errorf(t, "bad limit %s", t)
+		}
+		if _, ok := p.symbol(","); !ok {
+			break
+		}
+	}
+	if p.keyword("by") {
+		t := p.next()
+		lf, ok := limitFieldValues[strings.ToLower(t.text)]
+		if t.kind != sqWord || !ok {
+			return nil, p.errorf(t, "can't limit by %s", t)
+		}
+		lim.Field = lf
+		if p.keyword("desc") {
+			lim.Descending = true
+		} else {
+			p.keyword("asc")
+		}
+	}
+	return lim, nil
+}
+
+// parseSmartInt reads a value for an int field: stars for ratings,
+// durations for total_time and sizes for size
+func parseSmartInt(f Field, s string) (int64, error) {
+	switch f {
+	case Rating, AlbumRating:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(math.Round(v * 20)), nil
+	case TotalTime:
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			return v, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		return int64(d / time.Millisecond), nil
+	case Size:
+		return parseSmartSize(s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+var smartSizeUnits = []struct{
+	suffix string
+	n      int64
+}{
+	{"KB", 1024},
+	{"MB", 1024 * 1024},
+	{"GB", 1024 * 1024 * 1024},
+	{"TB", 1024 * 1024 * 1024 * 1024},
+	{"B", 1},
+}
+
+func parseSmartSize(s string) (int64, error) {
+	u := strings.ToUpper(s)
+	for _, unit := range smartSizeUnits {
+		if strings.HasSuffix(u, unit.suffix) {
+			v, err := strconv.ParseInt(u[:len(u) - len(unit.suffix)], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return v * unit.n, nil
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func formatSmartSize(n int64) string {
+	for _, unit := range smartSizeUnits {
+		if n != 0 && n % unit.n == 0 && n / unit.n < 1024 {
+			return strconv.FormatInt(n / unit.n, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+func formatSmartDuration(ms int64) string {
+	s := (time.Duration(ms) * time.Millisecond).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s) - 2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s) - 2]
+	}
+	return s
+}
+
+func parseSmartDate(s string) (Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return FromTime(t), nil
+		}
+	}
+	return 0, fmt.Errorf("bad date %q", s)
+}
+
+func formatSmartDate(v Time) string {
+	t := v.Time().Local()
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+// String gives the smart playlist in the query language ParseSmart
+// reads
+func (spl *Smart) String() string {
+	parts := []string{}
+	if spl.RuleSet != nil {
+		s := spl.RuleSet.query(false)
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if spl.Limit != nil {
+		parts = append(parts, spl.Limit.query())
+	}
+	if !spl.LiveUpdating {
+		parts = append(parts, "static")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (rs *RuleSet) query(nested bool) string {
+	parts := []string{}
+	for _, r := range rs.Rules {
+		s := r.query()
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	s := strings.Join(parts, " " + strings.ToLower(rs.Conjunction.String()) + " ")
+	if nested && len(parts) > 1 {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// query gives the rule in the query language.  cloud and location
+// rules, which never make it in from iTunes, have nothing to say.
+func (r *Rule) query() string {
+	if r.RuleType == RulesetRule {
+		if r.RuleSet == nil {
+			return ""
+		}
+		return r.RuleSet.query(true)
+	}
+	if r.IsPlaylistRule() {
+		plid := r.playlistID()
+		if plid == nil {
+			if r.Not() {
+				return "in any playlist"
+			}
+			return "not in any playlist"
+		}
+		if r.Not() {
+			return "not in playlist " + plid.String()
+		}
+		return "in playlist " + plid.String()
+	}
+	if r.Field == nil && (r.RuleType == StringRule || r.RuleType == IntRule || r.RuleType == DateRule) {
+		return ""
+	}
+	var f Field
+	vals := []string{}
+	switch r.RuleType {
+	case StringRule:
+		f = *r.Field
+		for _, v := range r.StringValues {
+			vals = append(vals, strconv.Quote(v))
+		}
+	case IntRule:
+		f = *r.Field
+		for _, v := range r.IntValues {
+			vals = append(vals, formatSmartInt(f, v))
+		}
+	case DateRule:
+		f = *r.Field
+		if r.Operator == WITHIN && (len(r.TimeValues) > 0 || r.Unit != nil) {
+			n, unit := r.Relative()
+			if r.Unit == nil {
+				n, unit = relativeFromITunes(int64(r.TimeValues[0]))
+			}
+			name := unit.String()
+			if n == 1 {
+				name = strings.TrimSuffix(name, "s")
+			}
+			s := fmt.Sprintf("%s in last %d %s", f, n, name)
+			if r.Not() {
+				return "not " + s
+			}
+			return s
+		}
+		for _, v := range r.TimeValues {
+			vals = append(vals, formatSmartDate(v))
+		}
+	case BooleanRule, LoveRule:
+		f = r.boolField()
+		if r.BoolValue != nil {
+			if r.RuleType == LoveRule && !*r.BoolValue {
+				if r.Not() {
+					return "not disliked"
+				}
+				return "disliked"
+			}
+			s := f.String()
+			if !*r.BoolValue {
+				s += " = false"
+			}
+			if r.Not() {
+				return "not " + s
+			}
+			return s
+		}
+	case MediaKindRule:
+		f = MediaKindField
+		if r.MediaKindValue != nil {
+			vals = append(vals, r.MediaKindValue.String())
+		}
+	default:
+		return ""
+	}
+	if len(vals) == 0 {
+		if r.Not() {
+			return f.String() + " is not empty"
+		}
+		return f.String() + " is empty"
+	}
+	var op string
+	switch r.Operator {
+	case GREATERTHAN:
+		op = ">"
+		if r.Not() {
+			op = "<="
+		}
+	case LESSTHAN:
+		op = "<"
+		if r.Not() {
+			op = ">="
+		}
+	case CONTAINS:
+		op = "contains"
+	case STARTSWITH:
+		op = "starts with"
+	case ENDSWITH:
+		op = "ends with"
+	case BITWISE:
+		op = "has"
+	case BETWEEN:
+		if len(vals) == 1 {
+			// Where compares against the zero value
+			switch r.RuleType {
+			case StringRule:
+				vals = append(vals, `""`)
+			case IntRule:
+				vals = append(vals, formatSmartInt(f, 0))
+			case DateRule:
+				vals = append(vals, formatSmartDate(0))
+			}
+		}
+		op = "between"
+		vals = []string{vals[0] + " and " + vals[1]}
+	default:
+		op = "="
+		if r.Not() {
+			op = "!="
+		}
+	}
+	if r.Not() && op[0] != '<' && op[0] != '>' && op[0] != '!' {
+		op = "not " + op
+	}
+	return f.String() + " " + op + " " + vals[0]
+}
+
+func formatSmartInt(f Field, v int64) string {
+	switch f {
+	case Rating, AlbumRating:
+		return strconv.FormatFloat(float64(v) / 20, 'f', -1, 64)
+	case TotalTime:
+		return formatSmartDuration(v)
+	case Size:
+		return formatSmartSize(v)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func (sl *SmartLimit) query() string {
+	vals := []string{}
+	if sl.MaxItems != nil {
+		vals = append(vals, strconv.FormatUint(*sl.MaxItems, 10))
+	}
+	if sl.MaxTime != nil {
+		vals = append(vals, formatSmartDuration(int64(*sl.MaxTime)))
+	}
+	if sl.MaxSize != nil {
+		vals = append(vals, formatSmartSize(int64(*sl.MaxSize)))
+	}
+	s := "limit"
+	if len(vals) > 0 {
+		s += " " + strings.Join(vals, ", ")
+	}
+	name, ok := limitFieldNames[sl.Field]
+	if ok {
+		s += " by " + name
+		if sl.Descending {
+			s += " desc"
+		}
+	}
+	return s
+}
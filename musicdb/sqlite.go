@@ -0,0 +1,555 @@
+package musicdb
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// the sqlite driver, with the functions postgres has that sqlite
+// doesn't
+const sqliteDriverName = "sqlite3_synos"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: sqliteConnect,
+	})
+	sqlx.BindDriver(sqliteDriverName, sqlx.QUESTION)
+	registerDialect(sqliteDialect{})
+}
+
+func sqliteConnect(conn *sqlite3.SQLiteConn) error {
+	funcs := []struct {
+		name string
+		impl interface{}
+		pure bool
+	}{
+		{"now", sqliteNow, false},
+		{"greatest", sqliteGreatest, true},
+		{"date_part", sqliteDatePart, true},
+		{"time_bucket", sqliteTimeBucket, true},
+		{"similarity", sqliteSimilarity, true},
+		{"word_similarity", sqliteWordSimilarity, true},
+		{"ts_match", sqliteTextMatch, true},
+		{"ts_rank", sqliteTextRank, true},
+		{"ts_empty", sqliteTextEmpty, true},
+	}
+	for _, f := range funcs {
+		err := conn.RegisterFunc(f.name, f.impl, f.pure)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqliteDialect struct{}
+
+func (d sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (d sqliteDialect) DriverName() string {
+	return sqliteDriverName
+}
+
+// postgres syntax sqlite doesn't have, and what it has instead.  LIKE
+// is already case insensitive in sqlite, but doesn't take \ as an
+// escape character unless it's told to.
+var sqliteRewrites = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)\bI?LIKE\s+\?`), `LIKE ? ESCAPE '\'`},
+	{regexp.MustCompile(`(?i)\bIS\s+NOT\s+DISTINCT\s+FROM\b`), `IS`},
+	{regexp.MustCompile(`(?i)\bIS\s+DISTINCT\s+FROM\b`), `IS NOT`},
+	{regexp.MustCompile(`(?i)\bBOOL_OR\(`), `MAX(`},
+	{regexp.MustCompile(`(?i)\bBOOL_AND\(`), `MIN(`},
+	{regexp.MustCompile(`(?i)\btimestamp with time zone\b`), `timestamp`},
+	{regexp.MustCompile(`(?i)\bbytea\b`), `blob`},
+	{regexp.MustCompile(`(?i)\bDEFAULT now\(\)`), `DEFAULT CURRENT_TIMESTAMP`},
+}
+
+func (d sqliteDialect) Rewrite(qs string) string {
+	out := qs
+	for _, rw := range sqliteRewrites {
+		out = rw.re.ReplaceAllLiteralString(out, rw.repl)
+	}
+	return out
+}
+
+func (d sqliteDialect) Age(expr string) string {
+	return `((julianday('now') - julianday(` + expr + `)) * 86400.0)`
+}
+
+func (d sqliteDialect) Ago(n int64, unit Unit) string {
+	switch unit {
+	case Weeks:
+		n *= 7
+		unit = Days
+	case Seconds, Minutes, Hours, Days, Months:
+	default:
+		unit = Days
+	}
+	return fmt.Sprintf("datetime('now', '-%d %s')", n, unit)
+}
+
+func (d sqliteDialect) TimeBucket(expr, interval, tz string) (string, []interface{}) {
+	return `time_bucket(` + expr + `, ?, ?)`, []interface{}{interval, tz}
+}
+
+func (d sqliteDialect) TextMatch(index string, q TextQuery) string {
+	return `ts_match(` + index + `, ?, '` + string(q) + `')`
+}
+
+func (d sqliteDialect) TextRank(index string, q TextQuery) string {
+	return `ts_rank(` + index + `, ?, '` + string(q) + `')`
+}
+
+func (d sqliteDialect) TextEmpty(q TextQuery) string {
+	return `ts_empty(?, '` + string(q) + `')`
+}
+
+func (d sqliteDialect) TextConcat(a, b string) string {
+	return `(` + a + ` || char(10) || coalesce(` + b + `, ''))`
+}
+
+// sqliteText is the text of a function argument.  the driver gives
+// null arguments as a nil []byte.
+func sqliteText(v interface{}) (string, bool) {
+	switch xv := v.(type) {
+	case string:
+		return xv, true
+	case []byte:
+		if xv == nil {
+			return "", false
+		}
+		return string(xv), true
+	case int64:
+		return strconv.FormatInt(xv, 10), true
+	case float64:
+		return strconv.FormatFloat(xv, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+func sqliteTime(v interface{}) (time.Time, bool) {
+	switch xv := v.(type) {
+	case int64:
+		return time.Unix(xv, 0).In(time.UTC), true
+	case float64:
+		s, f := math.Modf(xv)
+		return time.Unix(int64(s), int64(f * 1e9)).In(time.UTC), true
+	case time.Time:
+		return xv.In(time.UTC), true
+	}
+	s, ok := sqliteText(v)
+	if !ok {
+		return time.Time{}, false
+	}
+	tm, err := parseTimeText(s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return tm.In(time.UTC), true
+}
+
+func sqliteNow() string {
+	return time.Now().In(time.UTC).Format(timeLayouts[0])
+}
+
+// sqliteGreatest is the largest of its arguments that isn't null, like
+// postgres's GREATEST, rather than sqlite's max, which is null if any
+// argument is
+func sqliteGreatest(args ...interface{}) interface{} {
+	var best interface{}
+	for _, arg := range args {
+		if b, ok := arg.([]byte); ok && b == nil {
+			continue
+		}
+		if best == nil || sqliteLess(best, arg) {
+			best = arg
+		}
+	}
+	return best
+}
+
+func sqliteLess(a, b interface{}) bool {
+	fa, aok := sqliteNumber(a)
+	fb, bok := sqliteNumber(b)
+	if aok && bok {
+		return fa < fb
+	}
+	sa, _ := sqliteText(a)
+	sb, _ := sqliteText(b)
+	return sa < sb
+}
+
+func sqliteNumber(v interface{}) (float64, bool) {
+	switch xv := v.(type) {
+	case int64:
+		return float64(xv), true
+	case float64:
+		return xv, true
+	}
+	return 0, false
+}
+
+func sqliteDatePart(field, v interface{}) interface{} {
+	f, _ := sqliteText(field)
+	tm, ok := sqliteTime(v)
+	if !ok {
+		return nil
+	}
+	switch strings.ToLower(f) {
+	case "year":
+		return float64(tm.Year())
+	case "quarter":
+		return float64((int(tm.Month()) - 1) / 3 + 1)
+	case "month":
+		return float64(tm.Month())
+	case "week":
+		_, w := tm.ISOWeek()
+		return float64(w)
+	case "day":
+		return float64(tm.Day())
+	case "dow":
+		return float64(tm.Weekday())
+	case "doy":
+		return float64(tm.YearDay())
+	case "hour":
+		return float64(tm.Hour())
+	case "minute":
+		return float64(tm.Minute())
+	case "second":
+		return float64(tm.Second()) + float64(tm.Nanosecond()) / 1e9
+	case "epoch":
+		return float64(tm.UnixNano()) / 1e9
+	}
+	return nil
+}
+
+// sqliteTimeBucket is the hour of the day a time is in, or the start of
+// its day, week or month, in a time zone
+func sqliteTimeBucket(v, interval, tz interface{}) interface{} {
+	tm, ok := sqliteTime(v)
+	if !ok {
+		return nil
+	}
+	name, _ := sqliteText(tz)
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = time.UTC
+	}
+	tm = tm.In(loc)
+	iv, _ := sqliteText(interval)
+	day := time.Date(tm.Year(), tm.Month(), tm.Day(), 0, 0, 0, 0, loc)
+	switch iv {
+	case "hour":
+		return float64(tm.Hour())
+	case "week":
+		// weeks start on monday, like postgres's date_trunc
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		day = time.Date(tm.Year(), tm.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	return day.In(time.UTC).Format(timeLayouts[0])
+}
+
+// textTokens are the lowercase words of a text
+func textTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// pgTrigrams are the trigrams of every word in a text, like pg_trgm's
+func pgTrigrams(s string) map[string]bool {
+	tgs := map[string]bool{}
+	for _, w := range textTokens(s) {
+		for tg := range trigrams(w) {
+			tgs[tg] = true
+		}
+	}
+	return tgs
+}
+
+func sqliteSimilarity(a, b interface{}) interface{} {
+	sa, aok := sqliteText(a)
+	sb, bok := sqliteText(b)
+	if !aok || !bok {
+		return nil
+	}
+	ta := pgTrigrams(sa)
+	tb := pgTrigrams(sb)
+	common := 0
+	for tg := range ta {
+		if tb[tg] {
+			common++
+		}
+	}
+	total := len(ta) + len(tb) - common
+	if total == 0 {
+		return 0.0
+	}
+	return float64(common) / float64(total)
+}
+
+// sqliteWordSimilarity is how much of the first text's trigrams are in
+// the closest run of as many words in the second, which is near enough
+// to pg_trgm's word_similarity
+func sqliteWordSimilarity(a, b interface{}) interface{} {
+	sa, aok := sqliteText(a)
+	sb, bok := sqliteText(b)
+	if !aok || !bok {
+		return nil
+	}
+	ta := pgTrigrams(sa)
+	if len(ta) == 0 {
+		return 0.0
+	}
+	n := len(textTokens(sa))
+	words := textTokens(sb)
+	best := 0
+	for i := range words {
+		tw := map[string]bool{}
+		for j := i; j < len(words) && j < i + n; j++ {
+			for tg := range trigrams(words[j]) {
+				tw[tg] = true
+			}
+		}
+		common := 0
+		for tg := range ta {
+			if tw[tg] {
+				common++
+			}
+		}
+		if common > best {
+			best = common
+		}
+	}
+	return float64(best) / float64(len(ta))
+}
+
+// a full text index in sqlite is the text it's made from, in sections
+// that start with their weight and a tab, as made by the generated
+// search_vector columns.  words are matched by a rough english stem
+// rather than postgres's dictionary.
+var textWeights = map[string]float64{"A": 1.0, "B": 0.4, "C": 0.2, "D": 0.1}
+
+type textToken struct {
+	word   string
+	stem   string
+	weight float64
+}
+
+func textStem(w string) string {
+	for _, suffix := range []string{"ing", "ed", "es", "ly", "s"} {
+		if strings.HasSuffix(w, suffix) && len(w) - len(suffix) >= 3 {
+			return strings.TrimSuffix(w, suffix)
+		}
+	}
+	return w
+}
+
+func textIndex(doc string) []textToken {
+	tokens := []textToken{}
+	weight := textWeights["D"]
+	for _, line := range strings.Split(doc, "\n") {
+		if len(line) >= 2 && line[1] == '\t' {
+			if w, ok := textWeights[line[:1]]; ok {
+				weight = w
+				line = line[2:]
+			}
+		}
+		for _, word := range textTokens(line) {
+			tokens = append(tokens, textToken{word: word, stem: textStem(word), weight: weight})
+		}
+	}
+	return tokens
+}
+
+// textTerm is one thing a full text query looks for: a word, a prefix
+// of a word, or a phrase
+type textTerm struct {
+	words  []string
+	prefix bool
+	not    bool
+}
+
+// match gives the weight of the best place a term is found in an index
+func (t textTerm) match(doc []textToken) (float64, bool) {
+	best := 0.0
+	found := false
+	for i := 0; i + len(t.words) <= len(doc); i++ {
+		ok := true
+		for j, w := range t.words {
+			if t.prefix {
+				ok = strings.HasPrefix(doc[i+j].word, w)
+			} else {
+				ok = doc[i+j].stem == w
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			found = true
+			if doc[i].weight > best {
+				best = doc[i].weight
+			}
+		}
+	}
+	return best, found
+}
+
+func textStems(s string) []string {
+	words := textTokens(s)
+	for i, w := range words {
+		words[i] = textStem(w)
+	}
+	return words
+}
+
+// parseTextQuery splits a full text query into clauses, any of which
+// can match, of terms that all have to
+func parseTextQuery(q string, kind TextQuery) [][]textTerm {
+	clause := []textTerm{}
+	switch kind {
+	case TextPrefix:
+		for _, part := range strings.Split(q, "&") {
+			for _, w := range textTokens(strings.TrimSuffix(strings.TrimSpace(part), ":*")) {
+				clause = append(clause, textTerm{words: []string{w}, prefix: true})
+			}
+		}
+	case TextPlain:
+		for _, w := range textStems(q) {
+			clause = append(clause, textTerm{words: []string{w}})
+		}
+	case TextPhrase:
+		words := textStems(q)
+		if len(words) > 0 {
+			clause = append(clause, textTerm{words: words})
+		}
+	case TextWeb:
+		clauses := [][]textTerm{}
+		rs := []rune(q)
+		i := 0
+		for i < len(rs) {
+			if unicode.IsSpace(rs[i]) {
+				i++
+				continue
+			}
+			not := false
+			if rs[i] == '-' {
+				not = true
+				i++
+			}
+			if i < len(rs) && rs[i] == '"' {
+				j := i + 1
+				for j < len(rs) && rs[j] != '"' {
+					j++
+				}
+				words := textStems(string(rs[i+1:j]))
+				if len(words) > 0 {
+					clause = append(clause, textTerm{words: words, not: not})
+				}
+				i = j + 1
+				continue
+			}
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) {
+				j++
+			}
+			word := string(rs[i:j])
+			i = j
+			if !not && strings.EqualFold(word, "or") {
+				clauses = append(clauses, clause)
+				clause = []textTerm{}
+				continue
+			}
+			for _, w := range textStems(word) {
+				clause = append(clause, textTerm{words: []string{w}, not: not})
+			}
+		}
+		return append(clauses, clause)
+	}
+	return [][]textTerm{clause}
+}
+
+// textSearch ranks how well a full text index matches a query, or gives
+// false if it doesn't
+func textSearch(doc, q string, kind TextQuery) (float64, bool) {
+	tokens := textIndex(doc)
+	best := 0.0
+	matched := false
+	for _, clause := range parseTextQuery(q, kind) {
+		if len(clause) == 0 {
+			continue
+		}
+		score := 0.0
+		n := 0
+		ok := true
+		for _, t := range clause {
+			w, found := t.match(tokens)
+			if found == t.not {
+				ok = false
+				break
+			}
+			if !t.not {
+				score += w
+				n++
+			}
+		}
+		if !ok {
+			continue
+		}
+		matched = true
+		if n > 0 && score / float64(n) > best {
+			best = score / float64(n)
+		}
+	}
+	// about where postgres's ts_rank puts one match of each weight
+	return best * 0.6, matched
+}
+
+func sqliteTextMatch(doc, q, kind interface{}) interface{} {
+	sd, dok := sqliteText(doc)
+	sq, qok := sqliteText(q)
+	k, _ := sqliteText(kind)
+	if !dok || !qok {
+		return nil
+	}
+	_, ok := textSearch(sd, sq, TextQuery(k))
+	return ok
+}
+
+func sqliteTextRank(doc, q, kind interface{}) interface{} {
+	sd, dok := sqliteText(doc)
+	sq, qok := sqliteText(q)
+	k, _ := sqliteText(kind)
+	if !dok || !qok {
+		return 0.0
+	}
+	rank, _ := textSearch(sd, sq, TextQuery(k))
+	return rank
+}
+
+func sqliteTextEmpty(q, kind interface{}) interface{} {
+	sq, _ := sqliteText(q)
+	k, _ := sqliteText(kind)
+	for _, clause := range parseTextQuery(sq, TextQuery(k)) {
+		if len(clause) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,343 @@
+package musicdb
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/itunes/persistentId"
+)
+
+// how long a play lasted: whatever the client told us, or the whole
+// track for plays that weren't skipped
+const listenedExpr = `CASE WHEN e.skipped THEN COALESCE(e.duration, 0) ELSE COALESCE(e.duration, t.total_time, 0) END`
+
+const playsExpr = `SUM(CASE WHEN e.skipped THEN 0 ELSE 1 END)`
+const skipsExpr = `SUM(CASE WHEN e.skipped THEN 1 ELSE 0 END)`
+
+// StatsWindow picks the plays that statistics are computed over.  a
+// nil user means everyone's plays, and nil times leave the window open
+// at that end.
+type StatsWindow struct {
+	UserID *pid.PersistentID
+	Since  *Time
+	Until  *Time
+}
+
+// where builds the conditions on the play_event table, aliased e
+func (w StatsWindow) where() (string, []interface{}) {
+	conds := []string{"e.track_id = t.id"}
+	args := []interface{}{}
+	if w.UserID != nil {
+		conds = append(conds, "e.user_id = ?")
+		args = append(args, *w.UserID)
+	}
+	if w.Since != nil {
+		conds = append(conds, "e.play_date >= ?")
+		args = append(args, *w.Since)
+	}
+	if w.Until != nil {
+		conds = append(conds, "e.play_date < ?")
+		args = append(args, *w.Until)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// dateRange builds conditions putting col inside the window's times
+func (w StatsWindow) dateRange(col string) (string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+	if w.Since != nil {
+		conds = append(conds, col + " >= ?")
+		args = append(args, *w.Since)
+	}
+	if w.Until != nil {
+		conds = append(conds, col + " < ?")
+		args = append(args, *w.Until)
+	}
+	if len(conds) == 0 {
+		return "1 = 1", args
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+type PlayStat struct {
+	Name   string `json:"name" db:"name"`
+	Artist string `json:"artist,omitempty" db:"artist"`
+	Plays  int    `json:"plays" db:"plays"`
+	Skips  int    `json:"skips" db:"skips"`
+	// milliseconds
+	Time   uint64 `json:"time" db:"listened"`
+}
+
+type TrackStat struct {
+	Track *Track  `json:"track"`
+	Plays int     `json:"plays"`
+	Skips int     `json:"skips"`
+	Time  uint64  `json:"time"`
+}
+
+func (db *DB) topStats(w StatsWindow, cols, group string, limit int) ([]*PlayStat, error) {
+	where, args := w.where()
+	qs := `SELECT ` + cols + `, ` + playsExpr + ` AS plays, ` + skipsExpr + ` AS skips, SUM(` + listenedExpr + `) AS listened FROM play_event e, track t WHERE ` + where + ` GROUP BY ` + group + ` ORDER BY plays DESC, listened DESC`
+	if limit > 0 {
+		qs += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := []*PlayStat{}
+	for rows.Next() {
+		stat := &PlayStat{}
+		err = rows.StructScan(stat)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (db *DB) TopArtists(w StatsWindow, limit int) ([]*PlayStat, error) {
+	return db.topStats(w, `COALESCE(MIN(t.artist), '') AS name`, `t.sort_artist`, limit)
+}
+
+func (db *DB) TopAlbums(w StatsWindow, limit int) ([]*PlayStat, error) {
+	return db.topStats(w, `COALESCE(MIN(t.album), '') AS name, COALESCE(MIN(COALESCE(t.album_artist, t.artist)), '') AS artist`, `COALESCE(t.sort_album_artist, t.sort_artist), t.sort_album`, limit)
+}
+
+func (db *DB) TopGenres(w StatsWindow, limit int) ([]*PlayStat, error) {
+	return db.topStats(w, `COALESCE(MIN(t.genre), '') AS name`, `t.sort_genre`, limit)
+}
+
+func (db *DB) TopTracks(w StatsWindow, limit int) ([]*TrackStat, error) {
+	where, args := w.where()
+	qs := `SELECT track.*, xuser.homedir, s.plays, s.skips, s.listened FROM (SELECT e.track_id, ` + playsExpr + ` AS plays, ` + skipsExpr + ` AS skips, SUM(` + listenedExpr + `) AS listened FROM play_event e, track t WHERE ` + where + ` GROUP BY e.track_id) s, track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.id = s.track_id ORDER BY s.plays DESC, s.listened DESC`
+	if limit > 0 {
+		qs += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := []*TrackStat{}
+	for rows.Next() {
+		var row struct {
+			Track
+			Plays int `db:"plays"`
+			Skips int `db:"skips"`
+			Listened uint64 `db:"listened"`
+		}
+		err = rows.StructScan(&row)
+		if err != nil {
+			return nil, err
+		}
+		track := row.Track
+		track.db = db
+		stats = append(stats, &TrackStat{
+			Track: &track,
+			Plays: row.Plays,
+			Skips: row.Skips,
+			Time: row.Listened,
+		})
+	}
+	return stats, nil
+}
+
+// TimeBucket is the listening in one interval, or in one hour of the
+// day, summed over every day in the window
+type TimeBucket struct {
+	Start *Time  `json:"start,omitempty"`
+	Hour  *int   `json:"hour,omitempty"`
+	Plays int    `json:"plays"`
+	Time  uint64 `json:"time"`
+}
+
+var ListeningIntervals = map[string]bool{
+	"hour": true,
+	"day": true,
+	"week": true,
+	"month": true,
+}
+
+// ListeningTime breaks listening down by day, week or month, or by hour
+// of the day.  intervals and hours follow the given time zone.
+func (db *DB) ListeningTime(w StatsWindow, interval string, loc *time.Location) ([]*TimeBucket, error) {
+	if !ListeningIntervals[interval] {
+		return nil, errors.Errorf("unknown interval %s", interval)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	tz := loc.String()
+	bucket, args := dialect.TimeBucket(`e.play_date`, interval, tz)
+	where, wargs := w.where()
+	args = append(args, wargs...)
+	qs := `SELECT ` + bucket + ` AS bucket, ` + playsExpr + ` AS plays, SUM(` + listenedExpr + `) AS listened FROM play_event e, track t WHERE ` + where + ` GROUP BY 1 ORDER BY 1`
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	buckets := []*TimeBucket{}
+	for rows.Next() {
+		b := &TimeBucket{}
+		if interval == "hour" {
+			var hour float64
+			err = rows.Scan(&hour, &b.Plays, &b.Time)
+			h := int(hour)
+			b.Hour = &h
+		} else {
+			b.Start = new(Time)
+			err = rows.Scan(b.Start, &b.Plays, &b.Time)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+type DiscoveryStats struct {
+	// tracks added to the library in the window
+	Added       int     `json:"added"`
+	// of those, how many were played in the window
+	AddedPlayed int     `json:"added_played"`
+	// tracks played for the first time ever in the window, whenever
+	// they were added
+	FirstPlays  int     `json:"first_plays"`
+	// distinct tracks played in the window
+	Played      int     `json:"played"`
+	// share of new tracks that got listened to
+	Rate        float64 `json:"rate"`
+}
+
+// Discovery measures how much new music is being listened to
+func (db *DB) Discovery(w StatsWindow) (*DiscoveryStats, error) {
+	stats := &DiscoveryStats{}
+	cond, args := w.dateRange("date_added")
+	qs := `SELECT COUNT(*) FROM track WHERE ` + cond
+	if w.UserID != nil {
+		qs += ` AND owner_id = ?`
+		args = append(args, *w.UserID)
+	}
+	err := db.QueryRow(qs, args...).Scan(&stats.Added)
+	if err != nil {
+		return nil, err
+	}
+	where, args := w.where()
+	cond, cargs := w.dateRange("t.date_added")
+	args = append(args, cargs...)
+	qs = `SELECT COUNT(DISTINCT t.id) FROM play_event e, track t WHERE ` + where + ` AND ` + cond
+	if w.UserID != nil {
+		qs += ` AND t.owner_id = ?`
+		args = append(args, *w.UserID)
+	}
+	err = db.QueryRow(qs, args...).Scan(&stats.AddedPlayed)
+	if err != nil {
+		return nil, err
+	}
+	where, args = w.where()
+	qs = `SELECT COUNT(DISTINCT t.id) FROM play_event e, track t WHERE ` + where
+	err = db.QueryRow(qs, args...).Scan(&stats.Played)
+	if err != nil {
+		return nil, err
+	}
+	cond, args = w.dateRange("f.first")
+	qs = `SELECT COUNT(*) FROM (SELECT track_id, MIN(play_date) AS first FROM play_event WHERE EXISTS (SELECT 1 FROM track WHERE track.id = play_event.track_id)`
+	if w.UserID != nil {
+		qs += ` AND user_id = ?`
+		args = append([]interface{}{*w.UserID}, args...)
+	}
+	qs += ` GROUP BY track_id) f WHERE ` + cond
+	err = db.QueryRow(qs, args...).Scan(&stats.FirstPlays)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Added > 0 {
+		stats.Rate = float64(stats.AddedPlayed) / float64(stats.Added)
+	}
+	return stats, nil
+}
+
+type YearSummary struct {
+	Year            int             `json:"year"`
+	Plays           int             `json:"plays"`
+	Skips           int             `json:"skips"`
+	// milliseconds
+	Time            uint64          `json:"time"`
+	DistinctTracks  int             `json:"distinct_tracks"`
+	DistinctArtists int             `json:"distinct_artists"`
+	TopArtists      []*PlayStat     `json:"top_artists"`
+	TopAlbums       []*PlayStat     `json:"top_albums"`
+	TopGenres       []*PlayStat     `json:"top_genres"`
+	TopTracks       []*TrackStat    `json:"top_tracks"`
+	Months          []*TimeBucket   `json:"months"`
+	Hours           []*TimeBucket   `json:"hours"`
+	BusiestDay      *TimeBucket     `json:"busiest_day,omitempty"`
+	Discovery       *DiscoveryStats `json:"discovery"`
+}
+
+// YearInReview sums up a user's listening over a calendar year in the
+// given time zone
+func (db *DB) YearInReview(userId pid.PersistentID, year int, loc *time.Location, limit int) (*YearSummary, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	since := FromTime(time.Date(year, time.January, 1, 0, 0, 0, 0, loc))
+	until := FromTime(time.Date(year + 1, time.January, 1, 0, 0, 0, 0, loc))
+	w := StatsWindow{UserID: &userId, Since: &since, Until: &until}
+	summary := &YearSummary{Year: year}
+	where, args := w.where()
+	qs := `SELECT COUNT(*), COALESCE(` + skipsExpr + `, 0), COALESCE(SUM(` + listenedExpr + `), 0), COUNT(DISTINCT t.id), COUNT(DISTINCT t.sort_artist) FROM play_event e, track t WHERE ` + where
+	var total int
+	err := db.QueryRow(qs, args...).Scan(&total, &summary.Skips, &summary.Time, &summary.DistinctTracks, &summary.DistinctArtists)
+	if err != nil {
+		return nil, err
+	}
+	summary.Plays = total - summary.Skips
+	summary.TopArtists, err = db.TopArtists(w, limit)
+	if err != nil {
+		return nil, err
+	}
+	summary.TopAlbums, err = db.TopAlbums(w, limit)
+	if err != nil {
+		return nil, err
+	}
+	summary.TopGenres, err = db.TopGenres(w, limit)
+	if err != nil {
+		return nil, err
+	}
+	summary.TopTracks, err = db.TopTracks(w, limit)
+	if err != nil {
+		return nil, err
+	}
+	summary.Months, err = db.ListeningTime(w, "month", loc)
+	if err != nil {
+		return nil, err
+	}
+	summary.Hours, err = db.ListeningTime(w, "hour", loc)
+	if err != nil {
+		return nil, err
+	}
+	days, err := db.ListeningTime(w, "day", loc)
+	if err != nil {
+		return nil, err
+	}
+	for _, day := range days {
+		if summary.BusiestDay == nil || day.Time > summary.BusiestDay.Time {
+			summary.BusiestDay = day
+		}
+	}
+	summary.Discovery, err = db.Discovery(w)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
@@ -9,6 +9,29 @@ import (
 
 type Time int64
 
+// layouts of times kept as text, as sqlite does
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseTimeText(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		tm, err := time.ParseInLocation(layout, s, time.UTC)
+		if err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("can't parse time value %s", s)
+}
+
 func Now() Time {
 	return FromTime(time.Now())
 }
@@ -31,7 +54,8 @@ func (t *Time) Set(tm time.Time) {
 }
 
 func (t Time) Value() (driver.Value, error) {
-	return t.Time(), nil
+	// in utc, so times kept as text sort in order
+	return t.Time().In(time.UTC), nil
 }
 
 func (t *Time) Scan(value interface{}) error {
@@ -44,9 +68,9 @@ func (t *Time) Scan(value interface{}) error {
 		*t = Time(v)
 		return nil
 	case string:
-		tm, err := time.ParseInLocation(v, "2006-01-02 15:04:05", time.UTC)
+		tm, err := parseTimeText(v)
 		if err != nil {
-			return errors.Wrap(err, "can't parse time value " + v)
+			return err
 		}
 		t.Set(tm)
 		return nil
@@ -29,6 +29,8 @@ type Track struct {
 	JookiID          *string      `json:"jooki_id,omitempty" db:"jooki_id"`
 	Album            *string      `json:"album,omitempty" db:"album"`
 	AlbumArtist      *string      `json:"album_artist,omitempty" db:"album_artist"`
+	AlbumGain        *float64     `json:"album_gain,omitempty" db:"album_gain"`
+	AlbumPeak        *float64     `json:"album_peak,omitempty" db:"album_peak"`
 	AlbumRating      *uint8       `json:"album_rating,omitempty" db:"album_rating"`
 	Artist           *string      `json:"artist,omitempty" db:"artist"`
 	BitRate          *uint        `json:"bitrate,omitempty" db:"bitrate"`
@@ -69,7 +71,9 @@ type Track struct {
 	SortName         *string      `json:"sort_name,omitempty" db:"sort_name"`
 	TotalTime        *uint        `json:"total_time,omitempty" db:"total_time"`
 	TrackCount       *uint8       `json:"track_count,omitempty" db:"track_count"`
+	TrackGain        *float64     `json:"track_gain,omitempty" db:"track_gain"`
 	TrackNumber      *uint8       `json:"track_number,omitempty" db:"track_number"`
+	TrackPeak        *float64     `json:"track_peak,omitempty" db:"track_peak"`
 	VolumeAdjustment *uint8       `json:"volume_adjustment,omitempty" db:"volume_adjustment"`
 	Work             *string      `json:"work,omitempty" db:"work"`
 	MediaKind        MediaKind    `json:"media_kind,omitempty" db:"media_kind"`
@@ -81,6 +85,8 @@ type Track struct {
 	Homedir              *string      `json:"-" db:"homedir" dbignore:"insert update"`
 	LyricsID         *pid.PersistentID `json:"lyrics_id" db:"lyrics_id"`
 	Lyrics           *string           `json:"lyrics" db:"-"`
+	AlbumID          *pid.PersistentID `json:"album_id,omitempty" db:"album_id"`
+	SearchVector     *string           `json:"-" db:"search_vector" dbignore:"insert update"`
 	db *DB
 }
 
@@ -0,0 +1,724 @@
+package musicdb
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rclancey/itunes/persistentId"
+)
+
+var ErrNotInTrash = errors.New("not in the trash")
+var ErrTrashConflict = errors.New("something else has taken its place")
+
+// files of deleted tracks go in this folder at the top of the media
+// folder they were in.  the scanner skips it like any other dot folder.
+const trashFolder = ".synos-trash"
+
+type TrashKind string
+
+const (
+	TrashTrack    = TrashKind("track")
+	TrashPlaylist = TrashKind("playlist")
+)
+
+// TrashActor is what deleted something
+type TrashActor string
+
+const (
+	TrashedByUser    = TrashActor("user")
+	TrashedByITunes  = TrashActor("itunes")
+	TrashedByScanner = TrashActor("scanner")
+)
+
+// TrashItem is a deleted track or playlist.  Data holds what it was,
+// and what's needed to put it back.
+type TrashItem struct {
+	PersistentID pid.PersistentID  `json:"persistent_id" db:"id"`
+	Kind         TrashKind         `json:"kind" db:"kind"`
+	OwnerID      pid.PersistentID  `json:"owner_id" db:"owner_id"`
+	Name         *string           `json:"name" db:"name"`
+	DeletedAt    Time              `json:"deleted_at" db:"deleted_at"`
+	DeletedBy    *pid.PersistentID `json:"deleted_by,omitempty" db:"deleted_by"`
+	Actor        TrashActor        `json:"actor" db:"actor"`
+	File         *string           `json:"-" db:"file"`
+	Data         []byte            `json:"-" db:"data"`
+	Track        *Track            `json:"track,omitempty" db:"-"`
+	Playlist     *Playlist         `json:"playlist,omitempty" db:"-"`
+}
+
+type trashedMembership struct {
+	PlaylistID pid.PersistentID
+	Position   int
+}
+
+type trashedTrack struct {
+	Track      *Track
+	Playlists  []trashedMembership
+	ScanFile   *ScanFile
+	ITunesData []byte
+	// where the file was before it was moved to the trash folder
+	Path       string
+}
+
+type trashedPlaylist struct {
+	Playlist   *Playlist
+	ITunesData []byte
+}
+
+func (item *TrashItem) decode() error {
+	switch item.Kind {
+	case TrashTrack:
+		tt := &trashedTrack{}
+		err := deserializeGob(item.Data, tt)
+		if err != nil {
+			return err
+		}
+		item.Track = tt.Track
+	case TrashPlaylist:
+		tp := &trashedPlaylist{}
+		err := deserializeGob(item.Data, tp)
+		if err != nil {
+			return err
+		}
+		item.Playlist = tp.Playlist
+	}
+	return nil
+}
+
+// putInTrash keeps a deleted row.  anything already in the trash under
+// the same id came back without being restored, and is replaced.
+func (db *DB) putInTrash(tx *Tx, item *TrashItem) error {
+	qs := `DELETE FROM trash WHERE kind = ? AND id = ?`
+	_, err := tx.Exec(qs, item.Kind, item.PersistentID)
+	if err != nil {
+		return err
+	}
+	qs = `INSERT INTO trash (id, kind, owner_id, name, deleted_at, deleted_by, actor, file, data) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(qs, item.PersistentID, item.Kind, item.OwnerID, item.Name, item.DeletedAt, item.DeletedBy, item.Actor, item.File, item.Data)
+	return err
+}
+
+func newTrashItem(kind TrashKind, id, ownerId pid.PersistentID, name *string, user *User, actor TrashActor) *TrashItem {
+	item := &TrashItem{
+		PersistentID: id,
+		Kind: kind,
+		OwnerID: ownerId,
+		Name: name,
+		DeletedAt: Now(),
+		Actor: actor,
+	}
+	if user != nil {
+		uid := user.PersistentID
+		item.DeletedBy = &uid
+	}
+	return item
+}
+
+func (db *DB) itunesData(tx *Tx, table string, id pid.PersistentID) ([]byte, error) {
+	var data []byte
+	qs := `SELECT data FROM ` + table + ` WHERE id = ?`
+	err := tx.QueryRow(qs, id.String()).Scan(&data)
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		return nil, err
+	}
+	return data, nil
+}
+
+// restoreITunesData puts back the itunes sync record of something
+// restored from the trash, so that the next sync updates it rather than
+// adding it again
+func (db *DB) restoreITunesData(tx *Tx, table string, id, ownerId pid.PersistentID, data []byte) error {
+	if data == nil {
+		return nil
+	}
+	var n int
+	qs := `SELECT COUNT(*) FROM ` + table + ` WHERE id = ?`
+	err := tx.QueryRow(qs, id.String()).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	qs = `INSERT INTO ` + table + ` (id, data, mod_date, owner_id) VALUES(?, ?, ?, ?)`
+	_, err = tx.Exec(qs, id.String(), data, time.Now().In(time.UTC), ownerId)
+	return err
+}
+
+// trashFileMove works out where a track's file goes in the trash.  files
+// that are missing, shared with another track or outside the media
+// folders stay where they are.
+func (db *DB) trashFileMove(tx *Tx, tr *Track) (*FileMove, error) {
+	finder := GetGlobalFinder()
+	if finder == nil || tr.Location == nil {
+		return nil, nil
+	}
+	fn := tr.Path()
+	st, err := os.Stat(fn)
+	if err != nil || !st.Mode().IsRegular() {
+		return nil, nil
+	}
+	var n int
+	qs := `SELECT COUNT(*) FROM track WHERE location = ? AND id != ?`
+	err = tx.QueryRow(qs, *tr.Location, tr.PersistentID).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, nil
+	}
+	root := reorganizeRoot(finder, &User{PersistentID: tr.OwnerID, HomeDirectory: tr.Homedir}, fn)
+	if root == "" || pathAfter(fn, root) == "" {
+		return nil, nil
+	}
+	dst := filepath.Join(root, trashFolder, tr.PersistentID.String() + filepath.Ext(fn))
+	return &FileMove{TrackID: tr.PersistentID, Root: root, From: fn, To: dst}, nil
+}
+
+// trashTrack moves a track to the trash, along with its places in
+// playlists and its scan record.  its play history is kept.  with
+// move, it works out where the track's file should go in the trash
+// folder; moving it is left to the caller, so that it can be done just
+// before the transaction is committed.
+func (db *DB) trashTrack(tx *Tx, id pid.PersistentID, user *User, actor TrashActor, move bool) (*FileMove, error) {
+	qs := `SELECT track.*, xuser.homedir FROM track LEFT OUTER JOIN xuser ON track.owner_id = xuser.id WHERE track.id = ?`
+	tr := &Track{}
+	err := tx.QueryRow(qs, id).StructScan(tr)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tr.db = db
+	tt := &trashedTrack{Track: tr, Playlists: []trashedMembership{}}
+	qs = `SELECT playlist_id, position FROM playlist_track WHERE track_id = ? ORDER BY playlist_id, position`
+	rows, err := tx.Query(qs, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var m trashedMembership
+		err = rows.Scan(&m.PlaylistID, &m.Position)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tt.Playlists = append(tt.Playlists, m)
+	}
+	rows.Close()
+	sf := &ScanFile{}
+	qs = `SELECT * FROM scan_file WHERE track_id = ?`
+	err = tx.QueryRow(qs, id).StructScan(sf)
+	if err == nil {
+		tt.ScanFile = sf
+	} else if errors.Cause(err) != sql.ErrNoRows {
+		return nil, err
+	}
+	tt.ITunesData, err = db.itunesData(tx, "itunes_track", id)
+	if err != nil {
+		return nil, err
+	}
+	var mv *FileMove
+	if move {
+		mv, err = db.trashFileMove(tx, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	item := newTrashItem(TrashTrack, id, tr.OwnerID, tr.Name, user, actor)
+	if mv != nil {
+		tt.Path = mv.From
+		item.File = &mv.To
+	}
+	item.Data = serializeGob(tt)
+	qs = `DELETE FROM playlist_track WHERE track_id = ?`
+	_, err = tx.Exec(qs, id)
+	if err != nil {
+		return nil, err
+	}
+	err = db.deleteFingerprint(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	qs = `DELETE FROM track_artist WHERE track_id = ?`
+	_, err = tx.Exec(qs, id)
+	if err != nil {
+		return nil, err
+	}
+	qs = `DELETE FROM scan_file WHERE track_id = ?`
+	_, err = tx.Exec(qs, id)
+	if err != nil {
+		return nil, err
+	}
+	qs = `DELETE FROM track WHERE id = ?`
+	_, err = tx.Exec(qs, id)
+	if err != nil {
+		return nil, err
+	}
+	return mv, db.putInTrash(tx, item)
+}
+
+// trashPlaylist moves a playlist to the trash.  its revisions are kept
+// for when it's restored.
+func (db *DB) trashPlaylist(tx *Tx, id pid.PersistentID, user *User, actor TrashActor) error {
+	var c int
+	qs := `SELECT COUNT(*) FROM playlist WHERE parent_id = ?`
+	err := tx.QueryRow(qs, id).Scan(&c)
+	if err != nil {
+		return err
+	}
+	if c != 0 {
+		return PlaylistFolderNotEmpty
+	}
+	pl := &Playlist{}
+	qs = `SELECT * FROM playlist WHERE id = ?`
+	err = tx.QueryRow(qs, id).StructScan(pl)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if !pl.Folder && pl.Smart == nil {
+		pl.TrackIDs = []pid.PersistentID{}
+		qs = `SELECT track_id FROM playlist_track WHERE playlist_id = ? ORDER BY position`
+		rows, err := tx.Query(qs, id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var trid pid.PersistentID
+			err = rows.Scan(&trid)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			pl.TrackIDs = append(pl.TrackIDs, trid)
+		}
+		rows.Close()
+	}
+	tp := &trashedPlaylist{Playlist: pl}
+	tp.ITunesData, err = db.itunesData(tx, "itunes_playlist", id)
+	if err != nil {
+		return err
+	}
+	name := pl.Name
+	item := newTrashItem(TrashPlaylist, id, pl.OwnerID, &name, user, actor)
+	item.Data = serializeGob(tp)
+	qs = `DELETE FROM playlist_track WHERE playlist_id = ?`
+	_, err = tx.Exec(qs, id)
+	if err != nil {
+		return err
+	}
+	qs = `DELETE FROM playlist WHERE id = ?`
+	_, err = tx.Exec(qs, id)
+	if err != nil {
+		return err
+	}
+	return db.putInTrash(tx, item)
+}
+
+// Trash lists what's in a user's trash, most recently deleted first
+func (db *DB) Trash(user *User) ([]*TrashItem, error) {
+	qs := `SELECT * FROM trash WHERE owner_id = ? ORDER BY deleted_at DESC`
+	rows, err := db.Query(qs, user.PersistentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*TrashItem{}
+	for rows.Next() {
+		item := &TrashItem{}
+		err = rows.StructScan(item)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't scan trash item")
+		}
+		err = item.decode()
+		if err != nil {
+			log.Println("can't decode trash item", item.Kind, item.PersistentID, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (db *DB) GetTrashItem(kind TrashKind, id pid.PersistentID, user *User) (*TrashItem, error) {
+	qs := `SELECT * FROM trash WHERE kind = ? AND id = ? AND owner_id = ?`
+	item := &TrashItem{}
+	err := db.QueryRow(qs, kind, id, user.PersistentID).StructScan(item)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "can't query trash item " + id.String())
+	}
+	return item, nil
+}
+
+// restoreMemberships puts a restored track back in the playlists it was
+// in, as near as it can to where it was.  playlists that have since
+// been deleted, or become smart playlists, are left alone.
+func (db *DB) restoreMemberships(tx *Tx, id pid.PersistentID, ms []trashedMembership, user *User) error {
+	byPlaylist := map[pid.PersistentID][]int{}
+	order := []pid.PersistentID{}
+	for _, m := range ms {
+		if _, ok := byPlaylist[m.PlaylistID]; !ok {
+			order = append(order, m.PlaylistID)
+		}
+		byPlaylist[m.PlaylistID] = append(byPlaylist[m.PlaylistID], m.Position)
+	}
+	for _, plid := range order {
+		pl := &Playlist{}
+		qs := `SELECT * FROM playlist WHERE id = ?`
+		err := tx.QueryRow(qs, plid).StructScan(pl)
+		if err != nil {
+			if errors.Cause(err) == sql.ErrNoRows {
+				continue
+			}
+			return err
+		}
+		if pl.Folder || pl.Smart != nil {
+			continue
+		}
+		pl.TrackIDs = []pid.PersistentID{}
+		qs = `SELECT track_id FROM playlist_track WHERE playlist_id = ? ORDER BY position`
+		rows, err := tx.Query(qs, plid)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var trid pid.PersistentID
+			err = rows.Scan(&trid)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			pl.TrackIDs = append(pl.TrackIDs, trid)
+		}
+		rows.Close()
+		// positions are in order, so each one goes in after the ones
+		// before it
+		for _, pos := range byPlaylist[plid] {
+			if pos > len(pl.TrackIDs) {
+				pos = len(pl.TrackIDs)
+			}
+			pl.TrackIDs = append(pl.TrackIDs[:pos], append([]pid.PersistentID{id}, pl.TrackIDs[pos:]...)...)
+		}
+		err = db.savePlaylistTracksWithTx(pl, tx)
+		if err != nil {
+			return err
+		}
+		err = db.recordPlaylistRevision(tx, pl, &user.PersistentID, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreTrack takes a track out of the trash, putting it back in its
+// playlists and its file back where it was
+func (db *DB) RestoreTrack(id pid.PersistentID, user *User) (*Track, error) {
+	item, err := db.GetTrashItem(TrashTrack, id, user)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrNotInTrash
+	}
+	tt := &trashedTrack{}
+	err = deserializeGob(item.Data, tt)
+	if err != nil {
+		return nil, err
+	}
+	tr := tt.Track
+	tr.db = db
+	var n int
+	qs := `SELECT COUNT(*) FROM track WHERE id = ?`
+	err = db.QueryRow(qs, id).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, ErrTrashConflict
+	}
+	if tr.Location != nil {
+		qs = `SELECT COUNT(*) FROM track WHERE owner_id = ? AND location = ?`
+		err = db.QueryRow(qs, tr.OwnerID, *tr.Location).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, ErrTrashConflict
+		}
+	}
+	var mv *FileMove
+	if item.File != nil && tt.Path != "" {
+		if _, err := os.Stat(tt.Path); err == nil {
+			return nil, ErrTrashConflict
+		}
+		if _, err := os.Stat(*item.File); err == nil {
+			mv = &FileMove{TrackID: id, From: *item.File, To: tt.Path}
+		}
+	}
+	hasFile := mv != nil
+	if !hasFile && tr.Location != nil {
+		_, err := os.Stat(tr.Path())
+		hasFile = err == nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = db.assignAlbum(tx, tr)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = db.insertStruct(tx, tr)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = db.assignArtists(tx, tr)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = db.restoreMemberships(tx, id, tt.Playlists, user)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	// without its scan record, the scanner would take the file for a
+	// new one
+	if tt.ScanFile != nil && hasFile {
+		sf := tt.ScanFile
+		qs = `INSERT INTO scan_file (track_id, owner_id, path, size, mod_date, data) VALUES(?, ?, ?, ?, ?, ?)`
+		_, err = tx.Exec(qs, sf.TrackID, sf.OwnerID, sf.Path, sf.Size, sf.ModDate, sf.Data)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = db.restoreITunesData(tx, "itunes_track", id, tr.OwnerID, tt.ITunesData)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	qs = `DELETE FROM trash WHERE kind = ? AND id = ?`
+	_, err = tx.Exec(qs, TrashTrack, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if mv != nil {
+		err = moveFile(mv.From, mv.To, false)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		if mv != nil {
+			moveFile(mv.To, mv.From, false)
+		}
+		return nil, err
+	}
+	return db.GetTrack(id)
+}
+
+// RestorePlaylist takes a playlist out of the trash.  if the folder it
+// was in is gone, it goes back at the top level, and tracks deleted
+// since are left out.
+func (db *DB) RestorePlaylist(id pid.PersistentID, user *User) (*Playlist, error) {
+	item, err := db.GetTrashItem(TrashPlaylist, id, user)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrNotInTrash
+	}
+	tp := &trashedPlaylist{}
+	err = deserializeGob(item.Data, tp)
+	if err != nil {
+		return nil, err
+	}
+	pl := tp.Playlist
+	pl.db = db
+	var n int
+	qs := `SELECT COUNT(*) FROM playlist WHERE id = ?`
+	err = db.QueryRow(qs, id).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, ErrTrashConflict
+	}
+	if pl.ParentPersistentID != nil {
+		parent, err := db.GetPlaylist(*pl.ParentPersistentID, &User{PersistentID: pl.OwnerID})
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil || !parent.Folder {
+			pl.ParentPersistentID = nil
+		}
+	}
+	if !pl.Folder && pl.Smart == nil {
+		pl.TrackIDs, err = db.existingTrackIDs(pl.TrackIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = db.insertStruct(tx, pl)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	// carry on from the revision it was at, so its history still lines
+	// up
+	qs = `UPDATE playlist SET revision = ? WHERE id = ?`
+	_, err = tx.Exec(qs, pl.Revision, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = db.savePlaylistTracksWithTx(pl, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = db.recordPlaylistRevision(tx, pl, &user.PersistentID, nil)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = db.restoreITunesData(tx, "itunes_playlist", id, pl.OwnerID, tp.ITunesData)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	qs = `DELETE FROM trash WHERE kind = ? AND id = ?`
+	_, err = tx.Exec(qs, TrashPlaylist, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// purgeTrashItem deletes something in the trash for good.  if it has
+// come back some other way since, only the trash is cleared out.
+func (db *DB) purgeTrashItem(item *TrashItem) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var n int
+	switch item.Kind {
+	case TrashTrack:
+		qs := `SELECT COUNT(*) FROM track WHERE id = ?`
+		err = tx.QueryRow(qs, item.PersistentID).Scan(&n)
+		if err == nil && n == 0 {
+			err = db.deleteTrackId(tx, item.PersistentID)
+			if err == nil {
+				tt := &trashedTrack{}
+				if deserializeGob(item.Data, tt) == nil && tt.Track != nil && tt.Track.AlbumID != nil {
+					err = db.pruneAlbum(tx, *tt.Track.AlbumID, item.PersistentID)
+				}
+			}
+		}
+	case TrashPlaylist:
+		qs := `SELECT COUNT(*) FROM playlist WHERE id = ?`
+		err = tx.QueryRow(qs, item.PersistentID).Scan(&n)
+		if err == nil && n == 0 {
+			qs = `DELETE FROM playlist_revision WHERE playlist_id = ?`
+			_, err = tx.Exec(qs, item.PersistentID)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	qs := `DELETE FROM trash WHERE kind = ? AND id = ?`
+	_, err = tx.Exec(qs, item.Kind, item.PersistentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if item.File != nil {
+		err = os.Remove(*item.File)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// PurgeTrashItem deletes something in a user's trash for good
+func (db *DB) PurgeTrashItem(kind TrashKind, id pid.PersistentID, user *User) error {
+	item, err := db.GetTrashItem(kind, id, user)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return ErrNotInTrash
+	}
+	return db.purgeTrashItem(item)
+}
+
+// EmptyTrash deletes everything in a user's trash for good
+func (db *DB) EmptyTrash(user *User) (int, error) {
+	qs := `SELECT * FROM trash WHERE owner_id = ?`
+	return db.purgeTrash(qs, user.PersistentID)
+}
+
+// PurgeTrash deletes for good whatever was put in the trash before a
+// given time
+func (db *DB) PurgeTrash(before time.Time) (int, error) {
+	qs := `SELECT * FROM trash WHERE deleted_at < ?`
+	return db.purgeTrash(qs, FromTime(before))
+}
+
+func (db *DB) purgeTrash(qs string, args ...interface{}) (int, error) {
+	rows, err := db.Query(qs, args...)
+	if err != nil {
+		return 0, err
+	}
+	items := []*TrashItem{}
+	for rows.Next() {
+		item := &TrashItem{}
+		err = rows.StructScan(item)
+		if err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "can't scan trash item")
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	n := 0
+	for _, item := range items {
+		err = db.purgeTrashItem(item)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -35,43 +35,6 @@ func (g *Genre) Sorted() []string {
 	return sortNames(g.Names)
 }
 
-type Artist struct {
-	SortName string `json:"sort"`
-	Names map[string]int `json:"names"`
-	db *DB
-}
-
-func (a *Artist) Sorted() []string {
-	return sortNames(a.Names)
-}
-
-func (a *Artist) Count() int {
-	count := 0
-	for _, v := range a.Names {
-		count += v
-	}
-	return count
-}
-
-type Album struct {
-	Artist *Artist `json:"artist"`
-	SortName string `json:"sort"`
-	Names map[string]int `json:"names"`
-	db *DB
-}
-
-func (a *Album) Sorted() []string {
-	return sortNames(a.Names)
-}
-
-func (a *Album) Count() int {
-	count := 0
-	for _, v := range a.Names {
-		count += v
-	}
-	return count
-}
-
 func NewGenre(name string) *Genre {
 	if name == "" {
 		return nil
@@ -42,6 +42,11 @@ type User struct {
 	TmpTwoFactor  *authenticator.TwoFactorAuthenticator `json:"tmp_twofactor_auth,omitempty" db:"tmp_twofactor_auth"`
 	IsAdmin       bool         `json:"admin,omitempty" db:"admin"`
 	LastLibraryUpdate *Time `json:"last_library_update" db:"last_library_update"`
+	WriteTags     bool         `json:"write_tags,omitempty" db:"write_tags"`
+	LastFMUser    *string      `json:"lastfm_user,omitempty" db:"lastfm_user"`
+	LastFMSession *string      `json:"lastfm_session,omitempty" db:"lastfm_session"`
+	ListenBrainzUser  *string  `json:"listenbrainz_user,omitempty" db:"listenbrainz_user"`
+	ListenBrainzToken *string  `json:"listenbrainz_token,omitempty" db:"listenbrainz_token"`
 	db *DB
 }
 
@@ -305,6 +310,8 @@ func (u *User) Clean() *User {
 	clone.Password = nil
 	clone.TwoFactor = nil
 	clone.TmpTwoFactor = nil
+	clone.LastFMSession = nil
+	clone.ListenBrainzToken = nil
 	return &clone
 }
 
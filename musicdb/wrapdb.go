@@ -8,10 +8,8 @@ import (
 	"github.com/pkg/errors"
 )
 
-var bindType = sqlx.BindType("postgres")
-
 func queryfix(qs string) string {
-	return sqlx.Rebind(bindType, qs)
+	return sqlx.Rebind(sqlx.BindType(dialect.DriverName()), dialect.Rewrite(qs))
 }
 
 type Row struct {
@@ -14,6 +14,8 @@ import (
 
 	"github.com/dhowden/tag"
 	"github.com/tcolgate/mp3"
+
+	"github.com/rclancey/synos/musicdb"
 )
 
 type Stream struct {
@@ -29,6 +31,8 @@ type Stream struct {
 	wake chan bool
 	current string
 	closed bool
+	// called as each library track starts going out to listeners
+	OnTrack func(tr *musicdb.Track)
 }
 
 func NewStream(name string, station Station) (*Stream, error) {
@@ -169,7 +173,12 @@ func (s *Stream) run() {
 			break
 		}
 		fn := s.station.Next()
-		t, err := NewTranscoder(fn, 128000)
+		var gain *float64
+		gs, ok := s.station.(GainStation)
+		if ok {
+			gain = gs.Gain()
+		}
+		t, err := NewGainTranscoder(fn, 128000, gain)
 		if err != nil {
 			errcnt++
 			log.Println(err)
@@ -181,6 +190,11 @@ func (s *Stream) run() {
 		}
 		s.current = fn
 		errcnt = 0
+		var track *musicdb.Track
+		ts, ok := s.station.(TrackStation)
+		if ok {
+			track = ts.Current()
+		}
 		d := mp3.NewDecoder(t)
 		var frame mp3.Frame
 		skipped := 0
@@ -193,6 +207,13 @@ func (s *Stream) run() {
 			if s.closed {
 				break
 			}
+			if track != nil {
+				// only once someone is listening
+				if s.OnTrack != nil {
+					go s.OnTrack(track)
+				}
+				track = nil
+			}
 			err := d.Decode(&frame, &skipped)
 			if err != nil {
 				if err != io.EOF {
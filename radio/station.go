@@ -14,12 +14,27 @@ type Station interface{
 	Description() string
 }
 
+// GainStation is a station that knows how much to adjust the volume of
+// the track Next last returned
+type GainStation interface {
+	Gain() *float64
+}
+
+// TrackStation is a station that plays tracks from the library, and can
+// say which one Next last returned
+type TrackStation interface {
+	Current() *musicdb.Track
+}
+
 type PlaylistStation struct {
 	db *musicdb.DB
 	playlistId pid.PersistentID
 	tracks []*musicdb.Track
 	index int
 	shuffle bool
+	gainMode musicdb.GainMode
+	preamp float64
+	current *musicdb.Track
 }
 
 func NewPlaylistStation(db *musicdb.DB, playlistId pid.PersistentID, shuffle bool) (*PlaylistStation, error) {
@@ -31,6 +46,24 @@ func NewPlaylistStation(db *musicdb.DB, playlistId pid.PersistentID, shuffle boo
 	}, nil
 }
 
+// SetGain makes the station play tracks at their track or album gain,
+// plus preamp dB
+func (s *PlaylistStation) SetGain(mode musicdb.GainMode, preamp float64) {
+	s.gainMode = mode
+	s.preamp = preamp
+}
+
+func (s *PlaylistStation) Gain() *float64 {
+	if s.current == nil {
+		return nil
+	}
+	return s.current.PlaybackGain(s.gainMode, s.preamp)
+}
+
+func (s *PlaylistStation) Current() *musicdb.Track {
+	return s.current
+}
+
 func (s *PlaylistStation) Name() string {
 	pl, err := s.db.GetPlaylist(s.playlistId, nil)
 	if err != nil {
@@ -85,8 +118,8 @@ func (s *PlaylistStation) Next() string {
 			rand.Shuffle(len(s.tracks), func(i, j int) { s.tracks[i], s.tracks[j] = s.tracks[j], s.tracks[i] })
 		}
 	}
-	fn := s.tracks[s.index].Path()
+	s.current = s.tracks[s.index]
 	s.index++
-	return fn
+	return s.current.Path()
 }
 
@@ -14,8 +14,19 @@ type Transcoder struct {
 }
 
 func NewTranscoder(fn string, bitrate int) (*Transcoder, error) {
+	return NewGainTranscoder(fn, bitrate, nil)
+}
+
+// NewGainTranscoder transcodes to mp3, adjusting the volume by gain dB
+// if it's not nil
+func NewGainTranscoder(fn string, bitrate int, gain *float64) (*Transcoder, error) {
 	log.Println("transcoding", fn)
-	cmd := exec.Command("ffmpeg", "-loglevel", "error", "-i", fn, "-vn", "-f", "mp3", "-acodec", "libmp3lame", "-ab", fmt.Sprintf("%dk", bitrate / 1000), "-")
+	args := []string{"-loglevel", "error", "-i", fn, "-vn"}
+	if gain != nil {
+		args = append(args, "-af", fmt.Sprintf("volume=%.2fdB", *gain))
+	}
+	args = append(args, "-f", "mp3", "-acodec", "libmp3lame", "-ab", fmt.Sprintf("%dk", bitrate / 1000), "-")
+	cmd := exec.Command("ffmpeg", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Println(err)
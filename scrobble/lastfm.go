@@ -0,0 +1,188 @@
+package scrobble
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/synos/musicdb"
+)
+
+const (
+	LastFMRoot = "https://ws.audioscrobbler.com/2.0/"
+	LastFMAuthRoot = "https://www.last.fm/api/auth/"
+)
+
+// last.fm errors worth retrying: service offline, temporarily
+// unavailable, rate limited
+var lastFMTemporary = map[int]bool{
+	11: true,
+	16: true,
+	29: true,
+}
+
+// LastFM scrobbles with the Last.fm 2.0 api.  users connect through the
+// web authentication flow, which gives us a session key to sign their
+// requests with.
+type LastFM struct {
+	APIKey  string
+	Secret  string
+	BaseURL string
+	AuthURL string
+	Client  *http.Client
+}
+
+func NewLastFM(apiKey, secret string) *LastFM {
+	return &LastFM{
+		APIKey: apiKey,
+		Secret: secret,
+		BaseURL: LastFMRoot,
+		AuthURL: LastFMAuthRoot,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (lf *LastFM) Name() string {
+	return "lastfm"
+}
+
+func (lf *LastFM) BatchSize() int {
+	return 50
+}
+
+func (lf *LastFM) Credential(user *musicdb.User) string {
+	if user.LastFMSession == nil {
+		return ""
+	}
+	return *user.LastFMSession
+}
+
+// sign computes the api signature: the md5 of every parameter name and
+// value, sorted by name, followed by the shared secret
+func (lf *LastFM) sign(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k == "format" || k == "callback" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteString(params.Get(k))
+	}
+	sb.WriteString(lf.Secret)
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (lf *LastFM) call(method string, params url.Values, result interface{}) error {
+	params.Set("method", method)
+	params.Set("api_key", lf.APIKey)
+	params.Set("api_sig", lf.sign(params))
+	params.Set("format", "json")
+	res, err := lf.Client.PostForm(lf.BaseURL, params)
+	if err != nil {
+		return errors.Wrap(err, "can't reach last.fm")
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "can't read last.fm response")
+	}
+	var lferr struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &lferr)
+	if lferr.Error != 0 {
+		return &Error{
+			Service: lf.Name(),
+			Code: lferr.Error,
+			Message: lferr.Message,
+			Temporary: lastFMTemporary[lferr.Error],
+		}
+	}
+	if res.StatusCode >= 400 {
+		return &Error{
+			Service: lf.Name(),
+			Code: res.StatusCode,
+			Message: res.Status,
+			Temporary: res.StatusCode >= 500,
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(data, result), "can't parse last.fm response")
+}
+
+// AuthorizeURL is where to send a user to let us scrobble for them.
+// last.fm sends them back to callback with a token for GetSession.
+func (lf *LastFM) AuthorizeURL(callback string) string {
+	q := url.Values{}
+	q.Set("api_key", lf.APIKey)
+	q.Set("cb", callback)
+	return lf.AuthURL + "?" + q.Encode()
+}
+
+// GetSession trades an authorization token for the user's last.fm name
+// and session key
+func (lf *LastFM) GetSession(token string) (string, string, error) {
+	var res struct {
+		Session struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		} `json:"session"`
+	}
+	err := lf.call("auth.getSession", url.Values{"token": []string{token}}, &res)
+	if err != nil {
+		return "", "", err
+	}
+	return res.Session.Name, res.Session.Key, nil
+}
+
+func (lf *LastFM) trackParams(params url.Values, l *Listen, suffix string) {
+	params.Set("artist" + suffix, l.Artist)
+	params.Set("track" + suffix, l.Track)
+	if l.Album != "" {
+		params.Set("album" + suffix, l.Album)
+	}
+	if l.AlbumArtist != "" {
+		params.Set("albumArtist" + suffix, l.AlbumArtist)
+	}
+	if l.TrackNumber > 0 {
+		params.Set("trackNumber" + suffix, strconv.Itoa(l.TrackNumber))
+	}
+	if l.Duration > 0 {
+		params.Set("duration" + suffix, strconv.Itoa(l.Duration))
+	}
+}
+
+func (lf *LastFM) NowPlaying(cred string, l *Listen) error {
+	params := url.Values{}
+	params.Set("sk", cred)
+	lf.trackParams(params, l, "")
+	return lf.call("track.updateNowPlaying", params, nil)
+}
+
+func (lf *LastFM) Submit(cred string, ls []*Listen) error {
+	params := url.Values{}
+	params.Set("sk", cred)
+	for i, l := range ls {
+		suffix := "[" + strconv.Itoa(i) + "]"
+		lf.trackParams(params, l, suffix)
+		params.Set("timestamp" + suffix, strconv.FormatInt(l.Timestamp, 10))
+	}
+	return lf.call("track.scrobble", params, nil)
+}
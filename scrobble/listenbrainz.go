@@ -0,0 +1,178 @@
+package scrobble
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/synos/musicdb"
+)
+
+const ListenBrainzRoot = "https://api.listenbrainz.org"
+
+// ListenBrainz submits listens to a ListenBrainz server.  users connect
+// by giving us the user token from their ListenBrainz profile.
+type ListenBrainz struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewListenBrainz(baseURL string) *ListenBrainz {
+	if baseURL == "" {
+		baseURL = ListenBrainzRoot
+	}
+	return &ListenBrainz{
+		BaseURL: baseURL,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (lb *ListenBrainz) Name() string {
+	return "listenbrainz"
+}
+
+func (lb *ListenBrainz) BatchSize() int {
+	return 100
+}
+
+func (lb *ListenBrainz) Credential(user *musicdb.User) string {
+	if user.ListenBrainzToken == nil {
+		return ""
+	}
+	return *user.ListenBrainzToken
+}
+
+func (lb *ListenBrainz) call(method, path, token string, body interface{}, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, lb.BaseURL + path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token " + token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := lb.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "can't reach listenbrainz")
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "can't read listenbrainz response")
+	}
+	if res.StatusCode >= 400 {
+		var lberr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &lberr)
+		if lberr.Error == "" {
+			lberr.Error = res.Status
+		}
+		return &Error{
+			Service: lb.Name(),
+			Code: res.StatusCode,
+			Message: lberr.Error,
+			Temporary: res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500,
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(data, result), "can't parse listenbrainz response")
+}
+
+// ValidateToken checks a user token, giving the name of the user it
+// belongs to
+func (lb *ListenBrainz) ValidateToken(token string) (string, error) {
+	var res struct {
+		Valid    bool   `json:"valid"`
+		UserName string `json:"user_name"`
+		Message  string `json:"message"`
+	}
+	err := lb.call(http.MethodGet, "/1/validate-token", token, nil, &res)
+	if err != nil {
+		return "", err
+	}
+	if !res.Valid {
+		return "", &Error{Service: lb.Name(), Code: http.StatusUnauthorized, Message: res.Message}
+	}
+	return res.UserName, nil
+}
+
+type lbAdditionalInfo struct {
+	DurationMS       int    `json:"duration_ms,omitempty"`
+	TrackNumber      int    `json:"tracknumber,omitempty"`
+	SubmissionClient string `json:"submission_client"`
+	MediaPlayer      string `json:"media_player"`
+}
+
+type lbTrackMetadata struct {
+	ArtistName     string            `json:"artist_name"`
+	TrackName      string            `json:"track_name"`
+	ReleaseName    string            `json:"release_name,omitempty"`
+	AdditionalInfo *lbAdditionalInfo `json:"additional_info"`
+}
+
+type lbListen struct {
+	ListenedAt     int64            `json:"listened_at,omitempty"`
+	TrackMetadata  *lbTrackMetadata `json:"track_metadata"`
+}
+
+type lbSubmission struct {
+	ListenType string      `json:"listen_type"`
+	Payload    []*lbListen `json:"payload"`
+}
+
+func lbFromListen(l *Listen, withTime bool) *lbListen {
+	lbl := &lbListen{
+		TrackMetadata: &lbTrackMetadata{
+			ArtistName: l.Artist,
+			TrackName: l.Track,
+			ReleaseName: l.Album,
+			AdditionalInfo: &lbAdditionalInfo{
+				DurationMS: l.Duration * 1000,
+				TrackNumber: l.TrackNumber,
+				SubmissionClient: "Synos",
+				MediaPlayer: "Synos",
+			},
+		},
+	}
+	if withTime {
+		lbl.ListenedAt = l.Timestamp
+	}
+	return lbl
+}
+
+func (lb *ListenBrainz) NowPlaying(cred string, l *Listen) error {
+	sub := &lbSubmission{
+		ListenType: "playing_now",
+		Payload: []*lbListen{lbFromListen(l, false)},
+	}
+	return lb.call(http.MethodPost, "/1/submit-listens", cred, sub, nil)
+}
+
+func (lb *ListenBrainz) Submit(cred string, ls []*Listen) error {
+	sub := &lbSubmission{
+		ListenType: "import",
+		Payload: make([]*lbListen, len(ls)),
+	}
+	if len(ls) == 1 {
+		sub.ListenType = "single"
+	}
+	for i, l := range ls {
+		sub.Payload[i] = lbFromListen(l, true)
+	}
+	return lb.call(http.MethodPost, "/1/submit-listens", cred, sub, nil)
+}
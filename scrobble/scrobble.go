@@ -0,0 +1,106 @@
+// Package scrobble submits what users listen to to services like
+// Last.fm and ListenBrainz.  plays are queued in the database, so that
+// scrobbles survive restarts and outages and go out once the service is
+// reachable again.
+package scrobble
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rclancey/synos/musicdb"
+)
+
+// Listen is a play as the scrobbling services see it
+type Listen struct {
+	Artist      string `json:"artist"`
+	Track       string `json:"track"`
+	Album       string `json:"album,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+	TrackNumber int    `json:"track_number,omitempty"`
+	// seconds
+	Duration    int    `json:"duration,omitempty"`
+	// unix time the track started playing
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// NewListen describes a play of tr starting at when.  tracks without
+// an artist or a name can't be scrobbled, and give nil.
+func NewListen(tr *musicdb.Track, when time.Time) *Listen {
+	if tr.Artist == nil || *tr.Artist == "" || tr.Name == nil || *tr.Name == "" {
+		return nil
+	}
+	l := &Listen{
+		Artist: *tr.Artist,
+		Track: *tr.Name,
+		Timestamp: when.Unix(),
+	}
+	if tr.Album != nil {
+		l.Album = *tr.Album
+	}
+	if tr.AlbumArtist != nil {
+		l.AlbumArtist = *tr.AlbumArtist
+	}
+	if tr.TrackNumber != nil {
+		l.TrackNumber = int(*tr.TrackNumber)
+	}
+	if tr.TotalTime != nil {
+		l.Duration = int(*tr.TotalTime / 1000)
+	}
+	return l
+}
+
+// Service is a scrobbling service
+type Service interface {
+	Name() string
+	// Credential is the user's session key or token for the service, or
+	// "" if they haven't connected to it
+	Credential(user *musicdb.User) string
+	NowPlaying(cred string, l *Listen) error
+	Submit(cred string, ls []*Listen) error
+	// how many listens Submit takes at once
+	BatchSize() int
+}
+
+// Error is an error reported by a scrobbling service
+type Error struct {
+	Service   string
+	Code      int
+	Message   string
+	Temporary bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error %d: %s", e.Service, e.Code, e.Message)
+}
+
+// IsTemporary tells whether a failed submission is worth retrying.
+// errors from the service are when it says so; anything else is network
+// trouble, which always is.
+func IsTemporary(err error) bool {
+	var serr *Error
+	if errors.As(err, &serr) {
+		return serr.Temporary
+	}
+	return true
+}
+
+// ScrobbleDelay is how long a track has to play before it counts: half
+// its length, but no more than four minutes
+func ScrobbleDelay(tr *musicdb.Track) time.Duration {
+	if tr.TotalTime == nil || *tr.TotalTime == 0 {
+		return 30 * time.Second
+	}
+	d := time.Duration(*tr.TotalTime) * time.Millisecond / 2
+	if d > 4 * time.Minute {
+		d = 4 * time.Minute
+	}
+	return d
+}
+
+// Scrobbleable says whether the services accept plays of tr at all;
+// they ignore tracks under 30 seconds
+func Scrobbleable(tr *musicdb.Track) bool {
+	return tr.TotalTime == nil || *tr.TotalTime == 0 || *tr.TotalTime >= 30000
+}
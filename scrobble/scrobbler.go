@@ -0,0 +1,263 @@
+package scrobble
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rclancey/synos/musicdb"
+)
+
+// give up on a scrobble after this many failures
+const (
+	maxTemporaryAttempts = 50
+	maxPermanentAttempts = 3
+	maxBackoff = 6 * time.Hour
+)
+
+// Scrobbler sends users' plays to each service they've connected.  now
+// playing notices go out right away; scrobbles are queued and submitted
+// in batches once they're due.
+type Scrobbler struct {
+	DB       *musicdb.DB
+	Services []Service
+	Interval time.Duration
+	quit     chan bool
+	wake     chan bool
+	wg       sync.WaitGroup
+	lock     sync.Mutex
+}
+
+func NewScrobbler(db *musicdb.DB, services ...Service) *Scrobbler {
+	return &Scrobbler{
+		DB: db,
+		Services: services,
+		Interval: time.Minute,
+		wake: make(chan bool, 1),
+	}
+}
+
+func (s *Scrobbler) Service(name string) Service {
+	for _, svc := range s.Services {
+		if svc.Name() == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+// NowPlaying tells the user's services what they've started listening
+// to.  it doesn't wait for them to answer.
+func (s *Scrobbler) NowPlaying(user *musicdb.User, tr *musicdb.Track) {
+	if user == nil {
+		return
+	}
+	l := NewListen(tr, time.Now())
+	if l == nil {
+		return
+	}
+	for _, svc := range s.Services {
+		cred := svc.Credential(user)
+		if cred == "" {
+			continue
+		}
+		go func(svc Service, cred string) {
+			err := svc.NowPlaying(cred, l)
+			if err != nil {
+				log.Printf("error sending now playing to %s for %s: %s", svc.Name(), user.Username, err)
+			}
+		}(svc, cred)
+	}
+}
+
+// Scrobble queues a play for each of the user's services.  it becomes
+// due once the track has played long enough to count.
+func (s *Scrobbler) Scrobble(user *musicdb.User, tr *musicdb.Track, ev *musicdb.PlayEvent) error {
+	if user == nil || !Scrobbleable(tr) {
+		return nil
+	}
+	l := NewListen(tr, ev.PlayDate.Time())
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	due := musicdb.FromTime(ev.PlayDate.Time().Add(ScrobbleDelay(tr)))
+	for _, svc := range s.Services {
+		if svc.Credential(user) == "" {
+			continue
+		}
+		evId := ev.PersistentID
+		q := &musicdb.QueuedScrobble{
+			UserID: user.PersistentID,
+			Service: svc.Name(),
+			PlayEventID: &evId,
+			PlayDate: ev.PlayDate,
+			Data: string(data),
+			NextAttempt: due,
+		}
+		err = s.DB.QueueScrobble(q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Skipped drops the scrobbles of a play that was skipped before it
+// counted
+func (s *Scrobbler) Skipped(tr *musicdb.Track, ev *musicdb.PlayEvent) error {
+	played := time.Since(ev.PlayDate.Time())
+	if ev.Duration != nil {
+		played = time.Duration(*ev.Duration) * time.Millisecond
+	}
+	if played >= ScrobbleDelay(tr) {
+		return nil
+	}
+	return s.DB.CancelScrobbles(ev.PersistentID)
+}
+
+func (s *Scrobbler) Start() {
+	s.quit = make(chan bool)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			err := s.Flush()
+			if err != nil {
+				log.Println("error flushing scrobble queue:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Wake flushes the queue now rather than at the next interval
+func (s *Scrobbler) Wake() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+func (s *Scrobbler) Close() {
+	if s.quit == nil {
+		return
+	}
+	close(s.quit)
+	s.wg.Wait()
+	s.quit = nil
+}
+
+// Flush submits every scrobble that's due, a batch per user and service
+func (s *Scrobbler) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queue, err := s.DB.DueScrobbles(musicdb.Now(), 1000)
+	if err != nil {
+		return err
+	}
+	for len(queue) > 0 {
+		n := 1
+		for n < len(queue) && queue[n].UserID == queue[0].UserID && queue[n].Service == queue[0].Service {
+			n++
+		}
+		s.submit(queue[:n])
+		queue = queue[n:]
+	}
+	return nil
+}
+
+// submit sends one user's queued scrobbles to one service
+func (s *Scrobbler) submit(queue []*musicdb.QueuedScrobble) {
+	svc := s.Service(queue[0].Service)
+	user := &musicdb.User{PersistentID: queue[0].UserID}
+	err := user.Reload(s.DB)
+	cred := ""
+	if err == nil && svc != nil {
+		cred = svc.Credential(user)
+	}
+	if cred == "" {
+		// the service has been turned off, or the user has gone or
+		// disconnected from it
+		for _, q := range queue {
+			s.DB.DeleteScrobble(q.PersistentID)
+		}
+		return
+	}
+	size := svc.BatchSize()
+	for len(queue) > 0 {
+		batch := queue
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+		queue = queue[len(batch):]
+		listens := make([]*Listen, 0, len(batch))
+		good := make([]*musicdb.QueuedScrobble, 0, len(batch))
+		for _, q := range batch {
+			l := &Listen{}
+			err = json.Unmarshal([]byte(q.Data), l)
+			if err != nil {
+				log.Println("dropping unreadable scrobble:", err)
+				s.DB.DeleteScrobble(q.PersistentID)
+				continue
+			}
+			listens = append(listens, l)
+			good = append(good, q)
+		}
+		if len(listens) == 0 {
+			continue
+		}
+		err = svc.Submit(cred, listens)
+		for _, q := range good {
+			if err == nil {
+				s.DB.DeleteScrobble(q.PersistentID)
+			} else {
+				s.retry(q, err)
+			}
+		}
+		if err != nil {
+			log.Printf("error scrobbling to %s for %s: %s", svc.Name(), user.Username, err)
+			if IsTemporary(err) {
+				// the rest would only fail the same way
+				for _, q := range queue {
+					s.retry(q, err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// retry pushes a failed scrobble back with exponential backoff, or
+// gives up on it if it's failed too often
+func (s *Scrobbler) retry(q *musicdb.QueuedScrobble, err error) {
+	q.Attempts++
+	max := maxTemporaryAttempts
+	if !IsTemporary(err) {
+		max = maxPermanentAttempts
+	}
+	if q.Attempts >= max {
+		log.Printf("giving up on %s scrobble %s after %d attempts", q.Service, q.PersistentID, q.Attempts)
+		s.DB.DeleteScrobble(q.PersistentID)
+		return
+	}
+	backoff := time.Minute << uint(q.Attempts)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	msg := err.Error()
+	q.LastError = &msg
+	q.NextAttempt = musicdb.FromTime(time.Now().Add(backoff))
+	s.DB.RetryScrobble(q)
+}
@@ -41,6 +41,8 @@ type Sonos struct {
 	db *musicdb.DB
 	closed bool
 	Events chan interface{}
+	// play queued tracks at their track or album gain
+	GainMode musicdb.GainMode
 }
 
 func NewSonos(iface string, rootUrl *url.URL, db *musicdb.DB) (*Sonos, error) {
@@ -327,8 +329,17 @@ func (s *Sonos) GetQueue() (queue *Queue, xerr error) {
 
 func (s *Sonos) trackUri(track *musicdb.Track) string {
 	ext := filepath.Ext(track.Path())
+	if s.GainMode != musicdb.GainNone {
+		// normalized tracks are transcoded to mp3
+		ext = ".mp3"
+	}
 	path := "/api/track/" + track.PersistentID.String() + ext
 	u, _ := url.Parse(path)
+	q := url.Values{"source": []string{string(musicdb.SourceSonos)}}
+	if s.GainMode != musicdb.GainNone {
+		q.Set("gain", string(s.GainMode))
+	}
+	u.RawQuery = q.Encode()
 	ref := s.rootUrl.ResolveReference(u)
 	return ref.String()
 }
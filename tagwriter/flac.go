@@ -0,0 +1,122 @@
+package tagwriter
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	flacStreamInfo = 0
+	flacPadding = 1
+	flacVorbisComment = 4
+	flacPicture = 6
+)
+
+const flacPaddingSize = 4096
+
+type flacBlock struct {
+	typ byte
+	data []byte
+}
+
+func readFLACBlocks(f *os.File) ([]*flacBlock, int64, error) {
+	hdr := make([]byte, 4)
+	_, err := f.ReadAt(hdr, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(hdr) != "fLaC" {
+		return nil, 0, errors.New("not a flac file")
+	}
+	offset := int64(4)
+	blocks := []*flacBlock{}
+	for {
+		_, err = f.ReadAt(hdr, offset)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "can't read flac metadata")
+		}
+		last := hdr[0] & 0x80 != 0
+		size := int(hdr[1]) << 16 | int(hdr[2]) << 8 | int(hdr[3])
+		data := make([]byte, size)
+		_, err = f.ReadAt(data, offset + 4)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "can't read flac metadata")
+		}
+		blocks = append(blocks, &flacBlock{typ: hdr[0] & 0x7f, data: data})
+		offset += int64(4 + size)
+		if last {
+			break
+		}
+	}
+	if len(blocks) == 0 || blocks[0].typ != flacStreamInfo {
+		return nil, 0, errors.New("flac file missing stream info")
+	}
+	return blocks, offset, nil
+}
+
+func writeFLAC(in *os.File, out *os.File, tags *Tags) error {
+	blocks, audioStart, err := readFLACBlocks(in)
+	if err != nil {
+		return err
+	}
+	var vc *vorbisComment
+	keep := []*flacBlock{}
+	for _, block := range blocks {
+		switch block.typ {
+		case flacPadding:
+			continue
+		case flacVorbisComment:
+			if vc == nil {
+				vc, err = parseVorbisComment(block.data)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		case flacPicture:
+			if tags.Artwork != nil && pictureType(block.data) == 3 {
+				continue
+			}
+		}
+		keep = append(keep, block)
+	}
+	if vc == nil {
+		vc = &vorbisComment{vendor: vorbisVendor}
+	}
+	vc.apply(tags, false)
+	blocks = []*flacBlock{keep[0], &flacBlock{typ: flacVorbisComment, data: vc.bytes()}}
+	blocks = append(blocks, keep[1:]...)
+	if tags.Artwork != nil && len(tags.Artwork.Data) > 0 {
+		blocks = append(blocks, &flacBlock{typ: flacPicture, data: pictureBlock(tags.Artwork)})
+	}
+	blocks = append(blocks, &flacBlock{typ: flacPadding, data: make([]byte, flacPaddingSize)})
+	_, err = out.Write([]byte("fLaC"))
+	if err != nil {
+		return err
+	}
+	for i, block := range blocks {
+		if len(block.data) >= 1 << 24 {
+			return errors.New("flac metadata block too large")
+		}
+		hdr := []byte{block.typ, byte(len(block.data) >> 16), byte(len(block.data) >> 8), byte(len(block.data))}
+		if i == len(blocks) - 1 {
+			hdr[0] |= 0x80
+		}
+		_, err = out.Write(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(block.data)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = in.Seek(audioStart, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,454 @@
+package tagwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+const id3Padding = 1024
+
+type id3Frame struct {
+	id    string
+	flags []byte
+	data  []byte
+}
+
+// id3v2.2 frames that can be carried over to 2.3 unchanged but for
+// their ids
+var id3v22Frames = map[string]string{
+	"BUF": "RBUF",
+	"CNT": "PCNT",
+	"COM": "COMM",
+	"CRA": "AENC",
+	"ETC": "ETCO",
+	"EQU": "EQUA",
+	"GEO": "GEOB",
+	"GP1": "GRP1",
+	"IPL": "IPLS",
+	"LNK": "LINK",
+	"MCI": "MCDI",
+	"MLL": "MLLT",
+	"MVI": "MVIN",
+	"MVN": "MVNM",
+	"POP": "POPM",
+	"REV": "RVRB",
+	"RVA": "RVAD",
+	"SLT": "SYLT",
+	"STC": "SYTC",
+	"TAL": "TALB",
+	"TBP": "TBPM",
+	"TCM": "TCOM",
+	"TCO": "TCON",
+	"TCP": "TCMP",
+	"TCR": "TCOP",
+	"TDA": "TDAT",
+	"TDY": "TDLY",
+	"TEN": "TENC",
+	"TFT": "TFLT",
+	"TIM": "TIME",
+	"TKE": "TKEY",
+	"TLA": "TLAN",
+	"TLE": "TLEN",
+	"TMT": "TMED",
+	"TOA": "TOPE",
+	"TOF": "TOFN",
+	"TOL": "TOLY",
+	"TOR": "TORY",
+	"TOT": "TOAL",
+	"TP1": "TPE1",
+	"TP2": "TPE2",
+	"TP3": "TPE3",
+	"TP4": "TPE4",
+	"TPA": "TPOS",
+	"TPB": "TPUB",
+	"TRC": "TSRC",
+	"TRD": "TRDA",
+	"TRK": "TRCK",
+	"TS2": "TSO2",
+	"TSA": "TSOA",
+	"TSC": "TSOC",
+	"TSI": "TSIZ",
+	"TSP": "TSOP",
+	"TSS": "TSSE",
+	"TST": "TSOT",
+	"TT1": "TIT1",
+	"TT2": "TIT2",
+	"TT3": "TIT3",
+	"TXT": "TEXT",
+	"TXX": "TXXX",
+	"TYE": "TYER",
+	"UFI": "UFID",
+	"ULT": "USLT",
+	"WAF": "WOAF",
+	"WAR": "WOAR",
+	"WAS": "WOAS",
+	"WCM": "WCOM",
+	"WCP": "WCOP",
+	"WPB": "WPUB",
+	"WXX": "WXXX",
+}
+
+// id3v22Frame converts a 2.2 frame to 2.3.  a PIC frame has a three
+// letter image format where APIC has a mime type, and frames 2.3 has
+// no equivalent for are kept as experimental frames, whose ids start
+// with an X.
+func id3v22Frame(id string, data []byte) (string, []byte) {
+	if xid, ok := id3v22Frames[id]; ok {
+		return xid, data
+	}
+	if id == "PIC" && len(data) >= 4 {
+		var mimeType string
+		switch format := strings.ToLower(string(data[1:4])); format {
+		case "jpg":
+			mimeType = "image/jpeg"
+		case "-->":
+			// the picture is a link
+			mimeType = format
+		default:
+			mimeType = "image/" + format
+		}
+		xdata := []byte{data[0]}
+		xdata = append(xdata, []byte(mimeType)...)
+		xdata = append(xdata, 0)
+		return "APIC", append(xdata, data[4:]...)
+	}
+	return "X" + id, data
+}
+
+func synchsafe(b []byte) int {
+	return int(b[0]) << 21 | int(b[1]) << 14 | int(b[2]) << 7 | int(b[3])
+}
+
+func putSynchsafe(n int) []byte {
+	return []byte{byte(n >> 21) & 0x7f, byte(n >> 14) & 0x7f, byte(n >> 7) & 0x7f, byte(n) & 0x7f}
+}
+
+func readID3(f *os.File) (byte, []*id3Frame, int64, error) {
+	hdr := make([]byte, 10)
+	_, err := f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return 0, nil, 0, err
+	}
+	if string(hdr[:3]) != "ID3" {
+		return 0, nil, 0, nil
+	}
+	version := hdr[3]
+	flags := hdr[5]
+	size := synchsafe(hdr[6:10])
+	tagSize := int64(10 + size)
+	if version == 4 && flags & 0x10 != 0 {
+		tagSize += 10
+	}
+	body := make([]byte, size)
+	_, err = f.ReadAt(body, 10)
+	if err != nil {
+		return 0, nil, 0, errors.Wrap(err, "can't read id3 tag")
+	}
+	if flags & 0x80 != 0 && version < 4 {
+		body = bytes.ReplaceAll(body, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags & 0x40 != 0 && version > 2 && len(body) >= 4 {
+		if version == 3 {
+			body = body[4 + int(binary.BigEndian.Uint32(body[:4])):]
+		} else {
+			body = body[synchsafe(body[:4]):]
+		}
+	}
+	frames := []*id3Frame{}
+	pos := 0
+	for {
+		var id string
+		var fsize int
+		var fflags []byte
+		if version == 2 {
+			if pos + 6 > len(body) || body[pos] == 0 {
+				break
+			}
+			id = string(body[pos:pos+3])
+			fsize = int(body[pos+3]) << 16 | int(body[pos+4]) << 8 | int(body[pos+5])
+			fflags = []byte{0, 0}
+			pos += 6
+		} else {
+			if pos + 10 > len(body) || body[pos] == 0 {
+				break
+			}
+			id = string(body[pos:pos+4])
+			if version == 4 {
+				fsize = synchsafe(body[pos+4:pos+8])
+			} else {
+				fsize = int(binary.BigEndian.Uint32(body[pos+4:pos+8]))
+			}
+			fflags = body[pos+8:pos+10]
+			pos += 10
+		}
+		if fsize < 0 || pos + fsize > len(body) {
+			break
+		}
+		data := body[pos:pos+fsize]
+		pos += fsize
+		if version == 2 {
+			id, data = id3v22Frame(id, data)
+		}
+		frames = append(frames, &id3Frame{id: id, flags: fflags, data: data})
+	}
+	return version, frames, tagSize, nil
+}
+
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func id3EncodeString(version byte, enc byte, s string, terminate bool) []byte {
+	var b []byte
+	switch enc {
+	case 0:
+		for _, r := range s {
+			b = append(b, byte(r))
+		}
+		if terminate {
+			b = append(b, 0)
+		}
+	case 1:
+		b = []byte{0xff, 0xfe}
+		for _, u := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(u), byte(u >> 8))
+		}
+		if terminate {
+			b = append(b, 0, 0)
+		}
+	default:
+		b = []byte(s)
+		if terminate {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+func id3Encoding(version byte, s string) byte {
+	if version == 4 {
+		return 3
+	}
+	if isLatin1(s) {
+		return 0
+	}
+	return 1
+}
+
+func id3Text(version byte, s string) []byte {
+	enc := id3Encoding(version, s)
+	return append([]byte{enc}, id3EncodeString(version, enc, s, false)...)
+}
+
+func id3DecodeText(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	enc := data[0]
+	data = data[1:]
+	switch enc {
+	case 1, 2:
+		if len(data) >= 2 && enc == 1 {
+			bigEndian := data[0] == 0xfe && data[1] == 0xff
+			data = data[2:]
+			if bigEndian {
+				enc = 2
+			}
+		}
+		u := make([]uint16, len(data) / 2)
+		for i := range u {
+			if enc == 2 {
+				u[i] = uint16(data[2*i]) << 8 | uint16(data[2*i+1])
+			} else {
+				u[i] = uint16(data[2*i+1]) << 8 | uint16(data[2*i])
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(u)), "\x00")
+	case 3:
+		return strings.TrimRight(string(data), "\x00")
+	}
+	rs := make([]rune, len(data))
+	for i, c := range data {
+		rs[i] = rune(c)
+	}
+	return strings.TrimRight(string(rs), "\x00")
+}
+
+// apicPictureType finds the picture type in an APIC frame body
+func apicPictureType(data []byte) int {
+	if len(data) < 2 {
+		return -1
+	}
+	idx := bytes.IndexByte(data[1:], 0)
+	if idx < 0 || idx + 2 >= len(data) {
+		return -1
+	}
+	return int(data[idx+2])
+}
+
+type id3Tag struct {
+	version byte
+	frames []*id3Frame
+}
+
+func (t *id3Tag) get(id string) *id3Frame {
+	for _, fr := range t.frames {
+		if fr.id == id {
+			return fr
+		}
+	}
+	return nil
+}
+
+// set replaces all frames with the given id that match filter.  the
+// new frame takes the place of the first one replaced, or goes at the
+// end if there were none.  a nil data removes the frames.
+func (t *id3Tag) set(id string, data []byte, filter func(*id3Frame) bool) {
+	frames := []*id3Frame{}
+	placed := false
+	for _, fr := range t.frames {
+		if fr.id == id && (filter == nil || filter(fr)) {
+			if !placed && data != nil {
+				frames = append(frames, &id3Frame{id: id, flags: []byte{0, 0}, data: data})
+			}
+			placed = true
+			continue
+		}
+		frames = append(frames, fr)
+	}
+	if !placed && data != nil {
+		frames = append(frames, &id3Frame{id: id, flags: []byte{0, 0}, data: data})
+	}
+	t.frames = frames
+}
+
+func (t *id3Tag) setText(id string, val *string) {
+	if val == nil {
+		return
+	}
+	if *val == "" {
+		t.set(id, nil, nil)
+	} else {
+		t.set(id, id3Text(t.version, *val), nil)
+	}
+}
+
+func (t *id3Tag) setPair(id string, num, count *int) {
+	if num == nil && count == nil {
+		return
+	}
+	var n, c int
+	fr := t.get(id)
+	if fr != nil {
+		n, c = parsePair(id3DecodeText(fr.data))
+	}
+	s := formatPair(mergePair(n, c, num, count))
+	t.setText(id, &s)
+}
+
+func (t *id3Tag) apply(tags *Tags) {
+	t.setText("TIT2", tags.Name)
+	t.setText("TPE1", tags.Artist)
+	t.setText("TALB", tags.Album)
+	t.setText("TPE2", tags.AlbumArtist)
+	t.setText("TCON", tags.Genre)
+	t.setPair("TRCK", tags.TrackNumber, tags.TrackCount)
+	t.setPair("TPOS", tags.DiscNumber, tags.DiscCount)
+	if tags.Year != nil {
+		y := formatYear(tags.Year)
+		if t.version == 4 {
+			t.set("TYER", nil, nil)
+			t.setText("TDRC", &y)
+		} else {
+			t.set("TDRC", nil, nil)
+			t.setText("TYER", &y)
+		}
+	}
+	if tags.Compilation != nil {
+		if *tags.Compilation {
+			t.set("TCMP", id3Text(t.version, "1"), nil)
+		} else {
+			t.set("TCMP", nil, nil)
+		}
+	}
+	if tags.Lyrics != nil {
+		if *tags.Lyrics == "" {
+			t.set("USLT", nil, nil)
+		} else {
+			enc := id3Encoding(t.version, *tags.Lyrics)
+			data := append([]byte{enc}, []byte("eng")...)
+			data = append(data, id3EncodeString(t.version, enc, "", true)...)
+			data = append(data, id3EncodeString(t.version, enc, *tags.Lyrics, false)...)
+			t.set("USLT", data, nil)
+		}
+	}
+	if tags.Artwork != nil {
+		front := func(fr *id3Frame) bool {
+			return apicPictureType(fr.data) == 3
+		}
+		if len(tags.Artwork.Data) == 0 {
+			t.set("APIC", nil, front)
+		} else {
+			data := []byte{0}
+			data = append(data, []byte(tags.Artwork.MIMEType)...)
+			data = append(data, 0, 3, 0)
+			data = append(data, tags.Artwork.Data...)
+			t.set("APIC", data, front)
+		}
+	}
+}
+
+func (t *id3Tag) bytes() []byte {
+	var body bytes.Buffer
+	for _, fr := range t.frames {
+		body.WriteString(fr.id)
+		if t.version == 4 {
+			body.Write(putSynchsafe(len(fr.data)))
+		} else {
+			sz := make([]byte, 4)
+			binary.BigEndian.PutUint32(sz, uint32(len(fr.data)))
+			body.Write(sz)
+		}
+		body.Write(fr.flags)
+		body.Write(fr.data)
+	}
+	body.Write(make([]byte, id3Padding))
+	hdr := []byte{'I', 'D', '3', t.version, 0, 0}
+	hdr = append(hdr, putSynchsafe(body.Len())...)
+	return append(hdr, body.Bytes()...)
+}
+
+func writeID3(in *os.File, out *os.File, tags *Tags) error {
+	version, frames, tagSize, err := readID3(in)
+	if err != nil {
+		return err
+	}
+	if version != 4 {
+		// 2.2 frames have been converted to 2.3, and files without a
+		// tag get 2.3 for the sake of older players
+		version = 3
+	}
+	t := &id3Tag{version: version, frames: frames}
+	t.apply(tags)
+	_, err = out.Write(t.bytes())
+	if err != nil {
+		return err
+	}
+	_, err = in.Seek(tagSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,428 @@
+package tagwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type mp4Atom struct {
+	typ string
+	prefix []byte
+	data []byte
+	children []*mp4Atom
+	container bool
+}
+
+type mp4Box struct {
+	typ string
+	offset int64
+	size int64
+}
+
+var mp4Containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"udta": true,
+	"meta": true,
+	"ilst": true,
+}
+
+func readMP4Boxes(f *os.File) ([]*mp4Box, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := st.Size()
+	boxes := []*mp4Box{}
+	var offset int64
+	hdr := make([]byte, 16)
+	for offset + 8 <= end {
+		_, err = f.ReadAt(hdr[:8], offset)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+		if size == 1 {
+			_, err = f.ReadAt(hdr[8:16], offset + 8)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		} else if size == 0 {
+			size = end - offset
+		}
+		if size < 8 || offset + size > end {
+			return nil, errors.Errorf("bad mp4 atom %q at %d", typ, offset)
+		}
+		boxes = append(boxes, &mp4Box{typ: typ, offset: offset, size: size})
+		offset += size
+	}
+	return boxes, nil
+}
+
+func parseMP4Atoms(data []byte) ([]*mp4Atom, error) {
+	atoms := []*mp4Atom{}
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		typ := string(data[4:8])
+		hlen := uint64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				return nil, errors.Errorf("bad mp4 atom %q", typ)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			hlen = 16
+		} else if size == 0 {
+			size = uint64(len(data))
+		}
+		if size < hlen || size > uint64(len(data)) {
+			return nil, errors.Errorf("bad mp4 atom %q", typ)
+		}
+		atom, err := parseMP4Atom(typ, data[hlen:size])
+		if err != nil {
+			return nil, err
+		}
+		atoms = append(atoms, atom)
+		data = data[size:]
+	}
+	return atoms, nil
+}
+
+func parseMP4Atom(typ string, payload []byte) (*mp4Atom, error) {
+	atom := &mp4Atom{typ: typ}
+	if !mp4Containers[typ] {
+		atom.data = payload
+		return atom, nil
+	}
+	atom.container = true
+	if typ == "meta" && !(len(payload) >= 8 && string(payload[4:8]) == "hdlr") {
+		// iTunes style meta atoms carry a version and flags before
+		// their children; quicktime style ones don't
+		if len(payload) < 4 {
+			return nil, errors.New("bad mp4 meta atom")
+		}
+		atom.prefix = payload[:4]
+		payload = payload[4:]
+	}
+	children, err := parseMP4Atoms(payload)
+	if err != nil {
+		return nil, err
+	}
+	atom.children = children
+	return atom, nil
+}
+
+func (a *mp4Atom) size() int {
+	n := 8 + len(a.prefix)
+	if a.container {
+		for _, c := range a.children {
+			n += c.size()
+		}
+	} else {
+		n += len(a.data)
+	}
+	return n
+}
+
+func (a *mp4Atom) write(buf *bytes.Buffer) {
+	sz := make([]byte, 4)
+	binary.BigEndian.PutUint32(sz, uint32(a.size()))
+	buf.Write(sz)
+	buf.WriteString(a.typ)
+	buf.Write(a.prefix)
+	if a.container {
+		for _, c := range a.children {
+			c.write(buf)
+		}
+	} else {
+		buf.Write(a.data)
+	}
+}
+
+func (a *mp4Atom) child(typ string) *mp4Atom {
+	for _, c := range a.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+func (a *mp4Atom) childOrNew(typ string, init func() *mp4Atom) *mp4Atom {
+	c := a.child(typ)
+	if c == nil {
+		c = init()
+		a.children = append(a.children, c)
+	}
+	return c
+}
+
+func (a *mp4Atom) walk(typ string, f func(*mp4Atom)) {
+	for _, c := range a.children {
+		if c.typ == typ {
+			f(c)
+		}
+		if c.container {
+			c.walk(typ, f)
+		}
+	}
+}
+
+func newMP4Meta() *mp4Atom {
+	hdlr := make([]byte, 25)
+	copy(hdlr[8:12], "mdir")
+	copy(hdlr[12:16], "appl")
+	return &mp4Atom{
+		typ: "meta",
+		container: true,
+		prefix: []byte{0, 0, 0, 0},
+		children: []*mp4Atom{
+			&mp4Atom{typ: "hdlr", data: hdlr},
+		},
+	}
+}
+
+func mp4Item(typ string, dataType uint32, value []byte) *mp4Atom {
+	data := make([]byte, 8, 8 + len(value))
+	binary.BigEndian.PutUint32(data[:4], dataType)
+	data = append(data, value...)
+	return &mp4Atom{
+		typ: typ,
+		container: true,
+		children: []*mp4Atom{
+			&mp4Atom{typ: "data", data: data},
+		},
+	}
+}
+
+// mp4ItemValue returns the value of the data atom in an ilst item
+func mp4ItemValue(item *mp4Atom) []byte {
+	if item.container {
+		data := item.child("data")
+		if data != nil && len(data.data) >= 8 {
+			return data.data[8:]
+		}
+		return nil
+	}
+	children, err := parseMP4Atoms(item.data)
+	if err != nil {
+		return nil
+	}
+	for _, c := range children {
+		if c.typ == "data" && len(c.data) >= 8 {
+			return c.data[8:]
+		}
+	}
+	return nil
+}
+
+type mp4Ilst struct {
+	atom *mp4Atom
+}
+
+func (l *mp4Ilst) get(typ string) *mp4Atom {
+	return l.atom.child(typ)
+}
+
+func (l *mp4Ilst) set(typ string, item *mp4Atom) {
+	children := []*mp4Atom{}
+	placed := false
+	for _, c := range l.atom.children {
+		if c.typ == typ {
+			if !placed && item != nil {
+				children = append(children, item)
+			}
+			placed = true
+			continue
+		}
+		children = append(children, c)
+	}
+	if !placed && item != nil {
+		children = append(children, item)
+	}
+	l.atom.children = children
+}
+
+func (l *mp4Ilst) setText(typ string, val *string) {
+	if val == nil {
+		return
+	}
+	if *val == "" {
+		l.set(typ, nil)
+	} else {
+		l.set(typ, mp4Item(typ, 1, []byte(*val)))
+	}
+}
+
+func (l *mp4Ilst) setPair(typ string, num, count *int) {
+	if num == nil && count == nil {
+		return
+	}
+	var n, c int
+	item := l.get(typ)
+	if item != nil {
+		v := mp4ItemValue(item)
+		if len(v) >= 6 {
+			n = int(binary.BigEndian.Uint16(v[2:4]))
+			c = int(binary.BigEndian.Uint16(v[4:6]))
+		}
+	}
+	n, c = mergePair(n, c, num, count)
+	if n == 0 && c == 0 {
+		l.set(typ, nil)
+		return
+	}
+	var v []byte
+	if typ == "trkn" {
+		v = make([]byte, 8)
+	} else {
+		v = make([]byte, 6)
+	}
+	binary.BigEndian.PutUint16(v[2:4], uint16(n))
+	binary.BigEndian.PutUint16(v[4:6], uint16(c))
+	l.set(typ, mp4Item(typ, 0, v))
+}
+
+func (l *mp4Ilst) apply(tags *Tags) {
+	l.setText("\xa9nam", tags.Name)
+	l.setText("\xa9ART", tags.Artist)
+	l.setText("\xa9alb", tags.Album)
+	l.setText("aART", tags.AlbumArtist)
+	if tags.Genre != nil {
+		l.set("gnre", nil)
+		l.setText("\xa9gen", tags.Genre)
+	}
+	l.setPair("trkn", tags.TrackNumber, tags.TrackCount)
+	l.setPair("disk", tags.DiscNumber, tags.DiscCount)
+	if tags.Year != nil {
+		y := formatYear(tags.Year)
+		l.setText("\xa9day", &y)
+	}
+	if tags.Compilation != nil {
+		if *tags.Compilation {
+			l.set("cpil", mp4Item("cpil", 21, []byte{1}))
+		} else {
+			l.set("cpil", nil)
+		}
+	}
+	l.setText("\xa9lyr", tags.Lyrics)
+	if tags.Artwork != nil {
+		if len(tags.Artwork.Data) == 0 {
+			l.set("covr", nil)
+		} else {
+			var dataType uint32 = 13
+			switch strings.ToLower(tags.Artwork.MIMEType) {
+			case "image/png":
+				dataType = 14
+			case "image/bmp":
+				dataType = 27
+			}
+			l.set("covr", mp4Item("covr", dataType, tags.Artwork.Data))
+		}
+	}
+}
+
+// shiftChunkOffsets moves the sample table chunk offsets that point past
+// pos by delta, for when a moov atom ahead of the media data changes size
+func shiftChunkOffsets(moov *mp4Atom, pos int64, delta int64) error {
+	var err error
+	moov.walk("stco", func(a *mp4Atom) {
+		if len(a.data) < 8 {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(a.data[4:8]))
+		for i := 0; i < n && 12 + i * 4 <= len(a.data); i++ {
+			b := a.data[8 + i * 4:12 + i * 4]
+			v := int64(binary.BigEndian.Uint32(b))
+			if v > pos {
+				v += delta
+				if v < 0 || v > 0xffffffff {
+					err = errors.New("chunk offset out of range")
+					return
+				}
+				binary.BigEndian.PutUint32(b, uint32(v))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	moov.walk("co64", func(a *mp4Atom) {
+		if len(a.data) < 8 {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(a.data[4:8]))
+		for i := 0; i < n && 16 + i * 8 <= len(a.data); i++ {
+			b := a.data[8 + i * 8:16 + i * 8]
+			v := int64(binary.BigEndian.Uint64(b))
+			if v > pos {
+				binary.BigEndian.PutUint64(b, uint64(v + delta))
+			}
+		}
+	})
+	return nil
+}
+
+func writeMP4(in *os.File, out *os.File, tags *Tags) error {
+	boxes, err := readMP4Boxes(in)
+	if err != nil {
+		return err
+	}
+	var moovBox *mp4Box
+	for _, box := range boxes {
+		if box.typ == "moov" {
+			moovBox = box
+			break
+		}
+	}
+	if moovBox == nil {
+		return errors.New("no moov atom")
+	}
+	raw := make([]byte, moovBox.size)
+	_, err = in.ReadAt(raw, moovBox.offset)
+	if err != nil {
+		return err
+	}
+	atoms, err := parseMP4Atoms(raw)
+	if err != nil {
+		return err
+	}
+	moov := atoms[0]
+	udta := moov.childOrNew("udta", func() *mp4Atom {
+		return &mp4Atom{typ: "udta", container: true}
+	})
+	meta := udta.childOrNew("meta", newMP4Meta)
+	ilst := meta.childOrNew("ilst", func() *mp4Atom {
+		return &mp4Atom{typ: "ilst", container: true}
+	})
+	(&mp4Ilst{atom: ilst}).apply(tags)
+	delta := int64(moov.size()) - moovBox.size
+	if delta != 0 {
+		err = shiftChunkOffsets(moov, moovBox.offset, delta)
+		if err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	moov.write(buf)
+	for _, box := range boxes {
+		if box == moovBox {
+			_, err = out.Write(buf.Bytes())
+		} else {
+			_, err = io.Copy(out, io.NewSectionReader(in, box.offset, box.size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package tagwriter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r & 0x80000000 != 0 {
+				r = r << 1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc << 8 ^ oggCRCTable[byte(crc >> 24) ^ b]
+	}
+	return crc
+}
+
+type oggPage struct {
+	flags byte
+	granule uint64
+	serial uint32
+	seq uint32
+	segments []byte
+	data []byte
+}
+
+func readOggPage(r io.Reader) (*oggPage, error) {
+	hdr := make([]byte, 27)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "OggS" {
+		return nil, errors.New("bad ogg page")
+	}
+	page := &oggPage{
+		flags: hdr[5],
+		granule: binary.LittleEndian.Uint64(hdr[6:14]),
+		serial: binary.LittleEndian.Uint32(hdr[14:18]),
+		seq: binary.LittleEndian.Uint32(hdr[18:22]),
+		segments: make([]byte, int(hdr[26])),
+	}
+	_, err = io.ReadFull(r, page.segments)
+	if err != nil {
+		return nil, errors.Wrap(err, "short ogg page")
+	}
+	size := 0
+	for _, s := range page.segments {
+		size += int(s)
+	}
+	page.data = make([]byte, size)
+	_, err = io.ReadFull(r, page.data)
+	if err != nil {
+		return nil, errors.Wrap(err, "short ogg page")
+	}
+	return page, nil
+}
+
+func (page *oggPage) bytes() []byte {
+	buf := make([]byte, 27, 27 + len(page.segments) + len(page.data))
+	copy(buf, "OggS")
+	buf[5] = page.flags
+	binary.LittleEndian.PutUint64(buf[6:14], page.granule)
+	binary.LittleEndian.PutUint32(buf[14:18], page.serial)
+	binary.LittleEndian.PutUint32(buf[18:22], page.seq)
+	buf[26] = byte(len(page.segments))
+	buf = append(buf, page.segments...)
+	buf = append(buf, page.data...)
+	binary.LittleEndian.PutUint32(buf[22:26], oggCRC(buf))
+	return buf
+}
+
+// paginate lays packets out over as few pages as the 255 segment limit
+// allows, giving the first packet a page of its own as the vorbis and
+// opus specs require of the identification header
+func paginate(packets [][]byte, serial uint32, seq uint32) []*oggPage {
+	pages := []*oggPage{}
+	page := &oggPage{serial: serial, seq: seq}
+	complete := false
+	finish := func() {
+		if complete {
+			page.granule = 0
+		} else {
+			page.granule = 0xffffffffffffffff
+		}
+		pages = append(pages, page)
+		seq++
+		page = &oggPage{serial: serial, seq: seq}
+		complete = false
+	}
+	for i, packet := range packets {
+		if i == 1 {
+			finish()
+		}
+		n := len(packet)
+		for {
+			if len(page.segments) == 255 {
+				finish()
+				if n < len(packet) {
+					page.flags |= 0x01
+				}
+			}
+			seg := n
+			if seg > 255 {
+				seg = 255
+			}
+			page.segments = append(page.segments, byte(seg))
+			page.data = append(page.data, packet[len(packet) - n:len(packet) - n + seg]...)
+			n -= seg
+			if seg < 255 {
+				complete = true
+				break
+			}
+		}
+	}
+	finish()
+	pages[0].flags |= 0x02
+	return pages
+}
+
+func writeOgg(in *os.File, out *os.File, tags *Tags) error {
+	r := bufio.NewReader(in)
+	var serial uint32
+	var pkt []byte
+	packets := [][]byte{}
+	nheaders := 0
+	headerPages := 0
+	for nheaders == 0 || len(packets) < nheaders {
+		page, err := readOggPage(r)
+		if err != nil {
+			return errors.Wrap(err, "can't read ogg headers")
+		}
+		if headerPages == 0 {
+			serial = page.serial
+		} else if page.serial != serial {
+			return errors.New("multiplexed ogg streams not supported")
+		}
+		headerPages++
+		pos := 0
+		for _, s := range page.segments {
+			pkt = append(pkt, page.data[pos:pos + int(s)]...)
+			pos += int(s)
+			if s < 255 {
+				packets = append(packets, pkt)
+				pkt = nil
+				if len(packets) == 1 {
+					switch {
+					case bytes.HasPrefix(packets[0], []byte("\x01vorbis")):
+						nheaders = 3
+					case bytes.HasPrefix(packets[0], []byte("OpusHead")):
+						nheaders = 2
+					default:
+						return errors.New("unsupported ogg codec")
+					}
+				}
+			}
+		}
+		if nheaders > 0 && len(packets) >= nheaders && (pkt != nil || len(packets) > nheaders) {
+			return errors.New("audio data in ogg header pages")
+		}
+	}
+	var prefix, suffix []byte
+	if nheaders == 3 {
+		prefix = []byte("\x03vorbis")
+		suffix = []byte{1}
+	} else {
+		prefix = []byte("OpusTags")
+	}
+	if !bytes.HasPrefix(packets[1], prefix) {
+		return errors.New("missing ogg comment header")
+	}
+	vc, err := parseVorbisComment(packets[1][len(prefix):])
+	if err != nil {
+		return err
+	}
+	vc.apply(tags, true)
+	packet := append(append([]byte{}, prefix...), vc.bytes()...)
+	packets[1] = append(packet, suffix...)
+	pages := paginate(packets, serial, 0)
+	for _, page := range pages {
+		_, err = out.Write(page.bytes())
+		if err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(out)
+	shift := uint32(len(pages) - headerPages)
+	for {
+		page, err := readOggPage(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if page.serial == serial {
+			page.seq += shift
+		}
+		_, err = w.Write(page.bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,228 @@
+package tagwriter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dhowden/tag"
+	"github.com/pkg/errors"
+)
+
+var ErrUnsupportedFormat = errors.New("tag writing not supported for this file type")
+
+// Tags holds the metadata to write into a file.  nil fields are left
+// untouched; empty strings and zero numbers remove the tag.
+type Tags struct {
+	Name        *string  `json:"name,omitempty"`
+	Artist      *string  `json:"artist,omitempty"`
+	Album       *string  `json:"album,omitempty"`
+	AlbumArtist *string  `json:"album_artist,omitempty"`
+	Genre       *string  `json:"genre,omitempty"`
+	TrackNumber *int     `json:"track_number,omitempty"`
+	TrackCount  *int     `json:"track_count,omitempty"`
+	DiscNumber  *int     `json:"disc_number,omitempty"`
+	DiscCount   *int     `json:"disc_count,omitempty"`
+	Year        *int     `json:"year,omitempty"`
+	Compilation *bool    `json:"compilation,omitempty"`
+	Lyrics      *string  `json:"lyrics,omitempty"`
+	Artwork     *Artwork `json:"artwork,omitempty"`
+}
+
+type Artwork struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"-"`
+}
+
+func (a *Artwork) String() string {
+	if a == nil || len(a.Data) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s, %d bytes", a.MIMEType, len(a.Data))
+}
+
+type Change struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+type writerFunc func(in *os.File, out *os.File, tags *Tags) error
+
+func writerFor(fn string) (writerFunc, error) {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".mp3":
+		return writeID3, nil
+	case ".m4a", ".m4b", ".m4p", ".mp4":
+		return writeMP4, nil
+	case ".flac":
+		return writeFLAC, nil
+	case ".ogg", ".oga", ".opus":
+		return writeOgg, nil
+	}
+	return nil, errors.Wrap(ErrUnsupportedFormat, fn)
+}
+
+func CanWrite(fn string) bool {
+	_, err := writerFor(fn)
+	return err == nil
+}
+
+// Write replaces the tags in fn.  The new file is written alongside the
+// original and renamed into place, so a failure part way through leaves
+// the original intact.
+func Write(fn string, tags *Tags) error {
+	w, err := writerFor(fn)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(fn)
+	if err != nil {
+		return errors.Wrap(err, "can't open " + fn)
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return errors.Wrap(err, "can't stat " + fn)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(fn), "." + filepath.Base(fn) + ".tags-")
+	if err != nil {
+		return errors.Wrap(err, "can't create temp file for " + fn)
+	}
+	tmpfn := out.Name()
+	err = w(in, out, tags)
+	if err != nil {
+		out.Close()
+		os.Remove(tmpfn)
+		return errors.Wrap(err, "can't write tags to " + fn)
+	}
+	err = out.Close()
+	if err != nil {
+		os.Remove(tmpfn)
+		return errors.Wrap(err, "can't write tags to " + fn)
+	}
+	os.Chmod(tmpfn, st.Mode())
+	err = os.Rename(tmpfn, fn)
+	if err != nil {
+		os.Remove(tmpfn)
+		return errors.Wrap(err, "can't replace " + fn)
+	}
+	return nil
+}
+
+// Preview reports what Write would change, without touching the file
+func Preview(fn string, tags *Tags) ([]*Change, error) {
+	_, err := writerFor(fn)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open " + fn)
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read tags from " + fn)
+	}
+	changes := []*Change{}
+	str := func(field string, old string, cur *string) {
+		if cur != nil && *cur != old {
+			changes = append(changes, &Change{Field: field, Old: old, New: *cur})
+		}
+	}
+	num := func(field string, old int, cur *int) {
+		if cur != nil && *cur != old {
+			changes = append(changes, &Change{Field: field, Old: old, New: *cur})
+		}
+	}
+	str("name", m.Title(), tags.Name)
+	str("artist", m.Artist(), tags.Artist)
+	str("album", m.Album(), tags.Album)
+	str("album_artist", m.AlbumArtist(), tags.AlbumArtist)
+	str("genre", m.Genre(), tags.Genre)
+	tn, tc := m.Track()
+	num("track_number", tn, tags.TrackNumber)
+	num("track_count", tc, tags.TrackCount)
+	dn, dc := m.Disc()
+	num("disc_number", dn, tags.DiscNumber)
+	num("disc_count", dc, tags.DiscCount)
+	num("year", m.Year(), tags.Year)
+	if tags.Compilation != nil {
+		old := rawCompilation(m)
+		if old != *tags.Compilation {
+			changes = append(changes, &Change{Field: "compilation", Old: old, New: *tags.Compilation})
+		}
+	}
+	str("lyrics", m.Lyrics(), tags.Lyrics)
+	if tags.Artwork != nil {
+		pic := m.Picture()
+		if pic == nil || !bytes.Equal(pic.Data, tags.Artwork.Data) {
+			var old string
+			if pic != nil {
+				old = (&Artwork{MIMEType: pic.MIMEType, Data: pic.Data}).String()
+			}
+			changes = append(changes, &Change{Field: "artwork", Old: old, New: tags.Artwork.String()})
+		}
+	}
+	return changes, nil
+}
+
+func rawCompilation(m tag.Metadata) bool {
+	for k, v := range m.Raw() {
+		switch strings.ToLower(k) {
+		case "tcmp", "tcp", "cpil", "compilation":
+			switch tv := v.(type) {
+			case string:
+				return tv == "1" || strings.ToLower(tv) == "true"
+			case int:
+				return tv != 0
+			case bool:
+				return tv
+			}
+		}
+	}
+	return false
+}
+
+// parsePair parses strings like "3/12" as used for track and disc numbers
+func parsePair(s string) (int, int) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	n, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
+	c := 0
+	if len(parts) > 1 {
+		c, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	return n, c
+}
+
+func mergePair(n, c int, num, count *int) (int, int) {
+	if num != nil {
+		n = *num
+	}
+	if count != nil {
+		c = *count
+	}
+	return n, c
+}
+
+func formatPair(n, c int) string {
+	if n == 0 && c == 0 {
+		return ""
+	}
+	if c > 0 {
+		return fmt.Sprintf("%d/%d", n, c)
+	}
+	return strconv.Itoa(n)
+}
+
+func formatYear(y *int) string {
+	if y == nil || *y == 0 {
+		return ""
+	}
+	return strconv.Itoa(*y)
+}
@@ -0,0 +1,203 @@
+package tagwriter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const vorbisVendor = "synos"
+
+type vorbisComment struct {
+	vendor string
+	comments []string
+}
+
+func parseVorbisComment(data []byte) (*vorbisComment, error) {
+	if len(data) < 4 {
+		return nil, errors.New("short vorbis comment")
+	}
+	vc := &vorbisComment{}
+	n := int(binary.LittleEndian.Uint32(data[:4]))
+	data = data[4:]
+	if n > len(data) {
+		return nil, errors.New("bad vorbis comment vendor")
+	}
+	vc.vendor = string(data[:n])
+	data = data[n:]
+	if len(data) < 4 {
+		return nil, errors.New("short vorbis comment")
+	}
+	count := int(binary.LittleEndian.Uint32(data[:4]))
+	data = data[4:]
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("short vorbis comment")
+		}
+		n = int(binary.LittleEndian.Uint32(data[:4]))
+		data = data[4:]
+		if n > len(data) {
+			return nil, errors.New("bad vorbis comment")
+		}
+		vc.comments = append(vc.comments, string(data[:n]))
+		data = data[n:]
+	}
+	return vc, nil
+}
+
+func (vc *vorbisComment) bytes() []byte {
+	buf := &bytes.Buffer{}
+	n := make([]byte, 4)
+	binary.LittleEndian.PutUint32(n, uint32(len(vc.vendor)))
+	buf.Write(n)
+	buf.WriteString(vc.vendor)
+	binary.LittleEndian.PutUint32(n, uint32(len(vc.comments)))
+	buf.Write(n)
+	for _, c := range vc.comments {
+		binary.LittleEndian.PutUint32(n, uint32(len(c)))
+		buf.Write(n)
+		buf.WriteString(c)
+	}
+	return buf.Bytes()
+}
+
+func vorbisKey(c string) string {
+	idx := strings.Index(c, "=")
+	if idx < 0 {
+		return strings.ToUpper(c)
+	}
+	return strings.ToUpper(c[:idx])
+}
+
+func (vc *vorbisComment) get(key string) string {
+	for _, c := range vc.comments {
+		if vorbisKey(c) == key {
+			return c[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// set removes every comment with one of the given keys, and then adds
+// the value under the first key unless it's empty
+func (vc *vorbisComment) set(val string, keys ...string) {
+	comments := []string{}
+	for _, c := range vc.comments {
+		k := vorbisKey(c)
+		keep := true
+		for _, key := range keys {
+			if k == key {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			comments = append(comments, c)
+		}
+	}
+	if val != "" {
+		comments = append(comments, keys[0] + "=" + val)
+	}
+	vc.comments = comments
+}
+
+func (vc *vorbisComment) setText(val *string, keys ...string) {
+	if val != nil {
+		vc.set(*val, keys...)
+	}
+}
+
+func (vc *vorbisComment) setPair(num, count *int, numKey string, countKeys ...string) {
+	if num == nil && count == nil {
+		return
+	}
+	n, c := parsePair(vc.get(numKey))
+	for _, key := range countKeys {
+		if v := vc.get(key); v != "" {
+			c, _ = parsePair(v)
+			break
+		}
+	}
+	n, c = mergePair(n, c, num, count)
+	if n == 0 {
+		vc.set("", numKey)
+	} else {
+		vc.set(formatPair(n, 0), numKey)
+	}
+	if c == 0 {
+		vc.set("", countKeys...)
+	} else {
+		vc.set(formatPair(c, 0), countKeys...)
+	}
+}
+
+// apply updates the comments from tags.  artwork is only stored in the
+// comments for ogg; flac has a separate metadata block for it.
+func (vc *vorbisComment) apply(tags *Tags, artwork bool) {
+	vc.setText(tags.Name, "TITLE")
+	vc.setText(tags.Artist, "ARTIST")
+	vc.setText(tags.Album, "ALBUM")
+	vc.setText(tags.AlbumArtist, "ALBUMARTIST", "ALBUM ARTIST")
+	vc.setText(tags.Genre, "GENRE")
+	vc.setPair(tags.TrackNumber, tags.TrackCount, "TRACKNUMBER", "TRACKTOTAL", "TOTALTRACKS")
+	vc.setPair(tags.DiscNumber, tags.DiscCount, "DISCNUMBER", "DISCTOTAL", "TOTALDISCS")
+	if tags.Year != nil {
+		vc.set(formatYear(tags.Year), "DATE", "YEAR")
+	}
+	if tags.Compilation != nil {
+		if *tags.Compilation {
+			vc.set("1", "COMPILATION")
+		} else {
+			vc.set("", "COMPILATION")
+		}
+	}
+	vc.setText(tags.Lyrics, "LYRICS", "UNSYNCEDLYRICS")
+	if artwork && tags.Artwork != nil {
+		val := ""
+		if len(tags.Artwork.Data) > 0 {
+			val = base64.StdEncoding.EncodeToString(pictureBlock(tags.Artwork))
+		}
+		vc.set(val, "METADATA_BLOCK_PICTURE", "COVERART", "COVERARTMIME")
+	}
+}
+
+// pictureBlock encodes artwork as a flac picture block, which is also
+// how ogg files carry cover art
+func pictureBlock(art *Artwork) []byte {
+	var width, height int
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(art.Data))
+	if err == nil {
+		width = cfg.Width
+		height = cfg.Height
+	}
+	buf := &bytes.Buffer{}
+	put := func(v int) {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		buf.Write(b)
+	}
+	put(3)
+	put(len(art.MIMEType))
+	buf.WriteString(art.MIMEType)
+	put(0)
+	put(width)
+	put(height)
+	put(24)
+	put(0)
+	put(len(art.Data))
+	buf.Write(art.Data)
+	return buf.Bytes()
+}
+
+func pictureType(block []byte) int {
+	if len(block) < 4 {
+		return -1
+	}
+	return int(binary.BigEndian.Uint32(block[:4]))
+}
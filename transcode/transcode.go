@@ -0,0 +1,259 @@
+// Package transcode converts audio files to formats and bitrates better
+// suited to the client, keeping the results in a size bounded disk cache
+// so that repeat plays and range requests are served from a plain file.
+package transcode
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownFormat = errors.New("unknown transcoding format")
+
+type Format struct {
+	Name           string
+	Ext            string
+	ContentType    string
+	DefaultBitrate int
+	MinBitrate     int
+	MaxBitrate     int
+	args           []string
+}
+
+var Formats = map[string]*Format{
+	"mp3": &Format{
+		Name: "mp3",
+		Ext: ".mp3",
+		ContentType: "audio/mpeg",
+		DefaultBitrate: 192000,
+		MinBitrate: 32000,
+		MaxBitrate: 320000,
+		args: []string{"-f", "mp3", "-acodec", "libmp3lame"},
+	},
+	"aac": &Format{
+		Name: "aac",
+		Ext: ".m4a",
+		ContentType: "audio/mp4",
+		DefaultBitrate: 160000,
+		MinBitrate: 32000,
+		MaxBitrate: 320000,
+		args: []string{"-f", "ipod", "-acodec", "aac", "-movflags", "+faststart"},
+	},
+	"opus": &Format{
+		Name: "opus",
+		Ext: ".opus",
+		ContentType: "audio/ogg",
+		DefaultBitrate: 128000,
+		MinBitrate: 16000,
+		MaxBitrate: 256000,
+		args: []string{"-f", "ogg", "-acodec", "libopus"},
+	},
+}
+
+// Request describes one transcoding of a source file
+type Request struct {
+	Source  string
+	Format  *Format
+	Bitrate int
+	// volume adjustment in dB, for normalized playback
+	Gain    *float64
+}
+
+func NewRequest(fn, format string, bitrate int, gain *float64) (*Request, error) {
+	f, ok := Formats[format]
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownFormat, format)
+	}
+	if bitrate <= 0 {
+		bitrate = f.DefaultBitrate
+	} else if bitrate < f.MinBitrate {
+		bitrate = f.MinBitrate
+	} else if bitrate > f.MaxBitrate {
+		bitrate = f.MaxBitrate
+	}
+	return &Request{
+		Source: fn,
+		Format: f,
+		Bitrate: bitrate,
+		Gain: gain,
+	}, nil
+}
+
+// key identifies a transcoding.  the source's size and modification
+// time are included, so a changed file is transcoded again rather than
+// served stale.
+func (r *Request) key() (string, error) {
+	st, err := os.Stat(r.Source)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	gain := "none"
+	if r.Gain != nil {
+		gain = fmt.Sprintf("%.2f", *r.Gain)
+	}
+	s := fmt.Sprintf("%s\x00%d\x00%d\x00%s\x00%d\x00%s", r.Source, st.Size(), st.ModTime().UnixNano(), r.Format.Name, r.Bitrate, gain)
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:]) + r.Format.Ext, nil
+}
+
+func (r *Request) args(out string) []string {
+	args := []string{"-loglevel", "error", "-y", "-i", r.Source, "-vn"}
+	if r.Gain != nil {
+		args = append(args, "-af", fmt.Sprintf("volume=%.2fdB", *r.Gain))
+	}
+	args = append(args, r.Format.args...)
+	args = append(args, "-ab", fmt.Sprintf("%dk", r.Bitrate / 1000), out)
+	return args
+}
+
+type job struct {
+	done chan bool
+	err error
+}
+
+// Cache runs transcodings through a fixed number of ffmpeg workers and
+// keeps the results on disk, evicting the least recently used files once
+// the cache grows past its maximum size
+type Cache struct {
+	dir     string
+	maxSize int64
+	workers chan bool
+	lock    sync.Mutex
+	jobs    map[string]*job
+}
+
+func NewCache(dir string, maxSize int64, workers int) (*Cache, error) {
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &Cache{
+		dir: dir,
+		maxSize: maxSize,
+		workers: make(chan bool, workers),
+		jobs: map[string]*job{},
+	}, nil
+}
+
+// Get returns the path to the transcoded file, transcoding it first if
+// it isn't already cached.  concurrent requests for the same transcoding
+// share one ffmpeg process.
+func (c *Cache) Get(r *Request) (string, error) {
+	key, err := r.key()
+	if err != nil {
+		return "", err
+	}
+	fn := filepath.Join(c.dir, key)
+	c.lock.Lock()
+	j, ok := c.jobs[key]
+	if !ok {
+		_, err = os.Stat(fn)
+		if err == nil {
+			c.lock.Unlock()
+			c.touch(fn)
+			return fn, nil
+		}
+		j = &job{done: make(chan bool)}
+		c.jobs[key] = j
+		go c.run(r, fn, key, j)
+	}
+	c.lock.Unlock()
+	<-j.done
+	if j.err != nil {
+		return "", j.err
+	}
+	return fn, nil
+}
+
+func (c *Cache) touch(fn string) {
+	now := time.Now()
+	os.Chtimes(fn, now, now)
+}
+
+func (c *Cache) run(r *Request, fn, key string, j *job) {
+	c.workers <- true
+	j.err = c.transcode(r, fn)
+	<-c.workers
+	c.lock.Lock()
+	delete(c.jobs, key)
+	c.lock.Unlock()
+	close(j.done)
+	if j.err == nil {
+		c.evict()
+	}
+}
+
+func (c *Cache) transcode(r *Request, fn string) error {
+	log.Println("transcoding", r.Source, "to", r.Format.Name, r.Bitrate)
+	f, err := ioutil.TempFile(c.dir, ".transcode-*" + r.Format.Ext)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpfn := f.Name()
+	f.Close()
+	out, err := exec.Command("ffmpeg", r.args(tmpfn)...).CombinedOutput()
+	if err != nil {
+		os.Remove(tmpfn)
+		return errors.Wrapf(err, "can't transcode %s: %s", r.Source, string(out))
+	}
+	err = os.Rename(tmpfn, fn)
+	if err != nil {
+		os.Remove(tmpfn)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// evict removes the least recently used files until the cache fits in
+// its maximum size
+func (c *Cache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Println("can't read transcode cache:", err)
+		return
+	}
+	files := []os.FileInfo{}
+	var total int64
+	for _, st := range infos {
+		if st.IsDir() || strings.HasPrefix(st.Name(), ".") {
+			continue
+		}
+		files = append(files, st)
+		total += st.Size()
+	}
+	if total <= c.maxSize {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, st := range files {
+		if total <= c.maxSize {
+			break
+		}
+		err := os.Remove(filepath.Join(c.dir, st.Name()))
+		if err != nil {
+			log.Println("can't evict from transcode cache:", err)
+			continue
+		}
+		total -= st.Size()
+	}
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watcher reports batches of changed files and directories under a set
+// of root directories.  Changes are collected until nothing has happened
+// for the configured delay, so that a file being copied or a directory
+// being moved is reported once.
+type Watcher struct {
+	C chan []string
+	Errors chan error
+	roots []string
+	delay time.Duration
+	lock sync.Mutex
+	pending map[string]bool
+	timer *time.Timer
+	quit chan bool
+	closed bool
+	impl
+}
+
+func NewWatcher(delay time.Duration, roots ...string) (*Watcher, error) {
+	w := &Watcher{
+		C: make(chan []string, 16),
+		Errors: make(chan error, 16),
+		roots: roots,
+		delay: delay,
+		pending: map[string]bool{},
+		quit: make(chan bool),
+	}
+	err := w.start()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Watcher) Roots() []string {
+	return w.roots
+}
+
+func (w *Watcher) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.lock.Unlock()
+	close(w.quit)
+	return w.stop()
+}
+
+func (w *Watcher) changed(fn string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	w.pending[fn] = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, w.flush)
+	} else {
+		w.timer.Reset(w.delay)
+	}
+}
+
+func (w *Watcher) flush() {
+	w.lock.Lock()
+	if w.closed || len(w.pending) == 0 {
+		w.lock.Unlock()
+		return
+	}
+	fns := make([]string, 0, len(w.pending))
+	for fn := range w.pending {
+		if !w.covered(fn) {
+			fns = append(fns, fn)
+		}
+	}
+	w.pending = map[string]bool{}
+	w.lock.Unlock()
+	select {
+	case w.C <- fns:
+	case <-w.quit:
+	}
+}
+
+// covered reports whether a parent directory of fn is also pending,
+// in which case reporting fn separately is redundant
+func (w *Watcher) covered(fn string) bool {
+	dn := filepath.Dir(fn)
+	for dn != fn {
+		if w.pending[dn] {
+			return true
+		}
+		fn = dn
+		dn = filepath.Dir(fn)
+	}
+	return false
+}
+
+func (w *Watcher) error(err error) {
+	select {
+	case w.Errors <- err:
+	default:
+	}
+}
+
+func skipDir(dn string, st os.FileInfo) bool {
+	return strings.HasPrefix(st.Name(), ".")
+}
@@ -0,0 +1,140 @@
+package watcher
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF | syscall.IN_ATTRIB
+
+type impl struct {
+	fd int
+	f *os.File
+	wlock sync.Mutex
+	watches map[int32]string
+}
+
+func (w *Watcher) start() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return errors.Wrap(err, "can't initialize inotify")
+	}
+	w.fd = fd
+	w.f = os.NewFile(uintptr(fd), "inotify")
+	w.watches = map[int32]string{}
+	for _, root := range w.roots {
+		err = w.addTree(root)
+		if err != nil {
+			w.f.Close()
+			return err
+		}
+	}
+	go w.run()
+	return nil
+}
+
+func (w *Watcher) stop() error {
+	return w.f.Close()
+}
+
+func (w *Watcher) addWatch(dn string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dn, watchMask)
+	if err != nil {
+		return errors.Wrap(err, "can't watch " + dn)
+	}
+	w.wlock.Lock()
+	w.watches[int32(wd)] = dn
+	w.wlock.Unlock()
+	return nil
+}
+
+func (w *Watcher) addTree(root string) error {
+	return filepath.Walk(root, func(fn string, st os.FileInfo, err error) error {
+		if err != nil {
+			if fn == root {
+				return err
+			}
+			w.error(err)
+			return nil
+		}
+		if !st.IsDir() {
+			return nil
+		}
+		if fn != root && skipDir(fn, st) {
+			return filepath.SkipDir
+		}
+		err = w.addWatch(fn)
+		if err != nil {
+			if fn == root {
+				return err
+			}
+			w.error(err)
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) run() {
+	buf := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.quit:
+				return
+			default:
+			}
+			w.error(errors.Wrap(err, "can't read inotify events"))
+			return
+		}
+		offset := 0
+		for offset + syscall.SizeofInotifyEvent <= n {
+			evt := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(evt.Len)
+			offset = nameEnd
+			name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+			w.handle(evt.Wd, evt.Mask, name)
+		}
+	}
+}
+
+func (w *Watcher) handle(wd int32, mask uint32, name string) {
+	if mask & syscall.IN_Q_OVERFLOW != 0 {
+		// we've lost events, so everything needs to be rechecked
+		for _, root := range w.roots {
+			w.changed(root)
+		}
+		return
+	}
+	w.wlock.Lock()
+	dn, ok := w.watches[wd]
+	if mask & syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.wlock.Unlock()
+	if !ok {
+		return
+	}
+	if mask & (syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF) != 0 {
+		w.changed(dn)
+		return
+	}
+	if name == "" {
+		return
+	}
+	fn := filepath.Join(dn, name)
+	if mask & syscall.IN_ISDIR != 0 && mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0 {
+		err := w.addTree(fn)
+		if err != nil {
+			w.error(err)
+		}
+	}
+	w.changed(fn)
+}
@@ -0,0 +1,91 @@
+// +build !linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type fileState struct {
+	size int64
+	modTime time.Time
+}
+
+type impl struct {
+	state map[string]fileState
+}
+
+// without inotify, fall back to periodically walking the roots and
+// comparing sizes and mod times
+
+func (w *Watcher) start() error {
+	state, err := w.snapshot()
+	if err != nil {
+		return err
+	}
+	w.state = state
+	go w.run()
+	return nil
+}
+
+func (w *Watcher) stop() error {
+	return nil
+}
+
+func (w *Watcher) snapshot() (map[string]fileState, error) {
+	state := map[string]fileState{}
+	for _, root := range w.roots {
+		err := filepath.Walk(root, func(fn string, st os.FileInfo, err error) error {
+			if err != nil {
+				if fn == root {
+					return err
+				}
+				return nil
+			}
+			if st.IsDir() {
+				if fn != root && skipDir(fn, st) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			state[fn] = fileState{size: st.Size(), modTime: st.ModTime()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.delay * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			state, err := w.snapshot()
+			if err != nil {
+				w.error(err)
+				continue
+			}
+			for fn, cur := range state {
+				prev, ok := w.state[fn]
+				if !ok || prev != cur {
+					w.changed(fn)
+				}
+			}
+			for fn := range w.state {
+				_, ok := state[fn]
+				if !ok {
+					w.changed(fn)
+				}
+			}
+			w.state = state
+		}
+	}
+}